@@ -0,0 +1,332 @@
+// Package ack 在gws连接上实现应用层确认: 发送的消息带有ID, 对端确认后回调OnAck, 超时未确认时重传, 提供至少一次的投递语义
+// Package ack implements application level acknowledgements on top of gws connections: messages are sent with an id,
+// the OnAck callback runs once the remote side acknowledges them and unacknowledged messages are retransmitted
+// on timeout, giving at-least-once delivery
+package ack
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/internal/envelope"
+)
+
+// 协议帧: 魔数(1) 类型(1) ID(8, 大端), 数据帧之后是原始的操作码(1)和载荷; 协议帧总是以二进制帧发送.
+// 不需要确认的应用消息同样带有协议头, 见Peer.WriteMessage
+// protocol frame layout: magic(1) kind(1) id(8, big endian); data frames continue with the original opcode(1)
+// and the payload. Protocol frames are always sent as binary frames. Application messages that need no
+// acknowledgement carry the header too, see Peer.WriteMessage
+const (
+	magic byte = 0xB9
+
+	kindData byte = 1
+	kindAck  byte = 2
+
+	defaultRetryInterval = 5 * time.Second
+	defaultMaxRetries    = 3
+	defaultDedupWindow   = 1024
+
+	// 存放Peer的SessionStorage键
+	// SessionStorage key of the peer
+	sessionKey = "gws/ack"
+)
+
+var (
+	// ErrClosed 连接已经关闭, 未确认的消息不再重传
+	// the connection was closed, unacknowledged messages are no longer retransmitted
+	ErrClosed = errors.New("ack: connection closed")
+
+	// ErrTimeout 重传次数用尽之后仍未确认
+	// the message was not acknowledged after the last retransmission
+	ErrTimeout = errors.New("ack: timeout")
+)
+
+// AckFunc 确认回调, 每条消息恰好调用一次: 确认时err为nil, 否则为ErrTimeout或者ErrClosed
+// AckFunc is the acknowledgement callback, called exactly once per message: err is nil once acknowledged,
+// ErrTimeout or ErrClosed otherwise
+type AckFunc func(id uint64, err error)
+
+// Config 确认配置
+// Acknowledgement configuration
+type Config struct {
+	// 重传间隔, 默认5秒
+	// Retransmission interval, 5s by default
+	RetryInterval time.Duration
+
+	// 最大重传次数, 默认3次, 负数表示一直重传到连接关闭
+	// Maximum number of retransmissions, 3 by default; a negative value retransmits until the connection closes
+	MaxRetries int
+
+	// 接收端记住的最近收到的ID数量, 用于丢弃重传造成的重复消息, 默认1024, 负数表示不去重
+	// Number of recently received ids remembered by the receiver to drop duplicates caused by retransmissions,
+	// 1024 by default; a negative value disables deduplication
+	DedupWindow int
+}
+
+func (c *Config) init() {
+	if c.RetryInterval <= 0 {
+		c.RetryInterval = defaultRetryInterval
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultMaxRetries
+	}
+	if c.DedupWindow == 0 {
+		c.DedupWindow = defaultDedupWindow
+	}
+}
+
+// 等待确认的消息
+// a message waiting for its acknowledgement
+type pending struct {
+	frame   []byte
+	retries int
+	timer   *time.Timer
+	onAck   AckFunc
+}
+
+// Peer 一个连接上的确认端点, 两端都可以发送需要确认的消息
+// Peer is the acknowledgement endpoint of a connection, both ends can send messages that need acknowledging
+type Peer struct {
+	conn *gws.Conn
+	conf Config
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*pending
+	closed  bool
+
+	// 最近收到的ID, 环形缓冲区和集合
+	// recently received ids, a ring and a set
+	seen     map[uint64]struct{}
+	seenRing []uint64
+	seenNext int
+}
+
+func newPeer(socket *gws.Conn, conf Config) *Peer {
+	var peer = &Peer{conn: socket, conf: conf, pending: make(map[uint64]*pending)}
+	if conf.DedupWindow > 0 {
+		peer.seen = make(map[uint64]struct{}, conf.DedupWindow)
+		peer.seenRing = make([]uint64, 0, conf.DedupWindow)
+	}
+	return peer
+}
+
+// Conn 底层连接
+// Conn returns the underlying connection
+func (c *Peer) Conn() *gws.Conn {
+	return c.conn
+}
+
+// Pending 等待确认的消息数量
+// Pending returns the number of messages waiting for their acknowledgement
+func (c *Peer) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Send 分配ID并异步发送消息, 对端确认, 重传次数用尽或者连接关闭时调用onAck, onAck可以为nil.
+// onAck在确认到达的读协程或者定时器协程中执行, 不应该阻塞
+// Send assigns an id and writes the message asynchronously. onAck runs once the remote side acknowledges it,
+// the retransmissions are exhausted or the connection closes; it may be nil. onAck runs on the read goroutine
+// that received the acknowledgement or on a timer goroutine and should not block
+func (c *Peer) Send(opcode gws.Opcode, payload []byte, onAck AckFunc) (uint64, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, ErrClosed
+	}
+	c.seq++
+	var id = c.seq
+	var frame = envelope.Wrap(magic, kindData, id, opcode, payload)
+	var item = &pending{frame: frame, onAck: onAck}
+	item.timer = time.AfterFunc(c.conf.RetryInterval, func() { c.retry(id) })
+	c.pending[id] = item
+	c.mu.Unlock()
+
+	if err := c.conn.WriteAsync(gws.OpcodeBinary, frame); err != nil {
+		c.finish(id, err)
+		return id, err
+	}
+	return id, nil
+}
+
+// WriteMessage 发送一条不需要确认的应用消息, 对端的EventHandler去掉协议头后转发给应用的处理器.
+// 被包装的连接上不能直接调用gws.Conn的写方法发送应用消息, 对端会以协议错误关闭连接
+// WriteMessage sends an application message that needs no acknowledgement, the EventHandler of the remote side
+// forwards it to the application handler without the protocol header. Application messages must not be written
+// with the methods of gws.Conn on a wrapped connection, the remote side closes the connection with a protocol error
+func (c *Peer) WriteMessage(opcode gws.Opcode, payload []byte) error {
+	return c.conn.WriteMessage(gws.OpcodeBinary, envelope.Wrap(magic, envelope.KindMessage, 0, opcode, payload))
+}
+
+// 重传, 帧与第一次发送的完全相同
+// retransmit the frame exactly as it was first sent
+func (c *Peer) retry(id uint64) {
+	c.mu.Lock()
+	var item = c.pending[id]
+	if item == nil || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	if c.conf.MaxRetries > 0 && item.retries >= c.conf.MaxRetries {
+		c.mu.Unlock()
+		c.finish(id, ErrTimeout)
+		return
+	}
+	item.retries++
+	item.timer.Reset(c.conf.RetryInterval)
+	var frame = item.frame
+	c.mu.Unlock()
+	_ = c.conn.WriteAsync(gws.OpcodeBinary, frame)
+}
+
+// 结束等待, 调用确认回调; 已经结束的消息被忽略
+// stop waiting and run the callback; messages that are already finished are ignored
+func (c *Peer) finish(id uint64, err error) {
+	c.mu.Lock()
+	var item = c.pending[id]
+	delete(c.pending, id)
+	c.mu.Unlock()
+	if item == nil {
+		return
+	}
+	item.timer.Stop()
+	if item.onAck != nil {
+		item.onAck(id, err)
+	}
+}
+
+// 记录收到的ID, 返回它是否已经见过
+// record a received id, reporting whether it was seen before
+func (c *Peer) remember(id uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		return false
+	}
+	if _, ok := c.seen[id]; ok {
+		return true
+	}
+	if len(c.seenRing) < cap(c.seenRing) {
+		c.seenRing = append(c.seenRing, id)
+	} else {
+		delete(c.seen, c.seenRing[c.seenNext])
+		c.seenRing[c.seenNext] = id
+		c.seenNext = (c.seenNext + 1) % len(c.seenRing)
+	}
+	c.seen[id] = struct{}{}
+	return false
+}
+
+// 处理协议帧, 数据帧和应用消息去掉协议头后返回, 由调用方转发; 不是协议帧时以协议错误关闭连接
+// handle a protocol frame. Data frames and application messages are returned without the header for the caller
+// to forward, messages that are not protocol frames close the connection with a protocol error
+func (c *Peer) handle(message *gws.Message) *gws.Message {
+	var frame, ok = envelope.Parse(message, magic)
+	if !ok {
+		envelope.Reject(c.conn, message, envelope.ErrUnframed)
+		return nil
+	}
+
+	switch frame.Kind {
+	case envelope.KindMessage:
+		if !envelope.Unwrap(message, frame) {
+			envelope.Reject(c.conn, message, envelope.ErrMalformed)
+			return nil
+		}
+		return message
+	case kindData:
+		if len(frame.Body) < 1 {
+			envelope.Reject(c.conn, message, envelope.ErrMalformed)
+			return nil
+		}
+		// 先确认再交给应用, 重复的消息同样需要确认, 因为之前的确认可能丢失了
+		// acknowledge before handing over, duplicates are acknowledged too as the previous ack may have been lost
+		_ = c.conn.WriteAsync(gws.OpcodeBinary, envelope.New(magic, kindAck, frame.ID, 0))
+		if c.remember(frame.ID) {
+			break
+		}
+		envelope.Unwrap(message, frame)
+		return message
+	case kindAck:
+		c.finish(frame.ID, nil)
+	}
+	_ = message.Close()
+	return nil
+}
+
+// 连接关闭, 未确认的消息回调ErrClosed
+// the connection closed, unacknowledged messages are called back with ErrClosed
+func (c *Peer) close() {
+	c.mu.Lock()
+	c.closed = true
+	var ids = make([]uint64, 0, len(c.pending))
+	for id := range c.pending {
+		ids = append(ids, id)
+	}
+	c.mu.Unlock()
+	for _, id := range ids {
+		c.finish(id, ErrClosed)
+	}
+}
+
+// PeerOf 取回连接上的确认端点, 连接不是由EventHandler处理的或者还没有打开时返回nil
+// PeerOf returns the acknowledgement endpoint of a connection, nil if the connection is not handled by
+// an EventHandler or has not been opened yet
+func PeerOf(socket *gws.Conn) *Peer {
+	return envelope.Load[*Peer](socket, sessionKey)
+}
+
+// EventHandler 包装应用的事件处理器: 自动确认收到的消息, 去掉协议头后转发给next, 丢弃重传造成的重复消息; 其他消息和事件原样转发.
+// 两端都需要使用EventHandler
+// EventHandler wraps the event handler of the application: received messages are acknowledged automatically and
+// forwarded to next without the protocol header, duplicates caused by retransmissions are dropped; other events
+// are forwarded as they are. Both ends have to use an EventHandler and send every message with Peer.Send or
+// Peer.WriteMessage, a message without the protocol header closes the connection with a protocol error
+//
+// Example:
+//
+//	var server = gws.NewServer(ack.NewEventHandler(handler, ack.Config{}), nil)
+//
+//	// in OnOpen or later
+//	_, err := ack.PeerOf(socket).Send(gws.OpcodeText, []byte("hello"), func(id uint64, err error) {
+//		log.Printf("message %d: %v", id, err)
+//	})
+type EventHandler struct {
+	envelope.Forward
+	conf Config
+}
+
+// NewEventHandler 创建事件处理器包装
+// NewEventHandler creates the wrapper
+func NewEventHandler(next gws.Event, conf Config) *EventHandler {
+	conf.init()
+	return &EventHandler{Forward: envelope.Forward{Next: next}, conf: conf}
+}
+
+// Peer 取回或者创建连接上的确认端点; 客户端可以在ReadLoop之前用它取得端点
+// Peer returns the acknowledgement endpoint of a connection, creating it if needed. Clients may use it before ReadLoop
+func (c *EventHandler) Peer(socket *gws.Conn) *Peer {
+	return envelope.LoadOrStore(socket, sessionKey, func() *Peer { return newPeer(socket, c.conf) })
+}
+
+func (c *EventHandler) OnOpen(socket *gws.Conn) {
+	c.Peer(socket)
+	c.Next.OnOpen(socket)
+}
+
+func (c *EventHandler) OnClose(socket *gws.Conn, err error) {
+	if peer := PeerOf(socket); peer != nil {
+		peer.close()
+	}
+	c.Next.OnClose(socket, err)
+}
+
+func (c *EventHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	if forward := c.Peer(socket).handle(message); forward != nil {
+		c.Next.OnMessage(socket, forward)
+	}
+}
@@ -0,0 +1,156 @@
+package ack
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+type appHandler struct {
+	gws.BuiltinEventHandler
+	messages chan *gws.Message
+	opened   chan *gws.Conn
+}
+
+func (c *appHandler) OnOpen(socket *gws.Conn) {
+	if c.opened != nil {
+		c.opened <- socket
+	}
+}
+
+func (c *appHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	c.messages <- message
+}
+
+// 丢弃前drop条消息, 模拟丢包
+type lossyHandler struct {
+	gws.Event
+	drop int64
+}
+
+func (c *lossyHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	if atomic.AddInt64(&c.drop, -1) >= 0 {
+		_ = message.Close()
+		return
+	}
+	c.Event.OnMessage(socket, message)
+}
+
+// 建立一对连接, 服务端丢弃前drop条消息; 返回客户端的Peer和服务端的应用处理器
+func newPeers(t *testing.T, conf Config, drop int64) (*Peer, *appHandler) {
+	var app = &appHandler{messages: make(chan *gws.Message, 8), opened: make(chan *gws.Conn, 1)}
+	var handler = &lossyHandler{Event: NewEventHandler(app, conf), drop: drop}
+	var upgrader = gws.NewUpgrader(handler, nil)
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			socket.ReadLoop()
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	var clientHandler = NewEventHandler(&appHandler{messages: make(chan *gws.Message, 8)}, conf)
+	socket, _, err := gws.NewClient(clientHandler, &gws.ClientOption{Addr: "ws://" + strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = socket.NetConn().Close() })
+	var peer = clientHandler.Peer(socket)
+	go socket.ReadLoop()
+	<-app.opened
+	return peer, app
+}
+
+type ackResult struct {
+	id  uint64
+	err error
+}
+
+func TestPeer_Send(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("ack", func(t *testing.T) {
+		client, app := newPeers(t, Config{}, 0)
+		var acks = make(chan ackResult, 1)
+		id, err := client.Send(gws.OpcodeText, []byte("hello"), func(id uint64, err error) { acks <- ackResult{id, err} })
+		as.NoError(err)
+
+		var message = <-app.messages
+		as.Equal(gws.OpcodeText, message.Opcode)
+		as.Equal("hello", message.Data.String())
+		as.Equal(ackResult{id: id}, <-acks)
+		as.Equal(0, client.Pending())
+
+		// 不需要确认的应用消息去掉协议头后转发, 以魔数开头的载荷不会被误认为协议帧
+		var payload = string([]byte{magic, kindAck, 0, 0, 0, 0, 0, 0, 0, 1})
+		as.NoError(client.WriteMessage(gws.OpcodeBinary, []byte(payload)))
+		message = <-app.messages
+		as.Equal(gws.OpcodeBinary, message.Opcode)
+		as.Equal(payload, message.Data.String())
+		as.Equal(0, client.Pending())
+	})
+
+	// 没有协议头的消息以协议错误关闭连接
+	t.Run("unframed", func(t *testing.T) {
+		client, _ := newPeers(t, Config{RetryInterval: time.Minute}, 0)
+		as.NoError(client.Conn().WriteString("raw"))
+		as.Eventually(func() bool {
+			_, err := client.Send(gws.OpcodeText, nil, nil)
+			return errors.Is(err, ErrClosed)
+		}, time.Second, time.Millisecond)
+	})
+
+	// 丢失的消息被重传, 只交付一次
+	t.Run("retry", func(t *testing.T) {
+		client, app := newPeers(t, Config{RetryInterval: 20 * time.Millisecond}, 1)
+		var acks = make(chan ackResult, 1)
+		_, err := client.Send(gws.OpcodeBinary, []byte("hello"), func(id uint64, err error) { acks <- ackResult{id, err} })
+		as.NoError(err)
+		as.Equal("hello", (<-app.messages).Data.String())
+		as.NoError((<-acks).err)
+	})
+
+	// 重传次数用尽
+	t.Run("timeout", func(t *testing.T) {
+		client, app := newPeers(t, Config{RetryInterval: 10 * time.Millisecond, MaxRetries: 2}, 3)
+		var acks = make(chan ackResult, 1)
+		_, err := client.Send(gws.OpcodeText, []byte("hello"), func(id uint64, err error) { acks <- ackResult{id, err} })
+		as.NoError(err)
+		as.ErrorIs((<-acks).err, ErrTimeout)
+		as.Equal(0, client.Pending())
+		as.Len(app.messages, 0)
+	})
+
+	// 连接关闭时未确认的消息回调ErrClosed
+	t.Run("close", func(t *testing.T) {
+		client, _ := newPeers(t, Config{RetryInterval: time.Minute}, 1)
+		var acks = make(chan ackResult, 1)
+		_, err := client.Send(gws.OpcodeText, []byte("hello"), func(id uint64, err error) { acks <- ackResult{id, err} })
+		as.NoError(err)
+		client.Conn().WriteClose(1000, nil)
+		as.ErrorIs((<-acks).err, ErrClosed)
+		_, err = client.Send(gws.OpcodeText, nil, nil)
+		as.ErrorIs(err, ErrClosed)
+	})
+}
+
+func TestPeer_Dedup(t *testing.T) {
+	var as = assert.New(t)
+	var peer = newPeer(nil, Config{DedupWindow: 2})
+	as.False(peer.remember(1))
+	as.True(peer.remember(1))
+	as.False(peer.remember(2))
+	as.False(peer.remember(3))
+	as.False(peer.remember(1))
+	as.True(peer.remember(3))
+
+	peer = newPeer(nil, Config{DedupWindow: -1})
+	as.False(peer.remember(1))
+	as.False(peer.remember(1))
+}
@@ -0,0 +1,36 @@
+package gws
+
+// PayloadAllocator 入站消息载荷的分配器, 会被多个连接并发调用
+// Allocator of inbound message payloads, called concurrently by many connections
+type PayloadAllocator interface {
+	// Get 返回长度至少为n的缓冲区
+	// Get returns a buffer of at least n bytes
+	Get(n int) []byte
+
+	// Put 归还Get返回的缓冲区, 之后不会再被使用
+	// Put gives back a buffer returned by Get, it is not used afterwards
+	Put(p []byte)
+}
+
+// 单帧数据消息的载荷使用自定义的分配器, 分片消息需要重组, 仍然使用内存池
+// payloads of single frame data messages use the custom allocator, fragmented messages are reassembled and keep using the pool
+func (c *Conn) payloadAllocator(fin bool, opcode Opcode) PayloadAllocator {
+	if c.config.ReadPayloadAllocator == nil || !fin || c.continuationFrame != nil {
+		return nil
+	}
+	if opcode != OpcodeText && opcode != OpcodeBinary {
+		return nil
+	}
+	return c.config.ReadPayloadAllocator
+}
+
+// 归还内存中的载荷, 来自分配器的交给分配器, 否则放回内存池
+// give the in-memory payload back, to the allocator it came from or else to the pool
+func (c *Message) release() {
+	if c.alloc != nil {
+		c.alloc.Put(c.raw)
+		c.alloc, c.raw = nil, nil
+		return
+	}
+	myBufferPool.Put(c.Data, c.index)
+}
@@ -0,0 +1,130 @@
+package gws
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 记录分配和归还的分配器
+type countingAllocator struct {
+	mu   sync.Mutex
+	gets int
+	puts int
+	live map[*byte]bool
+}
+
+func (c *countingAllocator) Get(n int) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var p = make([]byte, n, n+16)
+	c.gets++
+	c.live[&p[:1][0]] = true
+	return p
+}
+
+func (c *countingAllocator) Put(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.puts++
+	delete(c.live, &p[:1][0])
+}
+
+func (c *countingAllocator) counts() (int, int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gets, c.puts, len(c.live)
+}
+
+func TestPayloadAllocator(t *testing.T) {
+	var as = assert.New(t)
+	var text = string(bytes.Repeat([]byte("hello"), 200))
+
+	var cases = []struct {
+		name       string
+		write      func(client *Conn)
+		retain     bool
+		gets, puts int
+	}{
+		{"single frame", func(client *Conn) { _ = client.WriteString(text) }, false, 1, 1},
+		{"retain", func(client *Conn) { _ = client.WriteString(text) }, true, 1, 0},
+		{"compressed", func(client *Conn) { _ = client.WriteString(text) }, false, 1, 1},
+		{"fragments", func(client *Conn) {
+			testWrite(client, false, OpcodeText, []byte(text[:100]))
+			testWrite(client, true, OpcodeContinuation, []byte(text[100:]))
+		}, false, 0, 0},
+	}
+	for _, item := range cases {
+		t.Run(item.name, func(t *testing.T) {
+			var alloc = &countingAllocator{live: make(map[*byte]bool)}
+			var received = make(chan struct{})
+			var serverHandler = new(webSocketMocker)
+			serverHandler.onMessage = func(socket *Conn, message *Message) {
+				as.Equal(text, message.Data.String())
+				if item.retain {
+					message.Retain()
+				}
+				_ = message.Close()
+				close(received)
+			}
+			var compressEnabled = item.name == "compressed"
+			var serverOption = &ServerOption{ReadPayloadAllocator: alloc, CompressEnabled: compressEnabled}
+			var clientOption = &ClientOption{CompressEnabled: compressEnabled}
+			server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), clientOption)
+			as.Equal(compressEnabled, server.compressEnabled)
+			go server.ReadLoop()
+			go client.ReadLoop()
+			item.write(client)
+			<-received
+
+			gets, puts, live := alloc.counts()
+			as.Equal(item.gets, gets)
+			as.Equal(item.puts, puts)
+			as.Equal(item.gets-item.puts, live)
+		})
+	}
+
+	// 读取失败时归还缓冲区; 有扩展时在emitMessage中校验utf8
+	for _, extensions := range [][]Extension{nil, {new(invertExtension)}} {
+		t.Run("invalid utf8", func(t *testing.T) {
+			var alloc = &countingAllocator{live: make(map[*byte]bool)}
+			var closed = make(chan struct{})
+			var serverHandler = new(webSocketMocker)
+			serverHandler.onClose = func(socket *Conn, err error) { close(closed) }
+			var serverOption = &ServerOption{ReadPayloadAllocator: alloc, CheckUtf8Enabled: true}
+			server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+			server.extensions = extensions
+			go server.ReadLoop()
+			go client.ReadLoop()
+			testWrite(client, true, OpcodeText, []byte{0xff, 0xfe})
+			<-closed
+			gets, puts, live := alloc.counts()
+			as.Equal(1, gets)
+			as.Equal(1, puts)
+			as.Equal(0, live)
+		})
+	}
+
+	// 扩展解码之后的消息关闭时, 取出的缓冲全部归还
+	t.Run("extension decoded", func(t *testing.T) {
+		SetBufferPoolStatsEnabled(true)
+		defer SetBufferPoolStatsEnabled(false)
+		var received = make(chan string, 1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			received <- message.Data.String()
+			_ = message.Close()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		server.extensions = []Extension{new(invertExtension)}
+		var before = BufferPoolStats()
+		go server.ReadLoop()
+		testWrite(client, true, OpcodeBinary, []byte("hello"))
+		as.Equal("hello", <-received)
+		var after = BufferPoolStats()
+		as.Equal(after.Gets-before.Gets, after.Puts-before.Puts)
+		as.Equal(before.RetainedBytes, after.RetainedBytes)
+	})
+}
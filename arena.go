@@ -0,0 +1,50 @@
+package gws
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+const (
+	// 写缓冲区的内存池下标, 与myBufferPool的下标区分
+	// pool index of the write arena, distinct from the indexes of myBufferPool
+	arenaIndex = -1
+
+	// 负载小于该长度的消息走快速路径, 帧的头部最多6字节(2字节头部和4字节掩码)
+	// messages with a payload shorter than this take the fast path, their header is at most 6 bytes (2 + 4 of mask)
+	smallPayloadSize = 128
+	smallFrameSize   = smallPayloadSize + 6
+)
+
+// 连接独占的预分配写缓冲区, 同一时间只能被一个帧占用
+// buffer preallocated for a connection, held by at most one frame at a time
+type writeArena struct {
+	buf  *bytes.Buffer
+	size int
+	busy int32
+}
+
+func newWriteArena(size int) *writeArena {
+	return &writeArena{buf: bytes.NewBuffer(make([]byte, 0, size)), size: size}
+}
+
+// 获取编码帧的缓冲区, 优先使用连接的写缓冲区, 被占用或者容量不足时从内存池获取
+// get a buffer to encode a frame into, preferring the arena of the connection and falling back to the pool
+// when it is in use or too small
+func (c *Conn) getFrameBuffer(n int) (*bytes.Buffer, int) {
+	if c.arena != nil && n <= c.arena.size && atomic.CompareAndSwapInt32(&c.arena.busy, 0, 1) {
+		c.arena.buf.Reset()
+		return c.arena.buf, arenaIndex
+	}
+	return myBufferPool.Get(n)
+}
+
+// 归还getFrameBuffer获取的缓冲区
+// return a buffer obtained from getFrameBuffer
+func (c *Conn) putFrameBuffer(buf *bytes.Buffer, index int) {
+	if index == arenaIndex {
+		atomic.StoreInt32(&c.arena.busy, 0)
+		return
+	}
+	myBufferPool.Put(buf, index)
+}
@@ -0,0 +1,74 @@
+package gws
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteArena(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("get and put", func(t *testing.T) {
+		var socket = &Conn{arena: newWriteArena(256)}
+		buf, index := socket.getFrameBuffer(100)
+		as.Equal(arenaIndex, index)
+		as.True(buf == socket.arena.buf)
+
+		// 被占用时回退到内存池
+		buf2, index2 := socket.getFrameBuffer(100)
+		as.NotEqual(arenaIndex, index2)
+		socket.putFrameBuffer(buf2, index2)
+
+		socket.putFrameBuffer(buf, index)
+		_, index = socket.getFrameBuffer(100)
+		as.Equal(arenaIndex, index)
+		socket.putFrameBuffer(buf, index)
+
+		// 放不下时使用内存池
+		_, index = socket.getFrameBuffer(1000)
+		as.NotEqual(arenaIndex, index)
+
+		// 没有开启时使用内存池
+		_, index = (&Conn{}).getFrameBuffer(10)
+		as.NotEqual(arenaIndex, index)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		const count = 100
+		var wg = &sync.WaitGroup{}
+		wg.Add(4 * count)
+		var mu = &sync.Mutex{}
+		var received = make(map[string]int)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			mu.Lock()
+			received[message.Data.String()]++
+			mu.Unlock()
+			wg.Done()
+		}
+		var serverOption = &ServerOption{WriteArenaSize: 64, CompressEnabled: true, CompressThreshold: 512}
+		server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{CompressEnabled: true})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 同步, 异步, 广播以及超过写缓冲区和被压缩的消息, 并发写入
+		var small, large = "hello", string(bytes.Repeat([]byte("world"), 200))
+		var broadcaster = NewBroadcaster(OpcodeText, []byte("broadcast"))
+		for i := 0; i < count; i++ {
+			go func() { as.NoError(server.WriteString(small)) }()
+			go func() { as.NoError(server.WriteString(large)) }()
+			as.NoError(server.WriteAsync(OpcodeText, []byte("async")))
+			as.NoError(broadcaster.Broadcast(server))
+		}
+		wg.Wait()
+		broadcaster.Release()
+		as.Equal(map[string]int{small: count, large: count, "async": count, "broadcast": count}, received)
+		// 对端收到消息时写入方可能还没有归还缓冲区
+		as.Eventually(func() bool { return atomic.LoadInt32(&server.arena.busy) == 0 }, time.Second, time.Millisecond)
+	})
+}
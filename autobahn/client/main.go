@@ -29,6 +29,7 @@ func testCase(id int) {
 		ReadAsyncEnabled:    true,
 		CompressEnabled:     true,
 		CheckUtf8Enabled:    true,
+		AutoPongEnabled:     true,
 		ReadMaxPayloadSize:  32 * 1024 * 1024,
 		WriteMaxPayloadSize: 32 * 1024 * 1024,
 	})
@@ -52,9 +53,7 @@ func (c *WebSocket) OnClose(socket *gws.Conn, err error) {
 	c.onexit <- struct{}{}
 }
 
-func (c *WebSocket) OnPing(socket *gws.Conn, payload []byte) {
-	_ = socket.WritePong(payload)
-}
+func (c *WebSocket) OnPing(socket *gws.Conn, payload []byte) {}
 
 func (c *WebSocket) OnPong(socket *gws.Conn, payload []byte) {}
 
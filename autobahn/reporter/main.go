@@ -18,6 +18,7 @@ import (
 var (
 	verbose = flag.Bool("verbose", false, "be verbose")
 	web     = flag.String("http", "", "open web browser instead")
+	strict  = flag.String("strict", "strict", "comma separated agents on which NON-STRICT results fail the test")
 )
 
 const (
@@ -29,16 +30,26 @@ const (
 	statusFailed        = "FAILED"
 )
 
-func failing(behavior string) bool {
+func failing(behavior string, strict bool) bool {
 	switch behavior {
-	// case statusUnclean, statusFailed, statusNonStrict: // we should probably fix the nonstrict as well at some point
 	case statusUnclean, statusFailed:
 		return true
+	case statusNonStrict:
+		return strict
 	default:
 		return false
 	}
 }
 
+func isStrict(agent string) bool {
+	for _, item := range strings.Split(*strict, ",") {
+		if strings.TrimSpace(item) == agent {
+			return true
+		}
+	}
+	return false
+}
+
 type statusCounter struct {
 	Total         int
 	OK            int
@@ -89,7 +100,7 @@ func main() {
 	}
 
 	var report report
-	if err := decodeFile(os.Args[1], &report); err != nil {
+	if err := decodeFile(flag.Arg(0), &report); err != nil {
 		log.Fatal(err)
 	}
 
@@ -124,7 +135,7 @@ func main() {
 				log.Fatal(err)
 			}
 			counter.Inc(c.Behavior)
-			bad := failing(c.Behavior)
+			bad := failing(c.Behavior, isStrict(server))
 			if bad {
 				srvFailed = true
 				failed = true
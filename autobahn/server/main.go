@@ -15,19 +15,22 @@ func main() {
 	var upgrader = gws.NewUpgrader(new(WebSocket), &gws.ServerOption{
 		CompressEnabled:     true,
 		CheckUtf8Enabled:    true,
+		AutoPongEnabled:     true,
 		ReadMaxPayloadSize:  32 * 1024 * 1024,
 		WriteMaxPayloadSize: 32 * 1024 * 1024,
 	})
 
-	mux := &http.ServeMux{}
-	mux.HandleFunc("/connect", func(writer http.ResponseWriter, request *http.Request) {
-		socket, err := upgrader.Upgrade(writer, request)
-		if err != nil {
-			return
-		}
-		socket.ReadLoop()
+	// 严格模式的agent, NON-STRICT的结果视为失败
+	var strictUpgrader = gws.NewUpgrader(new(WebSocket), &gws.ServerOption{
+		CompressEnabled:     true,
+		StrictProtocol:      true,
+		AutoPongEnabled:     true,
+		ReadMaxPayloadSize:  32 * 1024 * 1024,
+		WriteMaxPayloadSize: 32 * 1024 * 1024,
 	})
 
+	mux := newServeMux(upgrader)
+
 	lnTCP, err := net.Listen("tcp", "localhost:3000")
 	if err != nil {
 		panic(err)
@@ -36,6 +39,14 @@ func main() {
 		log.Println("non-tls server exit:", http.Serve(lnTCP, mux))
 	}()
 
+	lnStrict, err := net.Listen("tcp", "localhost:3002")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		log.Println("strict server exit:", http.Serve(lnStrict, newServeMux(strictUpgrader)))
+	}()
+
 	cert, err := tls.X509KeyPair(rsaCertPEM, rsaKeyPEM)
 	if err != nil {
 		log.Fatalf("tls.X509KeyPair failed: %v", err)
@@ -51,6 +62,18 @@ func main() {
 	log.Println("tls server exit:", http.Serve(lnTLS, mux))
 }
 
+func newServeMux(upgrader *gws.Upgrader) *http.ServeMux {
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/connect", func(writer http.ResponseWriter, request *http.Request) {
+		socket, err := upgrader.Upgrade(writer, request)
+		if err != nil {
+			return
+		}
+		socket.ReadLoop()
+	})
+	return mux
+}
+
 type WebSocket struct{}
 
 func (c *WebSocket) OnClose(socket *gws.Conn, err error) {
@@ -63,7 +86,6 @@ func (c *WebSocket) OnOpen(socket *gws.Conn) {
 
 func (c *WebSocket) OnPing(socket *gws.Conn, payload []byte) {
 	fmt.Printf("onping: payload=%s\n", string(payload))
-	_ = socket.WritePong(payload)
 }
 
 func (c *WebSocket) OnPong(socket *gws.Conn, payload []byte) {}
@@ -0,0 +1,318 @@
+// Package bench 压测工具, 启动一群客户端向回显服务发送消息, 统计吞吐和延迟分位数.
+// 性能回归测试和容量规划使用同一套工具
+// Package bench is a load generator: a swarm of clients sends messages to an echo service
+// and reports throughput and latency percentiles. Performance regression tests and capacity planning use the same tool
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/internal"
+)
+
+const (
+	defaultMessageSize = 64
+	defaultDuration    = 10 * time.Second
+	defaultDialWorkers = 32
+
+	// 结束发送后等待在途回显的最长时间
+	// how long to wait for the echoes in flight once sending stops
+	drainTimeout = time.Second
+
+	// 消息头部携带发送时间
+	// messages start with their send time
+	stampSize = 8
+)
+
+// Config 压测配置
+// Load generation configuration
+type Config struct {
+	// 服务地址, 例如ws://127.0.0.1:8000
+	// Address of the service, e.g. ws://127.0.0.1:8000
+	Addr string
+
+	// 连接数, 默认1
+	// Number of connections, defaults to 1
+	Connections int
+
+	// 消息长度, 默认64, 不小于8
+	// Message size, 64 by default and at least 8
+	MessageSize int
+
+	// 每个连接每秒发送的消息数; 0表示收到回显后立即发送下一条(每个连接只有一条在途的消息)
+	// Messages per second per connection. 0 sends the next message as soon as the echo arrives
+	// (one message in flight per connection)
+	Rate int
+
+	// 压测时长, 默认10秒; 设置了Messages时发送完毕即结束
+	// Duration of the run, 10 seconds by default. With Messages set the run ends once they are all echoed
+	Duration time.Duration
+
+	// 每个连接发送的消息数, 0表示不限制
+	// Messages sent per connection, 0 means unlimited
+	Messages int
+
+	// 开启压缩
+	// Enable compression
+	CompressEnabled bool
+
+	// 同时建立连接的协程数, 默认32
+	// Number of goroutines dialing at the same time, defaults to 32
+	DialWorkers int
+}
+
+func (c *Config) init() {
+	c.Connections = internal.SelectValue(c.Connections > 0, c.Connections, 1)
+	c.MessageSize = internal.SelectValue(c.MessageSize > 0, c.MessageSize, defaultMessageSize)
+	c.MessageSize = internal.SelectValue(c.MessageSize < stampSize, stampSize, c.MessageSize)
+	c.Duration = internal.SelectValue(c.Duration > 0, c.Duration, defaultDuration)
+	c.DialWorkers = internal.SelectValue(c.DialWorkers > 0, c.DialWorkers, defaultDialWorkers)
+}
+
+// Report 压测结果
+// Report is the result of a run
+type Report struct {
+	// 成功建立的连接数和失败的次数
+	// Connections established and dial failures
+	Connections int
+	DialErrors  int
+
+	// 发送和收到回显的消息数, 以及写入失败和格式错误的回显数
+	// Messages sent, echoes received, and write failures plus malformed echoes
+	Sent     uint64
+	Received uint64
+	Errors   uint64
+
+	// 从第一个连接开始发送到结束的时长
+	// Time from the start of sending to the end of the run
+	Elapsed time.Duration
+
+	// 往返延迟
+	// Round trip latency
+	Latency Histogram
+}
+
+// Throughput 每秒收到的回显数
+// Throughput returns the echoes received per second
+func (c *Report) Throughput() float64 {
+	if c.Elapsed <= 0 {
+		return 0
+	}
+	return float64(c.Received) / c.Elapsed.Seconds()
+}
+
+// String 可读的摘要
+// String returns a human readable summary
+func (c *Report) String() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "connections=%d dial_errors=%d sent=%d received=%d errors=%d elapsed=%s throughput=%.0f/s\n",
+		c.Connections, c.DialErrors, c.Sent, c.Received, c.Errors, c.Elapsed.Round(time.Millisecond), c.Throughput())
+	_, _ = fmt.Fprintf(&b, "latency min=%s mean=%s p50=%s p90=%s p99=%s p99.9=%s max=%s",
+		c.Latency.Min(), c.Latency.Mean(), c.Latency.Percentile(50), c.Latency.Percentile(90),
+		c.Latency.Percentile(99), c.Latency.Percentile(99.9), c.Latency.Max())
+	return b.String()
+}
+
+// Run 建立连接并发送消息, 直到达到时长, 发送完Messages条消息或者ctx被取消
+// Run dials the connections and sends messages until the duration elapses, Messages messages are echoed or ctx is cancelled
+func Run(ctx context.Context, conf Config) (*Report, error) {
+	conf.init()
+	if conf.Addr == "" {
+		return nil, errors.New("bench: empty address")
+	}
+
+	var report = &Report{}
+	var start = time.Now()
+	var clients = dial(conf, start, report)
+	if len(clients) == 0 {
+		return report, errors.New("bench: no connection established")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.Duration)
+	defer cancel()
+
+	var sendStart = time.Now()
+	var wg sync.WaitGroup
+	wg.Add(len(clients))
+	for _, item := range clients {
+		go func(client *client) {
+			defer wg.Done()
+			client.send(ctx, conf)
+		}(item)
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(sendStart)
+
+	for _, item := range clients {
+		item.close()
+		report.Sent += item.sent
+		report.Received += atomic.LoadUint64(&item.received)
+		report.Errors += atomic.LoadUint64(&item.errors)
+		report.Latency.Merge(&item.latency)
+	}
+	return report, nil
+}
+
+// 并发建立连接
+// dial the connections concurrently
+func dial(conf Config, start time.Time, report *Report) []*client {
+	var mu sync.Mutex
+	var clients = make([]*client, 0, conf.Connections)
+	var jobs = make(chan struct{}, conf.Connections)
+	for i := 0; i < conf.Connections; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	wg.Add(conf.DialWorkers)
+	for i := 0; i < conf.DialWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				var c = newClient(conf, start)
+				socket, _, err := gws.NewClient(c, &gws.ClientOption{Addr: conf.Addr, CompressEnabled: conf.CompressEnabled})
+				mu.Lock()
+				if err != nil {
+					report.DialErrors++
+				} else {
+					c.socket = socket
+					clients = append(clients, c)
+				}
+				mu.Unlock()
+				if err == nil {
+					go socket.ReadLoop()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	report.Connections = len(clients)
+	return clients
+}
+
+// 一个压测连接. latency只在读协程中修改, 连接关闭后读取
+// one load generating connection. latency is only modified by the read goroutine and read after closing
+type client struct {
+	// 64位原子操作的计数器放在开头保证对齐
+	// counters used with 64-bit atomics come first to keep them aligned
+	sent     uint64
+	received uint64
+	errors   uint64
+
+	gws.BuiltinEventHandler
+	socket  *gws.Conn
+	start   time.Time
+	payload []byte
+	echoed  chan struct{}
+	closed  chan struct{}
+	latency Histogram
+}
+
+func newClient(conf Config, start time.Time) *client {
+	return &client{
+		start:   start,
+		payload: internal.AlphabetNumeric.Generate(conf.MessageSize),
+		echoed:  make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *client) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+	var p = message.Bytes()
+	if len(p) < stampSize {
+		atomic.AddUint64(&c.errors, 1)
+		return
+	}
+	var sentAt = time.Duration(binary.LittleEndian.Uint64(p))
+	c.latency.Record(time.Since(c.start) - sentAt)
+	atomic.AddUint64(&c.received, 1)
+	select {
+	case c.echoed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *client) OnClose(socket *gws.Conn, err error) {
+	close(c.closed)
+}
+
+// 按速率发送, Rate为0时等待回显后再发送下一条
+// send at the configured rate, or wait for the echo before sending the next message if Rate is 0
+func (c *client) send(ctx context.Context, conf Config) {
+	var tick <-chan time.Time
+	if conf.Rate > 0 {
+		var ticker = time.NewTicker(time.Second / time.Duration(conf.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+loop:
+	for conf.Messages <= 0 || c.sent < uint64(conf.Messages) {
+		binary.LittleEndian.PutUint64(c.payload, uint64(time.Since(c.start)))
+		if err := c.socket.WriteMessage(gws.OpcodeBinary, c.payload); err != nil {
+			atomic.AddUint64(&c.errors, 1)
+			return
+		}
+		c.sent++
+
+		var next = c.echoed
+		if tick != nil {
+			next = nil
+		}
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-c.closed:
+			return
+		case <-next:
+		case <-tick:
+		}
+	}
+
+	// 等待在途的回显
+	// wait for the echoes in flight
+	var timeout = time.NewTimer(drainTimeout)
+	defer timeout.Stop()
+	for atomic.LoadUint64(&c.received) < c.sent {
+		select {
+		case <-timeout.C:
+			return
+		case <-c.closed:
+			return
+		case <-c.echoed:
+		}
+	}
+}
+
+// 关闭连接并等待读协程退出
+// close the connection and wait for the read goroutine to exit
+func (c *client) close() {
+	c.socket.WriteClose(1000, nil)
+	select {
+	case <-c.closed:
+	case <-time.After(time.Second):
+		_ = c.socket.NetConn().Close()
+		<-c.closed
+	}
+}
+
+// EchoHandler 回显服务的事件处理器, 原样返回收到的消息
+// EchoHandler is the event handler of an echo service, it sends every message back unchanged
+type EchoHandler struct {
+	gws.BuiltinEventHandler
+}
+
+func (c EchoHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+}
@@ -0,0 +1,130 @@
+package bench
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+func newEchoServer(t testing.TB, option *gws.ServerOption) string {
+	var server = gws.NewServer(EchoHandler{}, option)
+	server.OnRequest = func(socket *gws.Conn, request *http.Request) { socket.ReadLoop() }
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go server.RunListener(listener)
+	return "ws://" + listener.Addr().String()
+}
+
+func TestHistogram(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("empty", func(t *testing.T) {
+		var h Histogram
+		as.Equal(time.Duration(0), h.Percentile(99))
+		as.Equal(time.Duration(0), h.Mean())
+	})
+
+	t.Run("percentile", func(t *testing.T) {
+		var h Histogram
+		for i := 1; i <= 10000; i++ {
+			h.Record(time.Duration(i) * time.Microsecond)
+		}
+		as.Equal(uint64(10000), h.Count())
+		as.Equal(time.Microsecond, h.Min())
+		as.Equal(10*time.Millisecond, h.Max())
+		as.InDelta(float64(5000*time.Microsecond), float64(h.Mean()), float64(time.Microsecond))
+		// 相对误差不超过1/16
+		for _, p := range []float64{50, 90, 99, 99.9} {
+			var expected = float64(p/100*10000) * float64(time.Microsecond)
+			as.InEpsilon(expected, float64(h.Percentile(p)), 1.0/16)
+		}
+		as.Equal(h.Max(), h.Percentile(100))
+	})
+
+	t.Run("bucket", func(t *testing.T) {
+		for _, v := range []uint64{0, 1, 31, 32, 33, 34, 1000, 1 << 40, 1<<63 - 1} {
+			var i = bucketOf(v)
+			as.Less(i, histogramSize)
+			as.LessOrEqual(v, bucketValue(i))
+			if i > 0 {
+				as.Greater(v, bucketValue(i-1))
+			}
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		var a, b Histogram
+		a.Record(time.Millisecond)
+		b.Record(time.Microsecond)
+		b.Record(time.Second)
+		a.Merge(&b)
+		a.Merge(&Histogram{})
+		as.Equal(uint64(3), a.Count())
+		as.Equal(time.Microsecond, a.Min())
+		as.Equal(time.Second, a.Max())
+	})
+}
+
+func TestRun(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("messages", func(t *testing.T) {
+		var addr = newEchoServer(t, nil)
+		report, err := Run(context.Background(), Config{Addr: addr, Connections: 8, Messages: 100})
+		as.NoError(err)
+		as.Equal(8, report.Connections)
+		as.Equal(uint64(800), report.Sent)
+		as.Equal(uint64(800), report.Received)
+		as.Equal(uint64(800), report.Latency.Count())
+		as.Greater(report.Throughput(), 0.0)
+		as.Contains(report.String(), "p99=")
+	})
+
+	t.Run("rate", func(t *testing.T) {
+		var addr = newEchoServer(t, &gws.ServerOption{CompressEnabled: true})
+		report, err := Run(context.Background(), Config{
+			Addr:            addr,
+			Connections:     2,
+			MessageSize:     1024,
+			Rate:            100,
+			Duration:        200 * time.Millisecond,
+			CompressEnabled: true,
+		})
+		as.NoError(err)
+		as.Equal(report.Sent, report.Received)
+		// 每个连接约20条
+		as.InDelta(40, float64(report.Sent), 20)
+	})
+
+	t.Run("dial error", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		as.NoError(err)
+		var addr = "ws://" + listener.Addr().String()
+		_ = listener.Close()
+		report, err := Run(context.Background(), Config{Addr: addr, Connections: 2})
+		as.Error(err)
+		as.Equal(2, report.DialErrors)
+
+		_, err = Run(context.Background(), Config{})
+		as.Error(err)
+	})
+}
+
+// 单连接往返的基准测试, 用于发现性能回归
+func BenchmarkEcho(b *testing.B) {
+	var addr = newEchoServer(b, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	report, err := Run(context.Background(), Config{Addr: addr, Messages: b.N, Duration: time.Hour})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(report.Latency.Percentile(99).Nanoseconds()), "p99-ns")
+}
@@ -0,0 +1,48 @@
+// gwsbench 压测命令行工具, 也可以启动回显服务作为压测对象
+// gwsbench is the load generation command, it can also start an echo service to be benchmarked
+//
+// Example:
+//
+//	gwsbench -serve :8000
+//	gwsbench -addr ws://127.0.0.1:8000 -c 1000 -size 256 -rate 10 -d 30s
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/bench"
+)
+
+func main() {
+	var conf bench.Config
+	var serve = flag.String("serve", "", "start an echo service on this address instead of generating load")
+	flag.StringVar(&conf.Addr, "addr", "ws://127.0.0.1:8000", "address of the service")
+	flag.IntVar(&conf.Connections, "c", 1, "number of connections")
+	flag.IntVar(&conf.MessageSize, "size", 64, "message size in bytes")
+	flag.IntVar(&conf.Rate, "rate", 0, "messages per second per connection, 0 waits for each echo")
+	flag.DurationVar(&conf.Duration, "d", 0, "duration of the run, 10s by default")
+	flag.IntVar(&conf.Messages, "n", 0, "messages per connection, 0 means unlimited")
+	flag.BoolVar(&conf.CompressEnabled, "compress", false, "enable compression")
+	flag.Parse()
+
+	if *serve != "" {
+		var server = gws.NewServer(bench.EchoHandler{}, &gws.ServerOption{CompressEnabled: conf.CompressEnabled})
+		log.Fatalf("%v", server.Run(*serve))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	report, err := bench.Run(ctx, conf)
+	if report != nil {
+		fmt.Println(report.String())
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
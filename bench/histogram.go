@@ -0,0 +1,132 @@
+package bench
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	// 每个2的幂区间划分的子桶数, 相对误差不超过1/16
+	// sub-buckets per power of two, the relative error is at most 1/16
+	subBuckets = 16
+
+	// 小于该值的延迟精确记录
+	// latencies below this value are recorded exactly
+	linearBuckets = 2 * subBuckets
+
+	histogramSize = linearBuckets + 64*subBuckets
+)
+
+// Histogram 对数线性的延迟直方图, 内存固定, 可以合并. 不是并发安全的
+// Histogram is a log-linear latency histogram with a fixed footprint that can be merged. It is not safe for concurrent use
+type Histogram struct {
+	counts [histogramSize]uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func bucketOf(v uint64) int {
+	if v < linearBuckets {
+		return int(v)
+	}
+	var shift = bits.Len64(v) - 5
+	var top = v >> uint(shift)
+	return linearBuckets + (shift-1)*subBuckets + int(top-subBuckets)
+}
+
+// 桶内的最大值
+// the largest value of a bucket
+func bucketValue(index int) uint64 {
+	if index < linearBuckets {
+		return uint64(index)
+	}
+	var shift = (index-linearBuckets)/subBuckets + 1
+	var top = uint64((index-linearBuckets)%subBuckets + subBuckets)
+	return (top+1)<<uint(shift) - 1
+}
+
+// Record 记录一个延迟
+// Record records a latency
+func (c *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	c.counts[bucketOf(uint64(d))]++
+	if c.count == 0 || d < c.min {
+		c.min = d
+	}
+	if d > c.max {
+		c.max = d
+	}
+	c.count++
+	c.sum += d
+}
+
+// Merge 合并另一个直方图
+// Merge adds the samples of another histogram
+func (c *Histogram) Merge(other *Histogram) {
+	if other.count == 0 {
+		return
+	}
+	for i, n := range other.counts {
+		c.counts[i] += n
+	}
+	if c.count == 0 || other.min < c.min {
+		c.min = other.min
+	}
+	if other.max > c.max {
+		c.max = other.max
+	}
+	c.count += other.count
+	c.sum += other.sum
+}
+
+// Count 样本数
+// Count returns the number of samples
+func (c *Histogram) Count() uint64 { return c.count }
+
+// Min 最小延迟
+// Min returns the smallest latency
+func (c *Histogram) Min() time.Duration { return c.min }
+
+// Max 最大延迟
+// Max returns the largest latency
+func (c *Histogram) Max() time.Duration { return c.max }
+
+// Mean 平均延迟
+// Mean returns the average latency
+func (c *Histogram) Mean() time.Duration {
+	if c.count == 0 {
+		return 0
+	}
+	return c.sum / time.Duration(c.count)
+}
+
+// Percentile 第p百分位的延迟, p的范围是[0, 100]
+// Percentile returns the latency at the p-th percentile, p ranges over [0, 100]
+func (c *Histogram) Percentile(p float64) time.Duration {
+	if c.count == 0 {
+		return 0
+	}
+	var rank = uint64(p / 100 * float64(c.count))
+	if rank >= c.count {
+		rank = c.count - 1
+	}
+	var seen uint64
+	for i, n := range c.counts {
+		seen += n
+		if seen > rank {
+			var v = time.Duration(bucketValue(i))
+			if v > c.max {
+				v = c.max
+			}
+			if v < c.min {
+				v = c.min
+			}
+			return v
+		}
+	}
+	return c.max
+}
@@ -3,8 +3,11 @@ package gws
 import (
 	"bufio"
 	"bytes"
+	"io"
 	"net"
 	"testing"
+
+	"github.com/lxzan/gws/internal"
 )
 
 type benchConn struct {
@@ -27,6 +30,45 @@ func BenchmarkConn_WriteMessage(b *testing.B) {
 		}
 	})
 
+	b.Run("small message", func(b *testing.B) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+		var conn = &Conn{
+			conn:   &benchConn{},
+			config: upgrader.option.getConfig(),
+		}
+		var payload = testdata[:64]
+		for i := 0; i < b.N; i++ {
+			_ = conn.WriteMessage(OpcodeBinary, payload)
+		}
+	})
+
+	b.Run("out message", func(b *testing.B) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+		var conn = &Conn{
+			conn:   &benchConn{},
+			config: upgrader.option.getConfig(),
+		}
+		var msg = NewOutMessage(OpcodeText)
+		defer msg.Release()
+		for i := 0; i < b.N; i++ {
+			msg.Reset()
+			_, _ = msg.Write(testdata)
+			_ = msg.Send(conn)
+		}
+	})
+
+	b.Run("write arena", func(b *testing.B) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, &ServerOption{WriteArenaSize: 2 * len(testdata)})
+		var conn = &Conn{
+			conn:   &benchConn{},
+			config: upgrader.option.getConfig(),
+			arena:  newWriteArena(2 * len(testdata)),
+		}
+		for i := 0; i < b.N; i++ {
+			_ = conn.WriteMessage(OpcodeText, testdata)
+		}
+	})
+
 	b.Run("compress enabled", func(b *testing.B) {
 		var upgrader = NewUpgrader(&BuiltinEventHandler{}, &ServerOption{
 			CompressEnabled: true,
@@ -92,4 +134,145 @@ func BenchmarkConn_ReadMessage(b *testing.B) {
 			_ = conn2.readMessage()
 		}
 	})
+
+	b.Run("large text", func(b *testing.B) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, &ServerOption{CheckUtf8Enabled: true})
+		var conn1 = &Conn{
+			isServer: false,
+			conn:     &benchConn{},
+			config:   upgrader.option.getConfig(),
+		}
+		var buf, _, _ = conn1.genFrame(OpcodeText, bytes.Repeat(testdata, 16))
+
+		var reader = bytes.NewReader(buf.Bytes())
+		var conn2 = &Conn{
+			isServer: true,
+			conn:     &benchConn{},
+			rbuf:     bufio.NewReaderSize(reader, buf.Len()),
+			config:   upgrader.option.getConfig(),
+			handler:  upgrader.eventHandler,
+		}
+		b.SetBytes(int64(buf.Len()))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			reader.Reset(buf.Bytes())
+			conn2.rbuf.Reset(reader)
+			_ = conn2.readMessage()
+		}
+	})
+}
+
+func BenchmarkConn_ReadMessage_Batch(b *testing.B) {
+	var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+	var conn1 = &Conn{
+		isServer: false,
+		conn:     &benchConn{},
+		config:   upgrader.option.getConfig(),
+	}
+	var frame, _, _ = conn1.genFrame(OpcodeText, []byte("hello"))
+	var buf = bytes.Repeat(frame.Bytes(), 64)
+
+	var reader = bytes.NewReader(buf)
+	var conn2 = &Conn{
+		isServer: true,
+		conn:     &benchConn{},
+		rbuf:     bufio.NewReader(reader),
+		config:   upgrader.option.getConfig(),
+		handler:  upgrader.eventHandler,
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(buf)
+		conn2.rbuf.Reset(reader)
+		_ = conn2.readMessage()
+	}
+}
+
+func BenchmarkQueue_Push(b *testing.B) {
+	b.Run("mutex", func(b *testing.B) {
+		var q = newWorkerQueue(1)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				q.Push(func() {})
+			}
+		})
+	})
+
+	b.Run("mpsc", func(b *testing.B) {
+		var q mpscQueue
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				q.Push(func() {})
+			}
+		})
+	})
+}
+
+func BenchmarkConn_EmitError(b *testing.B) {
+	var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+	var config = upgrader.option.getConfig()
+	var err = internal.NewError(internal.CloseGoingAway, io.EOF)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var conn = &Conn{conn: &benchConn{}, config: config, handler: &BuiltinEventHandler{}}
+		conn.emitError(err)
+	}
+}
+
+func BenchmarkPreset(b *testing.B) {
+	var presets = []struct {
+		name   string
+		preset Preset
+	}{
+		{"low latency", PresetLowLatency()},
+		{"high throughput", PresetHighThroughput()},
+		{"low memory", PresetLowMemory()},
+	}
+	for _, item := range presets {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, item.preset.Server)
+		var config = upgrader.option.getConfig()
+		var client = initClientOption(item.preset.Client).getConfig()
+
+		b.Run(item.name+"/write", func(b *testing.B) {
+			var conn = &Conn{
+				isServer:        true,
+				conn:            &benchConn{},
+				compressEnabled: config.CompressEnabled,
+				config:          config,
+			}
+			if config.WriteArenaSize > 0 {
+				conn.arena = newWriteArena(config.WriteArenaSize)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_ = conn.WriteMessage(OpcodeText, testdata)
+			}
+		})
+
+		b.Run(item.name+"/read", func(b *testing.B) {
+			var conn1 = &Conn{
+				isServer:        false,
+				conn:            &benchConn{},
+				compressEnabled: client.CompressEnabled,
+				config:          client,
+			}
+			var buf, _, _ = conn1.genFrame(OpcodeText, testdata)
+
+			var reader = bytes.NewReader(buf.Bytes())
+			var conn2 = &Conn{
+				isServer:        true,
+				conn:            &benchConn{},
+				rbuf:            bufio.NewReaderSize(reader, config.ReadBufferSize),
+				compressEnabled: config.CompressEnabled,
+				config:          config,
+				handler:         upgrader.eventHandler,
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reader.Reset(buf.Bytes())
+				conn2.rbuf.Reset(reader)
+				_ = conn2.readMessage()
+			}
+		})
+	}
 }
@@ -0,0 +1,193 @@
+package gws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 抓包文件的魔数
+// magic number at the start of a capture file
+const captureMagic = "GWSCAP1\n"
+
+// 记录头部长度: 方向(1) + 时间(8) + 首字节(1) + 标志(1) + 掩码(4) + 载荷长度(4)
+// record header length: direction(1) + time(8) + first byte(1) + flags(1) + mask key(4) + payload length(4)
+const captureRecordHeaderSize = 19
+
+// 标志位: 帧带有掩码
+// flag: the frame was masked
+const captureFlagMasked = 1
+
+// CapturedFrame 抓包记录的一帧
+// A frame recorded by the capture
+type CapturedFrame struct {
+	Direction FrameDirection
+	Time      time.Time
+	Fin       bool
+	RSV       uint8 // RSV1Bit, RSV2Bit和RSV3Bit的组合 / combination of RSV1Bit, RSV2Bit and RSV3Bit
+	Opcode    Opcode
+	Masked    bool
+	MaskKey   [4]byte
+
+	// 线路上的载荷, 已经去除掩码, 没有解压
+	// payload as on the wire with the mask removed, not decompressed
+	Payload []byte
+}
+
+// 连接的抓包写入器, 读写协程都会写入, 需要加锁
+// capture writer of a connection, written by both the read and write goroutines
+type frameCapture struct {
+	mu  sync.Mutex
+	bw  *bufio.Writer
+	err error
+}
+
+// 写入一条记录, 出错后不再写入
+// write a record, nothing is written after an error
+func (c *frameCapture) write(direction FrameDirection, b0 byte, masked bool, maskKey []byte, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+
+	var header [captureRecordHeaderSize]byte
+	header[0] = byte(direction)
+	binary.BigEndian.PutUint64(header[1:9], uint64(time.Now().UnixNano()))
+	header[9] = b0
+	if masked {
+		header[10] = captureFlagMasked
+		copy(header[11:15], maskKey)
+	}
+	binary.BigEndian.PutUint32(header[15:19], uint32(len(payload)))
+	if _, c.err = c.bw.Write(header[:]); c.err == nil {
+		_, c.err = c.bw.Write(payload)
+	}
+}
+
+// StartCapture 开始将这个连接收发的帧记录到w, 用于事后分析互操作问题, 不需要抓包和TLS密钥; 用NewCaptureReader读取
+// 每帧都会同步写入w, 只应该对选中的连接开启; 再次调用会先停止之前的抓包
+// StartCapture starts recording the frames sent and received on this connection to w, for postmortem analysis
+// of interop bugs without packet capture or TLS keys. Read it with NewCaptureReader.
+// Every frame is written to w synchronously, so only enable it for selected connections.
+// Calling it again stops the previous capture first
+func (c *Conn) StartCapture(w io.Writer) error {
+	var capture = &frameCapture{bw: bufio.NewWriter(w)}
+	_, _ = capture.bw.WriteString(captureMagic)
+	if err := capture.bw.Flush(); err != nil {
+		return err
+	}
+	if err := c.StopCapture(); err != nil {
+		c.config.Logger.Warn("gws: previous capture failed:", err.Error())
+	}
+	c.capture.Store(capture)
+	return nil
+}
+
+// StopCapture 停止抓包并刷新缓冲, 返回抓包过程中的第一个写入错误
+// StopCapture stops the capture and flushes the buffer, returns the first write error of the capture
+func (c *Conn) StopCapture() error {
+	var capture = c.loadCapture()
+	if capture == nil {
+		return nil
+	}
+	c.capture.Store((*frameCapture)(nil))
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if capture.err == nil {
+		capture.err = capture.bw.Flush()
+	}
+	var err = capture.err
+	if err == nil {
+		// 停止之后的写入被丢弃
+		// writes racing with the stop are dropped
+		capture.err = io.ErrClosedPipe
+	}
+	return err
+}
+
+func (c *Conn) loadCapture() *frameCapture {
+	capture, _ := c.capture.Load().(*frameCapture)
+	return capture
+}
+
+// 记录收到的帧, payload已经去除掩码
+// record a received frame, payload has been unmasked
+func (c *Conn) captureInbound(payload []byte) {
+	if capture := c.loadCapture(); capture != nil {
+		capture.write(FrameInbound, c.fh[0], c.fh.GetMask(), c.fh.GetMaskKey(), payload)
+	}
+}
+
+// 记录编码好的帧
+// record an encoded frame
+func (c *Conn) captureOutbound(frame []byte) {
+	var capture = c.loadCapture()
+	if capture == nil || len(frame) < 2 {
+		return
+	}
+	var offset = 2
+	switch frame[1] & 127 {
+	case 126:
+		offset += 2
+	case 127:
+		offset += 8
+	}
+	var masked = frame[1]&128 != 0
+	if !masked {
+		capture.write(FrameOutbound, frame[0], false, nil, frame[offset:])
+		return
+	}
+	var maskKey = frame[offset : offset+4]
+	var payload = append([]byte(nil), frame[offset+4:]...)
+	internal.MaskXOR(payload, maskKey)
+	capture.write(FrameOutbound, frame[0], true, maskKey, payload)
+}
+
+// CaptureReader 读取StartCapture写入的抓包文件
+// CaptureReader reads capture files written by StartCapture
+type CaptureReader struct {
+	br *bufio.Reader
+}
+
+// NewCaptureReader 校验文件头并创建读取器
+// NewCaptureReader checks the file header and creates a reader
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	var br = bufio.NewReader(r)
+	var magic = make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return nil, internal.ErrCaptureFormat
+	}
+	return &CaptureReader{br: br}, nil
+}
+
+// Next 读取下一帧, 读完时返回io.EOF, 记录不完整时返回io.ErrUnexpectedEOF
+// Next reads the next frame. It returns io.EOF at the end and io.ErrUnexpectedEOF if the record is truncated
+func (c *CaptureReader) Next() (*CapturedFrame, error) {
+	var header [captureRecordHeaderSize]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] > byte(FrameOutbound) {
+		return nil, internal.ErrCaptureFormat
+	}
+	var frame = &CapturedFrame{
+		Direction: FrameDirection(header[0]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+		Fin:       header[9]&128 != 0,
+		RSV:       header[9] & rsvMask,
+		Opcode:    Opcode(header[9] & 15),
+		Masked:    header[10]&captureFlagMasked != 0,
+		Payload:   make([]byte, binary.BigEndian.Uint32(header[15:19])),
+	}
+	copy(frame.MaskKey[:], header[11:15])
+	if _, err := io.ReadFull(c.br, frame.Payload); err != nil {
+		return nil, internal.SelectValue(err == io.EOF, io.ErrUnexpectedEOF, err)
+	}
+	return frame, nil
+}
@@ -0,0 +1,100 @@
+package gws
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn_Capture(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var received = make(chan struct{})
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		received <- struct{}{}
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	var serverBuf, clientBuf = bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	as.NoError(server.StartCapture(serverBuf))
+	as.NoError(client.StartCapture(clientBuf))
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(client.WriteString("hello"))
+	<-received
+	as.NoError(server.StopCapture())
+	as.NoError(client.StopCapture())
+	// 停止之后不再记录
+	as.NoError(client.WriteString("world"))
+	<-received
+
+	var readAll = func(buf *bytes.Buffer) []*CapturedFrame {
+		reader, err := NewCaptureReader(buf)
+		if !as.NoError(err) {
+			return nil
+		}
+		var frames []*CapturedFrame
+		for {
+			frame, err := reader.Next()
+			if err == io.EOF {
+				return frames
+			}
+			if !as.NoError(err) {
+				return frames
+			}
+			frames = append(frames, frame)
+		}
+	}
+
+	// 服务端: 收到带掩码的帧, 发送不带掩码的帧
+	var frames = readAll(serverBuf)
+	if as.Len(frames, 2) {
+		as.Equal(FrameInbound, frames[0].Direction)
+		as.True(frames[0].Masked)
+		as.True(frames[0].Fin)
+		as.Equal(OpcodeText, frames[0].Opcode)
+		as.Equal("hello", string(frames[0].Payload))
+		as.Equal(FrameOutbound, frames[1].Direction)
+		as.False(frames[1].Masked)
+		as.Equal("hello", string(frames[1].Payload))
+		as.False(frames[1].Time.Before(frames[0].Time))
+	}
+
+	// 客户端: 发送的帧去除掩码后记录
+	frames = readAll(clientBuf)
+	if as.Len(frames, 2) {
+		as.Equal(FrameOutbound, frames[0].Direction)
+		as.True(frames[0].Masked)
+		as.NotEqual([4]byte{}, frames[0].MaskKey)
+		as.Equal("hello", string(frames[0].Payload))
+		as.Equal(FrameInbound, frames[1].Direction)
+		as.Equal("hello", string(frames[1].Payload))
+	}
+}
+
+func TestCaptureReader(t *testing.T) {
+	var as = assert.New(t)
+
+	_, err := NewCaptureReader(bytes.NewBufferString("hello, world"))
+	as.ErrorIs(err, ErrCaptureFormat)
+
+	var buf = bytes.NewBuffer(nil)
+	var capture = &frameCapture{bw: bufio.NewWriter(buf)}
+	_, _ = capture.bw.WriteString(captureMagic)
+	capture.write(FrameInbound, 0x82, false, nil, []byte("hello"))
+	as.NoError(capture.bw.Flush())
+
+	// 截断的记录
+	reader, err := NewCaptureReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if as.NoError(err) {
+		_, err = reader.Next()
+		as.ErrorIs(err, io.ErrUnexpectedEOF)
+	}
+}
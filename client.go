@@ -2,9 +2,11 @@ package gws
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/binary"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -24,6 +26,7 @@ type connector struct {
 	eventHandler    Event
 	resp            *http.Response
 	secWebsocketKey string
+	rawRequest      []byte
 }
 
 // NewClient
@@ -81,8 +84,17 @@ func (c *connector) writeRequest() (*http.Request, error) {
 	r.Header.Set(internal.Connection.Key, internal.Connection.Val)
 	r.Header.Set(internal.Upgrade.Key, internal.Upgrade.Val)
 	r.Header.Set(internal.SecWebSocketVersion.Key, internal.SecWebSocketVersion.Val)
+	// 请求按处理出站数据的顺序排列, 先执行自定义扩展再压缩
+	// offers follow the order outbound data is processed in, custom extensions before compression
+	var offers []string
+	for _, ext := range c.option.Extensions {
+		offers = append(offers, offerExtension(ext)...)
+	}
 	if c.option.CompressEnabled {
-		r.Header.Set(internal.SecWebSocketExtensions.Key, internal.SecWebSocketExtensions.Val)
+		offers = append(offers, offerDeflateParams(c.option.ContextTakeoverEnabled, c.option.DecompressWindowBits).String())
+	}
+	if len(offers) > 0 {
+		r.Header.Set(internal.SecWebSocketExtensions.Key, strings.Join(offers, ", "))
 	}
 	if c.secWebsocketKey == "" {
 		var key [16]byte
@@ -91,14 +103,29 @@ func (c *connector) writeRequest() (*http.Request, error) {
 		c.secWebsocketKey = base64.StdEncoding.EncodeToString(key[0:])
 		r.Header.Set(internal.SecWebSocketKey.Key, c.secWebsocketKey)
 	}
-	return r, r.Write(c.conn)
+	if c.option.HandshakeCaptureSize <= 0 {
+		return r, r.Write(c.conn)
+	}
+	var buf = bytes.NewBuffer(nil)
+	if err := r.Write(buf); err != nil {
+		return r, err
+	}
+	c.rawRequest = truncateHandshake(buf.Bytes(), c.option.HandshakeCaptureSize)
+	_, err = c.conn.Write(buf.Bytes())
+	return r, err
 }
 
 func (c *connector) handshake() (*Conn, *http.Response, error) {
 	if err := c.conn.SetDeadline(time.Now().Add(c.option.HandshakeTimeout)); err != nil {
 		return nil, c.resp, err
 	}
-	br := bufio.NewReaderSize(c.conn, c.option.ReadBufferSize)
+	var recorder *handshakeRecorder
+	var reader io.Reader = c.conn
+	if n := c.option.HandshakeCaptureSize; n > 0 {
+		recorder = &handshakeRecorder{reader: c.conn, limit: n}
+		reader = recorder
+	}
+	br := bufio.NewReaderSize(reader, c.option.ReadBufferSize)
 	request, err := c.writeRequest()
 	if err != nil {
 		return nil, c.resp, err
@@ -111,14 +138,45 @@ func (c *connector) handshake() (*Conn, *http.Response, error) {
 	if err := <-channel; err != nil {
 		return nil, c.resp, err
 	}
+	var rawResponse []byte
+	if recorder != nil {
+		if rawResponse = truncateHandshake(recorder.stop(br.Buffered()), c.option.HandshakeCaptureSize); br.Buffered() == 0 {
+			br.Reset(c.conn)
+		}
+	}
 	if err := c.checkHeaders(); err != nil {
 		return nil, c.resp, err
 	}
 	if err := c.conn.SetDeadline(time.Time{}); err != nil {
 		return nil, c.resp, err
 	}
-	var compressEnabled = c.option.CompressEnabled && strings.Contains(c.resp.Header.Get(internal.SecWebSocketExtensions.Key), "permessage-deflate")
-	return serveWebSocket(false, c.option.getConfig(), new(sliceMap), c.conn, br, c.eventHandler, compressEnabled), c.resp, nil
+	var responses = parseExtensions(c.resp.Header.Get(internal.SecWebSocketExtensions.Key))
+	deflateResponse, compressEnabled := findExtension(responses, extensionDeflate)
+	compressEnabled = compressEnabled && c.option.CompressEnabled
+	var deflate deflateParams
+	if compressEnabled {
+		if deflate, err = acceptDeflateParams(deflateResponse.params, c.option.DecompressWindowBits, c.option.DeflateQuirksAllowed); err != nil {
+			return nil, c.resp, err
+		}
+		if c.option.DeflateQuirksAllowed {
+			if _, err := acceptDeflateParams(deflateResponse.params, c.option.DecompressWindowBits, false); err != nil {
+				c.option.Logger.Warn("gws: tolerated permessage-deflate response from", c.conn.RemoteAddr().String()+":", deflateResponse.String())
+			}
+		}
+	}
+	extensions, err := acceptExtensions(responses, c.option.Extensions, internal.SelectValue(compressEnabled, RSV1Bit, 0))
+	if err != nil {
+		return nil, c.resp, err
+	}
+	var socket = serveWebSocket(false, c.option.getConfig(), new(sliceMap), c.conn, br, c.eventHandler, compressEnabled)
+	socket.extensions = extensions
+	socket.subprotocol = c.resp.Header.Get(internal.SecWebSocketProtocol.Key)
+	socket.handshakeRequest, socket.handshakeResponse = c.rawRequest, rawResponse
+	if compressEnabled {
+		socket.deflateParams = deflate
+		socket.deflate = newDeflateState(false, deflate, socket.config)
+	}
+	return socket, c.resp, nil
 }
 
 func (c *connector) checkHeaders() error {
@@ -7,22 +7,177 @@ import (
 	"github.com/lxzan/gws/internal"
 	"io"
 	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
 
 const compressionRate = 3
 
+// CompressionStats 压缩统计
+// Compression statistics
+type CompressionStats struct {
+	// 压缩前的字节数
+	// bytes before compression
+	BytesIn uint64
+
+	// 压缩后的字节数
+	// bytes after compression
+	BytesOut uint64
+
+	// 压缩的消息数
+	// number of compressed messages
+	Compressed uint64
+
+	// 达到压缩阈值, 但被自适应策略或SetCompressionEnabled跳过的消息数
+	// number of messages above the threshold that were skipped by the adaptive policy or SetCompressionEnabled
+	Skipped uint64
+
+	// 压缩器池中发生锁等待的次数, 只在Upgrader的汇总统计中有效
+	// number of contended locks in the compressor pool, only reported by the aggregate statistics of the Upgrader
+	Contention uint64
+}
+
+// 压缩统计计数器
+// counters of the compression statistics
+type compressionCounter struct {
+	bytesIn    uint64
+	bytesOut   uint64
+	compressed uint64
+	skipped    uint64
+}
+
+func (c *compressionCounter) add(size, compressedSize int, compressed bool) {
+	if !compressed {
+		atomic.AddUint64(&c.skipped, 1)
+		return
+	}
+	atomic.AddUint64(&c.bytesIn, uint64(size))
+	atomic.AddUint64(&c.bytesOut, uint64(compressedSize))
+	atomic.AddUint64(&c.compressed, 1)
+}
+
+// Ratio 压缩率, 即压缩后与压缩前字节数之比, 没有压缩过消息时为1
+// Ratio returns the compressed size divided by the original size, 1 if nothing has been compressed
+func (c CompressionStats) Ratio() float64 {
+	if c.BytesIn == 0 {
+		return 1
+	}
+	return float64(c.BytesOut) / float64(c.BytesIn)
+}
+
+func (c *compressionCounter) snapshot() CompressionStats {
+	return CompressionStats{
+		BytesIn:    atomic.LoadUint64(&c.bytesIn),
+		BytesOut:   atomic.LoadUint64(&c.bytesOut),
+		Compressed: atomic.LoadUint64(&c.compressed),
+		Skipped:    atomic.LoadUint64(&c.skipped),
+	}
+}
+
+// 连接级别的压缩率统计, 用于自适应跳过压缩
+// per-connection compression ratio statistics for the adaptive compression skip
+type compressStat struct {
+	// 近期压缩率的指数移动平均, 千分比, 0表示还没有样本
+	// exponential moving average of the recent ratios in permille, 0 means no sample yet
+	ratio uint32
+	// 跳过压缩的消息计数
+	// number of messages that skipped compression
+	skipped uint32
+}
+
+// 是否跳过本次压缩; 跳过期间每CompressProbeInterval条消息压缩一次用于重新评估
+// whether to skip compressing this message; while skipping, one message in every CompressProbeInterval is
+// compressed to re-measure the ratio
+func (c *compressStat) skip(config *Config) bool {
+	if config.CompressSkipRatio <= 0 || atomic.LoadUint32(&c.ratio) <= uint32(config.CompressSkipRatio*1000) {
+		return false
+	}
+	var interval = uint32(internal.SelectValue(config.CompressProbeInterval <= 0, defaultCompressProbeInterval, config.CompressProbeInterval))
+	return atomic.AddUint32(&c.skipped, 1)%interval != 0
+}
+
+// 记录一次压缩的结果, 并发写入时丢失个别样本是可以接受的
+// record the result of a compression, losing a sample to a concurrent writer is acceptable
+func (c *compressStat) record(config *Config, size, compressedSize int) {
+	if config.CompressSkipRatio <= 0 || size <= 0 {
+		return
+	}
+	var ratio = uint32(compressedSize*1000/size) + 1
+	if old := atomic.LoadUint32(&c.ratio); old > 0 {
+		ratio = (old*3 + ratio) / 4
+	}
+	atomic.StoreUint32(&c.ratio, ratio)
+}
+
+// Compressor 压缩器, 用于替换默认的flate实现
+// 输出raw deflate格式的数据, 并以同步刷新(sync flush)结束, 末尾的0x00 0x00 0xff 0xff由gws去除
+// 同一个实例不会被并发调用; 开启了上下文接管的连接始终使用内置实现
+// Compressor replaces the default flate implementation.
+// It writes raw DEFLATE data ending with a sync flush; gws strips the trailing 0x00 0x00 0xff 0xff.
+// An instance is never called concurrently; connections with context takeover always use the built-in implementation
+type Compressor interface {
+	// Compress 压缩src并追加到dst
+	// Compress compresses src and appends the result to dst
+	Compress(src []byte, dst *bytes.Buffer) error
+}
+
+// Decompressor 解压器, 用于替换默认的flate实现
+// 输入raw deflate格式的数据, gws已经补上了同步刷新的尾部. 同一个实例不会被并发调用
+// Decompressor replaces the default flate implementation.
+// It reads raw DEFLATE data, gws has already appended the sync flush tail. An instance is never called concurrently
+type Decompressor interface {
+	// Decompress 解压src并写入dst; 超过解压限制时dst的Write会返回错误, 实现需要立即返回该错误
+	// Decompress decompresses src into dst; Write on dst fails once the decompression limits are exceeded,
+	// the implementation must return that error right away
+	Decompress(src io.Reader, dst io.Writer) error
+}
+
+// 限制解压后大小的写入器, 防止解压炸弹一次性占用大量内存
+// writer limiting the decompressed size, which keeps a decompression bomb from allocating a lot of memory at once
+type limitedWriter struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (c *limitedWriter) Write(p []byte) (int, error) {
+	if c.buf.Len()+len(p) > c.limit {
+		return 0, internal.ErrMessageTooLarge
+	}
+	return c.buf.Write(p)
+}
+
+// CompressClass 消息的压缩类别, 不同类别使用不同压缩级别的压缩器池
+// CompressClass tags a message with a compression class, each class uses a compressor pool of its own level
+type CompressClass uint8
+
+const (
+	// CompressClassDefault 使用CompressLevel
+	// CompressClassDefault uses CompressLevel
+	CompressClassDefault CompressClass = iota
+
+	// CompressClassRealtime 延迟敏感的小消息, 使用CompressLevelRealtime
+	// CompressClassRealtime is for latency-critical small messages, uses CompressLevelRealtime
+	CompressClassRealtime
+
+	// CompressClassBulk 大块数据(例如快照), 使用CompressLevelBulk
+	// CompressClassBulk is for bulk payloads such as snapshots, uses CompressLevelBulk
+	CompressClassBulk
+
+	compressClassNum
+)
+
 type compressors struct {
 	serial      uint64
 	size        uint64
 	compressors []*compressor
 }
 
-func (c *compressors) initialize(num int, level int) *compressors {
+func (c *compressors) initialize(num int, level int, newFunc func(level int) Compressor) *compressors {
 	c.size = uint64(internal.ToBinaryNumber(num))
 	for i := uint64(0); i < c.size; i++ {
-		c.compressors = append(c.compressors, newCompressor(level))
+		c.compressors = append(c.compressors, &compressor{cps: newFunc(level)})
 	}
 	return c
 }
@@ -32,28 +187,38 @@ func (c *compressors) Select() *compressor {
 	return c.compressors[j]
 }
 
+// 压缩器池中发生锁等待的总次数
+// total number of contended locks in the compressor pool
+func (c *compressors) contention() uint64 {
+	var sum uint64
+	for _, item := range c.compressors {
+		sum += atomic.LoadUint64(&item.contended)
+	}
+	return sum
+}
+
 func newCompressor(level int) *compressor {
-	fw, _ := flate.NewWriter(nil, level)
-	return &compressor{fw: fw, level: level}
+	return &compressor{cps: newFlateCompressor(level, nil)}
 }
 
 // 压缩器
 type compressor struct {
 	sync.Mutex
-	level int
-	fw    *flate.Writer
+	cps Compressor
+	// 获取锁时发生等待的次数
+	// number of times the lock was contended
+	contended uint64
 }
 
 // Compress 压缩
 func (c *compressor) Compress(src []byte, dst *bytes.Buffer) error {
-	c.Lock()
+	if !c.TryLock() {
+		atomic.AddUint64(&c.contended, 1)
+		c.Lock()
+	}
 	defer c.Unlock()
 
-	c.fw.Reset(dst)
-	if err := internal.WriteN(c.fw, src, len(src)); err != nil {
-		return err
-	}
-	if err := c.fw.Flush(); err != nil {
+	if err := c.cps.Compress(src, dst); err != nil {
 		return err
 	}
 	if n := dst.Len(); n >= 4 {
@@ -65,16 +230,43 @@ func (c *compressor) Compress(src []byte, dst *bytes.Buffer) error {
 	return nil
 }
 
+// dict为预设字典, 每次Reset后都会重新载入
+// dict is the preset dictionary, it is loaded again after every Reset
+func newFlateCompressor(level int, dict []byte) Compressor {
+	fw, _ := flate.NewWriterDict(nil, level, dict)
+	return &flateCompressor{fw: fw}
+}
+
+// 使用预设字典的内置压缩器工厂
+// factory of the built-in compressor with the preset dictionary
+func flateCompressorFunc(dict []byte) func(level int) Compressor {
+	return func(level int) Compressor { return newFlateCompressor(level, dict) }
+}
+
+// 内置的flate压缩器
+// built-in flate compressor
+type flateCompressor struct {
+	fw *flate.Writer
+}
+
+func (c *flateCompressor) Compress(src []byte, dst *bytes.Buffer) error {
+	c.fw.Reset(dst)
+	if err := internal.WriteN(c.fw, src, len(src)); err != nil {
+		return err
+	}
+	return c.fw.Flush()
+}
+
 type decompressors struct {
 	serial        uint64
 	size          uint64
 	decompressors []*decompressor
 }
 
-func (c *decompressors) initialize(num int, level int) *decompressors {
+func (c *decompressors) initialize(num int, newFunc func() Decompressor) *decompressors {
 	c.size = uint64(internal.ToBinaryNumber(num))
 	for i := uint64(0); i < c.size; i++ {
-		c.decompressors = append(c.decompressors, newDecompressor())
+		c.decompressors = append(c.decompressors, &decompressor{dps: newFunc()})
 	}
 	return c
 }
@@ -85,23 +277,281 @@ func (c *decompressors) Select() *decompressor {
 }
 
 func newDecompressor() *decompressor {
-	return &decompressor{fr: flate.NewReader(nil)}
+	return &decompressor{dps: newFlateDecompressor(nil)}
 }
 
 type decompressor struct {
 	sync.Mutex
-	fr io.ReadCloser
+	dps Decompressor
 }
 
-// Decompress 解压
-func (c *decompressor) Decompress(src *bytes.Buffer) (*bytes.Buffer, int, error) {
+// Decompress 解压, 解压后的长度超过limit时返回ErrMessageTooLarge
+// Decompress decompresses src, ErrMessageTooLarge is returned if the output exceeds limit
+func (c *decompressor) Decompress(src *bytes.Buffer, limit int) (*bytes.Buffer, int, error) {
 	c.Lock()
 	defer c.Unlock()
 
 	_, _ = src.Write(internal.FlateTail)
-	resetter := c.fr.(flate.Resetter)
-	_ = resetter.Reset(src, nil) // must return a null pointer
 	var dst, idx = myBufferPool.Get(src.Len() * compressionRate)
-	_, err := c.fr.(io.WriterTo).WriteTo(dst)
+	err := c.dps.Decompress(src, &limitedWriter{buf: dst, limit: limit})
 	return dst, idx, err
 }
+
+func newFlateDecompressor(dict []byte) Decompressor {
+	return &flateDecompressor{fr: flate.NewReader(nil), dict: dict}
+}
+
+// 使用预设字典的内置解压器工厂
+// factory of the built-in decompressor with the preset dictionary
+func flateDecompressorFunc(dict []byte) func() Decompressor {
+	return func() Decompressor { return newFlateDecompressor(dict) }
+}
+
+// 内置的flate解压器
+// built-in flate decompressor
+type flateDecompressor struct {
+	fr   io.ReadCloser
+	dict []byte
+}
+
+func (c *flateDecompressor) Decompress(src io.Reader, dst io.Writer) error {
+	resetter := c.fr.(flate.Resetter)
+	_ = resetter.Reset(src, c.dict) // must return a null pointer
+	_, err := c.fr.(io.WriterTo).WriteTo(dst)
+	return err
+}
+
+// permessage-deflate滑动窗口的位数范围
+// range of the permessage-deflate sliding window bits
+const (
+	minWindowBits = 8
+	maxWindowBits = 15
+)
+
+// permessage-deflate协商参数, 窗口位数为0表示未携带该参数
+// negotiated permessage-deflate parameters, zero window bits means the parameter is absent
+type deflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+// 解析协商参数; 客户端请求中不带值的client_max_window_bits解析为15; lenient时忽略重复或者取值无效的参数
+// parse the negotiation parameters; client_max_window_bits without a value in a client offer is parsed as 15.
+// Duplicate or invalid parameters are skipped if lenient
+func parseDeflateParams(params []string, lenient bool) (deflateParams, error) {
+	var p deflateParams
+	for _, item := range params {
+		var key, val = item, ""
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			key, val = item[:i], strings.Trim(strings.TrimSpace(item[i+1:]), `"`)
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "server_no_context_takeover":
+			p.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			p.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			bits, err := parseWindowBits(val, false)
+			if err != nil || p.serverMaxWindowBits != 0 {
+				if lenient {
+					continue
+				}
+				return p, internal.ErrHandshake
+			}
+			p.serverMaxWindowBits = bits
+		case "client_max_window_bits":
+			bits, err := parseWindowBits(val, true)
+			if err != nil || p.clientMaxWindowBits != 0 {
+				if lenient {
+					continue
+				}
+				return p, internal.ErrHandshake
+			}
+			p.clientMaxWindowBits = bits
+		}
+	}
+	return p, nil
+}
+
+func parseWindowBits(val string, optional bool) (int, error) {
+	if val == "" && optional {
+		return maxWindowBits, nil
+	}
+	bits, err := strconv.Atoi(val)
+	if err != nil || bits < minWindowBits || bits > maxWindowBits {
+		return 0, internal.ErrHandshake
+	}
+	return bits, nil
+}
+
+func (c deflateParams) String() string {
+	var s = extensionDeflate
+	if c.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if c.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if c.serverMaxWindowBits > 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(c.serverMaxWindowBits)
+	}
+	if c.clientMaxWindowBits > 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(c.clientMaxWindowBits)
+	}
+	return s
+}
+
+// 客户端请求参数, 不开启上下文接管时要求双方都不使用; windowBits小于15时要求服务端缩小窗口
+// parameters offered by the client, both sides are asked not to take over the context unless enabled;
+// the server is asked to shrink its window if windowBits is less than 15
+func offerDeflateParams(takeover bool, windowBits int) deflateParams {
+	var p = deflateParams{serverNoContextTakeover: !takeover, clientNoContextTakeover: !takeover}
+	if windowBits < maxWindowBits {
+		p.serverMaxWindowBits = windowBits
+	}
+	return p
+}
+
+// 服务端根据客户端请求和自身配置确定参数. 压缩器只支持32KB窗口, 客户端要求更小的服务端窗口时拒绝压缩
+// server side: decide the parameters from the client's offer and the local option.
+// The compressor only supports a 32KB window, so compression is declined if the client asks for a smaller server window
+func negotiateDeflateParams(offer []string, takeover bool, windowBits int, lenient bool) (deflateParams, bool) {
+	var p, err = parseDeflateParams(offer, lenient)
+	if err != nil || (p.serverMaxWindowBits != 0 && p.serverMaxWindowBits < maxWindowBits) {
+		return p, false
+	}
+	p.serverNoContextTakeover = p.serverNoContextTakeover || !takeover
+	p.clientNoContextTakeover = p.clientNoContextTakeover || !takeover
+	p.serverMaxWindowBits = 0
+	if p.clientMaxWindowBits != 0 {
+		p.clientMaxWindowBits = internal.SelectValue(windowBits < p.clientMaxWindowBits, windowBits, p.clientMaxWindowBits)
+	}
+	if p.clientMaxWindowBits == maxWindowBits {
+		p.clientMaxWindowBits = 0
+	}
+	return p, true
+}
+
+// 客户端校验服务端响应的参数. lenient时容忍回显的client_max_window_bits=15和超出请求的服务端窗口, 解压器总是支持32KB窗口
+// client side: validate the parameters in the server's response. If lenient, an echoed client_max_window_bits=15
+// and a server window larger than requested are tolerated, the decompressor always supports a 32KB window
+func acceptDeflateParams(response []string, windowBits int, lenient bool) (deflateParams, error) {
+	var p, err = parseDeflateParams(response, lenient)
+	if err != nil {
+		return p, err
+	}
+	if lenient {
+		if p.clientMaxWindowBits == maxWindowBits {
+			p.clientMaxWindowBits = 0
+		}
+		windowBits = maxWindowBits
+	}
+	// 客户端没有提供client_max_window_bits, 服务端不能携带; 服务端窗口不能超过请求的大小
+	// the client does not offer client_max_window_bits, so the server must not send it;
+	// the server window must not exceed the requested size
+	if p.clientMaxWindowBits != 0 || (windowBits < maxWindowBits && p.serverMaxWindowBits > windowBits) {
+		return p, internal.ErrHandshake
+	}
+	return p, nil
+}
+
+// 服务端/客户端窗口位数, 未携带参数时为15
+// server/client window bits, 15 if the parameter is absent
+func (c deflateParams) windowBits(isServer bool) int {
+	var bits = internal.SelectValue(isServer, c.serverMaxWindowBits, c.clientMaxWindowBits)
+	return internal.SelectValue(bits == 0, maxWindowBits, bits)
+}
+
+// CompressionParams permessage-deflate协商结果
+// Negotiated permessage-deflate parameters
+type CompressionParams struct {
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	ServerMaxWindowBits     int
+	ClientMaxWindowBits     int
+}
+
+// 连接级别的压缩上下文, 只有协商了上下文接管时才会创建
+// per-connection compression context, created only if context takeover was negotiated
+type deflateState struct {
+	level  int
+	preset []byte
+
+	// 出站消息共用同一个滑动窗口, 由写队列保证压缩顺序与发送顺序一致
+	// outbound messages share one sliding window, the write queue keeps compression order equal to wire order
+	writeTakeover bool
+	fw            *flate.Writer
+	wbuf          *bytes.Buffer
+
+	// 入站消息以最近解压的数据作为字典, 只在读协程中使用
+	// inbound messages use the recently decompressed data as dictionary, only used by the read goroutine
+	readTakeover bool
+	readWindow   int
+	dict         []byte
+	fr           io.ReadCloser
+}
+
+// 滑动窗口的初始内容为预设字典
+// the sliding windows start with the preset dictionary
+func newDeflateState(isServer bool, p deflateParams, config *Config) *deflateState {
+	var writeTakeover = config.ContextTakeoverEnabled && !internal.SelectValue(isServer, p.serverNoContextTakeover, p.clientNoContextTakeover)
+	var readTakeover = !internal.SelectValue(isServer, p.clientNoContextTakeover, p.serverNoContextTakeover)
+	if !writeTakeover && !readTakeover {
+		return nil
+	}
+	var state = &deflateState{
+		level:         config.CompressLevel,
+		preset:        config.CompressDictionary,
+		writeTakeover: writeTakeover,
+		readTakeover:  readTakeover,
+		readWindow:    1 << p.windowBits(!isServer),
+	}
+	state.dict = state.trim(append([]byte(nil), config.CompressDictionary...))
+	return state
+}
+
+// 只保留窗口大小以内的最近数据
+// keep only the most recent data within the window
+func (c *deflateState) trim(dict []byte) []byte {
+	if n := len(dict); n > c.readWindow {
+		copy(dict, dict[n-c.readWindow:])
+		dict = dict[:c.readWindow]
+	}
+	return dict
+}
+
+func (c *deflateState) Compress(src []byte, dst *bytes.Buffer) error {
+	if c.fw == nil {
+		c.wbuf = bytes.NewBuffer(nil)
+		c.fw, _ = flate.NewWriterDict(c.wbuf, c.level, c.preset)
+	}
+	c.wbuf.Reset()
+	if err := internal.WriteN(c.fw, src, len(src)); err != nil {
+		return err
+	}
+	if err := c.fw.Flush(); err != nil {
+		return err
+	}
+	var p = c.wbuf.Bytes()
+	if n := len(p); n >= 4 && binary.BigEndian.Uint32(p[n-4:]) == math.MaxUint16 {
+		p = p[:n-4]
+	}
+	_, err := dst.Write(p)
+	return err
+}
+
+func (c *deflateState) Decompress(src *bytes.Buffer, limit int) (*bytes.Buffer, int, error) {
+	if c.fr == nil {
+		c.fr = flate.NewReader(nil)
+	}
+	_, _ = src.Write(internal.FlateTail)
+	_ = c.fr.(flate.Resetter).Reset(src, c.dict)
+	var dst, idx = myBufferPool.Get(src.Len() * compressionRate)
+	if _, err := c.fr.(io.WriterTo).WriteTo(&limitedWriter{buf: dst, limit: limit}); err != nil {
+		return dst, idx, err
+	}
+	c.dict = c.trim(append(c.dict, dst.Bytes()...))
+	return dst, idx, nil
+}
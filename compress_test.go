@@ -3,7 +3,15 @@ package gws
 import (
 	"bytes"
 	"compress/flate"
+	"crypto/rand"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	klauspost "github.com/klauspost/compress/flate"
 	"github.com/lxzan/gws/internal"
@@ -27,7 +35,7 @@ func TestFlate(t *testing.T) {
 
 			var buf = bytes.NewBufferString("")
 			buf.Write(compressedBuf.Bytes())
-			plainText, _, err := dps.Decompress(buf)
+			plainText, _, err := dps.Decompress(buf, math.MaxInt32)
 			if err != nil {
 				as.NoError(err)
 				return
@@ -50,7 +58,7 @@ func TestFlate(t *testing.T) {
 		var buf = bytes.NewBufferString("")
 		buf.Write(compressedBuf.Bytes())
 		buf.WriteString("1234")
-		_, _, err := dps.Decompress(buf)
+		_, _, err := dps.Decompress(buf, math.MaxInt32)
 		as.Error(err)
 	})
 }
@@ -80,3 +88,629 @@ func BenchmarkKlauspostCompress(b *testing.B) {
 		fw.Flush()
 	}
 }
+
+func TestDeflateParams(t *testing.T) {
+	var as = assert.New(t)
+	as.Equal(internal.SecWebSocketExtensions.Val, offerDeflateParams(false, 15).String())
+	as.Equal(extensionDeflate, offerDeflateParams(true, 15).String())
+	as.Equal(extensionDeflate+"; server_max_window_bits=10", offerDeflateParams(true, 10).String())
+
+	t.Run("parse", func(t *testing.T) {
+		p, err := parseDeflateParams([]string{" Server_No_Context_Takeover", "client_max_window_bits", `server_max_window_bits="9"`}, false)
+		as.NoError(err)
+		as.Equal(deflateParams{serverNoContextTakeover: true, clientMaxWindowBits: 15, serverMaxWindowBits: 9}, p)
+
+		for _, params := range [][]string{
+			{"server_max_window_bits"},
+			{"server_max_window_bits=16"},
+			{"client_max_window_bits=7"},
+			{"client_max_window_bits=x"},
+			{"server_max_window_bits=10", "server_max_window_bits=11"},
+		} {
+			_, err = parseDeflateParams(params, false)
+			as.Error(err)
+		}
+	})
+
+	t.Run("negotiate", func(t *testing.T) {
+		p, ok := negotiateDeflateParams(nil, true, 15, false)
+		as.True(ok)
+		as.Equal(deflateParams{}, p)
+
+		p, ok = negotiateDeflateParams([]string{"server_no_context_takeover"}, true, 15, false)
+		as.True(ok)
+		as.Equal(deflateParams{serverNoContextTakeover: true}, p)
+
+		p, ok = negotiateDeflateParams(nil, false, 15, false)
+		as.True(ok)
+		as.Equal(offerDeflateParams(false, 15), p)
+
+		p, ok = negotiateDeflateParams([]string{"client_max_window_bits", "server_max_window_bits=15"}, true, 15, false)
+		as.True(ok)
+		as.Equal(extensionDeflate, p.String())
+
+		p, ok = negotiateDeflateParams([]string{"client_max_window_bits"}, true, 10, false)
+		as.True(ok)
+		as.Equal(extensionDeflate+"; client_max_window_bits=10", p.String())
+
+		p, ok = negotiateDeflateParams([]string{"client_max_window_bits=9"}, true, 10, false)
+		as.True(ok)
+		as.Equal(9, p.clientMaxWindowBits)
+
+		p, ok = negotiateDeflateParams(nil, true, 10, false)
+		as.True(ok)
+		as.Equal(0, p.clientMaxWindowBits)
+
+		_, ok = negotiateDeflateParams([]string{"server_max_window_bits=12"}, true, 15, false)
+		as.False(ok)
+		_, ok = negotiateDeflateParams([]string{"server_max_window_bits=16"}, true, 15, false)
+		as.False(ok)
+	})
+
+	t.Run("accept", func(t *testing.T) {
+		p, err := acceptDeflateParams([]string{"server_max_window_bits=10"}, 12, false)
+		as.NoError(err)
+		as.Equal(10, p.windowBits(true))
+		as.Equal(15, p.windowBits(false))
+
+		_, err = acceptDeflateParams([]string{"server_max_window_bits=10"}, 15, false)
+		as.NoError(err)
+		_, err = acceptDeflateParams([]string{"server_max_window_bits=13"}, 12, false)
+		as.Error(err)
+		_, err = acceptDeflateParams([]string{"client_max_window_bits=15"}, 15, false)
+		as.Error(err)
+		_, err = acceptDeflateParams([]string{"server_max_window_bits=x"}, 15, false)
+		as.Error(err)
+	})
+
+	// 兼容模式容忍重复或者取值无效的参数
+	t.Run("quirks", func(t *testing.T) {
+		p, err := parseDeflateParams([]string{"server_max_window_bits=16", "client_max_window_bits=10", "client_max_window_bits=11"}, true)
+		as.NoError(err)
+		as.Equal(deflateParams{clientMaxWindowBits: 10}, p)
+
+		_, ok := negotiateDeflateParams([]string{"server_max_window_bits"}, true, 15, true)
+		as.True(ok)
+
+		p, err = acceptDeflateParams([]string{"client_max_window_bits=15"}, 15, true)
+		as.NoError(err)
+		as.Equal(extensionDeflate, p.String())
+		_, err = acceptDeflateParams([]string{"server_max_window_bits=13"}, 12, true)
+		as.NoError(err)
+		_, err = acceptDeflateParams([]string{"client_max_window_bits=10"}, 15, true)
+		as.Error(err)
+	})
+
+	t.Run("state", func(t *testing.T) {
+		as.Nil(newDeflateState(true, offerDeflateParams(false, 15), &Config{ContextTakeoverEnabled: true}))
+		var s = newDeflateState(true, deflateParams{clientNoContextTakeover: true}, &Config{ContextTakeoverEnabled: true})
+		as.True(s.writeTakeover)
+		as.False(s.readTakeover)
+		s = newDeflateState(false, deflateParams{serverMaxWindowBits: 10}, &Config{CompressDictionary: make([]byte, 2048)})
+		as.False(s.writeTakeover)
+		as.True(s.readTakeover)
+		as.Equal(1024, s.readWindow)
+		as.Equal(1024, len(s.dict))
+	})
+}
+
+func TestDeflateState(t *testing.T) {
+	var as = assert.New(t)
+	var w = newDeflateState(true, deflateParams{}, &Config{ContextTakeoverEnabled: true, CompressLevel: flate.BestSpeed})
+	var r = newDeflateState(false, deflateParams{}, &Config{ContextTakeoverEnabled: true, CompressLevel: flate.BestSpeed})
+	var text = internal.AlphabetNumeric.Generate(512)
+	var sizes []int
+	for i := 0; i < 10; i++ {
+		var buf = bytes.NewBuffer(nil)
+		as.NoError(w.Compress(text, buf))
+		sizes = append(sizes, buf.Len())
+		dst, _, err := r.Decompress(buf, math.MaxInt32)
+		as.NoError(err)
+		as.Equal(string(text), dst.String())
+	}
+	as.Less(sizes[1], sizes[0]/4)
+	as.LessOrEqual(len(r.dict), 1<<maxWindowBits)
+}
+
+func TestContextTakeover(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("enabled", func(t *testing.T) {
+		const count = 30
+		var text = string(internal.AlphabetNumeric.Generate(1024))
+		var wg = &sync.WaitGroup{}
+		wg.Add(2 * count)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(text, message.Data.String())
+			wg.Done()
+		}
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(text, message.Data.String())
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{CompressEnabled: true, ContextTakeoverEnabled: true})
+		server, client, err := testHandshake(upgrader, clientHandler, &ClientOption{CompressEnabled: true, ContextTakeoverEnabled: true})
+		if !as.NoError(err) {
+			return
+		}
+		as.True(server.deflate.writeTakeover && server.deflate.readTakeover)
+		as.True(client.deflate.writeTakeover && client.deflate.readTakeover)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		for i := 0; i < count/3; i++ {
+			as.NoError(client.WriteString(text))
+			as.NoError(client.WriteAsync(OpcodeText, []byte(text)))
+			as.NoError(client.WriteString(text))
+			var b = NewBroadcaster(OpcodeText, []byte(text))
+			as.NoError(b.Broadcast(server))
+			as.NoError(server.WriteAsync(OpcodeText, []byte(text)))
+			as.NoError(server.WriteString(text))
+			b.Release()
+		}
+		wg.Wait()
+	})
+
+	t.Run("one side", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{CompressEnabled: true, ContextTakeoverEnabled: true})
+		server, client, err := testHandshake(upgrader, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+		if !as.NoError(err) {
+			return
+		}
+		as.True(server.compressEnabled && client.compressEnabled)
+		as.Nil(server.deflate)
+		as.Nil(client.deflate)
+	})
+
+	t.Run("window bits", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{CompressEnabled: true, ContextTakeoverEnabled: true, DecompressWindowBits: 10})
+		server, client, err := testHandshake(upgrader, new(webSocketMocker), &ClientOption{CompressEnabled: true, ContextTakeoverEnabled: true})
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(CompressionParams{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}, server.CompressionParams())
+		as.Equal(CompressionParams{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}, client.CompressionParams())
+		as.Equal(1<<15, server.deflate.readWindow)
+	})
+
+	t.Run("on handshake", func(t *testing.T) {
+		var params CompressionParams
+		var extensions string
+		var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{
+			CompressEnabled: true,
+			OnHandshake: func(socket *Conn, r *http.Request, responseHeader http.Header) {
+				params = socket.CompressionParams()
+				extensions = responseHeader.Get(internal.SecWebSocketExtensions.Key)
+			},
+		})
+		_, client, err := testHandshake(upgrader, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+		if !as.NoError(err) {
+			return
+		}
+		var expected = CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+		as.Equal(expected, params)
+		as.Equal(expected, client.CompressionParams())
+		as.Equal("permessage-deflate; server_no_context_takeover; client_no_context_takeover", extensions)
+	})
+
+	t.Run("smaller server window", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{CompressEnabled: true})
+		server, client, err := testHandshake(upgrader, new(webSocketMocker), &ClientOption{CompressEnabled: true, DecompressWindowBits: 10})
+		if !as.NoError(err) {
+			return
+		}
+		as.False(server.compressEnabled)
+		as.False(client.compressEnabled)
+		as.Equal(CompressionParams{}, client.CompressionParams())
+	})
+}
+
+type stdCompressor struct {
+	calls int64
+	fw    *flate.Writer
+}
+
+func (c *stdCompressor) Compress(src []byte, dst *bytes.Buffer) error {
+	atomic.AddInt64(&c.calls, 1)
+	c.fw.Reset(dst)
+	if _, err := c.fw.Write(src); err != nil {
+		return err
+	}
+	return c.fw.Flush()
+}
+
+type stdDecompressor struct {
+	calls int64
+}
+
+func (c *stdDecompressor) Decompress(src io.Reader, dst io.Writer) error {
+	atomic.AddInt64(&c.calls, 1)
+	fr := flate.NewReader(src)
+	defer fr.Close()
+	_, err := io.Copy(dst, fr)
+	return err
+}
+
+func TestCustomCompressor(t *testing.T) {
+	var as = assert.New(t)
+	var cps = &stdCompressor{}
+	var dps = &stdDecompressor{}
+	var newCompressor = func(level int) Compressor {
+		cps.fw, _ = flate.NewWriter(nil, level)
+		return cps
+	}
+	var newDecompressor = func() Decompressor { return dps }
+
+	var text = internal.AlphabetNumeric.Generate(1024)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(string(text), message.Data.String())
+		wg.Done()
+	}
+	var serverOption = &ServerOption{CompressEnabled: true, CompressorNum: 1, NewCompressor: newCompressor}
+	var clientOption = &ClientOption{CompressEnabled: true, NewDecompressor: newDecompressor}
+	server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(server.WriteMessage(OpcodeText, text))
+	wg.Wait()
+	as.Equal(int64(1), atomic.LoadInt64(&cps.calls))
+	as.Equal(int64(1), atomic.LoadInt64(&dps.calls))
+}
+
+func TestCompressDictionary(t *testing.T) {
+	var as = assert.New(t)
+	var dict = []byte(`{"id":0,"type":"telemetry","temperature":0,"humidity":0,"timestamp":0}`)
+	var text = []byte(`{"id":1,"type":"telemetry","temperature":21,"humidity":40,"timestamp":1700000000}`)
+
+	t.Run("compressor", func(t *testing.T) {
+		var compress = func(dict []byte) *bytes.Buffer {
+			var buf = bytes.NewBuffer(nil)
+			as.NoError((&compressor{cps: newFlateCompressor(flate.BestCompression, dict)}).Compress(text, buf))
+			return buf
+		}
+		var plain, preset = compress(nil), compress(dict)
+		as.Less(preset.Len(), plain.Len())
+
+		dst, _, err := (&decompressor{dps: newFlateDecompressor(dict)}).Decompress(preset, math.MaxInt32)
+		as.NoError(err)
+		as.Equal(string(text), dst.String())
+	})
+
+	for _, takeover := range []bool{false, true} {
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(string(text), message.Data.String())
+			wg.Done()
+		}
+		var serverOption = &ServerOption{CompressEnabled: true, CompressLevel: flate.BestCompression, CompressThreshold: 1, ContextTakeoverEnabled: takeover, CompressDictionary: dict}
+		var clientOption = &ClientOption{CompressEnabled: true, CompressLevel: flate.BestCompression, CompressThreshold: 1, ContextTakeoverEnabled: takeover, CompressDictionary: dict}
+		server, client, err := testHandshake(NewUpgrader(serverHandler, serverOption), new(webSocketMocker), clientOption)
+		if !as.NoError(err) {
+			return
+		}
+		as.Equal(takeover, server.deflate != nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		for i := 0; i < 3; i++ {
+			as.NoError(client.WriteMessage(OpcodeText, text))
+		}
+		wg.Wait()
+	}
+}
+
+func TestCompressSkip(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("stat", func(t *testing.T) {
+		var config = &Config{CompressSkipRatio: 0.9, CompressProbeInterval: 4}
+		var stat compressStat
+		as.False(stat.skip(config))
+		stat.record(config, 1000, 500)
+		as.False(stat.skip(config))
+		for i := 0; i < 5; i++ {
+			stat.record(config, 1000, 1100)
+		}
+		var skipped = 0
+		for i := 0; i < 8; i++ {
+			if stat.skip(config) {
+				skipped++
+			}
+		}
+		as.Equal(6, skipped)
+
+		var disabled compressStat
+		disabled.record(&Config{}, 1000, 1100)
+		as.False(disabled.skip(&Config{}))
+	})
+
+	t.Run("frame", func(t *testing.T) {
+		var serverOption = &ServerOption{CompressEnabled: true, CompressThreshold: 1, CompressSkipRatio: 0.9, CompressProbeInterval: 4}
+		server, _ := newPeer(new(webSocketMocker), serverOption, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+		var compressed = func(payload []byte) bool {
+			frame, index, err := server.genFrame(OpcodeBinary, payload)
+			as.NoError(err)
+			defer myBufferPool.Put(frame, index)
+			return frame.Bytes()[0]&RSV1Bit != 0
+		}
+
+		var random = make([]byte, 1024)
+		var results []bool
+		for i := 0; i < 8; i++ {
+			_, _ = rand.Read(random)
+			results = append(results, compressed(random))
+		}
+		as.Equal([]bool{true, false, false, false, true, false, false, false}, results)
+
+		var text = bytes.Repeat([]byte("hello"), 200)
+		for i := 0; i < 4; i++ {
+			compressed(text)
+		}
+		as.True(compressed(text))
+	})
+}
+
+func TestCompressionStats(t *testing.T) {
+	var as = assert.New(t)
+	var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{CompressEnabled: true, CompressThreshold: 8})
+	server, _, err := testHandshake(upgrader, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+	if !as.NoError(err) {
+		return
+	}
+	var text = bytes.Repeat([]byte("hello"), 100)
+	for _, payload := range [][]byte{text, text, []byte("hi")} {
+		frame, index, err := server.genFrame(OpcodeText, payload)
+		as.NoError(err)
+		myBufferPool.Put(frame, index)
+	}
+	server.SetCompressionEnabled(false)
+	frame, index, err := server.genFrame(OpcodeText, text)
+	as.NoError(err)
+	myBufferPool.Put(frame, index)
+
+	var stats = server.CompressionStats()
+	as.Equal(uint64(2), stats.Compressed)
+	as.Equal(uint64(1), stats.Skipped)
+	as.Equal(uint64(2*len(text)), stats.BytesIn)
+	as.Less(stats.BytesOut, stats.BytesIn)
+	as.Greater(stats.BytesOut, uint64(0))
+
+	var total = upgrader.CompressionStats()
+	as.Equal(stats.Compressed, total.Compressed)
+	as.Equal(stats.BytesOut, total.BytesOut)
+
+	var cps = newCompressor(flate.BestSpeed)
+	cps.Lock()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cps.Unlock()
+	}()
+	as.NoError(cps.Compress(text, bytes.NewBuffer(nil)))
+	as.Equal(uint64(1), cps.contended)
+}
+
+func TestDecompressorPinned(t *testing.T) {
+	var as = assert.New(t)
+	var text = string(bytes.Repeat([]byte("hello"), 200))
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var pinned []*decompressor
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(text, message.Data.String())
+		pinned = append(pinned, socket.decompressor)
+		wg.Done()
+	}
+	var serverOption = &ServerOption{CompressEnabled: true, DecompressorPinned: true}
+	server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteString(text))
+	as.NoError(client.WriteString(text))
+	wg.Wait()
+	as.NotNil(pinned[0])
+	as.Equal(pinned[0], pinned[1])
+	for _, item := range serverOption.config.decompressors.decompressors {
+		as.NotEqual(pinned[0], item)
+	}
+}
+
+func TestCompressorPinned(t *testing.T) {
+	var as = assert.New(t)
+	var text = string(bytes.Repeat([]byte("hello"), 200))
+	var wg = &sync.WaitGroup{}
+	wg.Add(3)
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(text, message.Data.String())
+		wg.Done()
+	}
+	var serverOption = &ServerOption{CompressEnabled: true, CompressorPinned: true, CompressLevelBulk: flate.BestCompression}
+	server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{CompressEnabled: true})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(server.WriteString(text))
+	as.NotNil(server.compressor)
+	var pinned = server.selectCompressor(CompressClassDefault)
+	as.NoError(server.WriteString(text))
+	as.Equal(pinned, server.selectCompressor(CompressClassDefault))
+	for _, item := range serverOption.config.compressors.compressors {
+		as.NotEqual(pinned, item)
+	}
+
+	// 单独设置了压缩级别的类别仍然使用压缩器池
+	as.NoError(server.WriteMessageClass(CompressClassBulk, OpcodeText, []byte(text)))
+	as.Contains(serverOption.config.classCompressors[CompressClassBulk].compressors, server.selectCompressor(CompressClassBulk))
+	wg.Wait()
+}
+
+func TestDecompressLimit(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("writer", func(t *testing.T) {
+		var buf = bytes.NewBuffer(nil)
+		var cps = newCompressor(flate.BestSpeed)
+		as.NoError(cps.Compress(make([]byte, 4096), buf))
+		_, _, err := newDecompressor().Decompress(buf, 1024)
+		as.ErrorIs(err, internal.ErrMessageTooLarge)
+
+		var socket = &Conn{config: &Config{ReadMaxDecompressedSize: 1000, ReadMaxExpansionRatio: 10}}
+		as.Equal(500, socket.decompressLimit(50))
+		as.Equal(1000, socket.decompressLimit(200))
+		socket.config.ReadMaxExpansionRatio = 0
+		as.Equal(1000, socket.decompressLimit(50))
+	})
+
+	var cases = []struct {
+		name   string
+		option *ServerOption
+	}{
+		{"size", &ServerOption{CompressEnabled: true, ReadMaxDecompressedSize: 1024}},
+		{"ratio", &ServerOption{CompressEnabled: true, ReadMaxExpansionRatio: 100}},
+		{"takeover", &ServerOption{CompressEnabled: true, ContextTakeoverEnabled: true, ReadMaxExpansionRatio: 100}},
+	}
+	for _, item := range cases {
+		t.Run(item.name, func(t *testing.T) {
+			var wg = &sync.WaitGroup{}
+			wg.Add(1)
+			var serverHandler = new(webSocketMocker)
+			serverHandler.onMessage = func(socket *Conn, message *Message) {
+				as.Fail("unexpected message")
+			}
+			serverHandler.onClose = func(socket *Conn, err error) {
+				var closeErr *CloseError
+				as.True(errors.As(err, &closeErr))
+				as.Equal(internal.CloseMessageTooLarge.Uint16(), closeErr.Code)
+				wg.Done()
+			}
+			var clientOption = &ClientOption{CompressEnabled: true, ContextTakeoverEnabled: item.option.ContextTakeoverEnabled}
+			server, client, err := testHandshake(NewUpgrader(serverHandler, item.option), new(webSocketMocker), clientOption)
+			if !as.NoError(err) {
+				return
+			}
+			as.Equal(item.option.ContextTakeoverEnabled, server.deflate != nil)
+			go server.ReadLoop()
+			go client.ReadLoop()
+			_ = client.WriteMessage(OpcodeBinary, make([]byte, 64*1024))
+			wg.Wait()
+		})
+	}
+}
+
+func TestCompressOpcodes(t *testing.T) {
+	var as = assert.New(t)
+	var serverOption = &ServerOption{CompressEnabled: true, CompressThreshold: 1, CompressOpcodes: []Opcode{OpcodeText}}
+	server, _ := newPeer(new(webSocketMocker), serverOption, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+	var compressed = func(opcode Opcode) bool {
+		frame, index, err := server.genFrame(opcode, bytes.Repeat([]byte("hello"), 100))
+		as.NoError(err)
+		defer myBufferPool.Put(frame, index)
+		return frame.Bytes()[0]&RSV1Bit != 0
+	}
+	as.True(compressed(OpcodeText))
+	as.False(compressed(OpcodeBinary))
+	as.False(compressed(OpcodePing))
+	as.Equal(uint64(0), server.CompressionStats().Skipped)
+	as.False(server.isCompressible(OpcodeBinary, make([]byte, 1024)))
+
+	server.config.CompressOpcodes = nil
+	as.True(compressed(OpcodeBinary))
+}
+
+func TestCompressClass(t *testing.T) {
+	var as = assert.New(t)
+	var words = []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot", "golf", "hotel", "india", "juliet"}
+	var text = bytes.NewBufferString("")
+	for i := 0; i < 20000; i++ {
+		text.WriteString(words[(i*7+i/3)%len(words)])
+		text.WriteByte(' ')
+	}
+	var payload = text.Bytes()
+
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(string(payload), message.Data.String())
+		wg.Done()
+	}
+	var serverOption = &ServerOption{CompressEnabled: true, CompressLevelBulk: flate.BestCompression}
+	server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{CompressEnabled: true})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var config = server.config
+	as.Equal(defaultClassCompressorNum, len(config.getCompressors(CompressClassBulk).compressors))
+	as.True(config.getCompressors(CompressClassRealtime) == config.compressors)
+	as.True(config.getCompressors(CompressClass(100)) == config.compressors)
+	as.Equal(1, len(client.config.compressors.compressors))
+	as.Nil(client.config.classCompressors[CompressClassBulk])
+
+	frame, index, err := server.genClassFrame(CompressClassDefault, OpcodeText, payload)
+	as.NoError(err)
+	var defaultSize = frame.Len()
+	myBufferPool.Put(frame, index)
+	frame, index, err = server.genClassFrame(CompressClassBulk, OpcodeText, payload)
+	as.NoError(err)
+	as.Less(frame.Len(), defaultSize)
+	myBufferPool.Put(frame, index)
+
+	as.NoError(server.WriteMessageClass(CompressClassBulk, OpcodeText, payload))
+	as.NoError(server.WriteAsyncClass(CompressClassRealtime, OpcodeText, payload))
+	wg.Wait()
+}
+
+func TestDeflateQuirks(t *testing.T) {
+	var as = assert.New(t)
+	var text = "hello hello hello world"
+	var buf = bytes.NewBuffer(nil)
+	fw, _ := klauspost.NewWriter(buf, klauspost.BestSpeed)
+	_, _ = fw.Write([]byte(text))
+	_ = fw.Flush()
+	// 没有去掉结尾00 00 ff ff的压缩数据
+	var unstripped = buf.Bytes()
+
+	t.Run("disabled", func(t *testing.T) {
+		var closed = make(chan error, 1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(serverHandler, &ServerOption{CompressEnabled: true}, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(testWriteRSV(client, true, OpcodeText, RSV1Bit, testCloneBytes(unstripped)))
+		as.Error(<-closed)
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		var messages = make(chan string, 2)
+		var logger = &levelLogger{ch: make(chan string, 4)}
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		var serverOption = &ServerOption{CompressEnabled: true, DeflateQuirksAllowed: true, Logger: logger}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(testWriteRSV(client, true, OpcodeText, RSV1Bit, testCloneBytes(unstripped)))
+		as.Equal(text, <-messages)
+		as.Equal("warn", <-logger.ch)
+
+		// 规范的消息不受影响, 只记录一次日志
+		as.NoError(testWriteRSV(client, true, OpcodeText, RSV1Bit, testCloneBytes(unstripped[:len(unstripped)-4])))
+		as.Equal(text, <-messages)
+		as.NoError(testWriteRSV(client, true, OpcodeText, RSV1Bit, testCloneBytes(unstripped)))
+		as.Equal(text, <-messages)
+		as.Equal([]string{"warn"}, logger.levels)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		var option = initServerOption(&ServerOption{DeflateQuirksAllowed: true, StrictProtocol: true})
+		as.False(option.DeflateQuirksAllowed)
+		as.False(option.getConfig().DeflateQuirksAllowed)
+	})
+}
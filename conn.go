@@ -3,17 +3,34 @@ package gws
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
-	"unicode/utf8"
+	"unsafe"
 
 	"github.com/lxzan/gws/internal"
 )
 
 type Conn struct {
+	// fields used with 64-bit atomics come first, so that they are 8-byte aligned on 32-bit platforms
+
+	// unique connection id
+	id uint64
+	// traffic statistics of the connection
+	counter connCounter
+	// compression statistics of the connection
+	compressionStats compressionCounter
+	// bytes waiting in the write queue, only tracked with MemoryWatermark
+	queuedBytes int64
+	// clock of the timer wheel when the last frame started, in UnixNano
+	lastActive int64
+
 	// store session information
 	SessionStorage SessionStorage
 	// store session
@@ -22,40 +39,141 @@ type Conn struct {
 	isServer bool
 	// whether to use compression
 	compressEnabled bool
+	// whether a tolerated masking violation has been logged
+	maskLogged bool
+	// whether a tolerated permessage-deflate quirk has been logged
+	deflateQuirkLogged bool
+	// outgoing compression turned off by SetCompressionEnabled
+	compressPaused uint32
 	// tcp connection
 	conn net.Conn
+	// destination of encoded frames set by the io_uring backend, nil to write to conn directly
+	writer io.Writer
+	// source of inbound bytes set by the io_uring backend, nil to read from conn directly
+	reader io.Reader
+	// write buffer preallocated for the connection, nil unless WriteArenaSize is set
+	arena *writeArena
+	// frame buffer of small messages, allocated on first use and held by one writer at a time
+	smallFrame *[smallFrameSize]byte
 	// server configs
 	config *Config
-	// read buffer
+	// read buffer, nil while released
 	rbuf *bufio.Reader
-	// continuation frame
-	continuationFrame continuationFrame
+	// holds the first byte read while the read buffer is released
+	prefix prefixReader
+	// unbuffered reader used instead of rbuf if RawReadEnabled
+	raw io.Reader
+	// continuation frame, nil unless a fragmented message is being received
+	continuationFrame *continuationFrame
+	// utf8 checker used while unmasking single frame text messages
+	textChecker internal.Utf8Checker
 	// frame header for read
 	fh frameHeader
 	// WebSocket Event Handler
 	handler Event
+	// handler set by SetEventHandler, holds eventHolder
+	swappedHandler atomic.Value
 
 	// whether server is closed
 	closed uint32
+	// held from claiming the close until the close frame is written, so that ReadLoop does not close the connection
+	// under the closing goroutine
+	closeMu sync.Mutex
+	// whether inbound data messages are dropped, set by StopReadingAndDrain
+	draining uint32
+	// whether smallFrame is held by a writer
+	smallBusy int32
+	// whether the read buffer is counted in the memory in use, only tracked with MemoryWatermark
+	readCharged int32
 	// async read task queue
 	readQueue workerQueue
 	// async write task queue
-	writeQueue workerQueue
+	writeQueue mpscQueue
+	// inbound rate limiter
+	limiter *readLimiter
+	// negotiated permessage-deflate parameters
+	deflateParams deflateParams
+	// recent compression ratio, used by the adaptive compression skip
+	compressStat compressStat
+	// dedicated decompressor if DecompressorPinned, created on first use
+	decompressor *decompressor
+	// dedicated compressor if CompressorPinned, created on first use. *compressor
+	compressor unsafe.Pointer
+	// compression context, nil unless context takeover was negotiated
+	deflate *deflateState
+	// negotiated custom extensions
+	extensions []Extension
+	// negotiated subprotocol, empty if none
+	subprotocol string
+	// raw upgrade request and response, nil unless HandshakeCaptureSize is set
+	handshakeRequest  []byte
+	handshakeResponse []byte
+	// holds *frameCapture set by StartCapture, nil if not capturing
+	capture atomic.Value
+	// detects stalled writes, nil unless WriteStallThreshold is set
+	watchdog *writeWatchdog
+	// event loop the connection is parked in, nil when served by ReadLoop
+	reactor   *Reactor
+	reactorFd int
+	// enforces IdleTimeout, nil if disabled
+	idleTimer *wheelTimer
+	// registry maintained by the server, nil if disabled
+	registry *ConnMap
+	// holds *connContext created on first use, cancelled when the connection is closed
+	ctx atomic.Value
+}
+
+type connContextKey struct{}
+
+// 连接的context及其取消函数, 以指针存入atomic.Value以便比较
+// the connection context with its cancel function, stored by pointer in atomic.Value so that it can be compared
+type connContext struct {
+	context.Context
+	cancel context.CancelFunc
 }
 
 func serveWebSocket(isServer bool, config *Config, session SessionStorage, netConn net.Conn, br *bufio.Reader, handler Event, compressEnabled bool) *Conn {
 	c := &Conn{
+		id:              nextConnID(),
 		isServer:        isServer,
 		SessionStorage:  session,
 		config:          config,
 		compressEnabled: compressEnabled,
 		conn:            netConn,
+		writer:          newConnWriter(netConn),
+		reader:          newConnReader(netConn),
 		closed:          0,
 		rbuf:            br,
 		fh:              frameHeader{},
 		handler:         handler,
-		readQueue:       workerQueue{maxConcurrency: int32(config.ReadAsyncGoLimit)},
-		writeQueue:      workerQueue{maxConcurrency: 1},
+		readQueue:       workerQueue{maxConcurrency: int32(internal.SelectValue(config.ReadAsyncOrdered, 1, config.ReadAsyncGoLimit)), sched: config.readScheduler},
+		limiter:         newReadLimiter(config),
+		counter:         connCounter{openedAt: time.Now().UnixNano()},
+	}
+	if config.RawReadEnabled {
+		c.rbuf, c.raw = nil, newRawReader(c.netReader(), br)
+	} else if c.reader != nil && br != nil {
+		resetReaderSource(br, c.reader)
+	}
+	if c.rbuf != nil {
+		c.chargeReadBuffer()
+	}
+	if config.WriteStallThreshold > 0 {
+		c.watchdog = &writeWatchdog{conn: c}
+	}
+	if config.timerWheel != nil {
+		c.idleTimer = config.timerWheel.newTimer(c.checkIdle)
+	}
+	if config.WriteArenaSize > 0 {
+		c.arena = newWriteArena(config.WriteArenaSize)
+	}
+	if err := c.SetSocketBuffers(config.SocketReadBufferSize, config.SocketWriteBufferSize); err != nil {
+		config.Logger.Error("gws: failed to set socket buffers:", err.Error())
+	}
+	if config.TCPKeepAliveEnabled {
+		if err := c.SetKeepAlive(config.TCPKeepAliveInterval, config.TCPKeepAliveCount); err != nil {
+			config.Logger.Error("gws: failed to set keepalive:", err.Error())
+		}
 	}
 	return c
 }
@@ -63,25 +181,87 @@ func serveWebSocket(isServer bool, config *Config, session SessionStorage, netCo
 // ReadLoop start a read message loop
 // 启动一个读消息的死循环
 func (c *Conn) ReadLoop() {
-	defer c.conn.Close()
+	defer c.closeConn()
 
-	c.handler.OnOpen(c)
+	c.eventHandler().OnOpen(c)
+	c.startIdleTimer()
 
 	for {
 		if err := c.readMessage(); err != nil {
-			c.emitError(err)
+			c.resetContinuation()
+			c.emitError(c.checkIdleTimeout(err))
 			return
 		}
+		c.releaseReadBuffer()
+	}
+}
+
+// ReadLoop退出时关闭连接; 等待其他协程写完关闭帧, 避免关闭帧被截断
+// close the connection when ReadLoop exits, waiting for another goroutine to finish writing the close frame
+// so that it is not cut off
+func (c *Conn) closeConn() {
+	c.closeMu.Lock()
+	_ = c.conn.Close()
+	c.closeMu.Unlock()
+}
+
+// 开始读取时启动空闲定时器, 握手完成前不会触发
+// start the idle timer once reading begins, so that it cannot fire before the handshake completes
+func (c *Conn) startIdleTimer() {
+	if c.idleTimer != nil {
+		c.refreshIdleTimeout()
+		c.idleTimer.reset(c.config.IdleTimeout)
 	}
 }
 
+// 刷新空闲超时, 只记录时间轮的时钟, 由定时器到期时检查
+// refresh the idle timeout by recording the clock of the timer wheel, which is checked when the timer expires
+func (c *Conn) refreshIdleTimeout() {
+	if c.idleTimer != nil {
+		atomic.StoreInt64(&c.lastActive, c.config.timerWheel.now())
+	}
+}
+
+// 空闲定时器到期, 期间读取过数据则按剩余时间重新设置, 否则关闭连接. 在时间轮的协程中执行, 关闭连接需要写关闭帧, 放到新协程中
+// the idle timer expired: reschedule for the remaining time if data was read meanwhile, otherwise close the connection.
+// It runs on the goroutine of the timer wheel, closing writes a close frame so it is done on a new goroutine
+func (c *Conn) checkIdle() {
+	if c.isClosed() {
+		return
+	}
+	var idle = time.Duration(c.config.timerWheel.now() - atomic.LoadInt64(&c.lastActive))
+	if idle < c.config.IdleTimeout {
+		c.idleTimer.reset(c.config.IdleTimeout - idle)
+		return
+	}
+	go c.emitError(c.protocolError(protocolErrorTimeout, internal.NewError(internal.CloseGoingAway, internal.ErrIdleTimeout)))
+}
+
+// 将读超时转换为空闲超时错误
+// convert read timeout to idle timeout error
+func (c *Conn) checkIdleTimeout(err error) error {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	// 关闭连接时设置的截止时间也会导致超时, 不计入统计
+	// closing the connection sets a deadline that times out the read as well, do not count it
+	if !c.isClosed() {
+		c.protocolError(protocolErrorTimeout, err)
+	}
+	if c.config.IdleTimeout <= 0 {
+		return err
+	}
+	return internal.NewError(internal.CloseGoingAway, internal.ErrIdleTimeout)
+}
+
 func (c *Conn) isTextValid(opcode Opcode, payload []byte) bool {
 	if !c.config.CheckUtf8Enabled {
 		return true
 	}
 	switch opcode {
 	case OpcodeText, OpcodeCloseConnection:
-		return utf8.Valid(payload)
+		return c.config.Utf8Validator(payload)
 	default:
 		return true
 	}
@@ -91,33 +271,121 @@ func (c *Conn) isClosed() bool {
 	return atomic.LoadUint32(&c.closed) == 1
 }
 
+// 出现错误时关闭连接, 如果handler实现了ErrorHandler会先调用OnError
+// close the connection on error, OnError is called first if the handler implements ErrorHandler
 func (c *Conn) emitError(err error) {
+	c.closeWithError(err, true)
+}
+
+// 关闭时的CloseError和关闭帧的载荷
+// the CloseError and the close frame payload of a closing connection
+type closeRecord struct {
+	err     CloseError
+	payload [internal.ThresholdV1]byte
+}
+
+// 连接已经关闭, 丢弃错误
+// the connection is already closed, drop the error
+func (c *Conn) dropError(err error, notify bool) {
+	if notify && debugEnabled(c.config.Logger) {
+		c.config.Logger.Debug("gws: error dropped after close:", err.Error())
+	}
+}
+
+// 写关闭帧的默认超时时间
+// default timeout for writing the close frame
+const defaultCloseFrameTimeout = 5 * time.Second
+
+// 写关闭帧. 先设置写截止时间, 对端不再读取时写入不会一直阻塞, 也不会让等待closeMu的ReadLoop一直阻塞
+// write the close frame. A write deadline is set first, so that the write, and ReadLoop waiting on closeMu,
+// cannot block forever on a peer that stopped reading
+func (c *Conn) writeCloseFrame(payload []byte) {
+	var timeout = internal.SelectValue(c.config.closeFrameTimeout > 0, c.config.closeFrameTimeout, defaultCloseFrameTimeout)
+	_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_ = c.doWrite(CompressClassDefault, OpcodeCloseConnection, payload)
+}
+
+func (c *Conn) closeWithError(err error, notify bool) {
 	if err == nil {
 		return
 	}
 
 	var responseCode = internal.CloseNormalClosure
-	var responseErr error = internal.CloseNormalClosure
+	var responseErr = err
+	var text = err.Error()
 	switch v := err.(type) {
 	case internal.StatusCode:
 		responseCode = v
 	case *internal.Error:
 		responseCode = v.Code
 		responseErr = v.Err
-	default:
-		responseErr = err
+	}
+	if notify && c.config.CloseCodeMapper != nil {
+		var code, reason = c.config.CloseCodeMapper(err)
+		switch {
+		case code == 0:
+			responseCode, text = 0, ""
+		case isSendableCloseCode(code):
+			responseCode, text = internal.StatusCode(code), reason
+		default:
+			code, text = DefaultCloseCode(err)
+			responseCode = internal.StatusCode(code)
+		}
 	}
 
-	var content = responseCode.Bytes()
-	content = append(content, err.Error()...)
-	if len(content) > internal.ThresholdV1 {
-		content = content[:internal.ThresholdV1]
+	// OnError在持有closeMu时调用, 已关闭的连接不加锁直接返回, 回调中调用WriteClose不会死锁
+	// OnError is called with closeMu held. A closed connection returns before locking,
+	// so calling WriteClose from the callback does not deadlock
+	if c.isClosed() {
+		c.dropError(err, notify)
+		return
 	}
-	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
-		_ = c.doWrite(OpcodeCloseConnection, content)
-		_ = c.conn.SetDeadline(time.Now())
-		c.handler.OnClose(c, responseErr)
+	c.closeMu.Lock()
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		c.closeMu.Unlock()
+		c.dropError(err, notify)
+		return
 	}
+
+	// CloseError和关闭帧的载荷一次分配, 载荷同时作为Reason
+	// CloseError and the close frame payload are allocated at once, the payload doubles as the Reason
+	var record = new(closeRecord)
+	var content = record.payload[:0]
+	if responseCode != 0 {
+		content = append(content, byte(responseCode>>8), byte(responseCode))
+	}
+	var codeLength = len(content)
+	if n := cap(content) - codeLength; len(text) > n {
+		text = text[:n]
+	}
+	content = append(content, text...)
+	var closeErr = &record.err
+	closeErr.Code, closeErr.Err, closeErr.Reason = responseCode.Uint16(), responseErr, content[codeLength:]
+
+	if notify {
+		// 先按状态码筛选, 大量连接因为超时或者网络错误关闭时不必解析错误链
+		// filter by the status code first, so that the error chain is not inspected when many connections
+		// close because of timeouts or network errors
+		switch closeReasonOfCode(responseCode) {
+		case CloseReasonProtocol, CloseReasonPolicy:
+			switch CloseReasonOf(closeErr) {
+			case CloseReasonProtocol, CloseReasonPolicy:
+				c.config.Logger.Warn("gws: closing connection from", c.RemoteAddr().String()+":", err.Error())
+			}
+		}
+		if h, ok := c.eventHandler().(ErrorHandler); ok {
+			h.OnError(c, err)
+		}
+		if c.config.serverStats != nil {
+			atomic.AddUint64(&c.config.serverStats.errors, 1)
+		}
+	}
+
+	c.writeCloseFrame(content)
+	_ = c.conn.SetDeadline(time.Now())
+	c.closeMu.Unlock()
+	c.onClosed()
+	c.notifyClosed(closeErr)
 }
 
 func (c *Conn) emitClose(buf *bytes.Buffer) error {
@@ -135,29 +403,89 @@ func (c *Conn) emitClose(buf *bytes.Buffer) error {
 		var b [2]byte
 		_, _ = buf.Read(b[0:])
 		realCode = binary.BigEndian.Uint16(b[0:])
-		switch realCode {
-		case 1004, 1005, 1006, 1014, 1015:
+		if code := internal.StatusCode(realCode); !code.IsValid() {
 			responseCode = internal.CloseProtocolError
-		default:
-			if realCode < 1000 || realCode >= 5000 || (realCode >= 1016 && realCode < 3000) {
-				responseCode = internal.CloseProtocolError
-			} else if realCode < 1016 {
-				responseCode = internal.CloseNormalClosure
-			} else {
-				responseCode = internal.StatusCode(realCode)
-			}
+		} else if realCode < 1016 {
+			responseCode = internal.CloseNormalClosure
+		} else {
+			responseCode = code
 		}
 		if !c.isTextValid(OpcodeCloseConnection, buf.Bytes()) {
 			responseCode = internal.CloseUnsupportedData
 		}
 	}
-	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
-		_ = c.doWrite(OpcodeCloseConnection, responseCode.Bytes())
-		c.handler.OnClose(c, &CloseError{Code: realCode, Reason: buf.Bytes()})
+	c.closeMu.Lock()
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		c.closeMu.Unlock()
+		return internal.CloseNormalClosure
 	}
+	c.writeCloseFrame(responseCode.Bytes())
+	c.closeMu.Unlock()
+	c.onClosed()
+	c.notifyClosed(&CloseError{Code: realCode, Reason: buf.Bytes()})
 	return internal.CloseNormalClosure
 }
 
+// atomic.Value要求存储相同的具体类型
+// atomic.Value requires a consistent concrete type
+type eventHolder struct {
+	Event
+}
+
+func (c *Conn) eventHandler() Event {
+	if v := c.swappedHandler.Load(); v != nil {
+		return v.(eventHolder).Event
+	}
+	return c.handler
+}
+
+// SetEventHandler 替换事件处理器, 并发安全; 从下一个事件开始生效, 正在执行的回调不受影响
+// 异步读模式下, 已经读取但尚未执行的消息仍然交给读取时的处理器
+// 适用于分阶段的协议, 例如鉴权阶段和数据阶段使用不同的处理器
+// Replace the event handler, safe for concurrent use. Takes effect from the next event, callbacks already running are not affected.
+// With asynchronous reads, messages read but not yet dispatched still go to the handler active when they were read.
+// Useful for protocols with distinct phases, e.g. an auth phase followed by a data phase
+func (c *Conn) SetEventHandler(handler Event) {
+	c.swappedHandler.Store(eventHolder{handler})
+}
+
+// 通知事件处理器和服务端审计钩子连接已关闭
+// notify the event handler and the audit hook of the server that the connection is closed
+func (c *Conn) notifyClosed(err *CloseError) {
+	err.Stats, err.ClosedAt = c.Stats(), time.Now()
+	c.eventHandler().OnClose(c, err)
+	if c.config.onConnClosed != nil {
+		c.config.onConnClosed(c, err)
+	}
+}
+
+// 连接关闭后(OnClose之前)释放连接级别的资源
+// release per-connection resources once closed, before OnClose
+func (c *Conn) onClosed() {
+	if v := c.ctx.Load(); v != nil {
+		v.(*connContext).cancel()
+	}
+	if c.config.serverStats != nil {
+		atomic.AddUint64(&c.config.serverStats.closed, 1)
+	}
+	if c.registry != nil {
+		c.registry.Remove(c)
+	}
+	if c.watchdog != nil {
+		c.watchdog.stop()
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.stop()
+	}
+	if c.reactor != nil {
+		c.reactor.remove(c)
+	}
+	c.dischargeReadBuffer()
+	if s, ok := c.SessionStorage.(interface{ stopTimers() }); ok {
+		s.stopTimers()
+	}
+}
+
 // SetDeadline sets deadline
 func (c *Conn) SetDeadline(t time.Time) error {
 	if c.isClosed() {
@@ -169,6 +497,7 @@ func (c *Conn) SetDeadline(t time.Time) error {
 }
 
 // SetReadDeadline sets read deadline
+// If IdleTimeout is enabled, a read timeout is reported as an idle timeout
 func (c *Conn) SetReadDeadline(t time.Time) error {
 	if c.isClosed() {
 		return internal.ErrConnClosed
@@ -188,6 +517,115 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 	return err
 }
 
+// Context 返回连接级别的context, 连接关闭时(在OnClose之前)被取消, 可以通过ConnFromContext取回连接
+// 在OnMessage等回调中调用数据库/RPC时传入该context, 连接断开后下游调用会被一并取消
+// Context returns the per-connection context. It is cancelled when the connection is closed, before OnClose is called,
+// and carries the connection, which can be retrieved with ConnFromContext.
+// Pass it to downstream calls (DB, RPC) made from OnMessage and friends so they inherit the cancellation.
+func (c *Conn) Context() context.Context {
+	return c.loadContext().Context
+}
+
+// 首次使用时创建context; 在连接关闭之后创建的立即取消
+// create the context on first use, cancelling it right away if created after the connection is closed
+func (c *Conn) loadContext() *connContext {
+	if v := c.ctx.Load(); v != nil {
+		return v.(*connContext)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), connContextKey{}, c))
+	var result = &connContext{ctx, cancel}
+	if !c.ctx.CompareAndSwap(nil, result) {
+		cancel()
+		return c.ctx.Load().(*connContext)
+	}
+	if c.isClosed() {
+		cancel()
+	}
+	return result
+}
+
+// WithValue 向连接的context中添加一个值, 之后Context返回的context都携带该值, 并发安全
+// 与SessionStorage不同, 这些值随context传递给下游的tracer和客户端; key的使用规则同context.WithValue
+// WithValue adds a value to the connection context, contexts returned by Context afterwards carry it. Safe for concurrent use.
+// Unlike SessionStorage, the values travel with the context into tracers and downstream clients;
+// keys follow the rules of context.WithValue
+func (c *Conn) WithValue(key, value interface{}) {
+	for {
+		var old = c.loadContext()
+		var ctx = &connContext{context.WithValue(old.Context, key, value), old.cancel}
+		if c.ctx.CompareAndSwap(old, ctx) {
+			return
+		}
+	}
+}
+
+// ConnFromContext 从Conn.Context派生的context中取回连接
+// ConnFromContext retrieves the connection from a context derived from Conn.Context
+func ConnFromContext(ctx context.Context) (*Conn, bool) {
+	socket, ok := ctx.Value(connContextKey{}).(*Conn)
+	return socket, ok
+}
+
+// IsServer 是否为服务端连接
+// IsServer reports whether the connection was accepted by a server
+func (c *Conn) IsServer() bool {
+	return c.isServer
+}
+
+// CompressionEnabled 握手时是否协商了permessage-deflate
+// CompressionEnabled reports whether permessage-deflate was negotiated during the handshake
+func (c *Conn) CompressionEnabled() bool {
+	return c.compressEnabled
+}
+
+// SetCompressionEnabled 开启或关闭后续出站消息的压缩, 只在握手协商了permessage-deflate时有效, 不影响入站消息
+// 可用于在高负载时关闭低优先级连接的压缩以节省CPU
+// SetCompressionEnabled turns compression of subsequent outgoing messages on or off. It only takes effect if
+// permessage-deflate was negotiated and never affects incoming messages.
+// Servers can use it to shed CPU under load by disabling compression for low-priority connections
+func (c *Conn) SetCompressionEnabled(enabled bool) {
+	atomic.StoreUint32(&c.compressPaused, internal.SelectValue[uint32](enabled, 0, 1))
+}
+
+// CompressionStats 连接的压缩统计
+// CompressionStats returns the compression statistics of the connection
+func (c *Conn) CompressionStats() CompressionStats {
+	return c.compressionStats.snapshot()
+}
+
+// WriteQueueLen 写队列中等待发送的消息数量, 包括WriteAsync和Broadcast提交的消息
+// WriteQueueLen returns the number of messages waiting in the write queue, including those from WriteAsync and Broadcast
+func (c *Conn) WriteQueueLen() int {
+	return c.writeQueue.Len()
+}
+
+// 出站消息是否压缩
+// whether outgoing messages are compressed
+func (c *Conn) isWriteCompressed() bool {
+	return c.compressEnabled && atomic.LoadUint32(&c.compressPaused) == 0
+}
+
+// Extensions 握手时协商成功的自定义扩展, 按协商顺序排列
+// Extensions returns the custom extensions negotiated during the handshake, in negotiation order
+func (c *Conn) Extensions() []Extension {
+	return append([]Extension(nil), c.extensions...)
+}
+
+// CompressionParams 握手时协商的permessage-deflate参数, 未开启压缩时返回零值; 窗口位数为实际生效的值
+// CompressionParams returns the permessage-deflate parameters negotiated during the handshake, or the zero value
+// if compression is not enabled. Window bits are the effective values
+func (c *Conn) CompressionParams() CompressionParams {
+	if !c.compressEnabled {
+		return CompressionParams{}
+	}
+	return CompressionParams{
+		ServerNoContextTakeover: c.deflateParams.serverNoContextTakeover,
+		ClientNoContextTakeover: c.deflateParams.clientNoContextTakeover,
+		ServerMaxWindowBits:     c.deflateParams.windowBits(true),
+		ClientMaxWindowBits:     c.deflateParams.windowBits(false),
+	}
+}
+
 func (c *Conn) LocalAddr() net.Addr {
 	return c.conn.LocalAddr()
 }
@@ -196,6 +634,12 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// SubProtocol 协商的子协议, 没有协商时为空
+// SubProtocol returns the negotiated subprotocol, empty if none was negotiated
+func (c *Conn) SubProtocol() string {
+	return c.subprotocol
+}
+
 // NetConn get tcp/tls/... conn
 func (c *Conn) NetConn() net.Conn {
 	return c.conn
@@ -206,13 +650,65 @@ func (c *Conn) NetConn() net.Conn {
 // algorithm).  The default is true (no delay), meaning that data is
 // sent as soon as possible after a Write.
 func (c *Conn) SetNoDelay(noDelay bool) error {
-	switch v := c.conn.(type) {
+	if conn := tcpConn(c.conn); conn != nil {
+		return conn.SetNoDelay(noDelay)
+	}
+	return nil
+}
+
+// SetSocketBuffers 设置套接字的内核接收和发送缓冲区大小(SO_RCVBUF/SO_SNDBUF), 小于等于0的值保持不变; 不是TCP连接时什么也不做
+// SetSocketBuffers sets the kernel receive and send buffer sizes of the socket (SO_RCVBUF/SO_SNDBUF).
+// Values less than or equal to 0 are left unchanged; it does nothing if the connection is not TCP
+func (c *Conn) SetSocketBuffers(readSize, writeSize int) error {
+	var conn = tcpConn(c.conn)
+	if conn == nil {
+		return nil
+	}
+	if readSize > 0 {
+		if err := conn.SetReadBuffer(readSize); err != nil {
+			return err
+		}
+	}
+	if writeSize > 0 {
+		return conn.SetWriteBuffer(writeSize)
+	}
+	return nil
+}
+
+// SetKeepAlive 设置TCP保活: 连接空闲interval之后开始探测, 之后每隔interval探测一次, 连续count次没有响应时内核关闭连接
+// interval和count小于等于0时使用系统默认值; 部分平台(例如Windows和macOS)不支持设置count; 不是TCP连接时什么也不做
+// SetKeepAlive enables TCP keepalive: probing starts after the connection has been idle for interval and repeats
+// every interval, the kernel drops the connection after count unanswered probes.
+// interval and count less than or equal to 0 keep the system defaults; count cannot be set on some platforms
+// such as Windows and macOS. It does nothing if the connection is not TCP
+func (c *Conn) SetKeepAlive(interval time.Duration, count int) error {
+	var conn = tcpConn(c.conn)
+	if conn == nil {
+		return nil
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if interval > 0 {
+		if err := conn.SetKeepAlivePeriod(interval); err != nil {
+			return err
+		}
+	}
+	return setKeepAliveProbes(conn, interval, count)
+}
+
+// 取出底层的TCP连接, TLS连接取其内部的连接; 不是TCP连接时返回nil
+// the underlying TCP connection, unwrapping TLS; nil if the connection is not TCP
+func tcpConn(conn net.Conn) *net.TCPConn {
+	switch v := conn.(type) {
 	case *net.TCPConn:
-		return v.SetNoDelay(noDelay)
+		return v
 	case *tls.Conn:
 		if netConn, ok := v.NetConn().(*net.TCPConn); ok {
-			return netConn.SetNoDelay(noDelay)
+			return netConn
 		}
+	case *kernelTLSConn:
+		return v.socket.TCPConn
 	}
 	return nil
 }
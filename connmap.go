@@ -0,0 +1,68 @@
+package gws
+
+import "sync/atomic"
+
+// 连接ID生成器
+// connection id generator
+var connSequence uint64
+
+// ConnMap 分片的并发安全连接表, 以Conn.ID为键
+// 设置ServerOption.ConnMap后, 握手成功的连接会自动加入, 在OnClose之前自动移除
+// Sharded, concurrency-safe connection registry keyed by Conn.ID.
+// If set as ServerOption.ConnMap, connections are added after a successful handshake and removed before OnClose
+type ConnMap struct {
+	m *ConcurrentMap[uint64, *Conn]
+}
+
+// NewConnMap segments为分片数量, 0表示默认值16
+// segments is the number of shards, 0 means the default of 16
+func NewConnMap(segments uint64) *ConnMap {
+	return &ConnMap{m: NewConcurrentMap[uint64, *Conn](segments)}
+}
+
+func (c *ConnMap) Add(socket *Conn) {
+	c.m.Store(socket.id, socket)
+}
+
+func (c *ConnMap) Remove(socket *Conn) {
+	c.m.Delete(socket.id)
+}
+
+func (c *ConnMap) Get(id uint64) (*Conn, bool) {
+	return c.m.Load(id)
+}
+
+func (c *ConnMap) Len() int {
+	return c.m.Len()
+}
+
+// Range 遍历连接, f返回false时停止; 不要在f中调用Add/Remove
+// Range calls f for each connection and stops if f returns false; do not call Add/Remove within f
+func (c *ConnMap) Range(f func(socket *Conn) bool) {
+	c.m.Range(func(key uint64, value *Conn) bool {
+		return f(value)
+	})
+}
+
+// BroadcastAll 向所有连接广播消息, 返回遇到的第一个错误; 完成后仍需调用Broadcaster.Release
+// Broadcast the message to all connections and return the first error encountered; call Broadcaster.Release afterwards
+func (c *ConnMap) BroadcastAll(b *Broadcaster) error {
+	var err error
+	c.Range(func(socket *Conn) bool {
+		if e := b.Broadcast(socket); e != nil && err == nil {
+			err = e
+		}
+		return true
+	})
+	return err
+}
+
+// ID 进程内唯一的连接ID
+// ID returns the connection id, unique within the process
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+func nextConnID() uint64 {
+	return atomic.AddUint64(&connSequence, 1)
+}
@@ -0,0 +1,107 @@
+package gws
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 通过net.Pipe完成握手
+func testHandshake(upgrader *Upgrader, clientHandler Event, clientOption *ClientOption) (server, client *Conn, err error) {
+	s, c := net.Pipe()
+	var ch = make(chan error, 1)
+	go func() {
+		br := bufio.NewReader(s)
+		r, err := http.ReadRequest(br)
+		if err == nil {
+			server, err = upgrader.doUpgrade(r, nil, s, br)
+		}
+		ch <- err
+	}()
+	client, _, err = NewClientFromConn(clientHandler, clientOption, c)
+	if e := <-ch; err == nil {
+		err = e
+	}
+	return
+}
+
+func TestConnMap(t *testing.T) {
+	var as = assert.New(t)
+	var m = NewConnMap(0)
+	var sockets = make([]*Conn, 0)
+	for i := 0; i < 10; i++ {
+		server, _ := newPeer(new(webSocketMocker), nil, new(webSocketMocker), nil)
+		sockets = append(sockets, server)
+		m.Add(server)
+	}
+	as.Equal(10, m.Len())
+	as.NotEqual(sockets[0].ID(), sockets[1].ID())
+	socket, ok := m.Get(sockets[3].ID())
+	as.True(ok)
+	as.Equal(sockets[3], socket)
+
+	m.Remove(sockets[3])
+	_, ok = m.Get(sockets[3].ID())
+	as.False(ok)
+
+	var n = 0
+	m.Range(func(socket *Conn) bool {
+		n++
+		return n < 5
+	})
+	as.Equal(5, n)
+}
+
+func TestConnMap_BroadcastAll(t *testing.T) {
+	var as = assert.New(t)
+	var m = NewConnMap(4)
+	var wg = &sync.WaitGroup{}
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{CompressEnabled: i%2 == 0, CompressThreshold: 1}, clientHandler, &ClientOption{CompressEnabled: i%2 == 0})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		m.Add(server)
+	}
+	var b = NewBroadcaster(OpcodeText, []byte("hello"))
+	as.NoError(m.BroadcastAll(b))
+	b.Release()
+	wg.Wait()
+}
+
+func TestConnMap_Server(t *testing.T) {
+	var as = assert.New(t)
+	var m = NewConnMap(0)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) {
+		_, ok := m.Get(socket.ID())
+		as.False(ok)
+		wg.Done()
+	}
+	var upgrader = NewUpgrader(serverHandler, &ServerOption{ConnMap: m})
+	server, client, err := testHandshake(upgrader, new(webSocketMocker), nil)
+	if !as.NoError(err) {
+		return
+	}
+	socket, ok := m.Get(server.ID())
+	as.True(ok)
+	as.Equal(server, socket)
+	as.Equal(1, m.Len())
+
+	go server.ReadLoop()
+	go client.ReadLoop()
+	client.WriteClose(1000, nil)
+	wg.Wait()
+	as.Equal(0, m.Len())
+}
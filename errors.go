@@ -0,0 +1,280 @@
+package gws
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 导出的错误, 可以使用errors.Is判断
+// Exported sentinel errors, use errors.Is to check them
+var (
+	// ErrUnauthorized 鉴权失败
+	// Authorize returned false
+	ErrUnauthorized = internal.ErrUnauthorized
+
+	// ErrHandshake 握手失败
+	// Invalid handshake request or response
+	ErrHandshake = internal.ErrHandshake
+
+	// ErrVersionNotSupported 不支持的Sec-WebSocket-Version
+	// Unsupported Sec-WebSocket-Version
+	ErrVersionNotSupported = internal.ErrVersionNotSupported
+
+	// ErrGetMethodRequired 握手请求必须为GET方法
+	// The handshake request must use the GET method
+	ErrGetMethodRequired = internal.ErrGetMethodRequired
+
+	// ErrHijackNotSupported http.ResponseWriter不支持Hijack
+	// The http.ResponseWriter does not implement http.Hijacker
+	ErrHijackNotSupported = internal.ErrHijackNotSupported
+
+	// ErrSchema 不支持的协议, 地址必须为ws或者wss
+	// Unsupported scheme, the address must be ws or wss
+	ErrSchema = internal.ErrSchema
+
+	// ErrStatusCode 握手响应状态码不是101
+	// The handshake response status is not 101
+	ErrStatusCode = internal.ErrStatusCode
+
+	// ErrConnClosed 连接已关闭
+	// The connection is closed
+	ErrConnClosed = internal.ErrConnClosed
+
+	// ErrTextEncoding 文本不是合法的utf8编码
+	// Text payload is not valid utf8
+	ErrTextEncoding = internal.ErrTextEncoding
+
+	// ErrUnexpectedContentLength 读写的字节数与预期不符
+	// The number of bytes read or written does not match the expected length
+	ErrUnexpectedContentLength = internal.ErrUnexpectedContentLength
+
+	// ErrUnexpectedOpcode 收到了未定义的操作码
+	// Received an undefined opcode
+	ErrUnexpectedOpcode = internal.ErrUnexpectedOpcode
+
+	// ErrIdleTimeout 空闲超时, 在IdleTimeout内没有收到任何帧
+	// No frame was received within IdleTimeout
+	ErrIdleTimeout = internal.ErrIdleTimeout
+
+	// ErrRateLimitExceeded 超出读速率限制
+	// Read rate limit exceeded under RatePolicyClose
+	ErrRateLimitExceeded = internal.ErrRateLimitExceeded
+
+	// ErrTooManyFragments 分片数量超过ReadMaxFragments
+	// Number of fragments exceeds ReadMaxFragments
+	ErrTooManyFragments = internal.ErrTooManyFragments
+
+	// ErrMessageTooLarge 帧或者消息(重组或解压后)超过长度限制
+	// Frame or message length (after reassembly or decompression) exceeds the limit
+	ErrMessageTooLarge = internal.ErrMessageTooLarge
+
+	// ErrOpcodeDisallowed 收到了DisallowedOpcodes中的数据帧
+	// Received a data message whose opcode is listed in DisallowedOpcodes
+	ErrOpcodeDisallowed = internal.ErrOpcodeDisallowed
+
+	// ErrDrainTimeout StopReadingAndDrain没有在超时时间内发送完写队列
+	// StopReadingAndDrain could not flush the write queue within the timeout
+	ErrDrainTimeout = internal.ErrDrainTimeout
+
+	// ErrServerDraining Server.StartDraining之后拒绝新的握手
+	// New handshakes are rejected after Server.StartDraining
+	ErrServerDraining = internal.ErrServerDraining
+
+	// ErrCaptureFormat 不是StartCapture写入的抓包文件
+	// Not a capture file written by StartCapture
+	ErrCaptureFormat = internal.ErrCaptureFormat
+
+	// ErrWriteStalled 写入超过WriteStallThreshold没有完成, 连接被强制关闭
+	// A write did not complete within WriteStallThreshold and the connection was force-closed
+	ErrWriteStalled = internal.ErrWriteStalled
+
+	// ErrReactorUnsupported 当前平台或连接类型不支持Reactor, 请使用ReadLoop
+	// Reactor is not supported on this platform or connection type, use ReadLoop instead
+	ErrReactorUnsupported = internal.ErrReactorUnsupported
+
+	// ErrMemoryWatermark 近似内存占用超过MemoryWatermark, 拒绝新的握手或者关闭慢消费者
+	// The approximate memory in use exceeds MemoryWatermark: new handshakes are rejected and slow consumers are shed
+	ErrMemoryWatermark = internal.ErrMemoryWatermark
+
+	// ErrRelayIncompatible 中继的两个连接协商了不同的压缩参数或者扩展, 帧无法原样转发
+	// The relayed connections negotiated different compression parameters or extensions, frames cannot pass through
+	ErrRelayIncompatible = internal.ErrRelayIncompatible
+
+	// ErrNoUpstream UpstreamDialer没有配置上游地址
+	// The UpstreamDialer has no upstream addresses
+	ErrNoUpstream = internal.ErrNoUpstream
+)
+
+// CloseReason 连接关闭原因的分类, 用于决定重连, 告警或者忽略
+// Classification of why a connection was closed, to decide between reconnect, alert or ignore
+type CloseReason uint8
+
+const (
+	// CloseReasonUnknown 无法归类
+	// Cannot be classified
+	CloseReasonUnknown CloseReason = iota
+
+	// CloseReasonNormal 正常关闭(1000, 或者关闭帧中没有状态码)
+	// Normal closure (1000, or a close frame without status code)
+	CloseReasonNormal
+
+	// CloseReasonGoingAway 对端离开(1001), 例如服务重启或页面关闭
+	// The endpoint is going away (1001), e.g. server restart or page navigation
+	CloseReasonGoingAway
+
+	// CloseReasonTimeout 空闲超时或者读写超时
+	// Idle timeout or I/O timeout
+	CloseReasonTimeout
+
+	// CloseReasonNetwork 连接在关闭握手之前断开
+	// The connection dropped without a close handshake
+	CloseReasonNetwork
+
+	// CloseReasonProtocol 协议错误或者数据不合法(1002, 1003, 1007)
+	// Protocol violation or invalid data (1002, 1003, 1007)
+	CloseReasonProtocol
+
+	// CloseReasonPolicy 违反策略或者超出限制(1008, 1009)
+	// Policy violation or limit exceeded (1008, 1009)
+	CloseReasonPolicy
+
+	// CloseReasonServerError 服务端错误或者要求稍后重试(1010-1015)
+	// Server side failure or try again later (1010-1015)
+	CloseReasonServerError
+
+	// CloseReasonApplication 应用自定义状态码(3000-4999)
+	// Application defined status code (3000-4999)
+	CloseReasonApplication
+)
+
+var closeReasonNames = [...]string{
+	CloseReasonUnknown:     "unknown",
+	CloseReasonNormal:      "normal",
+	CloseReasonGoingAway:   "going away",
+	CloseReasonTimeout:     "timeout",
+	CloseReasonNetwork:     "network",
+	CloseReasonProtocol:    "protocol",
+	CloseReasonPolicy:      "policy",
+	CloseReasonServerError: "server error",
+	CloseReasonApplication: "application",
+}
+
+func (c CloseReason) String() string {
+	if int(c) < len(closeReasonNames) {
+		return closeReasonNames[c]
+	}
+	return closeReasonNames[CloseReasonUnknown]
+}
+
+// CloseReasonOf 对OnClose收到的错误进行分类
+// CloseReasonOf classifies the error delivered to OnClose
+func CloseReasonOf(err error) CloseReason {
+	closeErr, ok := err.(*CloseError)
+	if !ok {
+		var target *CloseError
+		if !errors.As(err, &target) {
+			return CloseReasonUnknown
+		}
+		closeErr = target
+	}
+
+	var netErr net.Error
+	if errors.Is(err, ErrIdleTimeout) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return CloseReasonTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) {
+		return CloseReasonNetwork
+	}
+
+	return closeReasonOfCode(StatusCode(closeErr.Code))
+}
+
+// 只按状态码分类
+// classify by the status code alone
+func closeReasonOfCode(code StatusCode) CloseReason {
+	switch {
+	case code == 0, code == CloseNormalClosure, code == CloseNoStatusReceived:
+		return CloseReasonNormal
+	case code == CloseGoingAway:
+		return CloseReasonGoingAway
+	case code == CloseProtocolError, code == CloseUnsupported, code == CloseUnsupportedData:
+		return CloseReasonProtocol
+	case code == ClosePolicyViolation, code == CloseMessageTooLarge:
+		return CloseReasonPolicy
+	case code >= CloseMissingExtension && code <= CloseTLSHandshake:
+		return CloseReasonServerError
+	case code == CloseAbnormalClosure:
+		return CloseReasonNetwork
+	case code >= 3000 && code <= 4999:
+		return CloseReasonApplication
+	default:
+		return CloseReasonUnknown
+	}
+}
+
+// IsNormalClose 连接是否正常关闭
+// IsNormalClose reports whether the connection was closed normally
+func IsNormalClose(err error) bool {
+	return CloseReasonOf(err) == CloseReasonNormal
+}
+
+// IsTimeout 连接是否因为空闲超时或者读写超时关闭
+// IsTimeout reports whether the connection was closed by an idle or I/O timeout
+func IsTimeout(err error) bool {
+	return CloseReasonOf(err) == CloseReasonTimeout
+}
+
+// IsGoingAway 对端是否以1001离开, 空闲超时不算在内
+// IsGoingAway reports whether the connection was closed with 1001, idle timeouts excluded
+func IsGoingAway(err error) bool {
+	return CloseReasonOf(err) == CloseReasonGoingAway
+}
+
+// CloseCodeMapper 把导致连接关闭的错误映射为关闭帧的状态码和原因, 状态码为0时关闭帧不带载荷, 忽略原因;
+// 原因超过123字节的部分被截断. 不能在关闭帧中发送的状态码(小于1000, 1005, 1006, 1015, 大于4999)回退到DefaultCloseCode
+// CloseCodeMapper maps the error closing a connection to the close frame code and reason. A zero code sends an
+// empty close frame and ignores the reason; reasons longer than 123 bytes are truncated. Codes that must not be sent
+// in a close frame (below 1000, 1005, 1006, 1015, above 4999) fall back to DefaultCloseCode
+//
+// Example:
+//
+//	option.CloseCodeMapper = func(err error) (uint16, string) {
+//		var validationErr *ValidationError
+//		switch {
+//		case errors.Is(err, os.ErrDeadlineExceeded):
+//			return 1001, "deadline exceeded"
+//		case errors.As(err, &validationErr):
+//			return 4400, validationErr.Error()
+//		default:
+//			return gws.DefaultCloseCode(err)
+//		}
+//	}
+type CloseCodeMapper func(err error) (code uint16, reason string)
+
+// DefaultCloseCode 默认的映射: 带状态码的内部错误使用其状态码, 其它错误使用1000; 原因为错误的文本
+// DefaultCloseCode is the default mapping: internal errors carrying a status code use it, any other error uses 1000.
+// The reason is the error text
+func DefaultCloseCode(err error) (code uint16, reason string) {
+	switch v := err.(type) {
+	case internal.StatusCode:
+		return v.Uint16(), v.Error()
+	case *internal.Error:
+		return v.Code.Uint16(), v.Error()
+	default:
+		return internal.CloseNormalClosure.Uint16(), err.Error()
+	}
+}
+
+// 状态码能否在关闭帧中发送, 1005, 1006和1015只用于本地表示
+// whether a code may be sent in a close frame, 1005, 1006 and 1015 are for local use only
+func isSendableCloseCode(code uint16) bool {
+	switch code {
+	case CloseNoStatusReceived.Uint16(), CloseAbnormalClosure.Uint16(), CloseTLSHandshake.Uint16():
+		return false
+	default:
+		return code >= 1000 && code <= 4999
+	}
+}
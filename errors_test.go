@@ -0,0 +1,180 @@
+package gws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseReasonOf(t *testing.T) {
+	var as = assert.New(t)
+	var timeoutErr = &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	var cases = []struct {
+		err    error
+		reason CloseReason
+	}{
+		{nil, CloseReasonUnknown},
+		{io.EOF, CloseReasonUnknown},
+		{&CloseError{Code: 1000}, CloseReasonNormal},
+		{&CloseError{Code: 0}, CloseReasonNormal},
+		{&CloseError{Code: 1001}, CloseReasonGoingAway},
+		{&CloseError{Code: 1001, Err: ErrIdleTimeout}, CloseReasonTimeout},
+		{&CloseError{Code: 1000, Err: timeoutErr}, CloseReasonTimeout},
+		{&CloseError{Code: 1000, Err: io.EOF}, CloseReasonNetwork},
+		{&CloseError{Code: 1000, Err: &net.OpError{Op: "read", Err: errors.New("reset")}}, CloseReasonNetwork},
+		{&CloseError{Code: 1006}, CloseReasonNetwork},
+		{&CloseError{Code: 1002, Err: internal.CloseProtocolError}, CloseReasonProtocol},
+		{&CloseError{Code: 1007, Err: ErrTextEncoding}, CloseReasonProtocol},
+		{&CloseError{Code: 1008, Err: ErrRateLimitExceeded}, CloseReasonPolicy},
+		{&CloseError{Code: 1009, Err: ErrMessageTooLarge}, CloseReasonPolicy},
+		{&CloseError{Code: 1011}, CloseReasonServerError},
+		{&CloseError{Code: 1013}, CloseReasonServerError},
+		{&CloseError{Code: 3001}, CloseReasonApplication},
+		{&CloseError{Code: 4000}, CloseReasonApplication},
+		{&CloseError{Code: 2000}, CloseReasonUnknown},
+	}
+	for _, item := range cases {
+		as.Equal(item.reason, CloseReasonOf(item.err), "%v", item.err)
+	}
+
+	as.True(IsNormalClose(&CloseError{Code: 1000}))
+	as.False(IsNormalClose(&CloseError{Code: 1000, Err: io.EOF}))
+	as.True(IsTimeout(&CloseError{Code: 1001, Err: ErrIdleTimeout}))
+	as.False(IsGoingAway(&CloseError{Code: 1001, Err: ErrIdleTimeout}))
+	as.True(IsGoingAway(&CloseError{Code: 1001}))
+	as.Equal("going away", CloseReasonGoingAway.String())
+	as.Equal("unknown", CloseReason(100).String())
+}
+
+func TestCloseReason_OnClose(t *testing.T) {
+	var as = assert.New(t)
+	var ch = make(chan error, 2)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) { ch <- err }
+	clientHandler.onClose = func(socket *Conn, err error) { ch <- err }
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	client.WriteClose(1001, nil)
+	go client.ReadLoop()
+	for i := 0; i < 2; i++ {
+		var err = <-ch
+		as.True(IsGoingAway(err))
+	}
+}
+
+func TestCloseError_Summary(t *testing.T) {
+	var as = assert.New(t)
+	var openedAt = time.Now()
+	var closeErr = &CloseError{
+		Code:     1009,
+		Err:      ErrMessageTooLarge,
+		Stats:    ConnStats{BytesIn: 1, BytesOut: 2, MessagesIn: 3, MessagesOut: 4, OpenedAt: openedAt},
+		ClosedAt: openedAt.Add(time.Minute),
+	}
+	as.Equal(ConnSummary{
+		Duration:    time.Minute,
+		BytesIn:     1,
+		BytesOut:    2,
+		MessagesIn:  3,
+		MessagesOut: 4,
+		CloseCode:   1009,
+		LastError:   ErrMessageTooLarge,
+	}, closeErr.Summary())
+
+	// 没有打开时间时不计算时长
+	as.Equal(time.Duration(0), (&CloseError{ClosedAt: openedAt}).Summary().Duration)
+}
+
+func TestCloseCodeMapper(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("default", func(t *testing.T) {
+		code, reason := DefaultCloseCode(internal.CloseGoingAway)
+		as.Equal(uint16(1001), code)
+		as.Equal(internal.CloseGoingAway.Error(), reason)
+		code, reason = DefaultCloseCode(internal.NewError(internal.CloseMessageTooLarge, ErrMessageTooLarge))
+		as.Equal(uint16(1009), code)
+		as.Equal(ErrMessageTooLarge.Error(), reason)
+		code, reason = DefaultCloseCode(io.EOF)
+		as.Equal(uint16(1000), code)
+		as.Equal(io.EOF.Error(), reason)
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		var errValidation = errors.New("validation failed")
+		var ch = make(chan error, 2)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) { ch <- err }
+		clientHandler.onClose = func(socket *Conn, err error) { ch <- err }
+		var serverOption = &ServerOption{CloseCodeMapper: func(err error) (uint16, string) {
+			if errors.Is(err, errValidation) {
+				return 4400, "bad input"
+			}
+			return DefaultCloseCode(err)
+		}}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		server.emitError(errValidation)
+
+		for i := 0; i < 2; i++ {
+			var closeErr *CloseError
+			as.ErrorAs(<-ch, &closeErr)
+			as.Equal(uint16(4400), closeErr.Code)
+			as.Equal("bad input", string(closeErr.Reason))
+		}
+	})
+
+	// 状态码为0时不发送原因, 无效的状态码回退到默认映射
+	t.Run("invalid", func(t *testing.T) {
+		for _, item := range []struct {
+			code   uint16
+			expect uint16
+			reason string
+		}{
+			{code: 0, expect: 0, reason: ""},
+			{code: 999, expect: 1000, reason: io.EOF.Error()},
+			{code: 1005, expect: 1000, reason: io.EOF.Error()},
+			{code: 1006, expect: 1000, reason: io.EOF.Error()},
+			{code: 1015, expect: 1000, reason: io.EOF.Error()},
+			{code: 5000, expect: 1000, reason: io.EOF.Error()},
+		} {
+			var code = item.code
+			var ch = make(chan error, 1)
+			var clientHandler = new(webSocketMocker)
+			clientHandler.onClose = func(socket *Conn, err error) { ch <- err }
+			var serverOption = &ServerOption{CloseCodeMapper: func(err error) (uint16, string) { return code, "mapped" }}
+			server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{})
+			go server.ReadLoop()
+			go client.ReadLoop()
+			server.emitError(io.EOF)
+			var closeErr *CloseError
+			as.ErrorAs(<-ch, &closeErr)
+			as.Equal(item.expect, closeErr.Code)
+			as.Equal(item.reason, string(closeErr.Reason))
+		}
+	})
+
+	// WriteClose指定的状态码不经过映射
+	t.Run("write close", func(t *testing.T) {
+		var ch = make(chan error, 1)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) { ch <- err }
+		var serverOption = &ServerOption{CloseCodeMapper: func(err error) (uint16, string) { return 4000, "" }}
+		server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		server.WriteClose(1001, nil)
+		var closeErr *CloseError
+		as.ErrorAs(<-ch, &closeErr)
+		as.Equal(uint16(1001), closeErr.Code)
+	})
+}
@@ -0,0 +1,63 @@
+// 打印Conn.StartCapture写入的抓包文件
+// Dump a capture file written by Conn.StartCapture
+//
+// Usage: go run ./examples/capture conn.gwscap
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"unicode/utf8"
+
+	"github.com/lxzan/gws"
+)
+
+// 每帧最多打印的载荷字节数
+// maximum payload bytes printed per frame
+const maxPayload = 64
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatalf("usage: %s <capture file>", os.Args[0])
+	}
+	file, err := os.Open(os.Args[1])
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	defer file.Close()
+
+	reader, err := gws.NewCaptureReader(file)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		var direction = "<-"
+		if frame.Direction == gws.FrameOutbound {
+			direction = "->"
+		}
+		fmt.Printf("%s %s opcode=%d fin=%t rsv=%03b masked=%t len=%d %s\n",
+			frame.Time.Format("15:04:05.000000"), direction, frame.Opcode, frame.Fin, frame.RSV>>4, frame.Masked,
+			len(frame.Payload), formatPayload(frame))
+	}
+}
+
+func formatPayload(frame *gws.CapturedFrame) string {
+	var p = frame.Payload
+	var suffix = ""
+	if len(p) > maxPayload {
+		p, suffix = p[:maxPayload], "..."
+	}
+	if frame.Opcode == gws.OpcodeText && frame.RSV == 0 && utf8.Valid(p) {
+		return fmt.Sprintf("%q%s", p, suffix)
+	}
+	return fmt.Sprintf("%x%s", p, suffix)
+}
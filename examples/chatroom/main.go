@@ -18,6 +18,7 @@ func main() {
 	var handler = NewWebSocket()
 	var upgrader = gws.NewUpgrader(handler, &gws.ServerOption{
 		CompressEnabled: true,
+		AutoPongEnabled: true,
 
 		// 在querystring里面传入用户名
 		// 把Sec-WebSocket-Key作为连接的key
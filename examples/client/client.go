@@ -10,7 +10,8 @@ import (
 
 func main() {
 	socket, _, err := gws.NewClient(new(WebSocket), &gws.ClientOption{
-		Addr: "ws://127.0.0.1:3000/connect",
+		Addr:            "ws://127.0.0.1:3000/connect",
+		AutoPongEnabled: true,
 	})
 	if err != nil {
 		log.Printf(err.Error())
@@ -42,9 +43,7 @@ func (c *WebSocket) OnOpen(socket *gws.Conn) {
 	_ = socket.WriteString("hello, there is client")
 }
 
-func (c *WebSocket) OnPing(socket *gws.Conn, payload []byte) {
-	_ = socket.WritePong(payload)
-}
+func (c *WebSocket) OnPing(socket *gws.Conn, payload []byte) {}
 
 func (c *WebSocket) OnMessage(socket *gws.Conn, message *gws.Message) {
 	defer message.Close()
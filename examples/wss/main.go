@@ -23,7 +23,7 @@ func init() {
 }
 
 func main() {
-	srv := gws.NewServer(new(Websocket), nil)
+	srv := gws.NewServer(new(Websocket), &gws.ServerOption{AutoPongEnabled: true})
 
 	if err := srv.RunTLS(":3000", dir+"/server.crt", dir+"/server.pem"); err != nil {
 		log.Panicln(err.Error())
@@ -34,10 +34,6 @@ type Websocket struct {
 	gws.BuiltinEventHandler
 }
 
-func (c *Websocket) OnPing(socket *gws.Conn, payload []byte) {
-	_ = socket.WritePong(payload)
-}
-
 func (c *Websocket) OnMessage(socket *gws.Conn, message *gws.Message) {
 	defer message.Close()
 	_ = socket.WriteMessage(message.Opcode, message.Bytes())
@@ -0,0 +1,272 @@
+package gws
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 帧头中RSV位的掩码
+// masks of the RSV bits in the first byte of the frame header
+const (
+	RSV1Bit uint8 = 64
+	RSV2Bit uint8 = 32
+	RSV3Bit uint8 = 16
+
+	rsvMask = RSV1Bit | RSV2Bit | RSV3Bit
+)
+
+// Extension 自定义扩展, permessage-deflate之外的扩展可以通过实现该接口接入, 不需要修改帧的编解码
+// 扩展作用于整条数据消息(不包括控制帧), 同一个实例被所有连接共享, 需要连接级别的状态请存放在socket中
+// 出站时先执行扩展编码再压缩, 入站时先解压再按相反的顺序执行扩展解码
+// Custom extension. Extensions other than permessage-deflate can be plugged in by implementing this interface
+// without modifying the framer.
+// Extensions apply to whole data messages (never control frames). One instance is shared by all connections,
+// store per-connection state in the socket.
+// Outbound messages are encoded by the extensions before compression, inbound messages are decompressed first
+// and then decoded by the extensions in reverse order.
+type Extension interface {
+	// Name Sec-WebSocket-Extensions中的扩展名
+	// the extension token in Sec-WebSocket-Extensions
+	Name() string
+
+	// RSV 扩展占用的RSV位, 例如RSV2Bit; 与已协商扩展冲突时不会被启用
+	// 服务端先协商自定义扩展, 占用RSV1的扩展会取代permessage-deflate
+	// the RSV bits claimed by the extension, e.g. RSV2Bit; it is not enabled if the bits conflict with a negotiated extension.
+	// The server negotiates custom extensions first, so one claiming RSV1 replaces permessage-deflate
+	RSV() uint8
+
+	// Offer 客户端请求中携带的参数, 需要提供多组候选参数时实现ExtensionOfferer
+	// parameters offered by the client, implement ExtensionOfferer to offer several alternatives
+	Offer() []string
+
+	// Negotiate 服务端根据客户端提供的参数决定是否启用, 返回响应参数
+	// server side: decide whether to enable the extension from the offered parameters, return the response parameters
+	Negotiate(params []string) (response []string, ok bool)
+
+	// Accept 客户端校验服务端响应的参数, 返回错误会导致握手失败
+	// client side: check the parameters responded by the server, an error fails the handshake
+	Accept(params []string) error
+
+	// Encode 编码出站消息, 返回新的payload以及是否设置RSV位
+	// encode an outbound message, return the new payload and whether to set the RSV bits
+	Encode(socket *Conn, opcode Opcode, payload []byte) ([]byte, bool, error)
+
+	// Decode 解码入站消息, rsv为消息首帧的RSV位
+	// decode an inbound message, rsv holds the RSV bits of the first frame of the message
+	Decode(socket *Conn, opcode Opcode, rsv uint8, payload []byte) ([]byte, error)
+}
+
+// 扩展协商的一项, 例如 permessage-deflate; client_max_window_bits
+// an element of the extension list, e.g. permessage-deflate; client_max_window_bits
+type extensionElement struct {
+	name   string
+	params []string
+}
+
+func (c extensionElement) String() string {
+	if len(c.params) == 0 {
+		return c.name
+	}
+	return c.name + "; " + strings.Join(c.params, "; ")
+}
+
+// 解析Sec-WebSocket-Extensions
+// parse Sec-WebSocket-Extensions
+func parseExtensions(header string) []extensionElement {
+	var elements []extensionElement
+	for _, item := range internal.Split(header, ",") {
+		var list = internal.Split(item, ";")
+		if len(list) == 0 {
+			continue
+		}
+		elements = append(elements, extensionElement{name: strings.ToLower(list[0]), params: list[1:]})
+	}
+	return elements
+}
+
+const extensionDeflate = "permessage-deflate"
+
+func findExtension(elements []extensionElement, name string) (extensionElement, bool) {
+	for _, item := range elements {
+		if item.name == name {
+			return item, true
+		}
+	}
+	return extensionElement{}, false
+}
+
+// ExtensionOfferer 可选接口, 客户端按优先级提供多组候选参数, 每组作为Sec-WebSocket-Extensions中的一项;
+// 服务端使用第一组可以接受的参数. 实现后Offer不再使用
+// Optional interface: the client offers several alternative parameter sets in order of preference, each one as an
+// element of Sec-WebSocket-Extensions, and the server picks the first acceptable one. Offer is unused once implemented
+type ExtensionOfferer interface {
+	Offers() [][]string
+}
+
+// 客户端请求中的扩展项
+// the elements offered by the client for an extension
+func offerExtension(ext Extension) []string {
+	var offers [][]string
+	if v, ok := ext.(ExtensionOfferer); ok {
+		offers = v.Offers()
+	} else {
+		offers = [][]string{ext.Offer()}
+	}
+	var elements = make([]string, 0, len(offers))
+	for _, params := range offers {
+		elements = append(elements, extensionElement{name: ext.Name(), params: params}.String())
+	}
+	return elements
+}
+
+// 协商成功的一项扩展, index为对应的请求项在Sec-WebSocket-Extensions中的位置
+// an extension accepted by the server, index is the position of the offer it answers in Sec-WebSocket-Extensions
+type extensionResponse struct {
+	index int
+	text  string
+}
+
+// 按扩展处理出站数据的顺序输出响应: 自定义扩展按协商的顺序在前, permessage-deflate总是在最后,
+// 与编码时先执行扩展再压缩一致
+// format the responses in the order the extensions process outbound data: custom extensions first in the order
+// they were negotiated, permessage-deflate always last, matching encoding before compression
+func formatExtensions(responses []extensionResponse) string {
+	sort.SliceStable(responses, func(i, j int) bool {
+		return !strings.HasPrefix(responses[i].text, extensionDeflate) && strings.HasPrefix(responses[j].text, extensionDeflate)
+	})
+	var list = make([]string, 0, len(responses))
+	for _, item := range responses {
+		list = append(list, item.text)
+	}
+	return strings.Join(list, ", ")
+}
+
+// 服务端协商自定义扩展, used为已经被占用的RSV位. 同一扩展的多个请求项是按优先级排列的候选参数, 使用第一个协商成功的
+// server side negotiation of custom extensions, used holds the RSV bits already taken.
+// Several offers of the same extension are alternatives in order of preference, the first one negotiated wins
+func negotiateExtensions(offers []extensionElement, extensions []Extension, used uint8) ([]Extension, []extensionResponse) {
+	var accepted []Extension
+	var responses []extensionResponse
+	for i, offer := range offers {
+		for _, ext := range extensions {
+			if !strings.EqualFold(ext.Name(), offer.name) || ext.RSV()&used != 0 || containsExtension(accepted, ext) {
+				continue
+			}
+			if params, ok := ext.Negotiate(offer.params); ok {
+				used |= ext.RSV()
+				accepted = append(accepted, ext)
+				responses = append(responses, extensionResponse{index: i, text: extensionElement{name: ext.Name(), params: params}.String()})
+			}
+		}
+	}
+	return accepted, responses
+}
+
+// 服务端协商permessage-deflate, 客户端可以按优先级提供多组参数, 使用第一组可以接受的
+// server side negotiation of permessage-deflate. The client may offer several parameter sets in order of preference,
+// the first acceptable one is used
+func negotiateDeflate(offers []extensionElement, takeover bool, windowBits int, lenient bool) (deflateParams, extensionResponse, bool) {
+	for i, offer := range offers {
+		if offer.name != extensionDeflate {
+			continue
+		}
+		if p, ok := negotiateDeflateParams(offer.params, takeover, windowBits, lenient); ok {
+			return p, extensionResponse{index: i, text: p.String()}, true
+		}
+	}
+	return deflateParams{}, extensionResponse{}, false
+}
+
+// 客户端校验服务端响应的扩展, 响应中出现未请求的扩展时握手失败
+// client side check of the extensions responded by the server, unrequested extensions fail the handshake
+func acceptExtensions(responses []extensionElement, extensions []Extension, used uint8) ([]Extension, error) {
+	var accepted []Extension
+	var deflated = false
+	for _, item := range responses {
+		if item.name == extensionDeflate {
+			// 服务端只能接受一组permessage-deflate参数
+			// the server accepts one permessage-deflate parameter set at most
+			if deflated {
+				return nil, internal.ErrHandshake
+			}
+			deflated = true
+			continue
+		}
+		var ext Extension
+		for _, v := range extensions {
+			if strings.EqualFold(v.Name(), item.name) {
+				ext = v
+				break
+			}
+		}
+		if ext == nil || ext.RSV()&used != 0 || containsExtension(accepted, ext) {
+			return nil, internal.ErrHandshake
+		}
+		if err := ext.Accept(item.params); err != nil {
+			return nil, err
+		}
+		used |= ext.RSV()
+		accepted = append(accepted, ext)
+	}
+	return accepted, nil
+}
+
+func claimsRSV(extensions []Extension, bits uint8) bool {
+	for _, item := range extensions {
+		if item.RSV()&bits != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func containsExtension(extensions []Extension, ext Extension) bool {
+	for _, item := range extensions {
+		if item == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// 出站消息依次经过扩展编码
+// encode an outbound message by the negotiated extensions in order
+func (c *Conn) encodeExtensions(opcode Opcode, payload []byte) ([]byte, uint8, error) {
+	var rsv uint8
+	for _, ext := range c.extensions {
+		p, set, err := ext.Encode(c, opcode, payload)
+		if err != nil {
+			return nil, 0, internal.NewError(internal.CloseInternalServerErr, err)
+		}
+		payload = p
+		if set {
+			rsv |= ext.RSV()
+		}
+	}
+	return payload, rsv, nil
+}
+
+// 入站消息按相反顺序经过扩展解码
+// decode an inbound message by the negotiated extensions in reverse order
+func (c *Conn) decodeExtensions(opcode Opcode, rsv uint8, payload []byte) ([]byte, error) {
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		p, err := c.extensions[i].Decode(c, opcode, rsv, payload)
+		if err != nil {
+			return nil, internal.NewError(internal.CloseProtocolError, err)
+		}
+		payload = p
+	}
+	return payload, nil
+}
+
+// 已协商的扩展占用的RSV位
+// RSV bits allowed by the negotiated extensions
+func (c *Conn) allowedRSV() uint8 {
+	var bits = internal.SelectValue(c.compressEnabled, RSV1Bit, 0)
+	for _, ext := range c.extensions {
+		bits |= ext.RSV()
+	}
+	return bits
+}
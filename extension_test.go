@@ -0,0 +1,240 @@
+package gws
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试用扩展: 按字节取反, 使用RSV2
+type invertExtension struct {
+	name string
+	rsv  uint8
+}
+
+func (c *invertExtension) Name() string {
+	return internal.SelectValue(c.name == "", "x-invert", c.name)
+}
+
+func (c *invertExtension) RSV() uint8 { return internal.SelectValue(c.rsv == 0, RSV2Bit, c.rsv) }
+
+func (c *invertExtension) Offer() []string { return []string{"level=1"} }
+
+func (c *invertExtension) Negotiate(params []string) ([]string, bool) {
+	return params, len(params) == 1 && params[0] == "level=1"
+}
+
+func (c *invertExtension) Accept(params []string) error {
+	if len(params) != 1 || params[0] != "level=1" {
+		return errors.New("unexpected params")
+	}
+	return nil
+}
+
+func (c *invertExtension) invert(payload []byte) []byte {
+	var p = make([]byte, len(payload))
+	for i, b := range payload {
+		p[i] = ^b
+	}
+	return p
+}
+
+func (c *invertExtension) Encode(socket *Conn, opcode Opcode, payload []byte) ([]byte, bool, error) {
+	return c.invert(payload), true, nil
+}
+
+func (c *invertExtension) Decode(socket *Conn, opcode Opcode, rsv uint8, payload []byte) ([]byte, error) {
+	if rsv&c.RSV() == 0 {
+		return payload, nil
+	}
+	return c.invert(payload), nil
+}
+
+func TestParseExtensions(t *testing.T) {
+	var as = assert.New(t)
+	var list = parseExtensions("permessage-deflate; client_max_window_bits, X-Invert; level=1")
+	as.Equal(2, len(list))
+	as.Equal("permessage-deflate", list[0].name)
+	as.Equal([]string{"client_max_window_bits"}, list[0].params)
+	as.Equal("x-invert", list[1].name)
+	as.Equal("x-invert; level=1", list[1].String())
+	as.Equal(0, len(parseExtensions("")))
+}
+
+func TestNegotiateExtensions(t *testing.T) {
+	var as = assert.New(t)
+	var ext = new(invertExtension)
+
+	t.Run("accepted", func(t *testing.T) {
+		var offers = parseExtensions("permessage-deflate, x-invert; level=1")
+		exts, responses := negotiateExtensions(offers, []Extension{ext}, RSV1Bit)
+		as.Equal([]Extension{ext}, exts)
+		as.Equal("x-invert; level=1", formatExtensions(responses))
+	})
+
+	t.Run("rejected params", func(t *testing.T) {
+		exts, responses := negotiateExtensions(parseExtensions("x-invert; level=2"), []Extension{ext}, 0)
+		as.Equal(0, len(exts))
+		as.Equal(0, len(responses))
+	})
+
+	t.Run("rsv conflict", func(t *testing.T) {
+		var other = &invertExtension{name: "x-other"}
+		exts, _ := negotiateExtensions(parseExtensions("x-invert; level=1, x-other; level=1"), []Extension{ext, other}, 0)
+		as.Equal([]Extension{ext}, exts)
+		exts, _ = negotiateExtensions(parseExtensions("x-invert; level=1"), []Extension{&invertExtension{rsv: RSV1Bit}}, RSV1Bit)
+		as.Equal(0, len(exts))
+	})
+
+	t.Run("client accept", func(t *testing.T) {
+		exts, err := acceptExtensions(parseExtensions("permessage-deflate, x-invert; level=1"), []Extension{ext}, RSV1Bit)
+		as.NoError(err)
+		as.Equal([]Extension{ext}, exts)
+
+		_, err = acceptExtensions(parseExtensions("x-unknown"), []Extension{ext}, 0)
+		as.ErrorIs(err, ErrHandshake)
+
+		_, err = acceptExtensions(parseExtensions("x-invert; level=2"), []Extension{ext}, 0)
+		as.Error(err)
+
+		_, err = acceptExtensions(parseExtensions("permessage-deflate, permessage-deflate"), nil, RSV1Bit)
+		as.ErrorIs(err, ErrHandshake)
+	})
+
+	// 同一扩展的多组候选参数, 使用第一组协商成功的
+	t.Run("fallback", func(t *testing.T) {
+		exts, responses := negotiateExtensions(parseExtensions("x-invert; level=2, x-invert; level=1, x-invert; level=1"), []Extension{ext}, 0)
+		as.Equal([]Extension{ext}, exts)
+		as.Equal("x-invert; level=1", formatExtensions(responses))
+
+		var offers = parseExtensions("x-invert; level=1, permessage-deflate; server_max_window_bits=10, permessage-deflate")
+		_, response, ok := negotiateDeflate(offers, false, maxWindowBits, false)
+		as.True(ok)
+		as.Equal(2, response.index)
+		_, _, ok = negotiateDeflate(offers[:2], false, maxWindowBits, false)
+		as.False(ok)
+	})
+
+	// 响应的顺序就是处理数据的顺序, permessage-deflate总是在自定义扩展之后
+	t.Run("order", func(t *testing.T) {
+		var responses = []extensionResponse{{index: 2, text: "x-invert"}, {index: 1, text: "x-other"}, {index: 0, text: "permessage-deflate"}}
+		as.Equal("x-invert, x-other, permessage-deflate", formatExtensions(responses))
+
+		var offers = parseExtensions("permessage-deflate, x-invert; level=1")
+		_, responses = negotiateExtensions(offers, []Extension{ext}, 0)
+		_, response, ok := negotiateDeflate(offers, false, maxWindowBits, false)
+		as.True(ok)
+		as.Equal("x-invert; level=1, permessage-deflate; server_no_context_takeover; client_no_context_takeover", formatExtensions(append(responses, response)))
+	})
+}
+
+type fallbackExtension struct {
+	invertExtension
+}
+
+func (c *fallbackExtension) Offers() [][]string { return [][]string{{"level=2"}, {"level=1"}} }
+
+// 客户端提供自定义扩展和permessage-deflate, 请求和响应都按处理数据的顺序排列
+func TestExtension_Handshake(t *testing.T) {
+	var as = assert.New(t)
+	var ext = new(fallbackExtension)
+	var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{CompressEnabled: true, Extensions: []Extension{ext}})
+	var headers = make(chan http.Header, 1)
+	upgrader.option.OnHandshake = func(socket *Conn, r *http.Request, responseHeader http.Header) {
+		headers <- r.Header.Clone()
+	}
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			socket.ReadLoop()
+		}
+	}))
+	defer server.Close()
+
+	socket, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+		Addr:            "ws://" + strings.TrimPrefix(server.URL, "http://"),
+		CompressEnabled: true,
+		Extensions:      []Extension{ext},
+	})
+	as.NoError(err)
+	as.Equal("x-invert; level=1, permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		resp.Header.Get("Sec-WebSocket-Extensions"))
+	as.Equal("x-invert; level=2, x-invert; level=1, permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		(<-headers).Get("Sec-WebSocket-Extensions"))
+	as.True(socket.compressEnabled)
+	as.Equal([]Extension{ext}, socket.extensions)
+	socket.WriteClose(1000, nil)
+}
+
+func TestExtension_Message(t *testing.T) {
+	var as = assert.New(t)
+
+	for _, compress := range []bool{false, true} {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var payload = internal.AlphabetNumeric.Generate(1024)
+		var ext = new(invertExtension)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{CompressEnabled: compress, CompressThreshold: 1, Extensions: []Extension{ext}}
+		var clientOption = &ClientOption{CompressEnabled: compress, CompressThreshold: 1, Extensions: []Extension{ext}}
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(payload, message.Bytes())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		server.extensions = []Extension{ext}
+		client.extensions = []Extension{ext}
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(client.WriteMessage(OpcodeText, payload))
+		wg.Wait()
+	}
+}
+
+func TestExtension_FrameRSV(t *testing.T) {
+	var as = assert.New(t)
+	var ext = new(invertExtension)
+	var socket = &Conn{config: initServerOption(nil).getConfig(), extensions: []Extension{ext}}
+	frame, _, err := socket.genFrame(OpcodeText, []byte("hello"))
+	as.NoError(err)
+	as.Equal(RSV2Bit, frame.Bytes()[0]&rsvMask)
+	as.Equal(uint8(OpcodeText), frame.Bytes()[0]&0x0F)
+	as.NotEqual([]byte("hello"), frame.Bytes()[frame.Len()-5:])
+
+	frame, _, err = socket.genFrame(OpcodePing, []byte("hello"))
+	as.NoError(err)
+	as.Equal(uint8(0), frame.Bytes()[0]&rsvMask)
+}
+
+func TestExtension_UnnegotiatedRSV(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) {
+		var closeErr *CloseError
+		as.True(errors.As(err, &closeErr))
+		as.Equal(CloseProtocolError.Uint16(), closeErr.Code)
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var frame = bytes.NewBuffer(nil)
+	var fh = frameHeader{}
+	n, _ := fh.GenerateHeader(false, true, false, OpcodeText, 5)
+	fh.SetRSV(RSV2Bit)
+	frame.Write(fh[:n])
+	frame.WriteString("hello")
+	_, _ = client.conn.Write(frame.Bytes())
+	wg.Wait()
+}
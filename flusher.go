@@ -0,0 +1,168 @@
+package gws
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// BroadcastFlusher 广播刷写器. 由它创建的Broadcaster不再为每个连接单独排队写入, 而是把生成好的帧交给连接所在的分片;
+// 每个分片有一个刷写协程, 把发往同一连接的多个广播帧合并成一次写队列任务, 直接写入TCP连接时通过writev一次写出,
+// 减少大规模扇出时的系统调用.
+// 注意: 经过刷写器的帧之间保持广播顺序, 但是在刷写时才进入连接的写队列, 可能排在之后发出的其他写入的后面
+// BroadcastFlusher gathers broadcast frames. A Broadcaster created by it hands the generated frame to the shard of
+// the connection instead of queueing a write per connection. Every shard runs a flusher goroutine that merges the
+// frames destined for the same connection into a single write queue job, written with one writev when writing to
+// a TCP connection directly, which cuts syscalls during large fan-outs.
+// Note: frames going through the flusher keep their broadcast order, but they enter the write queue of the connection
+// when flushed, possibly after other writes issued later
+type BroadcastFlusher struct {
+	once   sync.Once
+	wg     sync.WaitGroup
+	shards []*flushShard
+}
+
+type flushShard struct {
+	mu      sync.Mutex
+	pending map[*Conn]*flushBatch
+	stopped bool
+	signal  chan struct{}
+	done    chan struct{}
+}
+
+// 发往同一连接的一批广播帧
+// a batch of broadcast frames destined for one connection
+type flushBatch struct {
+	frames   net.Buffers
+	owners   []*Broadcaster
+	size     int
+	enqueued time.Time
+}
+
+// NewBroadcastFlusher shards为分片数量, 向上取整为2的幂, 0表示GOMAXPROCS
+// shards is the number of shards, rounded up to a power of 2; 0 means GOMAXPROCS
+func NewBroadcastFlusher(shards int) *BroadcastFlusher {
+	shards = internal.ToBinaryNumber(internal.SelectValue(shards <= 0, runtime.GOMAXPROCS(0), shards))
+	var c = &BroadcastFlusher{shards: make([]*flushShard, shards)}
+	for i := range c.shards {
+		var shard = &flushShard{
+			pending: make(map[*Conn]*flushBatch),
+			signal:  make(chan struct{}, 1),
+			done:    make(chan struct{}),
+		}
+		c.shards[i] = shard
+		c.wg.Add(1)
+		go shard.run(&c.wg)
+	}
+	return c
+}
+
+// NewBroadcaster 创建经过刷写器发送的广播器, 用法与NewBroadcaster相同
+// NewBroadcaster creates a broadcaster sending through the flusher, used the same way as NewBroadcaster
+func (c *BroadcastFlusher) NewBroadcaster(opcode Opcode, payload []byte) *Broadcaster {
+	var b = NewBroadcaster(opcode, payload)
+	b.flusher = c
+	return b
+}
+
+// Close 写出剩余的帧并停止刷写协程, 之后广播器退化为逐个连接排队写入
+// Close flushes the remaining frames and stops the flusher goroutines. Broadcasters fall back to
+// queueing a write per connection afterwards
+func (c *BroadcastFlusher) Close() {
+	c.once.Do(func() {
+		for _, item := range c.shards {
+			close(item.done)
+		}
+		c.wg.Wait()
+	})
+}
+
+// 把帧交给连接所在的分片, 刷写器已经关闭时返回false
+// hand the frame to the shard of the connection, false if the flusher was closed
+func (c *BroadcastFlusher) add(socket *Conn, b *Broadcaster, frame []byte, enqueued time.Time) bool {
+	var shard = c.shards[socket.id&uint64(len(c.shards)-1)]
+	shard.mu.Lock()
+	if shard.stopped {
+		shard.mu.Unlock()
+		return false
+	}
+	var batch = shard.pending[socket]
+	if batch == nil {
+		batch = &flushBatch{enqueued: enqueued}
+		shard.pending[socket] = batch
+	}
+	batch.frames = append(batch.frames, frame)
+	batch.owners = append(batch.owners, b)
+	batch.size += len(frame)
+	shard.mu.Unlock()
+
+	select {
+	case shard.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (c *flushShard) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-c.signal:
+			c.flush(false)
+		case <-c.done:
+			c.flush(true)
+			return
+		}
+	}
+}
+
+// 取走积累的批次, 每个连接推入一个写队列任务
+// take the gathered batches and push one write queue job per connection
+func (c *flushShard) flush(stop bool) {
+	c.mu.Lock()
+	var pending = c.pending
+	c.pending = make(map[*Conn]*flushBatch, len(pending))
+	c.stopped = stop
+	c.mu.Unlock()
+
+	for k, v := range pending {
+		var socket, batch = k, v
+		socket.writeQueue.Push(func() { socket.writeBatch(batch) })
+	}
+}
+
+func (c *Conn) writeBatch(batch *flushBatch) {
+	c.chargeWriteQueue(-batch.size)
+	if !c.isClosed() {
+		c.emitError(c.writeFrameBuffers(batch.frames, batch.enqueued))
+	}
+	for _, item := range batch.owners {
+		item.done()
+	}
+}
+
+// 一次写入多个帧, 直接写入连接时由net.Buffers合并为writev
+// write several frames at once, merged into a writev by net.Buffers when writing to the connection directly
+func (c *Conn) writeFrameBuffers(frames net.Buffers, enqueued time.Time) error {
+	if c.writer != nil {
+		for _, frame := range frames {
+			if err := c.writeFrameBytes(frame, enqueued); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, frame := range frames {
+		c.observeOutbound(frame, enqueued)
+		c.captureOutbound(frame)
+	}
+	if c.watchdog != nil {
+		c.watchdog.begin()
+		defer c.watchdog.end()
+	}
+	_, err := frames.WriteTo(c.conn)
+	return err
+}
@@ -0,0 +1,110 @@
+package gws
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroadcastFlusher(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("fan out", func(t *testing.T) {
+		const count, messages = 5, 20
+		var flusher = NewBroadcastFlusher(2)
+		defer flusher.Close()
+
+		var wg = &sync.WaitGroup{}
+		wg.Add(count)
+		var servers []*Conn
+		for i := 0; i < count; i++ {
+			var received []string
+			var clientHandler = new(webSocketMocker)
+			clientHandler.onMessage = func(socket *Conn, message *Message) {
+				if received = append(received, message.Data.String()); len(received) == messages {
+					for j := 0; j < messages; j++ {
+						as.Equal(fmt.Sprintf("message %d", j), received[j])
+					}
+					wg.Done()
+				}
+			}
+			server, client := newPeer(new(webSocketMocker), &ServerOption{}, clientHandler, &ClientOption{})
+			go server.ReadLoop()
+			go client.ReadLoop()
+			servers = append(servers, server)
+		}
+
+		for i := 0; i < messages; i++ {
+			var b = flusher.NewBroadcaster(OpcodeText, []byte(fmt.Sprintf("message %d", i)))
+			for _, server := range servers {
+				as.NoError(b.Broadcast(server))
+			}
+			b.Release()
+		}
+		wg.Wait()
+	})
+
+	// 刷写之前的广播帧合并为一批, 关闭后退化为逐个连接写入
+	t.Run("batch", func(t *testing.T) {
+		var shard = &flushShard{pending: make(map[*Conn]*flushBatch), signal: make(chan struct{}, 1)}
+		var flusher = &BroadcastFlusher{shards: []*flushShard{shard}}
+
+		var received = make(chan string, 8)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		var serverOption = &ServerOption{MemoryWatermark: 1 << 30}
+		server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var broadcasters []*Broadcaster
+		for _, text := range []string{"a", "b", "c"} {
+			var b = flusher.NewBroadcaster(OpcodeText, []byte(text))
+			as.NoError(b.Broadcast(server))
+			b.Release()
+			broadcasters = append(broadcasters, b)
+		}
+		as.Len(shard.pending, 1)
+		as.Len(shard.pending[server].frames, 3)
+		as.Equal(int64(server.config.ReadBufferSize+9), serverOption.config.memory.load())
+
+		shard.flush(true)
+		as.Equal("a", <-received)
+		as.Equal("b", <-received)
+		as.Equal("c", <-received)
+		as.Eventually(func() bool {
+			return serverOption.config.memory.load() == int64(server.config.ReadBufferSize)
+		}, time.Second, time.Millisecond)
+		for _, b := range broadcasters {
+			as.Eventually(func() bool { return atomic.LoadInt64(&b.state) == 0 }, time.Second, time.Millisecond)
+		}
+
+		var b = flusher.NewBroadcaster(OpcodeText, []byte("d"))
+		as.NoError(b.Broadcast(server))
+		b.Release()
+		as.Empty(shard.pending)
+		as.Equal("d", <-received)
+	})
+
+	// 关闭时写出剩余的帧
+	t.Run("close", func(t *testing.T) {
+		var flusher = NewBroadcastFlusher(0)
+		var received = make(chan string, 1)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		server, client := newPeer(new(webSocketMocker), &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var b = flusher.NewBroadcaster(OpcodeText, []byte("hello"))
+		as.NoError(b.Broadcast(server))
+		b.Release()
+		flusher.Close()
+		flusher.Close()
+		as.Equal("hello", <-received)
+	})
+}
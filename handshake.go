@@ -0,0 +1,73 @@
+package gws
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 记录握手阶段从连接读到的字节, 最多limit字节; 握手完成后调用stop, 之后只转发读取
+// records the bytes read from the connection during the handshake, limit bytes at most.
+// stop is called once the handshake is done, reads are only passed through after that
+type handshakeRecorder struct {
+	reader  io.Reader
+	limit   int
+	buf     []byte
+	n       int
+	stopped bool
+}
+
+func (c *handshakeRecorder) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if !c.stopped && n > 0 {
+		if room := c.limit - len(c.buf); room > 0 {
+			c.buf = append(c.buf, p[:internal.SelectValue(n < room, n, room)]...)
+		}
+		c.n += n
+	}
+	return n, err
+}
+
+// 停止记录, 返回握手消息本身的字节; buffered为读缓冲区中握手消息之后已经读入的字节数
+// stop recording and return the bytes of the handshake message itself.
+// buffered is the number of bytes past the message already pulled into the read buffer
+func (c *handshakeRecorder) stop(buffered int) []byte {
+	c.stopped = true
+	var n = c.n - buffered
+	return c.buf[:internal.SelectValue(n < len(c.buf), n, len(c.buf))]
+}
+
+// 重新序列化net/http已经解析的请求, 头部的顺序和大小写可能与原始请求不同
+// re-serialize a request already parsed by net/http. Header order and casing may differ from the original
+func dumpRequest(r *http.Request) []byte {
+	var buf = bytes.NewBuffer(nil)
+	buf.WriteString(r.Method + " " + r.RequestURI + " " + r.Proto + "\r\n")
+	if r.Host != "" {
+		buf.WriteString("Host: " + r.Host + "\r\n")
+	}
+	_ = r.Header.Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// 按上限截断保存的握手字节
+// truncate retained handshake bytes to the limit
+func truncateHandshake(b []byte, limit int) []byte {
+	if len(b) > limit {
+		b = b[:limit]
+	}
+	return append([]byte(nil), b...)
+}
+
+// Handshake 握手请求和响应的原始字节, 需要开启HandshakeCaptureSize, 否则返回nil; 不要修改返回的切片.
+// 通过Server或者客户端建立的连接记录的是线路上的原始字节; 通过Upgrader.Upgrade升级时请求已经被net/http解析,
+// 记录的是重新序列化的请求, 头部的顺序和大小写可能不同
+// Handshake returns the raw bytes of the upgrade request and response, nil unless HandshakeCaptureSize is set.
+// Do not modify the returned slices. Connections accepted by Server or dialed by the client retain the bytes exactly
+// as on the wire; with Upgrader.Upgrade the request has already been parsed by net/http and is re-serialized,
+// so header order and casing may differ
+func (c *Conn) Handshake() (request, response []byte) {
+	return c.handshakeRequest, c.handshakeResponse
+}
@@ -0,0 +1,104 @@
+package gws
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeRecorder(t *testing.T) {
+	var as = assert.New(t)
+	var raw = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	var recorder = &handshakeRecorder{reader: io.MultiReader(strings.NewReader(raw+"frame"), strings.NewReader(" bytes")), limit: 1024}
+	var br = bufio.NewReader(recorder)
+	_, err := http.ReadRequest(br)
+	as.NoError(err)
+	as.Equal(raw, string(recorder.stop(br.Buffered())))
+
+	// 停止后不再记录
+	var n = len(recorder.buf)
+	rest, err := io.ReadAll(br)
+	as.NoError(err)
+	as.Equal("frame bytes", string(rest))
+	as.Equal(n, len(recorder.buf))
+
+	recorder = &handshakeRecorder{reader: strings.NewReader(raw), limit: 8}
+	br = bufio.NewReader(recorder)
+	_, err = http.ReadRequest(br)
+	as.NoError(err)
+	as.Equal(raw[:8], string(recorder.stop(br.Buffered())))
+}
+
+func TestConn_Handshake(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("server", func(t *testing.T) {
+		var sockets = make(chan *Conn, 1)
+		var server = NewServer(new(BuiltinEventHandler), &ServerOption{HandshakeCaptureSize: 4096})
+		server.OnRequest = func(socket *Conn, request *http.Request) {
+			sockets <- socket
+			socket.ReadLoop()
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if !as.NoError(err) {
+			return
+		}
+		defer listener.Close()
+		go server.RunListener(listener)
+
+		var header = http.Header{}
+		header.Set("X-Signature", "abc")
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:                 "ws://" + listener.Addr().String(),
+			RequestHeader:        header,
+			HandshakeCaptureSize: 4096,
+		})
+		if !as.NoError(err) {
+			return
+		}
+		var socket = <-sockets
+
+		// 两端记录的是线路上相同的字节
+		serverRequest, serverResponse := socket.Handshake()
+		clientRequest, clientResponse := client.Handshake()
+		as.Equal(clientRequest, serverRequest)
+		as.Equal(clientResponse, serverResponse)
+		as.True(strings.HasPrefix(string(serverRequest), "GET / HTTP/1.1\r\n"))
+		as.Contains(string(serverRequest), "X-Signature: abc\r\n")
+		as.True(strings.HasSuffix(string(serverRequest), "\r\n\r\n"))
+		as.True(strings.HasPrefix(string(serverResponse), "HTTP/1.1 101 Switching Protocols\r\n"))
+		as.True(strings.HasSuffix(string(serverResponse), "\r\n\r\n"))
+		client.WriteClose(1000, nil)
+	})
+
+	t.Run("upgrader", func(t *testing.T) {
+		var sockets = make(chan *Conn, 1)
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{HandshakeCaptureSize: 16})
+		var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if socket, err := upgrader.Upgrade(w, r); err == nil {
+				sockets <- socket
+				socket.ReadLoop()
+			}
+		}))
+		defer server.Close()
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + strings.TrimPrefix(server.URL, "http://")})
+		if !as.NoError(err) {
+			return
+		}
+		request, response := client.Handshake()
+		as.Nil(request)
+		as.Nil(response)
+
+		request, response = (<-sockets).Handshake()
+		as.Equal("GET / HTTP/1.1\r\n", string(request))
+		as.Equal("HTTP/1.1 101 Swi", string(response))
+		client.WriteClose(1000, nil)
+	})
+}
@@ -6,3 +6,57 @@ var (
 	myBufferPool = internal.NewBufferPool()
 	myPadding    = frameHeader{}
 )
+
+// PoolStats 内置内存池的统计
+// Statistics of the built-in buffer pool
+type PoolStats struct {
+	// Get调用次数
+	// number of Get calls
+	Gets uint64
+
+	// 归还到池中的次数
+	// number of buffers returned to the pool
+	Puts uint64
+
+	// 池中没有可用缓冲而新分配的次数, 包括超过最大容量等级的分配
+	// number of allocations because the pool was empty, including those above the largest size class
+	Misses uint64
+
+	// 容量增长过大而没有放回池中的次数
+	// number of buffers that grew too large and were not returned to the pool
+	Discards uint64
+
+	// 通过Message.Retain脱离内存池的缓冲数
+	// number of buffers detached from the pool by Message.Retain
+	Detached uint64
+
+	// 取出后尚未归还的缓冲, 按容量等级计算的字节数; 持续增长说明有缓冲没有被释放, 例如忘记调用Message.Close.
+	// Message.Retain脱离的缓冲视为已归还, 不计入
+	// bytes of buffers taken and not yet returned, by size class. Steady growth means buffers are not released,
+	// e.g. Message.Close is missing. Buffers detached by Message.Retain count as returned and are not included
+	RetainedBytes uint64
+}
+
+// SetBufferPoolStatsEnabled 开启或者关闭内置内存池的统计, 默认关闭. 计数器被所有核心共享, 开启后每次取出和归还缓冲
+// 都有原子操作的开销; 请在创建连接之前开启, 否则RetainedBytes不准确
+// SetBufferPoolStatsEnabled turns the statistics of the built-in buffer pool on or off, they are off by default.
+// The counters are shared by all cores, so every get and put pays for an atomic operation once enabled.
+// Enable it before connections are created, otherwise RetainedBytes is inaccurate
+func SetBufferPoolStatsEnabled(enabled bool) {
+	myBufferPool.EnableStats(enabled)
+}
+
+// BufferPoolStats 内置内存池的统计快照, 所有连接共享同一个内存池; 需要先调用SetBufferPoolStatsEnabled, 否则都为0
+// BufferPoolStats returns a snapshot of the statistics of the built-in buffer pool shared by all connections.
+// All fields are zero unless SetBufferPoolStatsEnabled was called
+func BufferPoolStats() PoolStats {
+	var stats = myBufferPool.Stats()
+	return PoolStats{
+		Gets:          stats.Gets,
+		Puts:          stats.Puts,
+		Misses:        stats.Misses,
+		Discards:      stats.Discards,
+		Detached:      stats.Detached,
+		RetainedBytes: stats.RetainedBytes,
+	}
+}
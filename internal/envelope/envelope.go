@@ -0,0 +1,128 @@
+// Package envelope rpc, ack和resume共用的协议帧和事件处理器辅助.
+// 被包装的连接上每条消息都是带有协议头的二进制帧, 应用消息也不例外, 所以应用数据不会被误认为协议帧;
+// 没有协议头的消息是协议错误, 连接以1002关闭
+// Package envelope holds the protocol frames and event handler helpers shared by rpc, ack and resume.
+// Every message on a wrapped connection is a binary frame carrying the protocol header, application messages
+// included, so application data can never be mistaken for a protocol frame. A message without the header is
+// a protocol error and closes the connection with 1002
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/internal"
+)
+
+// 协议头: 魔数(1) 类型(1) ID(8, 大端); 魔数区分不同的协议, 两端的包装不一致时同样视为协议错误
+// header layout: magic(1) kind(1) id(8, big endian). The magic tells the protocols apart, mismatched wrappers
+// on the two ends are a protocol error as well
+const HeaderSize = 10
+
+// KindMessage 应用消息, 协议头之后是原始的操作码(1)和载荷; 各协议自己的类型从1开始
+// KindMessage is an application message, the header is followed by the original opcode(1) and the payload.
+// The kinds of each protocol start at 1
+const KindMessage byte = 0
+
+var (
+	// ErrUnframed 收到没有协议头的消息
+	// a message without the protocol header was received
+	ErrUnframed = errors.New("message without protocol header")
+
+	// ErrMalformed 协议帧的内容不完整
+	// the content of a protocol frame is incomplete
+	ErrMalformed = errors.New("malformed protocol frame")
+)
+
+// Frame 解析后的协议帧, Body为协议头之后的部分
+// Frame is a parsed protocol frame, Body is everything after the header
+type Frame struct {
+	Kind byte
+	ID   uint64
+	Body []byte
+}
+
+// New 创建协议帧, 协议头之后留出size字节
+// New creates a protocol frame with size bytes after the header
+func New(magic, kind byte, id uint64, size int) []byte {
+	var b = make([]byte, HeaderSize+size)
+	b[0], b[1] = magic, kind
+	binary.BigEndian.PutUint64(b[2:HeaderSize], id)
+	return b
+}
+
+// Wrap 用kind类型的协议帧包装一条消息, 保留原始的操作码
+// Wrap wraps a message in a protocol frame of the given kind, keeping the original opcode
+func Wrap(magic, kind byte, id uint64, opcode gws.Opcode, payload []byte) []byte {
+	var b = New(magic, kind, id, 1+len(payload))
+	b[HeaderSize] = byte(opcode)
+	copy(b[HeaderSize+1:], payload)
+	return b
+}
+
+// Parse 解析协议帧, 不是二进制帧, 长度不足或者魔数不符时返回false
+// Parse parses a protocol frame, false if the message is not binary, too short or has a different magic
+func Parse(message *gws.Message, magic byte) (Frame, bool) {
+	var p = message.Bytes()
+	if message.Opcode != gws.OpcodeBinary || len(p) < HeaderSize || p[0] != magic {
+		return Frame{}, false
+	}
+	return Frame{Kind: p[1], ID: binary.BigEndian.Uint64(p[2:HeaderSize]), Body: p[HeaderSize:]}, true
+}
+
+// Unwrap 去掉Wrap添加的协议头, 恢复原始的操作码; 帧太短时返回false
+// Unwrap strips the header added by Wrap and restores the original opcode, false if the frame is too short
+func Unwrap(message *gws.Message, frame Frame) bool {
+	if len(frame.Body) < 1 {
+		return false
+	}
+	message.Opcode = gws.Opcode(frame.Body[0])
+	message.Data.Next(HeaderSize + 1)
+	return true
+}
+
+// Reject 释放消息并以协议错误关闭连接, err作为关闭原因
+// Reject releases the message and closes the connection with a protocol error, err is the close reason
+func Reject(socket *gws.Conn, message *gws.Message, err error) {
+	_ = message.Close()
+	socket.WriteClose(internal.CloseProtocolError.Uint16(), []byte(err.Error()))
+}
+
+var mu sync.Mutex
+
+// Load 取回连接上key对应的端点, 没有时返回零值
+// Load returns the endpoint stored under key on the connection, the zero value if there is none
+func Load[T any](socket *gws.Conn, key string) (v T) {
+	if value, ok := socket.SessionStorage.Load(key); ok {
+		v, _ = value.(T)
+	}
+	return v
+}
+
+// LoadOrStore 取回连接上key对应的端点, 没有时用create创建并保存
+// LoadOrStore returns the endpoint stored under key on the connection, creating and storing it with create if needed
+func LoadOrStore[T any](socket *gws.Conn, key string, create func() T) T {
+	if value, ok := socket.SessionStorage.Load(key); ok {
+		return value.(T)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if value, ok := socket.SessionStorage.Load(key); ok {
+		return value.(T)
+	}
+	var v = create()
+	socket.SessionStorage.Store(key, v)
+	return v
+}
+
+// Forward 把心跳事件原样转发给Next, 嵌入各个包装的事件处理器
+// Forward passes the heartbeat events on to Next, embedded by the wrapping event handlers
+type Forward struct {
+	Next gws.Event
+}
+
+func (c Forward) OnPing(socket *gws.Conn, payload []byte) { c.Next.OnPing(socket, payload) }
+
+func (c Forward) OnPong(socket *gws.Conn, payload []byte) { c.Next.OnPong(socket, payload) }
@@ -10,6 +10,23 @@ var (
 	ErrAsyncIOCapFull          = GwsError("async io capacity is full")
 	ErrSchema                  = GwsError("protocol not supported")
 	ErrStatusCode              = GwsError("status code error")
+	ErrIdleTimeout             = GwsError("idle timeout")
+	ErrRateLimitExceeded       = GwsError("read rate limit exceeded")
+	ErrTooManyFragments        = GwsError("too many fragments")
+	ErrMessageTooLarge         = GwsError("message too large")
+	ErrVersionNotSupported     = GwsError("websocket version not supported")
+	ErrHijackNotSupported      = GwsError("response writer does not implement http.Hijacker")
+	ErrUnexpectedOpcode        = GwsError("unexpected opcode")
+	ErrOpcodeDisallowed        = GwsError("opcode disallowed")
+	ErrDrainTimeout            = GwsError("drain timeout")
+	ErrServerDraining          = GwsError("server is draining")
+	ErrCaptureFormat           = GwsError("invalid capture format")
+	ErrWriteStalled            = GwsError("write stalled")
+	ErrReactorUnsupported      = GwsError("reactor not supported")
+	ErrMemoryWatermark         = GwsError("memory watermark exceeded")
+	ErrRelayIncompatible       = GwsError("relay connections negotiated different extensions")
+	ErrNoUpstream              = GwsError("no upstream configured")
+	ErrPollBacklog             = GwsError("long-polling backlog exceeded")
 )
 
 type GwsError string
@@ -93,8 +110,49 @@ func (c StatusCode) Bytes() []byte {
 	return []byte{uint8(c >> 8), uint8(c << 8 >> 8)}
 }
 
+// 预先拼接的错误信息, 关闭连接时不再分配
+// error messages built up front, so that closing a connection does not allocate them
+var closeErrorText = func() map[StatusCode]string {
+	var m = make(map[StatusCode]string, len(closeErrorMap))
+	for k, v := range closeErrorMap {
+		m[k] = "gws: " + v
+	}
+	return m
+}()
+
 func (c StatusCode) Error() string {
-	return "gws: " + closeErrorMap[c]
+	if v, ok := closeErrorText[c]; ok {
+		return v
+	}
+	return "gws: "
+}
+
+// String 状态码描述
+// description of the status code
+func (c StatusCode) String() string {
+	if v, ok := closeErrorMap[c]; ok {
+		return v
+	}
+	return "unknown"
+}
+
+// IsValid 是否可以出现在关闭帧中
+// 1004, 1005, 1006, 1014, 1015 以及 1016-2999 为保留值, 小于1000或者大于等于5000的值非法
+// whether the code may appear in a close frame.
+// 1004, 1005, 1006, 1014, 1015 and 1016-2999 are reserved, values below 1000 or from 5000 on are invalid
+func (c StatusCode) IsValid() bool {
+	switch c {
+	case 1004, 1005, 1006, 1014, 1015:
+		return false
+	default:
+		return c >= 1000 && c < 5000 && (c < 1016 || c >= 3000)
+	}
+}
+
+// IsApplication 是否为应用自定义状态码(4000-4999)
+// whether the code is reserved for private use by applications (4000-4999)
+func (c StatusCode) IsApplication() bool {
+	return c >= 4000 && c < 5000
 }
 
 func NewError(code StatusCode, err error) *Error {
@@ -110,6 +168,10 @@ func (c *Error) Error() string {
 	return c.Err.Error()
 }
 
+func (c *Error) Unwrap() error {
+	return c.Err
+}
+
 func Errors(funcs ...func() error) error {
 	for _, f := range funcs {
 		if err := f(); err != nil {
@@ -0,0 +1,77 @@
+package internal
+
+import "encoding/binary"
+
+// 帧头的编解码, gws和wire共用一份实现
+// frame header encoding and decoding, one implementation shared by gws and wire
+
+// FrameLengthSize 长度码之后扩展长度的字节数, 0, 2或者8
+// FrameLengthSize returns the number of extended length bytes that follow the length code, 0, 2 or 8
+func FrameLengthSize(lengthCode uint8) int {
+	switch lengthCode & 127 {
+	case 126:
+		return 2
+	case 127:
+		return 8
+	default:
+		return 0
+	}
+}
+
+// FrameHeaderLength 根据帧头第二个字节计算帧头的总长度, 包括扩展长度和掩码
+// FrameHeaderLength computes the total header length, extended length and mask key included,
+// from the second byte of the header
+func FrameHeaderLength(b1 uint8) int {
+	var n = 2 + FrameLengthSize(b1)
+	if b1&128 != 0 {
+		n += 4
+	}
+	return n
+}
+
+// FrameHeaderSizeOf 编码长度为n的帧需要的帧头长度
+// FrameHeaderSizeOf returns the header length needed to encode a frame of n bytes
+func FrameHeaderSizeOf(n int, masked bool) int {
+	var size = 2
+	if n > ThresholdV2 {
+		size += 8
+	} else if n > ThresholdV1 {
+		size += 2
+	}
+	if masked {
+		size += 4
+	}
+	return size
+}
+
+// PutFrameLength 编码载荷长度, p从帧头的第二个字节开始, 长度码写入p[0]的低7位, 扩展长度写入之后; 返回扩展长度的字节数
+// PutFrameLength encodes the payload length. p starts at the second byte of the header, the length code goes
+// into the low 7 bits of p[0] and the extended length after it. It returns the number of extended length bytes
+func PutFrameLength(p []byte, n uint64) int {
+	switch {
+	case n <= ThresholdV1:
+		p[0] |= uint8(n)
+		return 0
+	case n <= ThresholdV2:
+		p[0] |= 126
+		binary.BigEndian.PutUint16(p[1:3], uint16(n))
+		return 2
+	default:
+		p[0] |= 127
+		binary.BigEndian.PutUint64(p[1:9], n)
+		return 8
+	}
+}
+
+// ParseFrameLength 解析载荷长度, ext为长度码之后的扩展长度
+// ParseFrameLength decodes the payload length, ext holds the extended length bytes after the length code
+func ParseFrameLength(lengthCode uint8, ext []byte) uint64 {
+	switch lengthCode & 127 {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(ext[:2]))
+	case 127:
+		return binary.BigEndian.Uint64(ext[:8])
+	default:
+		return uint64(lengthCode & 127)
+	}
+}
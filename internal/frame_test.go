@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameLength(t *testing.T) {
+	var as = assert.New(t)
+	for _, n := range []uint64{0, 125, 126, 65535, 65536, math.MaxInt32} {
+		for _, masked := range []bool{false, true} {
+			var p [FrameHeaderSize]byte
+			var ext = PutFrameLength(p[1:], n)
+			if masked {
+				p[1] |= 128
+			}
+			as.Equal(FrameLengthSize(p[1]), ext)
+			as.Equal(FrameHeaderSizeOf(int(n), masked), FrameHeaderLength(p[1]))
+			as.Equal(n, ParseFrameLength(p[1], p[2:]))
+		}
+	}
+}
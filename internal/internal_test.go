@@ -48,6 +48,24 @@ func TestError(t *testing.T) {
 	})
 }
 
+func TestStatusCode(t *testing.T) {
+	var as = assert.New(t)
+	as.Equal("close normal", CloseNormalClosure.String())
+	as.Equal("unknown", StatusCode(4001).String())
+	as.True(CloseNormalClosure.IsValid())
+	as.True(CloseTryAgainLater.IsValid())
+	as.True(StatusCode(3000).IsValid())
+	as.True(StatusCode(4999).IsValid())
+	as.False(CloseNoStatusReceived.IsValid())
+	as.False(CloseTLSHandshake.IsValid())
+	as.False(StatusCode(1014).IsValid())
+	as.False(StatusCode(1016).IsValid())
+	as.False(StatusCode(999).IsValid())
+	as.False(StatusCode(5000).IsValid())
+	as.True(StatusCode(4000).IsApplication())
+	as.False(CloseGoingAway.IsApplication())
+}
+
 func TestRandomString_Uint32(t *testing.T) {
 	Numeric.Uint32()
 }
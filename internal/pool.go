@@ -3,6 +3,7 @@ package internal
 import (
 	"bytes"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -20,8 +21,32 @@ const (
 )
 
 type BufferPool struct {
+	// 按容量等级统计, 下标0为超出最大等级的直接分配; 放在开头保证32位平台上64位原子操作的对齐
+	// counters per size class, index 0 counts oversized allocations. They come first to keep the 64-bit atomics
+	// aligned on 32-bit platforms
+	gets     [poolSize]uint64
+	puts     [poolSize]uint64
+	misses   [poolSize]uint64
+	discards [poolSize]uint64
+	detached [poolSize]uint64
+
 	pools  [poolSize]*sync.Pool
 	limits [poolSize]int
+
+	// 是否统计; 计数器被所有核心共享, 默认关闭, 避免热路径上的缓存行争用
+	// whether to count. The counters are shared by all cores, so they are off by default
+	// to keep cache line contention off the hot path
+	statsEnabled uint32
+}
+
+// PoolStats 内存池统计
+type PoolStats struct {
+	Gets          uint64 // Get调用次数
+	Puts          uint64 // Put调用次数, 不包括被丢弃的
+	Misses        uint64 // 池中没有可用缓冲, 新分配的次数
+	Discards      uint64 // 容量过大而没有放回池中的次数
+	Detached      uint64 // 通过Detach脱离内存池的次数
+	RetainedBytes uint64 // 取出后尚未归还的缓冲, 按容量等级计算的字节数; 不包括脱离的缓冲
 }
 
 func NewBufferPool() *BufferPool {
@@ -29,25 +54,59 @@ func NewBufferPool() *BufferPool {
 	p.limits = [poolSize]int{0, Lv1, Lv2, Lv3, Lv4, Lv5, Lv6, Lv7, Lv8, Lv9}
 	for i := 1; i < poolSize; i++ {
 		var capacity = p.limits[i]
+		var misses = &p.misses[i]
 		p.pools[i] = &sync.Pool{New: func() any {
+			if p.isStatsEnabled() {
+				atomic.AddUint64(misses, 1)
+			}
 			return bytes.NewBuffer(make([]byte, 0, capacity))
 		}}
 	}
 	return &p
 }
 
+// EnableStats 开启或者关闭统计, 应该在使用内存池之前设置, 否则RetainedBytes不准确
+func (p *BufferPool) EnableStats(enabled bool) {
+	var v uint32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&p.statsEnabled, v)
+}
+
+func (p *BufferPool) isStatsEnabled() bool {
+	return atomic.LoadUint32(&p.statsEnabled) == 1
+}
+
 func (p *BufferPool) Put(b *bytes.Buffer, index int) {
 	if index == 0 || b == nil {
 		return
 	}
 	if b.Cap() <= 2*p.limits[index] {
+		p.count(&p.puts[index])
 		p.pools[index].Put(b)
+	} else {
+		p.count(&p.discards[index])
+	}
+}
+
+// Detach 取出的缓冲不再归还, 视为已归还, 不计入RetainedBytes
+func (p *BufferPool) Detach(index int) {
+	if index > 0 {
+		p.count(&p.detached[index])
+	}
+}
+
+func (p *BufferPool) count(counter *uint64) {
+	if p.isStatsEnabled() {
+		atomic.AddUint64(counter, 1)
 	}
 }
 
 func (p *BufferPool) Get(n int) (*bytes.Buffer, int) {
 	for i := 1; i < poolSize; i++ {
 		if n <= p.limits[i] {
+			p.count(&p.gets[i])
 			b := p.pools[i].Get().(*bytes.Buffer)
 			if b.Cap() < n {
 				b.Grow(p.limits[i])
@@ -56,5 +115,25 @@ func (p *BufferPool) Get(n int) (*bytes.Buffer, int) {
 			return b, i
 		}
 	}
+	p.count(&p.gets[0])
+	p.count(&p.misses[0])
 	return bytes.NewBuffer(make([]byte, 0, n)), 0
 }
+
+// Stats 统计快照, 需要开启统计; 被丢弃和脱离的缓冲视为已归还
+func (p *BufferPool) Stats() PoolStats {
+	var stats PoolStats
+	for i := 0; i < poolSize; i++ {
+		var gets, puts, discards = atomic.LoadUint64(&p.gets[i]), atomic.LoadUint64(&p.puts[i]), atomic.LoadUint64(&p.discards[i])
+		var detached = atomic.LoadUint64(&p.detached[i])
+		stats.Gets += gets
+		stats.Puts += puts
+		stats.Misses += atomic.LoadUint64(&p.misses[i])
+		stats.Discards += discards
+		stats.Detached += detached
+		if returned := puts + discards + detached; i > 0 && gets > returned {
+			stats.RetainedBytes += (gets - returned) * uint64(p.limits[i])
+		}
+	}
+	return stats
+}
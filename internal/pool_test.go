@@ -54,3 +54,41 @@ func TestBufferPool(t *testing.T) {
 	buffer, _ := pool.Get(256 * 1024)
 	as.GreaterOrEqual(buffer.Cap(), 256*1024)
 }
+
+func TestBufferPool_Stats(t *testing.T) {
+	var as = assert.New(t)
+	var pool = NewBufferPool()
+
+	// 默认不统计
+	_, _ = pool.Get(100)
+	as.Equal(PoolStats{}, pool.Stats())
+	pool.EnableStats(true)
+
+	a, ia := pool.Get(100)
+	b, ib := pool.Get(3000)
+	_, _ = pool.Get(256 * 1024)
+	var stats = pool.Stats()
+	as.Equal(uint64(3), stats.Gets)
+	as.Equal(uint64(0), stats.Puts)
+	as.Equal(uint64(3), stats.Misses)
+	as.Equal(uint64(Lv1+Lv4), stats.RetainedBytes)
+
+	pool.Put(a, ia)
+	b.Grow(3 * Lv4)
+	pool.Put(b, ib)
+	stats = pool.Stats()
+	as.Equal(uint64(1), stats.Puts)
+	as.Equal(uint64(1), stats.Discards)
+	as.Equal(uint64(0), stats.RetainedBytes)
+
+	pool.Put(bytes.NewBuffer(make([]byte, 2)), 2)
+	as.Equal(uint64(0), pool.Stats().RetainedBytes)
+
+	// 脱离的缓冲视为已归还
+	_, ic := pool.Get(50)
+	as.Equal(uint64(Lv1), pool.Stats().RetainedBytes)
+	pool.Detach(ic)
+	stats = pool.Stats()
+	as.Equal(uint64(1), stats.Detached)
+	as.Equal(uint64(0), stats.RetainedBytes)
+}
@@ -0,0 +1,122 @@
+package internal
+
+import "unicode/utf8"
+
+// Utf8Checker 增量utf8校验器, 保存跨分片的不完整字符
+// incremental utf8 validator, carries the partial rune across fragments
+type Utf8Checker struct {
+	n   int
+	buf [utf8.UTFMax]byte
+}
+
+// 根据首字节计算字符长度, 非法首字节返回0
+// rune length by leading byte, 0 means invalid leading byte
+func runeLength(b byte) int {
+	switch {
+	case b < 0x80:
+		return 1
+	case b >= 0xC2 && b <= 0xDF:
+		return 2
+	case b >= 0xE0 && b <= 0xEF:
+		return 3
+	case b >= 0xF0 && b <= 0xF4:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// 检查不完整字符是否可能是合法字符的前缀
+// check whether the partial rune can be a prefix of a valid rune
+func validPrefix(p []byte) bool {
+	var need = runeLength(p[0])
+	if need == 0 {
+		return false
+	}
+	if len(p) == 1 {
+		return true
+	}
+	var b [utf8.UTFMax]byte
+	copy(b[:], p)
+	for i := len(p); i < need; i++ {
+		b[i] = 0x80
+	}
+	return utf8.Valid(b[:need])
+}
+
+// Reset 重置状态
+func (c *Utf8Checker) Reset() {
+	c.n = 0
+}
+
+// Done 没有残留的不完整字符
+// no partial rune is pending
+func (c *Utf8Checker) Done() bool {
+	return c.n == 0
+}
+
+// Check 校验一个分片, 尾部不完整的字符留到下一次校验
+// 所有完整的字符(包括跨分片拼接出的字符)都经过valid校验; 不完整字符的前缀检查使用标准库
+// validate a fragment, the incomplete rune at the tail is kept for the next call
+// all complete runes (including those joined across fragments) go through valid; the prefix check of an incomplete rune uses the standard library
+func (c *Utf8Checker) Check(p []byte, valid func(p []byte) bool) bool {
+	if c.n > 0 {
+		var need = runeLength(c.buf[0])
+		var m = copy(c.buf[c.n:need], p)
+		c.n += m
+		p = p[m:]
+		if c.n < need {
+			return validPrefix(c.buf[:c.n])
+		}
+		if !valid(c.buf[:need]) {
+			return false
+		}
+		c.n = 0
+	}
+
+	var start = len(p)
+	for i := len(p) - 1; i >= 0 && len(p)-i <= utf8.UTFMax; i-- {
+		if !utf8.RuneStart(p[i]) {
+			continue
+		}
+		if !utf8.FullRune(p[i:]) {
+			start = i
+		}
+		break
+	}
+	if !valid(p[:start]) {
+		return false
+	}
+	if start < len(p) {
+		if !validPrefix(p[start:]) {
+			return false
+		}
+		c.n = copy(c.buf[0:], p[start:])
+	}
+	return true
+}
+
+// 解除掩码和utf8校验融合时每块的长度. 每块解除掩码后趁数据还在缓存中立即校验, 载荷只从内存读取一次;
+// 必须是4的倍数, 保证每块的掩码对齐
+// chunk length when unmasking and utf8 validation are fused. Every chunk is validated right after unmasking while it
+// is still in cache, so the payload is read from memory only once. It must be a multiple of 4 to keep the mask aligned
+const maskCheckChunk = 2048
+
+// MaskXORCheck 解除掩码的同时增量校验utf8编码, 语义与MaskXOR之后调用Check相同; 校验失败时仍然解除全部掩码
+// MaskXORCheck unmasks the payload and validates it incrementally in the same pass, with the semantics of MaskXOR
+// followed by Check. The whole payload is unmasked even if validation fails
+func (c *Utf8Checker) MaskXORCheck(b []byte, key []byte, valid func(p []byte) bool) bool {
+	for len(b) > 0 {
+		var n = len(b)
+		if n > maskCheckChunk {
+			n = maskCheckChunk
+		}
+		MaskXOR(b[:n], key)
+		if !c.Check(b[:n], valid) {
+			MaskXOR(b[n:], key)
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUtf8Checker(t *testing.T) {
+	var as = assert.New(t)
+
+	var check = func(fragments ...[]byte) bool {
+		var c Utf8Checker
+		for _, p := range fragments {
+			if !c.Check(p, utf8.Valid) {
+				return false
+			}
+		}
+		return c.Done()
+	}
+
+	t.Run("split runes", func(t *testing.T) {
+		var s = []byte("κόσμε你好🙂hello")
+		for i := 0; i <= len(s); i++ {
+			for j := i; j <= len(s); j++ {
+				as.True(check(s[:i], s[i:j], s[j:]))
+			}
+		}
+	})
+
+	t.Run("incomplete tail", func(t *testing.T) {
+		var s = []byte("你好")
+		as.False(check(s[:4]))
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		var c Utf8Checker
+		as.True(c.Check([]byte{0xce, 0xba}, utf8.Valid))
+		as.False(c.Check([]byte{0xe1, 0xbd, 0xb9, 0xcf, 0x83, 0xce, 0xbc, 0xce, 0xb5, 0xed, 0xa0}, utf8.Valid))
+	})
+
+	t.Run("invalid prefix across fragments", func(t *testing.T) {
+		var c Utf8Checker
+		as.True(c.Check([]byte{0xf4}, utf8.Valid))
+		as.False(c.Check([]byte{0x90}, utf8.Valid))
+	})
+
+	t.Run("random", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			var n = AlphabetNumeric.Intn(16)
+			var p = make([]byte, n)
+			for j := range p {
+				p[j] = byte(AlphabetNumeric.Intn(256))
+			}
+			var k = AlphabetNumeric.Intn(n + 1)
+			as.Equal(utf8.Valid(p), check(p[:k], p[k:]))
+		}
+	})
+}
+
+func TestUtf8Checker_Validator(t *testing.T) {
+	var as = assert.New(t)
+	var runes []string
+	var valid = func(p []byte) bool {
+		runes = append(runes, string(p))
+		return utf8.Valid(p)
+	}
+	var s = []byte("你好")
+	var c Utf8Checker
+	as.True(c.Check(s[:2], valid))
+	as.True(c.Check(s[2:], valid))
+	as.True(c.Done())
+	as.Contains(runes, "你")
+}
+
+func TestUtf8Checker_MaskXORCheck(t *testing.T) {
+	var as = assert.New(t)
+	var key = []byte{0x12, 0x34, 0x56, 0x78}
+	var masked = func(p []byte) []byte {
+		var b = make([]byte, len(p))
+		copy(b, p)
+		MaskXOR(b, key)
+		return b
+	}
+
+	// 跨块的多字节字符
+	t.Run("valid", func(t *testing.T) {
+		var s = []byte(strings.Repeat("κόσμε你好🙂hello", 1000))
+		for _, n := range []int{0, 1, maskCheckChunk - 1, maskCheckChunk, maskCheckChunk + 1, len(s)} {
+			var b = masked(s[:n])
+			var c Utf8Checker
+			as.Equal(utf8.Valid(s[:n]), c.MaskXORCheck(b, key, utf8.Valid) && c.Done())
+			as.Equal(s[:n], b)
+		}
+	})
+
+	// 校验失败时也解除全部掩码
+	t.Run("invalid", func(t *testing.T) {
+		var s = []byte(strings.Repeat("a", 3*maskCheckChunk))
+		s[10] = 0xff
+		var b = masked(s)
+		var c Utf8Checker
+		as.False(c.MaskXORCheck(b, key, utf8.Valid))
+		as.Equal(s, b)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			var p = make([]byte, AlphabetNumeric.Intn(3*maskCheckChunk))
+			for j := range p {
+				p[j] = byte(AlphabetNumeric.Intn(128))
+			}
+			if len(p) > 0 && AlphabetNumeric.Intn(2) == 0 {
+				p[AlphabetNumeric.Intn(len(p))] = byte(128 + AlphabetNumeric.Intn(128))
+			}
+			var b = masked(p)
+			var c Utf8Checker
+			as.Equal(utf8.Valid(p), c.MaskXORCheck(b, key, utf8.Valid) && c.Done())
+			as.Equal(p, b)
+		}
+	})
+}
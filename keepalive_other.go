@@ -0,0 +1,14 @@
+//go:build !linux && !dragonfly && !freebsd && !netbsd
+
+package gws
+
+import (
+	"net"
+	"time"
+)
+
+// 不支持单独设置探测间隔和次数的平台, 只使用SetKeepAlivePeriod
+// platforms where the probe interval and count cannot be set separately, only SetKeepAlivePeriod applies
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+//go:build linux || dragonfly || freebsd || netbsd
+
+package gws
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// 设置保活探测的间隔和次数, 内核以秒为单位, 向上取整
+// set the interval and the count of keepalive probes; the kernel expects seconds, rounded up
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if interval > 0 {
+			var secs = int((interval + time.Second - 1) / time.Second)
+			if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs); serr != nil {
+				return
+			}
+		}
+		if count > 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,72 @@
+//go:build linux || dragonfly || freebsd || netbsd
+
+package gws
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func getsockoptInt(t *testing.T, conn net.Conn, level, opt int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+	var value int
+	_ = raw.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	assert.NoError(t, err)
+	return value
+}
+
+func TestConn_SetKeepAlive(t *testing.T) {
+	var as = assert.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	var accept = func() net.Conn {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		as.NoError(err)
+		t.Cleanup(func() { _ = client.Close() })
+		server, err := listener.Accept()
+		as.NoError(err)
+		return server
+	}
+
+	t.Run("option", func(t *testing.T) {
+		var option = initServerOption(&ServerOption{
+			TCPKeepAliveEnabled:  true,
+			TCPKeepAliveInterval: 1500 * time.Millisecond,
+			TCPKeepAliveCount:    3,
+		})
+		var conn = accept()
+		serveWebSocket(true, option.getConfig(), new(sliceMap), conn, nil, new(webSocketMocker), false)
+		as.Equal(1, getsockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+		as.Equal(2, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+		as.Equal(2, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+		as.Equal(3, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT))
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		// 只设置次数时保留间隔
+		var conn = accept()
+		var interval = getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+		as.NoError((&Conn{conn: conn}).SetKeepAlive(0, 5))
+		as.Equal(interval, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+		as.Equal(5, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT))
+	})
+
+	t.Run("other", func(t *testing.T) {
+		conn, _ := net.Pipe()
+		as.NoError((&Conn{conn: conn}).SetKeepAlive(time.Second, 3))
+
+		var closed = accept()
+		_ = closed.Close()
+		as.Error((&Conn{conn: closed}).SetKeepAlive(time.Second, 3))
+	})
+}
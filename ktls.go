@@ -0,0 +1,211 @@
+package gws
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// 平台或者内核不支持内核TLS(没有tls模块), 之后的连接不再尝试
+	// the platform or the kernel lacks kernel TLS (no tls module), later connections do not try again
+	errKernelTLSUnavailable = errors.New("gws: kernel tls unavailable")
+
+	errKernelTLSKeys      = errors.New("gws: unsupported cipher suite or missing traffic secret")
+	errKernelTLSOffloaded = errors.New("gws: tls records are written by the kernel")
+)
+
+// 内核TLS不可用时置为1
+// set to 1 once kernel TLS turns out to be unavailable
+var kernelTLSUnavailable uint32
+
+// 与tls.NewListener一样在接受的连接上运行TLS服务端; 握手之后尝试让内核接管发送方向的加密(kTLS), 失败时继续使用用户态TLS.
+// 为了让发送序号从0开始, 连接不发送会话票据; 服务端的应用流量密钥通过KeyLogWriter取得
+// runs the TLS server side on accepted connections like tls.NewListener. After the handshake the encryption of
+// outbound records is handed to the kernel (kTLS), falling back to userspace TLS if that fails. Connections send no
+// session tickets, so that the outbound sequence number starts at 0. The server application traffic secret is
+// obtained through KeyLogWriter
+type kernelTLSListener struct {
+	net.Listener
+	config *tls.Config
+	logger Logger
+}
+
+func (c *kernelTLSListener) Accept() (net.Conn, error) {
+	conn, err := c.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var tcp, ok = conn.(*net.TCPConn)
+	if !ok || atomic.LoadUint32(&kernelTLSUnavailable) == 1 {
+		return tls.Server(conn, c.config), nil
+	}
+	var keyLog = new(kernelTLSKeyLog)
+	var config = c.config.Clone()
+	config.KeyLogWriter = keyLog
+	config.SessionTicketsDisabled = true
+	var socket = &kernelTLSSocket{TCPConn: tcp}
+	return &kernelTLSConn{Conn: tls.Server(socket, config), socket: socket, keyLog: keyLog, logger: c.logger}, nil
+}
+
+// tls.Conn下面的套接字. 内核接管加密之后tls.Conn的密钥和序号已经过时, 它写入的记录(例如回应KeyUpdate)会破坏流,
+// 所以写入失败, 连接随之关闭
+// the socket beneath tls.Conn. Once the kernel encrypts, the keys and the sequence number of tls.Conn are stale and
+// a record written by it (e.g. answering a KeyUpdate) would corrupt the stream, so the write fails and the
+// connection is closed
+type kernelTLSSocket struct {
+	*net.TCPConn
+	offloaded uint32
+}
+
+func (c *kernelTLSSocket) isOffloaded() bool {
+	return atomic.LoadUint32(&c.offloaded) == 1
+}
+
+func (c *kernelTLSSocket) Write(p []byte) (int, error) {
+	if c.isOffloaded() {
+		return 0, errKernelTLSOffloaded
+	}
+	return c.TCPConn.Write(p)
+}
+
+// 服务端的TLS连接: 读取始终经过tls.Conn; 内核接管加密之后, 写入和关闭直接作用于套接字, 不再发送close_notify
+// server side TLS connection. Reads always go through tls.Conn. Once the kernel encrypts, writes and Close go
+// straight to the socket, and no close_notify is sent
+type kernelTLSConn struct {
+	*tls.Conn
+	socket *kernelTLSSocket
+	keyLog *kernelTLSKeyLog
+	logger Logger
+	once   sync.Once
+}
+
+func (c *kernelTLSConn) Read(p []byte) (int, error) {
+	c.once.Do(c.offload)
+	return c.Conn.Read(p)
+}
+
+func (c *kernelTLSConn) Write(p []byte) (int, error) {
+	if c.socket.isOffloaded() {
+		return c.socket.TCPConn.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *kernelTLSConn) Close() error {
+	if c.socket.isOffloaded() {
+		return c.socket.TCPConn.Close()
+	}
+	return c.Conn.Close()
+}
+
+// 完成握手, 然后尝试让内核接管发送方向的加密; 服务端先读取请求, 此时还没有写入过应用数据.
+// 握手错误由随后的Read返回
+// complete the handshake, then try to hand outbound encryption to the kernel. The server reads the request first,
+// so no application data has been written yet. A handshake error is returned by the Read that follows
+func (c *kernelTLSConn) offload() {
+	if c.Conn.Handshake() != nil {
+		return
+	}
+	var state = c.Conn.ConnectionState()
+	var secret = c.keyLog.secret
+	c.keyLog.secret = nil
+	if state.Version != tls.VersionTLS13 {
+		return
+	}
+	keys, err := newKernelTLSKeys(state.CipherSuite, secret)
+	if err == nil {
+		err = enableKernelTLS(c.socket.TCPConn, keys)
+	}
+	switch {
+	case err == nil:
+		atomic.StoreUint32(&c.socket.offloaded, 1)
+	case errors.Is(err, errKernelTLSUnavailable):
+		if atomic.CompareAndSwapUint32(&kernelTLSUnavailable, 0, 1) {
+			c.logger.Warn("gws: kernel tls unavailable, using userspace tls:", err.Error())
+		}
+	default:
+		if debugEnabled(c.logger) {
+			c.logger.Debug("gws: kernel tls not enabled for", c.RemoteAddr().String()+":", err.Error())
+		}
+	}
+}
+
+// 从KeyLogWriter的输出中取出服务端的应用流量密钥, 每个连接一个, 只在握手协程中写入
+// picks the server application traffic secret out of the KeyLogWriter output. One per connection, written only
+// by the handshake
+type kernelTLSKeyLog struct {
+	secret []byte
+}
+
+func (c *kernelTLSKeyLog) Write(p []byte) (int, error) {
+	var fields = bytes.Fields(p)
+	if len(fields) == 3 && string(fields[0]) == "SERVER_TRAFFIC_SECRET_0" {
+		if secret, err := hex.DecodeString(string(fields[2])); err == nil {
+			c.secret = secret
+		}
+	}
+	return len(p), nil
+}
+
+// TLS 1.3发送方向的流量密钥和IV, 见RFC 8446 7.3
+// outbound traffic key and IV of TLS 1.3, see RFC 8446 7.3
+type kernelTLSKeys struct {
+	suite uint16
+	key   []byte
+	iv    []byte
+}
+
+func newKernelTLSKeys(suite uint16, secret []byte) (*kernelTLSKeys, error) {
+	var newHash func() hash.Hash
+	var keyLength int
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		newHash, keyLength = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		newHash, keyLength = sha512.New384, 32
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		newHash, keyLength = sha256.New, 32
+	default:
+		return nil, errKernelTLSKeys
+	}
+	if len(secret) != newHash().Size() {
+		return nil, errKernelTLSKeys
+	}
+	return &kernelTLSKeys{
+		suite: suite,
+		key:   hkdfExpandLabel(newHash, secret, "key", keyLength),
+		iv:    hkdfExpandLabel(newHash, secret, "iv", 12),
+	}, nil
+}
+
+// 上下文为空的HKDF-Expand-Label, 见RFC 8446 7.1和RFC 5869 2.3
+// HKDF-Expand-Label with an empty context, see RFC 8446 7.1 and RFC 5869 2.3
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, length int) []byte {
+	const prefix = "tls13 "
+	var info = make([]byte, 0, 4+len(prefix)+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(prefix)+len(label)))
+	info = append(info, prefix...)
+	info = append(info, label...)
+	info = append(info, 0)
+
+	var mac = hmac.New(newHash, secret)
+	var out, block []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
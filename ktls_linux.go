@@ -0,0 +1,115 @@
+//go:build linux
+
+package gws
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const kernelTLSSupported = true
+
+// linux/tls.h
+const (
+	solTLS       = 282
+	tcpULP       = 31
+	tlsTX        = 1
+	tls13Version = 0x0304
+
+	tlsCipherAESGCM128        = 51
+	tlsCipherAESGCM256        = 52
+	tlsCipherChaCha20Poly1305 = 54
+)
+
+// tls12_crypto_info_aes_gcm_128, TLS 1.3同样使用; IV的前4字节是salt. 记录序号从0开始
+// tls12_crypto_info_aes_gcm_128, used for TLS 1.3 as well; the first 4 bytes of the IV are the salt.
+// The record sequence number starts at 0
+type kernelTLSInfoAESGCM128 struct {
+	version, cipherType uint16
+	iv                  [8]byte
+	key                 [16]byte
+	salt                [4]byte
+	recSeq              [8]byte
+}
+
+// tls12_crypto_info_aes_gcm_256
+type kernelTLSInfoAESGCM256 struct {
+	version, cipherType uint16
+	iv                  [8]byte
+	key                 [32]byte
+	salt                [4]byte
+	recSeq              [8]byte
+}
+
+// tls12_crypto_info_chacha20_poly1305, 没有salt
+// tls12_crypto_info_chacha20_poly1305, without salt
+type kernelTLSInfoChaCha20Poly1305 struct {
+	version, cipherType uint16
+	iv                  [12]byte
+	key                 [32]byte
+	recSeq              [8]byte
+}
+
+// 按密码套件编码内核的crypto_info
+// encode the crypto_info of the kernel for the cipher suite
+func kernelTLSCryptoInfo(keys *kernelTLSKeys) (unsafe.Pointer, uintptr, error) {
+	switch keys.suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		var info = &kernelTLSInfoAESGCM128{version: tls13Version, cipherType: tlsCipherAESGCM128}
+		copy(info.salt[:], keys.iv[:4])
+		copy(info.iv[:], keys.iv[4:])
+		copy(info.key[:], keys.key)
+		return unsafe.Pointer(info), unsafe.Sizeof(*info), nil
+	case tls.TLS_AES_256_GCM_SHA384:
+		var info = &kernelTLSInfoAESGCM256{version: tls13Version, cipherType: tlsCipherAESGCM256}
+		copy(info.salt[:], keys.iv[:4])
+		copy(info.iv[:], keys.iv[4:])
+		copy(info.key[:], keys.key)
+		return unsafe.Pointer(info), unsafe.Sizeof(*info), nil
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		var info = &kernelTLSInfoChaCha20Poly1305{version: tls13Version, cipherType: tlsCipherChaCha20Poly1305}
+		copy(info.iv[:], keys.iv)
+		copy(info.key[:], keys.key)
+		return unsafe.Pointer(info), unsafe.Sizeof(*info), nil
+	default:
+		return nil, 0, errKernelTLSKeys
+	}
+}
+
+// 在套接字上挂载tls ULP并设置发送方向的密钥. 内核没有tls模块(ENOENT)或者过旧(ENOPROTOOPT)时返回errKernelTLSUnavailable
+// attach the tls ULP to the socket and set the outbound keys. Returns errKernelTLSUnavailable if the kernel has no
+// tls module (ENOENT) or is too old (ENOPROTOOPT)
+func enableKernelTLS(conn *net.TCPConn, keys *kernelTLSKeys) error {
+	info, size, err := kernelTLSCryptoInfo(keys)
+	if err != nil {
+		return err
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if serr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, tcpULP, "tls"); serr != nil {
+			if errors.Is(serr, syscall.ENOENT) || errors.Is(serr, syscall.ENOPROTOOPT) {
+				serr = errKernelTLSUnavailable
+			}
+			return
+		}
+		// crypto_info按原样作为选项值传入, 在所有架构上都可用(386没有单独的setsockopt系统调用)
+		// crypto_info is passed as the raw option value, which works on every architecture (386 has no separate
+		// setsockopt system call)
+		serr = syscall.SetsockoptString(int(fd), solTLS, tlsTX, string(unsafe.Slice((*byte)(info), size)))
+	})
+	if err != nil {
+		return err
+	}
+	if serr == nil || serr == errKernelTLSUnavailable {
+		return serr
+	}
+	return os.NewSyscallError("setsockopt", serr)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gws
+
+import "net"
+
+// 内核TLS只在Linux上可用
+// kernel TLS is only available on Linux
+const kernelTLSSupported = false
+
+func enableKernelTLS(conn *net.TCPConn, keys *kernelTLSKeys) error {
+	return errKernelTLSUnavailable
+}
@@ -0,0 +1,138 @@
+package gws
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.LoadX509KeyPair("examples/wss/cert/server.crt", "examples/wss/cert/server.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// 记录开始之后写入的字节
+type recordingConn struct {
+	net.Conn
+	mu        sync.Mutex
+	recording bool
+	written   []byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.recording {
+		c.written = append(c.written, p...)
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func TestHkdfExpandLabel(t *testing.T) {
+	var as = assert.New(t)
+	// RFC 8448 3: 服务端应用数据的写密钥和IV
+	secret, _ := hex.DecodeString("a11af9f05531f856ad47116b45a950328204b4f44bfb6b3a4b4f1f3fcb631643")
+	keys, err := newKernelTLSKeys(tls.TLS_AES_128_GCM_SHA256, secret)
+	as.NoError(err)
+	as.Equal("9f02283b6c9c07efc26bb9f2ac92e356", hex.EncodeToString(keys.key))
+	as.Equal("cf782b88dd83549aadf1e984", hex.EncodeToString(keys.iv))
+
+	_, err = newKernelTLSKeys(tls.TLS_AES_256_GCM_SHA384, secret)
+	as.ErrorIs(err, errKernelTLSKeys)
+	_, err = newKernelTLSKeys(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, secret)
+	as.ErrorIs(err, errKernelTLSKeys)
+}
+
+// 用导出的密钥解开tls.Conn握手之后写出的第一个记录, 验证密钥和从0开始的序号
+func TestKernelTLSKeys(t *testing.T) {
+	var as = assert.New(t)
+	var serverConn, clientConn = net.Pipe()
+	var recorder = &recordingConn{Conn: serverConn}
+	var keyLog = new(kernelTLSKeyLog)
+	var server = tls.Server(recorder, &tls.Config{
+		Certificates:           []tls.Certificate{loadTestCertificate(t)},
+		KeyLogWriter:           keyLog,
+		SessionTicketsDisabled: true,
+	})
+	var client = tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	defer clientConn.Close()
+	defer serverConn.Close()
+	go func() { _ = client.Handshake() }()
+	as.NoError(server.Handshake())
+
+	var state = server.ConnectionState()
+	keys, err := newKernelTLSKeys(state.CipherSuite, keyLog.secret)
+	as.NoError(err)
+	if state.CipherSuite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		t.Skip("chacha20poly1305 is not in the standard library")
+	}
+
+	recorder.mu.Lock()
+	recorder.recording = true
+	recorder.mu.Unlock()
+	go func() { _, _ = client.Read(make([]byte, 16)) }()
+	_, err = server.Write([]byte("hello"))
+	as.NoError(err)
+
+	recorder.mu.Lock()
+	var record = recorder.written
+	recorder.mu.Unlock()
+	as.Equal(byte(0x17), record[0])
+	var n = int(binary.BigEndian.Uint16(record[3:5]))
+	block, _ := aes.NewCipher(keys.key)
+	aead, _ := cipher.NewGCM(block)
+	plaintext, err := aead.Open(nil, keys.iv, record[5:5+n], record[:5])
+	as.NoError(err)
+	as.Equal("hello\x17", string(plaintext))
+}
+
+func TestServer_KernelTLS(t *testing.T) {
+	var as = assert.New(t)
+	atomic.StoreUint32(&kernelTLSUnavailable, 0)
+	t.Cleanup(func() { atomic.StoreUint32(&kernelTLSUnavailable, 0) })
+
+	var handler = new(webSocketMocker)
+	handler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	var server = NewServer(handler, &ServerOption{KernelTLSEnabled: true})
+	var sockets = make(chan *Conn, 1)
+	server.OnRequest = func(socket *Conn, request *http.Request) {
+		sockets <- socket
+		socket.ReadLoop()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	as.NoError(err)
+	var config = &tls.Config{Certificates: []tls.Certificate{loadTestCertificate(t)}, NextProtos: []string{"http/1.1"}}
+	go server.RunListener(&kernelTLSListener{Listener: listener, config: config, logger: new(levelLogger)})
+
+	var messages = make(chan string, 1)
+	var client = new(webSocketMocker)
+	client.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+	socket, _, err := NewClient(client, &ClientOption{
+		Addr:      "wss://" + listener.Addr().String(),
+		TlsConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+	as.NoError(err)
+	go socket.ReadLoop()
+	as.NoError(socket.WriteString("hello"))
+	as.Equal("hello", <-messages)
+
+	// 内核支持时发送方向已经交给内核, 否则回退到用户态TLS并且之后不再尝试
+	var conn = (<-sockets).NetConn().(*kernelTLSConn)
+	as.True(conn.socket.isOffloaded() || atomic.LoadUint32(&kernelTLSUnavailable) == 1)
+	as.NotNil(tcpConn(conn))
+	socket.WriteClose(1000, nil)
+}
@@ -0,0 +1,128 @@
+package gws
+
+import (
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// RatePolicy 超出读速率限制后的处理策略
+// Handling policy when the read rate limit is exceeded
+type RatePolicy uint8
+
+const (
+	// RatePolicyDelay 延迟读取, 直到令牌足够
+	// Delay reads until enough tokens are available
+	RatePolicyDelay RatePolicy = 0
+
+	// RatePolicyDrop 丢弃超出限制的消息
+	// Drop messages exceeding the limit
+	RatePolicyDrop RatePolicy = 1
+
+	// RatePolicyClose 以1008状态码关闭连接
+	// Close the connection with 1008
+	RatePolicyClose RatePolicy = 2
+)
+
+// 令牌桶, 容量为一秒的配额
+// token bucket, the capacity is one second's quota
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (c *tokenBucket) refill(now time.Time) {
+	c.tokens += now.Sub(c.last).Seconds() * c.rate
+	if c.tokens > c.rate {
+		c.tokens = c.rate
+	}
+	c.last = now
+}
+
+// 检查令牌是否充足, 不扣减
+// 桶满时允许超过容量的请求通过(令牌变为负数), 否则大于一秒配额的消息永远无法通过
+// check whether there are enough tokens without consuming them.
+// A request larger than the capacity is allowed when the bucket is full (tokens go negative),
+// otherwise a message larger than one second's quota could never pass.
+func (c *tokenBucket) enough(n float64, now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	c.refill(now)
+	return c.tokens >= n || c.tokens >= c.rate
+}
+
+func (c *tokenBucket) take(n float64) {
+	if c != nil {
+		c.tokens -= n
+	}
+}
+
+// 预支令牌, 返回需要等待的时间
+// reserve n tokens, return the duration to wait
+func (c *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.refill(now)
+	c.tokens -= n
+	if c.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-c.tokens / c.rate * float64(time.Second))
+}
+
+// 读速率限制器, 只统计数据帧
+// read rate limiter, only data frames are counted
+type readLimiter struct {
+	policy RatePolicy
+	msgs   *tokenBucket
+	bytes  *tokenBucket
+}
+
+func newReadLimiter(config *Config) *readLimiter {
+	if config.ReadMessageRate <= 0 && config.ReadByteRate <= 0 {
+		return nil
+	}
+	return &readLimiter{
+		policy: config.ReadRatePolicy,
+		msgs:   newTokenBucket(config.ReadMessageRate),
+		bytes:  newTokenBucket(config.ReadByteRate),
+	}
+}
+
+// 检查消息是否允许被投递, 返回false表示丢弃; n为消息在线路上的字节数(解压前)
+// check whether the message can be delivered, false means drop it; n is the number of bytes on the wire (before decompression)
+func (c *readLimiter) check(n int) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	var now = time.Now()
+	switch c.policy {
+	case RatePolicyDrop, RatePolicyClose:
+		if c.msgs.enough(1, now) && c.bytes.enough(float64(n), now) {
+			c.msgs.take(1)
+			c.bytes.take(float64(n))
+			return true, nil
+		}
+		if c.policy == RatePolicyDrop {
+			return false, nil
+		}
+		return false, internal.NewError(internal.ClosePolicyViolation, internal.ErrRateLimitExceeded)
+	default:
+		var d1 = c.msgs.reserve(1, now)
+		var d2 = c.bytes.reserve(float64(n), now)
+		if d := internal.SelectValue(d1 > d2, d1, d2); d > 0 {
+			time.Sleep(d)
+		}
+		return true, nil
+	}
+}
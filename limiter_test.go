@@ -0,0 +1,123 @@
+package gws
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("disabled", func(t *testing.T) {
+		var bucket = newTokenBucket(0)
+		as.Nil(bucket)
+		as.True(bucket.enough(100, time.Now()))
+		as.Equal(time.Duration(0), bucket.reserve(100, time.Now()))
+	})
+
+	t.Run("enough", func(t *testing.T) {
+		var now = time.Now()
+		var bucket = newTokenBucket(10)
+		bucket.last = now
+		as.True(bucket.enough(10, now))
+		bucket.take(10)
+		as.False(bucket.enough(1, now))
+		as.True(bucket.enough(5, now.Add(500*time.Millisecond)))
+	})
+
+	t.Run("oversize when full", func(t *testing.T) {
+		var now = time.Now()
+		var bucket = newTokenBucket(10)
+		bucket.last = now
+		as.True(bucket.enough(100, now))
+		bucket.take(100)
+		as.False(bucket.enough(1, now.Add(time.Second)))
+	})
+
+	t.Run("reserve", func(t *testing.T) {
+		var now = time.Now()
+		var bucket = newTokenBucket(10)
+		bucket.last = now
+		as.Equal(time.Duration(0), bucket.reserve(10, now))
+		as.Equal(500*time.Millisecond, bucket.reserve(5, now))
+	})
+}
+
+func TestReadLimiter(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("disabled", func(t *testing.T) {
+		var limiter = newReadLimiter(&Config{})
+		as.Nil(limiter)
+		ok, err := limiter.check(100)
+		as.True(ok)
+		as.NoError(err)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		var limiter = newReadLimiter(&Config{ReadMessageRate: 1, ReadRatePolicy: RatePolicyDrop})
+		ok, err := limiter.check(100)
+		as.True(ok)
+		as.NoError(err)
+		ok, err = limiter.check(100)
+		as.False(ok)
+		as.NoError(err)
+	})
+
+	t.Run("no partial consume", func(t *testing.T) {
+		var limiter = newReadLimiter(&Config{ReadMessageRate: 2, ReadByteRate: 10, ReadRatePolicy: RatePolicyDrop})
+		ok, _ := limiter.check(10)
+		as.True(ok)
+		ok, _ = limiter.check(10)
+		as.False(ok)
+		as.InDelta(1, limiter.msgs.tokens, 0.1)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var limiter = newReadLimiter(&Config{ReadByteRate: 100, ReadRatePolicy: RatePolicyClose})
+		ok, err := limiter.check(100)
+		as.True(ok)
+		as.NoError(err)
+		ok, err = limiter.check(1)
+		as.False(ok)
+		as.ErrorIs(err, internal.ErrRateLimitExceeded)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		var limiter = newReadLimiter(&Config{ReadMessageRate: 20})
+		var t0 = time.Now()
+		for i := 0; i < 22; i++ {
+			ok, err := limiter.check(1)
+			as.True(ok)
+			as.NoError(err)
+		}
+		as.GreaterOrEqual(time.Since(t0), 50*time.Millisecond)
+	})
+}
+
+func TestConn_ReadRateLimit(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{ReadMessageRate: 1, ReadRatePolicy: RatePolicyClose}
+	var clientOption = &ClientOption{}
+
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.ErrorIs(err, internal.ErrRateLimitExceeded)
+		wg.Done()
+	}
+
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	_ = client.WriteString("hello")
+	_ = client.WriteString("world")
+	wg.Wait()
+}
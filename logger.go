@@ -0,0 +1,44 @@
+package gws
+
+import "log"
+
+// Logger 分级日志接口, 用于输出接入错误、握手失败、协议违规、内部panic以及连接关闭后被丢弃的错误
+// Leveled logger interface, used to report accept errors, handshake failures, protocol violations,
+// internal panics and errors dropped after the connection was closed
+type Logger interface {
+	// Debug 调试信息, 例如连接关闭后被丢弃的错误
+	// Debug information, such as errors dropped after the connection was closed
+	Debug(v ...any)
+
+	// Warn 不影响服务的异常, 例如对端的协议违规
+	// Anomalies that do not affect the service, such as protocol violations of the peer
+	Warn(v ...any)
+
+	// Error 需要关注的错误, 例如接入错误和panic
+	// Errors that need attention, such as accept errors and panics
+	Error(v ...any)
+}
+
+// 默认日志, 使用标准库log, 不输出Debug级别
+// the default logger uses the standard library log and drops the Debug level
+type stdLogger struct{}
+
+func (c *stdLogger) Debug(v ...any) {}
+
+func (c *stdLogger) Warn(v ...any) {
+	log.Println(v...)
+}
+
+func (c *stdLogger) Error(v ...any) {
+	log.Println(v...)
+}
+
+var defaultLogger Logger = new(stdLogger)
+
+// 是否需要输出Debug级别. 默认日志丢弃Debug, 此时不必构造参数, 避免大量连接关闭时的内存分配
+// whether the Debug level is wanted. The default logger drops it, so the arguments need not be built,
+// saving allocations when many connections close at once
+func debugEnabled(logger Logger) bool {
+	_, ok := logger.(*stdLogger)
+	return !ok
+}
@@ -0,0 +1,578 @@
+package gws
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// HeaderPollSession 长轮询会话ID的请求头
+// HeaderPollSession is the request header carrying the long-polling session id
+const HeaderPollSession = "Gws-Poll-Session"
+
+const (
+	defaultPollTimeout        = 25 * time.Second
+	defaultPollSessionTimeout = 60 * time.Second
+)
+
+// LongPollOption 长轮询配置
+// Long-polling configuration
+type LongPollOption struct {
+	// 一次轮询在没有数据时等待的最长时间, 默认25秒; 客户端使用同样的值
+	// How long a poll waits for data before returning empty, 25s by default. Clients have to use the same value
+	PollTimeout time.Duration
+
+	// 超过该时间没有轮询的会话被关闭, 默认60秒
+	// Sessions that have not polled for this long are closed, 60s by default
+	SessionTimeout time.Duration
+
+	// 等待客户端取走的出站数据上限(字节), 超过后会话以1008关闭; 默认为WriteMaxPayloadSize加一个帧头, 至少容纳一条消息
+	// Cap in bytes on outbound data waiting for the client to fetch it, above it the session is closed with 1008.
+	// Defaults to WriteMaxPayloadSize plus a frame header, so that at least one message fits
+	MaxPendingBytes int
+}
+
+func (c *LongPollOption) init() *LongPollOption {
+	var option = LongPollOption{}
+	if c != nil {
+		option = *c
+	}
+	if option.PollTimeout <= 0 {
+		option.PollTimeout = defaultPollTimeout
+	}
+	if option.SessionTimeout <= 0 {
+		option.SessionTimeout = defaultPollSessionTimeout
+	}
+	return &option
+}
+
+// 用HTTP请求模拟的连接的公共部分: 入站数据的缓冲区, 读超时和关闭状态.
+// 长轮询的连接上传输的仍然是websocket帧, 因此可以直接交给serveWebSocket
+// the common part of connections emulated over HTTP requests: the inbound buffer, the read deadline and the closed
+// state. Long-polling connections still carry websocket frames, so they are handed to serveWebSocket as they are
+type pollPipe struct {
+	mu           sync.Mutex
+	in           []byte
+	inClosed     bool
+	readDeadline time.Time
+	readable     chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+	remoteAddr   net.Addr
+}
+
+func newPollPipe(remoteAddr string) pollPipe {
+	return pollPipe{readable: make(chan struct{}, 1), done: make(chan struct{}), remoteAddr: pollAddr(remoteAddr)}
+}
+
+func (c *pollPipe) wake() {
+	select {
+	case c.readable <- struct{}{}:
+	default:
+	}
+}
+
+// 追加入站数据
+// append inbound data
+func (c *pollPipe) feed(p []byte) {
+	c.mu.Lock()
+	c.in = append(c.in, p...)
+	c.mu.Unlock()
+	c.wake()
+}
+
+// 对端不会再发送数据, 读完缓冲区后Read返回io.EOF
+// the peer sends nothing more, Read returns io.EOF once the buffer is drained
+func (c *pollPipe) closeInbound() {
+	c.mu.Lock()
+	c.inClosed = true
+	c.mu.Unlock()
+	c.wake()
+}
+
+func (c *pollPipe) Read(p []byte) (int, error) {
+	// 计时器只创建一次, 被唤醒后按新的读超时重置
+	// the timer is created once and reset to the new deadline after each wakeup
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		c.mu.Lock()
+		if len(c.in) > 0 {
+			var n = copy(p, c.in)
+			c.in = c.in[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		var inClosed, deadline = c.inClosed, c.readDeadline
+		c.mu.Unlock()
+		if inClosed {
+			return 0, io.EOF
+		}
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			var d = time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			if timer == nil {
+				timer = time.NewTimer(d)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(d)
+			}
+			timeout = timer.C
+		}
+		select {
+		case <-c.readable:
+		case <-c.done:
+			return 0, net.ErrClosed
+		case <-timeout:
+		}
+	}
+}
+
+func (c *pollPipe) closePipe() bool {
+	var closed = false
+	c.closeOnce.Do(func() {
+		close(c.done)
+		closed = true
+	})
+	return closed
+}
+
+func (c *pollPipe) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *pollPipe) LocalAddr() net.Addr { return pollAddr("") }
+
+func (c *pollPipe) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *pollPipe) SetDeadline(t time.Time) error { return c.SetReadDeadline(t) }
+
+// 设置读超时, 唤醒阻塞的Read重新计算
+// set the read deadline, waking a blocked Read to recompute it
+func (c *pollPipe) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.wake()
+	return nil
+}
+
+// 写入不会阻塞在网络上, 写超时没有意义
+// writes never block on the network, a write deadline is meaningless
+func (c *pollPipe) SetWriteDeadline(t time.Time) error { return nil }
+
+type pollAddr string
+
+func (c pollAddr) Network() string { return "longpoll" }
+
+func (c pollAddr) String() string { return string(c) }
+
+// 服务端的长轮询连接: 客户端POST的数据进入入站缓冲区, 写出的数据等待客户端GET取走
+// server side long-polling connection: data POSTed by the client enters the inbound buffer,
+// data written waits for the client to GET it
+type pollServerConn struct {
+	pollPipe
+	out      []byte
+	limit    int
+	writable chan struct{}
+	expiry   *time.Timer
+}
+
+// 客户端取走数据太慢时, 丢弃积压的数据, 只留下1008关闭帧, 然后关闭连接; 连接上的写入随之以ErrPollBacklog失败
+// when the client fetches too slowly, the backlog is dropped for a 1008 close frame and the connection is closed.
+// The write on the connection then fails with ErrPollBacklog
+func (c *pollServerConn) Write(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	c.mu.Lock()
+	if len(c.out)+len(p) > c.limit {
+		c.out = newPollCloseFrame(internal.ClosePolicyViolation, internal.ErrPollBacklog)
+		c.mu.Unlock()
+		c.closePipe()
+		c.notify()
+		return 0, internal.ErrPollBacklog
+	}
+	c.out = append(c.out, p...)
+	c.mu.Unlock()
+	c.notify()
+	return len(p), nil
+}
+
+// 唤醒等待数据的轮询
+// wake the poll waiting for data
+func (c *pollServerConn) notify() {
+	select {
+	case c.writable <- struct{}{}:
+	default:
+	}
+}
+
+// 编码服务端的关闭帧
+// encode a close frame of the server
+func newPollCloseFrame(code internal.StatusCode, err error) []byte {
+	var payload = append([]byte{byte(code >> 8), byte(code)}, err.Error()...)
+	var header = frameHeader{}
+	var n, _ = header.GenerateHeader(true, true, false, OpcodeCloseConnection, len(payload))
+	return append(header[:n:n], payload...)
+}
+
+// 取走待发送的数据, 没有数据时最多等待timeout; 连接关闭后仍然先交出剩余的数据
+// take the pending outbound data, waiting up to timeout if there is none. Data left after close is handed out first
+func (c *pollServerConn) take(ctx context.Context, timeout time.Duration) []byte {
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		if len(c.out) > 0 {
+			var p = c.out
+			c.out = nil
+			c.mu.Unlock()
+			return p
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.writable:
+		case <-c.done:
+			return nil
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *pollServerConn) Close() error {
+	c.closePipe()
+	return nil
+}
+
+// LongPollHandler 长轮询回退端点, 为无法建立websocket的客户端用HTTP长轮询模拟连接.
+// 连接上运行的仍然是websocket帧和同样的Event, 应用代码不需要区分; 同一路径上的websocket握手会被直接升级
+// LongPollHandler is the long-polling fallback endpoint, emulating connections over HTTP long polling for clients
+// that cannot establish a websocket. The connection still runs websocket frames and the same Event, application code
+// does not tell the difference. Websocket handshakes on the same path are upgraded directly
+//
+// Example:
+//
+//	var upgrader = gws.NewUpgrader(handler, nil)
+//	http.Handle("/ws", gws.NewLongPollHandler(upgrader, nil))
+//
+//	// client
+//	socket, _, err := gws.NewClientWithFallback(handler, &gws.ClientOption{Addr: "ws://127.0.0.1/ws"})
+type LongPollHandler struct {
+	upgrader *Upgrader
+	option   *LongPollOption
+	mu       sync.Mutex
+	sessions map[string]*pollServerConn
+}
+
+// NewLongPollHandler 创建长轮询端点, 使用upgrader的事件处理器和配置; option可以为nil
+// NewLongPollHandler creates the long-polling endpoint with the event handler and options of upgrader.
+// option may be nil
+func NewLongPollHandler(upgrader *Upgrader, option *LongPollOption) *LongPollHandler {
+	return &LongPollHandler{upgrader: upgrader, option: option.init(), sessions: make(map[string]*pollServerConn)}
+}
+
+// Len 长轮询会话数量
+// Len returns the number of long-polling sessions
+func (c *LongPollHandler) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions)
+}
+
+func (c *LongPollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get(internal.Upgrade.Key), internal.Upgrade.Val) {
+		if socket, err := c.upgrader.Upgrade(w, r); err == nil {
+			socket.ReadLoop()
+		}
+		return
+	}
+
+	var id = r.Header.Get(HeaderPollSession)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		c.open(w, r)
+		return
+	}
+
+	c.mu.Lock()
+	var conn = c.sessions[id]
+	c.mu.Unlock()
+	if conn == nil {
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		conn.expiry.Reset(c.option.SessionTimeout)
+		var p = conn.take(r.Context(), c.option.PollTimeout)
+		conn.expiry.Reset(c.option.SessionTimeout)
+		switch {
+		case len(p) > 0:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(p)
+		case conn.isClosed():
+			conn.expiry.Stop()
+			c.remove(id)
+			http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case http.MethodPost:
+		var limit = int64(c.upgrader.option.ReadMaxPayloadSize) + frameHeaderSize
+		p, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil || int64(len(p)) > limit {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		conn.feed(p)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		// 客户端已经离开, 不再需要保留未取走的数据
+		// the client is gone, pending outbound data is no longer needed
+		conn.expiry.Stop()
+		conn.closeInbound()
+		c.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// 打开会话, 与握手一样经过Authorize, 成功后在新协程中运行ReadLoop
+// open a session, going through Authorize like a handshake, then run ReadLoop on a new goroutine
+func (c *LongPollHandler) open(w http.ResponseWriter, r *http.Request) {
+	var option = c.upgrader.option
+	if option.config.memory.exceeded() {
+		atomic.AddUint64(&option.config.serverStats.handshakeErrors, 1)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	var session = new(sliceMap)
+	if !option.Authorize(r, session) {
+		atomic.AddUint64(&option.config.serverStats.handshakeErrors, 1)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var id = newPollSessionID()
+	var limit = internal.SelectValue(c.option.MaxPendingBytes > 0, c.option.MaxPendingBytes, option.WriteMaxPayloadSize+frameHeaderSize)
+	var conn = &pollServerConn{pollPipe: newPollPipe(r.RemoteAddr), limit: limit, writable: make(chan struct{}, 1)}
+	conn.expiry = time.AfterFunc(c.option.SessionTimeout, func() {
+		_ = conn.Close()
+		conn.closeInbound()
+		c.remove(id)
+	})
+	c.mu.Lock()
+	c.sessions[id] = conn
+	c.mu.Unlock()
+
+	var socket = serveWebSocket(true, option.getConfig(), session, conn, newStreamReader(conn, option.ReadBufferSize), c.upgrader.eventHandler, false)
+	if option.ConnMap != nil {
+		socket.registry = option.ConnMap
+		socket.registry.Add(socket)
+	}
+	atomic.AddUint64(&option.config.serverStats.accepted, 1)
+
+	w.Header().Set(HeaderPollSession, id)
+	w.WriteHeader(http.StatusOK)
+	go socket.ReadLoop()
+}
+
+// 会话ID来自crypto/rand, 持有ID即可收发会话的数据, 所以不能被猜到
+// session ids come from crypto/rand. Holding the id is enough to use the session, so it must not be guessable
+func newPollSessionID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (c *LongPollHandler) remove(id string) {
+	c.mu.Lock()
+	delete(c.sessions, id)
+	c.mu.Unlock()
+}
+
+// 客户端的长轮询连接: 写入的数据按顺序POST给服务端, 后台协程不断GET取回入站数据
+// client side long-polling connection: written data is POSTed to the server in order,
+// a background goroutine keeps GETting the inbound data
+type pollClientConn struct {
+	pollPipe
+	client  *http.Client
+	url     string
+	id      string
+	writeMu sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func (c *pollClientConn) newRequest(ctx context.Context, method string, body []byte) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set(HeaderPollSession, c.id)
+	return r, nil
+}
+
+func (c *pollClientConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	r, err := c.newRequest(c.ctx, http.MethodPost, p)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, internal.ErrStatusCode
+	}
+	return len(p), nil
+}
+
+// 轮询入站数据, 会话结束或者出错时结束入站
+// poll inbound data, ending the inbound side once the session is gone or on error
+func (c *pollClientConn) pollLoop() {
+	defer c.closeInbound()
+	for !c.isClosed() {
+		r, err := c.newRequest(c.ctx, http.MethodGet, nil)
+		if err != nil {
+			return
+		}
+		resp, err := c.client.Do(r)
+		if err != nil {
+			return
+		}
+		p, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		switch {
+		case err != nil:
+			return
+		case resp.StatusCode == http.StatusOK:
+			c.feed(p)
+		case resp.StatusCode != http.StatusNoContent:
+			return
+		}
+	}
+}
+
+// 关闭时通知服务端结束会话
+// tell the server to end the session on close
+func (c *pollClientConn) Close() error {
+	if !c.closePipe() {
+		return nil
+	}
+	c.cancel()
+	var ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r, err := c.newRequest(ctx, http.MethodDelete, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// NewLongPollClient 通过长轮询连接LongPollHandler, Addr使用ws/wss或者http/https地址均可; 返回的连接需要调用ReadLoop.
+// 压缩和扩展不可用
+// NewLongPollClient connects to a LongPollHandler over long polling, Addr may use ws/wss or http/https.
+// Call ReadLoop on the returned connection. Compression and extensions are not available
+func NewLongPollClient(handler Event, option *ClientOption) (*Conn, *http.Response, error) {
+	option = initClientOption(option)
+	URL, err := url.Parse(option.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch URL.Scheme {
+	case "ws", "http":
+		URL.Scheme = "http"
+	case "wss", "https":
+		URL.Scheme = "https"
+	default:
+		return nil, nil, internal.ErrSchema
+	}
+
+	var client = &http.Client{Transport: &http.Transport{TLSClientConfig: option.TlsConfig}}
+	r, err := http.NewRequest(http.MethodPost, URL.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Header = option.RequestHeader.Clone()
+	var ctx, cancel = context.WithTimeout(context.Background(), option.HandshakeTimeout)
+	defer cancel()
+	resp, err := client.Do(r.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = resp.Body.Close()
+	var id = resp.Header.Get(HeaderPollSession)
+	if resp.StatusCode != http.StatusOK || id == "" {
+		return nil, resp, internal.ErrStatusCode
+	}
+
+	var conn = &pollClientConn{pollPipe: newPollPipe(URL.Host), client: client, url: URL.String(), id: id}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+	go conn.pollLoop()
+	return serveWebSocket(false, option.getConfig(), new(sliceMap), conn, newStreamReader(conn, option.ReadBufferSize), handler, false), resp, nil
+}
+
+// NewClientWithFallback 先尝试建立websocket连接, 失败时回退到长轮询, 服务端需要使用LongPollHandler.
+// 两者都失败时返回长轮询的错误. 回退后的连接在整个生命周期内保持长轮询, 不会在之后透明地升级为websocket;
+// 需要重新尝试websocket时关闭连接, 再次调用NewClientWithFallback
+// NewClientWithFallback tries a websocket connection first and falls back to long polling if it fails,
+// the server has to use a LongPollHandler. If both fail the long-polling error is returned.
+// A connection that fell back stays on long polling for its whole lifetime, it is not transparently upgraded
+// to a websocket later. To try a websocket again, close the connection and call NewClientWithFallback again
+func NewClientWithFallback(handler Event, option *ClientOption) (*Conn, *http.Response, error) {
+	option = initClientOption(option)
+	if socket, resp, err := NewClient(handler, option); err == nil {
+		return socket, resp, nil
+	}
+	return NewLongPollClient(handler, option)
+}
@@ -0,0 +1,188 @@
+package gws
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 连接建立后立即写出超过积压上限的数据
+type pollFlooder struct {
+	BuiltinEventHandler
+	closed chan error
+}
+
+func (c *pollFlooder) OnOpen(socket *Conn) {
+	for i := 0; i < 4; i++ {
+		if socket.WriteMessage(OpcodeBinary, make([]byte, 100)) != nil {
+			return
+		}
+	}
+}
+
+func (c *pollFlooder) OnClose(socket *Conn, err error) { c.closed <- err }
+
+func newLongPollServer(t *testing.T, option *LongPollOption) (*LongPollHandler, string) {
+	var server = new(webSocketMocker)
+	server.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	var handler = NewLongPollHandler(NewUpgrader(server, nil), option)
+	var srv = httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return handler, "ws://" + strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestLongPoll(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("echo", func(t *testing.T) {
+		var handler, addr = newLongPollServer(t, &LongPollOption{PollTimeout: 50 * time.Millisecond})
+		var messages = make(chan string, 4)
+		var closed = make(chan error, 1)
+		var client = new(webSocketMocker)
+		client.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		client.onClose = func(socket *Conn, err error) { closed <- err }
+		socket, _, err := NewLongPollClient(client, &ClientOption{Addr: addr})
+		as.NoError(err)
+		go socket.ReadLoop()
+		as.Equal(1, handler.Len())
+
+		as.NoError(socket.WriteString("hello"))
+		as.NoError(socket.WriteString("world"))
+		as.Equal("hello", <-messages)
+		as.Equal("world", <-messages)
+
+		// 超过一次轮询的空闲后仍然可以收发
+		time.Sleep(120 * time.Millisecond)
+		as.NoError(socket.WriteString("again"))
+		as.Equal("again", <-messages)
+
+		socket.WriteClose(1000, nil)
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+		as.Eventually(func() bool { return handler.Len() == 0 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		var handler, addr = newLongPollServer(t, nil)
+		var messages = make(chan string, 1)
+		var client = new(webSocketMocker)
+		client.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		socket, _, err := NewClientWithFallback(client, &ClientOption{Addr: addr})
+		as.NoError(err)
+		go socket.ReadLoop()
+		as.NoError(socket.WriteString("hello"))
+		as.Equal("hello", <-messages)
+		as.Equal(0, handler.Len())
+		socket.WriteClose(1000, nil)
+	})
+
+	// 不支持websocket的中间设备拒绝握手时回退到长轮询
+	t.Run("fallback", func(t *testing.T) {
+		var handler = NewLongPollHandler(NewUpgrader(new(BuiltinEventHandler), nil), nil)
+		var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		socket, _, err := NewClientWithFallback(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + strings.TrimPrefix(srv.URL, "http://")})
+		as.NoError(err)
+		as.Equal("longpoll", socket.RemoteAddr().Network())
+		as.Equal(1, handler.Len())
+		socket.WriteClose(1000, nil)
+	})
+
+	t.Run("session", func(t *testing.T) {
+		var handler, addr = newLongPollServer(t, &LongPollOption{PollTimeout: 10 * time.Millisecond, SessionTimeout: 5 * time.Second})
+		var srvURL = "http" + strings.TrimPrefix(addr, "ws")
+
+		resp, err := http.Get(srvURL)
+		as.NoError(err)
+		as.Equal(http.StatusBadRequest, resp.StatusCode)
+
+		r, _ := http.NewRequest(http.MethodGet, srvURL, nil)
+		r.Header.Set(HeaderPollSession, "unknown")
+		resp, err = http.DefaultClient.Do(r)
+		as.NoError(err)
+		as.Equal(http.StatusGone, resp.StatusCode)
+
+		resp, err = http.Post(srvURL, "", nil)
+		as.NoError(err)
+		var id = resp.Header.Get(HeaderPollSession)
+		as.Len(id, 32)
+		_, err = hex.DecodeString(id)
+		as.NoError(err)
+		as.Equal(1, handler.Len())
+	})
+
+	// 客户端不取数据时, 积压超过上限的会话以1008关闭, 客户端取到关闭帧
+	t.Run("backlog", func(t *testing.T) {
+		var flooder = &pollFlooder{closed: make(chan error, 1)}
+		var handler = NewLongPollHandler(NewUpgrader(flooder, nil), &LongPollOption{PollTimeout: 10 * time.Millisecond, MaxPendingBytes: 256})
+		var srv = httptest.NewServer(handler)
+		defer srv.Close()
+
+		resp, err := http.Post(srv.URL, "", nil)
+		as.NoError(err)
+		var id = resp.Header.Get(HeaderPollSession)
+		select {
+		case err := <-flooder.closed:
+			as.ErrorIs(err, internal.ErrPollBacklog)
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+
+		var poll = func() *http.Response {
+			r, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			r.Header.Set(HeaderPollSession, id)
+			resp, err := http.DefaultClient.Do(r)
+			as.NoError(err)
+			return resp
+		}
+		resp = poll()
+		as.Equal(http.StatusOK, resp.StatusCode)
+		p, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		as.Equal(newPollCloseFrame(internal.ClosePolicyViolation, internal.ErrPollBacklog), p)
+		as.Equal(http.StatusGone, poll().StatusCode)
+		as.Equal(0, handler.Len())
+	})
+
+	// 阻塞的Read按重新设置的读超时返回
+	t.Run("read deadline", func(t *testing.T) {
+		var pipe = newPollPipe("")
+		_ = pipe.SetReadDeadline(time.Now().Add(time.Hour))
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			_ = pipe.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		}()
+		var start = time.Now()
+		_, err := pipe.Read(make([]byte, 8))
+		as.ErrorIs(err, os.ErrDeadlineExceeded)
+		as.Less(time.Since(start), time.Second)
+	})
+
+	// 不再轮询的会话过期
+	t.Run("expiry", func(t *testing.T) {
+		var handler, addr = newLongPollServer(t, &LongPollOption{PollTimeout: 10 * time.Millisecond, SessionTimeout: 30 * time.Millisecond})
+		resp, err := http.Post("http"+strings.TrimPrefix(addr, "ws"), "", nil)
+		as.NoError(err)
+		as.NotEmpty(resp.Header.Get(HeaderPollSession))
+		as.Eventually(func() bool { return handler.Len() == 0 }, time.Second, time.Millisecond)
+	})
+}
@@ -0,0 +1,86 @@
+package gws
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 服务端读缓冲区, 写队列和异步读队列占用的近似内存, 只在设置了MemoryWatermark时统计
+// approximate memory held by the read buffers, write queues and async read queues of a server,
+// only tracked when MemoryWatermark is set
+type memoryCounter struct {
+	used      int64
+	watermark int64
+}
+
+func newMemoryCounter(watermark int) *memoryCounter {
+	return &memoryCounter{watermark: int64(watermark)}
+}
+
+func (c *memoryCounter) add(n int) {
+	atomic.AddInt64(&c.used, int64(n))
+}
+
+func (c *memoryCounter) load() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.used)
+}
+
+// 是否超过水位线
+// whether the watermark is exceeded
+func (c *memoryCounter) exceeded() bool {
+	return c != nil && atomic.LoadInt64(&c.used) >= c.watermark
+}
+
+// 写队列中新增或者发出了n字节; 超过水位线时关闭积压超过MemorySlowConsumerBytes的连接
+// n bytes were queued for writing, or written if negative. Above the watermark a connection whose backlog
+// exceeds MemorySlowConsumerBytes is shed
+func (c *Conn) chargeWriteQueue(n int) {
+	var m = c.config.memory
+	if m == nil {
+		return
+	}
+	m.add(n)
+	var queued = atomic.AddInt64(&c.queuedBytes, int64(n))
+	if n > 0 && c.config.MemorySlowConsumerBytes > 0 && queued > int64(c.config.MemorySlowConsumerBytes) && m.exceeded() && !c.isClosed() {
+		c.config.Logger.Warn("gws: shedding slow consumer", c.RemoteAddr().String()+":", queued, "bytes queued")
+		// 写超时立即生效, 关闭帧不会阻塞在写满的连接上
+		// expire writes at once so that the close frame does not block on a saturated connection
+		_ = c.conn.SetWriteDeadline(time.Now())
+		c.emitError(internal.NewError(internal.CloseTryAgainLater, internal.ErrMemoryWatermark))
+	}
+}
+
+// 异步读队列中新增或者处理完了n字节
+// n bytes were queued for OnMessage, or dispatched if negative
+func (c *Conn) chargeReadQueue(n int) {
+	if c.config.memory != nil {
+		c.config.memory.add(n)
+	}
+}
+
+// 连接持有了读缓冲区
+// the connection took a read buffer
+func (c *Conn) chargeReadBuffer() {
+	if c.config.memory == nil || !atomic.CompareAndSwapInt32(&c.readCharged, 0, 1) {
+		return
+	}
+	c.config.memory.add(c.config.ReadBufferSize)
+	// 与连接关闭竞争时, 由先看到计数的一方扣除
+	// racing with close, whichever side sees the charge takes it back
+	if c.isClosed() {
+		c.dischargeReadBuffer()
+	}
+}
+
+// 连接归还了读缓冲区或者已经关闭
+// the connection gave its read buffer back or was closed
+func (c *Conn) dischargeReadBuffer() {
+	if c.config.memory != nil && atomic.CompareAndSwapInt32(&c.readCharged, 1, 0) {
+		c.config.memory.add(-c.config.ReadBufferSize)
+	}
+}
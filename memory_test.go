@@ -0,0 +1,149 @@
+package gws
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryWatermark(t *testing.T) {
+	var as = assert.New(t)
+
+	// 统计读缓冲区和写队列
+	t.Run("accounting", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var received = make(chan struct{}, 8)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- struct{}{} }
+		var serverOption = &ServerOption{MemoryWatermark: 1 << 30}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+		var memory = server.config.memory
+		as.Equal(int64(server.config.ReadBufferSize), memory.load())
+		as.Nil(client.config.memory)
+
+		// 对端不读取, 第一条消息阻塞在写入中, 其余的在队列中
+		var payload = internal.AlphabetNumeric.Generate(1000)
+		for i := 0; i < 3; i++ {
+			as.NoError(server.WriteAsync(OpcodeBinary, payload))
+		}
+		as.Eventually(func() bool {
+			return memory.load() == int64(server.config.ReadBufferSize+2*(len(payload)+4))
+		}, time.Second, time.Millisecond)
+
+		go client.ReadLoop()
+		for i := 0; i < 3; i++ {
+			<-received
+		}
+		as.Equal(int64(server.config.ReadBufferSize), memory.load())
+
+		// 关闭后释放读缓冲区
+		go server.ReadLoop()
+		client.WriteClose(1000, nil)
+		as.Eventually(func() bool { return memory.load() == 0 }, time.Second, time.Millisecond)
+	})
+
+	// 归还读缓冲区后不再计入
+	t.Run("read buffer release", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var received = make(chan struct{}, 1)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { received <- struct{}{} }
+		var serverOption = &ServerOption{MemoryWatermark: 1 << 30, ReadBufferReleaseEnabled: true}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(client.WriteString("hello"))
+		<-received
+		as.Eventually(func() bool { return server.config.memory.load() == 0 }, time.Second, time.Millisecond)
+		client.WriteClose(1000, nil)
+	})
+
+	// 超过水位线时关闭慢消费者
+	t.Run("shed slow consumer", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var closed = make(chan error, 1)
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		var serverOption = &ServerOption{MemoryWatermark: 1, MemorySlowConsumerBytes: 1000, Logger: new(levelLogger)}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+
+		var payload = internal.AlphabetNumeric.Generate(600)
+		for i := 0; i < 4; i++ {
+			_ = server.WriteAsync(OpcodeBinary, payload)
+		}
+		select {
+		case err := <-closed:
+			var closeErr *CloseError
+			as.True(errors.As(err, &closeErr))
+			as.Equal(internal.CloseTryAgainLater.Uint16(), closeErr.Code)
+			as.ErrorIs(err, ErrMemoryWatermark)
+		case <-time.After(time.Second):
+			as.Fail("slow consumer not shed")
+		}
+		as.Eventually(func() bool { return server.config.memory.load() == 0 }, time.Second, time.Millisecond)
+		_ = client.NetConn().Close()
+	})
+
+	// 超过水位线时拒绝新的握手, 就绪探针返回503
+	t.Run("reject upgrades", func(t *testing.T) {
+		var statuses = make(chan int, 1)
+		var server = NewServer(new(BuiltinEventHandler), &ServerOption{MemoryWatermark: 1 << 20, Logger: new(levelLogger)})
+		server.ReadyPath = "/readyz"
+		server.OnHandshakeFailed = func(r *http.Request, err error, status int) {
+			as.ErrorIs(err, ErrMemoryWatermark)
+			statuses <- status
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if !as.NoError(err) {
+			return
+		}
+		go server.RunListener(listener)
+		var addr = listener.Addr().String()
+
+		var memory = server.upgrader.option.config.memory
+		memory.add(1 << 20)
+		as.Equal(int64(1<<20), server.Stats().Memory)
+
+		_, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr})
+		as.Error(err)
+		if as.NotNil(resp) {
+			as.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		as.Equal(http.StatusServiceUnavailable, <-statuses)
+
+		probe, err := http.Get("http://" + addr + "/readyz")
+		if as.NoError(err) {
+			var buf = bytes.NewBuffer(nil)
+			_, _ = buf.ReadFrom(probe.Body)
+			_ = probe.Body.Close()
+			as.Equal(http.StatusServiceUnavailable, probe.StatusCode)
+			as.Equal("overloaded\n", buf.String())
+		}
+
+		// 回落到水位线以下后恢复
+		memory.add(-1)
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr})
+		if as.NoError(err) {
+			client.WriteClose(1000, nil)
+		}
+	})
+
+	t.Run("upgrader", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{MemoryWatermark: 1})
+		upgrader.option.config.memory.add(1)
+		var recorder = httptest.NewRecorder()
+		var request = httptest.NewRequest(http.MethodGet, "/", nil)
+		_, err := upgrader.Upgrade(recorder, request)
+		as.ErrorIs(err, ErrMemoryWatermark)
+		as.Equal(http.StatusServiceUnavailable, recorder.Code)
+
+		// 没有设置水位线时不统计
+		as.Nil(NewUpgrader(new(BuiltinEventHandler), nil).option.config.memory)
+	})
+}
@@ -0,0 +1,307 @@
+// Package metrics 为gws提供可选的Prometheus指标采集, 是独立的模块, gws本身不依赖Prometheus客户端库
+// Package metrics provides optional Prometheus metrics for gws. It is a separate module,
+// so gws itself does not depend on the Prometheus client library
+package metrics
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector 指标采集器, 实现prometheus.Collector, 通过Wrap, OnFrame和OnHandshakeError接入gws
+// 同一个实例可以被多个Upgrader和客户端共享
+// Collector implements prometheus.Collector and is wired into gws via Wrap, OnFrame and OnHandshakeError.
+// One instance can be shared by many upgraders and clients.
+// 内存池指标需要先调用gws.SetBufferPoolStatsEnabled, 否则都为0
+// The buffer pool metrics stay zero unless gws.SetBufferPoolStatsEnabled is called
+//
+// Example:
+//
+//	gws.SetBufferPoolStatsEnabled(true)
+//	var collector = metrics.New("gws")
+//	var upgrader = gws.NewUpgrader(collector.Wrap(handler), &gws.ServerOption{FrameObserver: collector})
+//	collector.AddCompressionStats(upgrader.CompressionStats)
+//	prometheus.MustRegister(collector)
+//	http.Handle("/metrics", promhttp.Handler())
+type Collector struct {
+	opened            uint64
+	closed            uint64
+	handshakeFailures uint64
+	messagesIn        uint64
+	messagesOut       uint64
+	bytesIn           uint64
+	bytesOut          uint64
+
+	// 活跃连接, 用于统计写队列深度
+	// active connections, used to sum the write queue depth
+	conns sync.Map
+
+	// 写队列延迟, 见gws.FrameInfo.QueueDelay
+	// write queue delay, see gws.FrameInfo.QueueDelay
+	queueDelay *histogram
+
+	mu         sync.Mutex
+	closeCodes map[uint16]uint64
+	stats      []func() gws.CompressionStats
+
+	descs descs
+}
+
+// 指标描述
+// metric descriptions
+type descs struct {
+	opened, closed, active, handshakeFailures                *prometheus.Desc
+	messagesIn, messagesOut, bytesIn, bytesOut               *prometheus.Desc
+	queueDepth, queueDelay                                   *prometheus.Desc
+	compressionIn, compressionOut, compressionSaved, skipped *prometheus.Desc
+	poolGets, poolMisses, poolDiscards, poolRetained         *prometheus.Desc
+	closeCodes                                               *prometheus.Desc
+}
+
+// New 创建指标采集器, namespace是指标名的前缀, 为空时使用gws
+// New creates a collector, namespace prefixes the metric names and defaults to gws
+func New(namespace string) *Collector {
+	if namespace == "" {
+		namespace = "gws"
+	}
+	var desc = func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+	}
+	return &Collector{
+		queueDelay: newHistogram(queueDelayBuckets),
+		closeCodes: make(map[uint16]uint64),
+		descs: descs{
+			opened:            desc("connections_opened_total", "Number of opened connections."),
+			closed:            desc("connections_closed_total", "Number of closed connections."),
+			active:            desc("connections_active", "Number of active connections."),
+			handshakeFailures: desc("handshake_failures_total", "Number of failed handshakes."),
+			messagesIn:        desc("messages_received_total", "Number of received data messages."),
+			messagesOut:       desc("messages_sent_total", "Number of sent data messages."),
+			bytesIn:           desc("bytes_received_total", "Payload bytes received on the wire."),
+			bytesOut:          desc("bytes_sent_total", "Payload bytes sent on the wire."),
+			queueDepth:        desc("write_queue_depth", "Messages waiting in the write queues of active connections."),
+			queueDelay:        desc("write_queue_delay_seconds", "Time from WriteAsync or Broadcast until the frame is written."),
+			compressionIn:     desc("compression_bytes_in_total", "Bytes before compression."),
+			compressionOut:    desc("compression_bytes_out_total", "Bytes after compression."),
+			compressionSaved:  desc("compression_saved_bytes_total", "Bytes saved by compression."),
+			skipped:           desc("compression_skipped_total", "Messages that skipped compression."),
+			poolGets:          desc("buffer_pool_gets_total", "Buffers taken from the buffer pool."),
+			poolMisses:        desc("buffer_pool_misses_total", "Buffers allocated because the buffer pool was empty."),
+			poolDiscards:      desc("buffer_pool_discards_total", "Buffers too large to be returned to the buffer pool."),
+			poolRetained:      desc("buffer_pool_retained_bytes", "Bytes of buffers taken from the buffer pool and not yet returned."),
+			closeCodes:        desc("close_codes_total", "Number of closed connections by close code.", "code"),
+		},
+	}
+}
+
+// Wrap 包装事件处理器, 统计连接的建立和关闭以及关闭码分布
+// Wrap wraps an event handler to count opened and closed connections and the distribution of close codes
+func (c *Collector) Wrap(handler gws.Event) gws.Event {
+	return &eventHandler{Event: handler, collector: c}
+}
+
+// OnFrame 实现gws.FrameObserver, 统计消息数, 字节数和写队列延迟; 字节数是线路上的载荷长度, 即压缩后的长度
+// OnFrame implements gws.FrameObserver and counts messages, bytes and the write queue delay.
+// Bytes are payload lengths on the wire, i.e. after compression
+func (c *Collector) OnFrame(socket *gws.Conn, frame gws.FrameInfo) {
+	var isMessage = frame.Fin && (frame.Opcode == gws.OpcodeText || frame.Opcode == gws.OpcodeBinary || frame.Opcode == gws.OpcodeContinuation)
+	if frame.Direction == gws.FrameInbound {
+		atomic.AddUint64(&c.bytesIn, uint64(frame.PayloadLength))
+		if isMessage {
+			atomic.AddUint64(&c.messagesIn, 1)
+		}
+		return
+	}
+	atomic.AddUint64(&c.bytesOut, uint64(frame.PayloadLength))
+	if isMessage {
+		atomic.AddUint64(&c.messagesOut, 1)
+	}
+	if frame.QueueDelay > 0 {
+		c.queueDelay.observe(frame.QueueDelay)
+	}
+}
+
+// OnHandshakeError 统计握手失败, 签名与gws.Server.OnError一致, 也可以在Upgrader.Upgrade返回错误时调用
+// OnHandshakeError counts failed handshakes. It matches gws.Server.OnError
+// and can also be called when Upgrader.Upgrade returns an error
+func (c *Collector) OnHandshakeError(conn net.Conn, err error) {
+	atomic.AddUint64(&c.handshakeFailures, 1)
+}
+
+// AddCompressionStats 添加压缩统计的来源, 例如Upgrader.CompressionStats, 采集时累加
+// AddCompressionStats adds a source of compression statistics such as Upgrader.CompressionStats,
+// the sources are summed up on collection
+func (c *Collector) AddCompressionStats(f func() gws.CompressionStats) {
+	c.mu.Lock()
+	c.stats = append(c.stats, f)
+	c.mu.Unlock()
+}
+
+// Describe 实现prometheus.Collector
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	var d = &c.descs
+	for _, item := range []*prometheus.Desc{
+		d.opened, d.closed, d.active, d.handshakeFailures,
+		d.messagesIn, d.messagesOut, d.bytesIn, d.bytesOut,
+		d.queueDepth, d.queueDelay,
+		d.compressionIn, d.compressionOut, d.compressionSaved, d.skipped,
+		d.poolGets, d.poolMisses, d.poolDiscards, d.poolRetained,
+		d.closeCodes,
+	} {
+		ch <- item
+	}
+}
+
+// Collect 实现prometheus.Collector
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	var d = &c.descs
+	var counter = func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	var gauge = func(desc *prometheus.Desc, value uint64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+
+	var opened, closed = atomic.LoadUint64(&c.opened), atomic.LoadUint64(&c.closed)
+	counter(d.opened, opened)
+	counter(d.closed, closed)
+	gauge(d.active, opened-closed)
+	counter(d.handshakeFailures, atomic.LoadUint64(&c.handshakeFailures))
+	counter(d.messagesIn, atomic.LoadUint64(&c.messagesIn))
+	counter(d.messagesOut, atomic.LoadUint64(&c.messagesOut))
+	counter(d.bytesIn, atomic.LoadUint64(&c.bytesIn))
+	counter(d.bytesOut, atomic.LoadUint64(&c.bytesOut))
+	gauge(d.queueDepth, c.writeQueueDepth())
+	ch <- c.queueDelay.metric(d.queueDelay)
+
+	var stats = c.compressionStats()
+	counter(d.compressionIn, stats.BytesIn)
+	counter(d.compressionOut, stats.BytesOut)
+	counter(d.compressionSaved, stats.BytesIn-stats.BytesOut)
+	counter(d.skipped, stats.Skipped)
+
+	var pool = gws.BufferPoolStats()
+	counter(d.poolGets, pool.Gets)
+	counter(d.poolMisses, pool.Misses)
+	counter(d.poolDiscards, pool.Discards)
+	gauge(d.poolRetained, pool.RetainedBytes)
+
+	c.mu.Lock()
+	var codes = make([]int, 0, len(c.closeCodes))
+	for code := range c.closeCodes {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		counter(d.closeCodes, c.closeCodes[uint16(code)], strconv.Itoa(code))
+	}
+	c.mu.Unlock()
+}
+
+func (c *Collector) writeQueueDepth() uint64 {
+	var sum = 0
+	c.conns.Range(func(key, value interface{}) bool {
+		sum += key.(*gws.Conn).WriteQueueLen()
+		return true
+	})
+	return uint64(sum)
+}
+
+func (c *Collector) compressionStats() gws.CompressionStats {
+	c.mu.Lock()
+	var funcs = append([]func() gws.CompressionStats(nil), c.stats...)
+	c.mu.Unlock()
+
+	var sum gws.CompressionStats
+	for _, f := range funcs {
+		var item = f()
+		sum.BytesIn += item.BytesIn
+		sum.BytesOut += item.BytesOut
+		sum.Compressed += item.Compressed
+		sum.Skipped += item.Skipped
+	}
+	return sum
+}
+
+func (c *Collector) onOpen(socket *gws.Conn) {
+	atomic.AddUint64(&c.opened, 1)
+	c.conns.Store(socket, struct{}{})
+}
+
+func (c *Collector) onClose(socket *gws.Conn, err error) {
+	atomic.AddUint64(&c.closed, 1)
+	c.conns.Delete(socket)
+	var code uint16
+	var closeErr *gws.CloseError
+	if errors.As(err, &closeErr) {
+		code = closeErr.Code
+	}
+	c.mu.Lock()
+	c.closeCodes[code]++
+	c.mu.Unlock()
+}
+
+// 写队列延迟直方图的上界, 单位秒
+// upper bounds of the write queue delay histogram in seconds
+var queueDelayBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// 无锁的直方图, 采集时转换为prometheus的常量直方图
+// lock-free histogram, converted to a constant prometheus histogram on collection
+type histogram struct {
+	bounds []float64
+	counts []uint64 // 每个区间的计数, 最后一个是+Inf / count per bucket, the last one is +Inf
+	sum    uint64   // 纳秒 / nanoseconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (c *histogram) observe(d time.Duration) {
+	var i = sort.SearchFloat64s(c.bounds, d.Seconds())
+	atomic.AddUint64(&c.counts[i], 1)
+	atomic.AddUint64(&c.sum, uint64(d))
+}
+
+func (c *histogram) metric(desc *prometheus.Desc) prometheus.Metric {
+	var buckets = make(map[float64]uint64, len(c.bounds))
+	var total uint64
+	for i := range c.counts {
+		total += atomic.LoadUint64(&c.counts[i])
+		if i < len(c.bounds) {
+			buckets[c.bounds[i]] = total
+		}
+	}
+	var sum = time.Duration(atomic.LoadUint64(&c.sum)).Seconds()
+	return prometheus.MustNewConstHistogram(desc, total, sum, buckets)
+}
+
+type eventHandler struct {
+	gws.Event
+	collector *Collector
+}
+
+func (c *eventHandler) OnOpen(socket *gws.Conn) {
+	c.collector.onOpen(socket)
+	c.Event.OnOpen(socket)
+}
+
+func (c *eventHandler) OnClose(socket *gws.Conn, err error) {
+	c.collector.onClose(socket, err)
+	c.Event.OnClose(socket, err)
+}
+
+var (
+	_ gws.FrameObserver    = (*Collector)(nil)
+	_ prometheus.Collector = (*Collector)(nil)
+)
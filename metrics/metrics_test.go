@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lxzan/gws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type serverHandler struct {
+	gws.BuiltinEventHandler
+	closed chan struct{}
+}
+
+func (c *serverHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	message.Close()
+}
+
+func (c *serverHandler) OnClose(socket *gws.Conn, err error) {
+	close(c.closed)
+}
+
+type clientHandler struct {
+	gws.BuiltinEventHandler
+	received chan string
+}
+
+func (c *clientHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	c.received <- message.Data.String()
+	message.Close()
+}
+
+func TestCollector(t *testing.T) {
+	var as = assert.New(t)
+	var collector = New("")
+	var handler = &serverHandler{closed: make(chan struct{})}
+	var upgrader = gws.NewUpgrader(collector.Wrap(handler), &gws.ServerOption{
+		CompressEnabled: true,
+		FrameObserver:   collector,
+	})
+	collector.AddCompressionStats(upgrader.CompressionStats)
+
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			collector.OnHandshakeError(nil, err)
+			return
+		}
+		go socket.ReadLoop()
+	}))
+	defer server.Close()
+
+	// 非WebSocket请求, 握手失败
+	if resp, err := http.Get(server.URL); err == nil {
+		_ = resp.Body.Close()
+	}
+
+	var client = &clientHandler{received: make(chan string, 1)}
+	socket, _, err := gws.NewClient(client, &gws.ClientOption{
+		Addr:            "ws://" + strings.TrimPrefix(server.URL, "http://"),
+		CompressEnabled: true,
+	})
+	if !as.NoError(err) {
+		return
+	}
+	go socket.ReadLoop()
+
+	var text = strings.Repeat("hello, world! ", 100)
+	as.NoError(socket.WriteString(text))
+	as.Equal(text, <-client.received)
+	socket.WriteClose(1000, nil)
+	<-handler.closed
+
+	var registry = prometheus.NewPedanticRegistry()
+	as.NoError(registry.Register(collector))
+	var recorder = httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var output = recorder.Body.String()
+	for _, line := range []string{
+		"gws_connections_opened_total 1\n",
+		"gws_connections_closed_total 1\n",
+		"gws_connections_active 0\n",
+		"gws_handshake_failures_total 1\n",
+		"gws_messages_received_total 1\n",
+		"gws_messages_sent_total 1\n",
+		"gws_compression_bytes_in_total 1400\n",
+		"gws_write_queue_depth 0\n",
+		"gws_close_codes_total{code=\"1000\"} 1\n",
+		"# TYPE gws_bytes_sent_total counter\n",
+		"# TYPE gws_buffer_pool_retained_bytes gauge\n",
+		"# TYPE gws_write_queue_delay_seconds histogram\n",
+		"gws_write_queue_delay_seconds_count 0\n",
+	} {
+		as.Contains(output, line)
+	}
+
+	// 一致性检查
+	count, err := testutil.GatherAndCount(registry)
+	as.NoError(err)
+	as.Equal(19, count)
+}
@@ -0,0 +1,137 @@
+// Package msglog 采样记录gws收发的消息, 用于生产环境排查问题而不会刷爆日志
+// Package msglog logs a sample of the messages sent and received by gws,
+// for debugging in production without drowning the logger
+package msglog
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lxzan/gws"
+)
+
+// 默认截断长度
+// default truncation length of payloads
+const defaultMaxPayload = 64
+
+// Config 采样配置, Every和PerSecond可以同时使用
+// Sampling configuration, Every and PerSecond can be combined
+type Config struct {
+	// 每N条消息记录1条, 0或者1表示全部记录
+	// Log 1 in N messages, 0 or 1 logs every message
+	Every uint64
+
+	// 每秒最多记录的条数, 0表示不限制
+	// Maximum number of messages logged per second, 0 means unlimited
+	PerSecond int
+
+	// 载荷截断的长度, 默认64, 负数表示不输出载荷
+	// Payloads are truncated to MaxPayload bytes, 64 by default. A negative value omits payloads
+	MaxPayload int
+
+	// 日志输出, 默认使用标准库log
+	// Log output, uses the standard library log by default
+	Output func(line string)
+}
+
+// Sampler 实现gws.MessageObserver, 采样记录消息的元数据和截断的载荷
+// Sampler implements gws.MessageObserver and logs the metadata and truncated payload of sampled messages
+//
+// Example:
+//
+//	var sampler = msglog.New(msglog.Config{Every: 100, PerSecond: 10})
+//	var server = gws.NewServer(handler, &gws.ServerOption{MessageObserver: sampler})
+type Sampler struct {
+	count uint64 // 64位原子操作, 放在开头保证对齐 / 64-bit atomic, first to keep it aligned
+	conf  Config
+
+	// 当前一秒的开始时间和已记录的条数
+	// start of the current second and the number of messages logged in it
+	mu          sync.Mutex
+	windowStart time.Time
+	windowCount int
+}
+
+// New 创建采样器
+// New creates a sampler
+func New(conf Config) *Sampler {
+	if conf.MaxPayload == 0 {
+		conf.MaxPayload = defaultMaxPayload
+	}
+	if conf.Output == nil {
+		conf.Output = func(line string) { log.Println(line) }
+	}
+	return &Sampler{conf: conf}
+}
+
+// ObserveMessage 实现gws.MessageObserver
+// ObserveMessage implements gws.MessageObserver
+func (c *Sampler) ObserveMessage(socket *gws.Conn, direction gws.FrameDirection, opcode gws.Opcode, payload []byte) {
+	if !c.sample() {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("gws: message")
+	_, _ = fmt.Fprintf(&b, " id=%d dir=%s opcode=%d len=%d", socket.ID(), directionName(direction), opcode, len(payload))
+	if c.conf.MaxPayload > 0 && len(payload) > 0 {
+		b.WriteString(" payload=")
+		b.WriteString(formatPayload(opcode, payload, c.conf.MaxPayload))
+	}
+	c.conf.Output(b.String())
+}
+
+// 是否记录这条消息
+// whether to log this message
+func (c *Sampler) sample() bool {
+	if c.conf.Every > 1 && (atomic.AddUint64(&c.count, 1)-1)%c.conf.Every != 0 {
+		return false
+	}
+	if c.conf.PerSecond <= 0 {
+		return true
+	}
+
+	var now = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.windowStart) >= time.Second {
+		c.windowStart, c.windowCount = now, 0
+	}
+	if c.windowCount >= c.conf.PerSecond {
+		return false
+	}
+	c.windowCount++
+	return true
+}
+
+func directionName(direction gws.FrameDirection) string {
+	if direction == gws.FrameInbound {
+		return "in"
+	}
+	return "out"
+}
+
+// 截断载荷, 合法utf8的文本加引号输出, 其他输出十六进制
+// truncate the payload, valid utf8 text is quoted and anything else is hex encoded
+func formatPayload(opcode gws.Opcode, payload []byte, maxPayload int) string {
+	var suffix = ""
+	if len(payload) > maxPayload {
+		payload, suffix = payload[:maxPayload], "..."
+		// 不要截断在utf8字符中间
+		// do not cut a utf8 character in half
+		for i := 0; i < utf8.UTFMax && len(payload) > 0 && !utf8.Valid(payload); i++ {
+			payload = payload[:len(payload)-1]
+		}
+	}
+	if opcode == gws.OpcodeText && utf8.Valid(payload) {
+		return fmt.Sprintf("%q%s", payload, suffix)
+	}
+	return fmt.Sprintf("%x%s", payload, suffix)
+}
+
+var _ gws.MessageObserver = (*Sampler)(nil)
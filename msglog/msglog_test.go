@@ -0,0 +1,86 @@
+package msglog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lxzan/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+type echoHandler struct {
+	gws.BuiltinEventHandler
+}
+
+func (c *echoHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	message.Close()
+}
+
+type clientHandler struct {
+	gws.BuiltinEventHandler
+	received chan struct{}
+}
+
+func (c *clientHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	message.Close()
+	c.received <- struct{}{}
+}
+
+func TestSampler(t *testing.T) {
+	var as = assert.New(t)
+	var lines = make(chan string, 8)
+	var sampler = New(Config{MaxPayload: 5, Output: func(line string) { lines <- line }})
+	var upgrader = gws.NewUpgrader(new(echoHandler), &gws.ServerOption{MessageObserver: sampler})
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			go socket.ReadLoop()
+		}
+	}))
+	defer server.Close()
+
+	var client = &clientHandler{received: make(chan struct{}, 1)}
+	socket, _, err := gws.NewClient(client, &gws.ClientOption{Addr: "ws://" + strings.TrimPrefix(server.URL, "http://")})
+	if !as.NoError(err) {
+		return
+	}
+	defer socket.NetConn().Close()
+	go socket.ReadLoop()
+	as.NoError(socket.WriteString("hello, world"))
+	<-client.received
+
+	as.Regexp(`^gws: message id=\d+ dir=in opcode=1 len=12 payload="hello"\.\.\.$`, <-lines)
+	as.Regexp(`^gws: message id=\d+ dir=out opcode=1 len=12 payload="hello"\.\.\.$`, <-lines)
+}
+
+func TestSampler_Sample(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("every", func(t *testing.T) {
+		var sampler = New(Config{Every: 3})
+		var sampled []bool
+		for i := 0; i < 6; i++ {
+			sampled = append(sampled, sampler.sample())
+		}
+		as.Equal([]bool{true, false, false, true, false, false}, sampled)
+	})
+
+	t.Run("per second", func(t *testing.T) {
+		var sampler = New(Config{PerSecond: 2})
+		as.True(sampler.sample())
+		as.True(sampler.sample())
+		as.False(sampler.sample())
+		// 进入下一秒
+		sampler.windowStart = sampler.windowStart.Add(-1e9)
+		as.True(sampler.sample())
+	})
+}
+
+func TestFormatPayload(t *testing.T) {
+	var as = assert.New(t)
+	as.Equal(`"hello"`, formatPayload(gws.OpcodeText, []byte("hello"), 64))
+	as.Equal(`"你"...`, formatPayload(gws.OpcodeText, []byte("你好"), 4))
+	as.Equal(`0102...`, formatPayload(gws.OpcodeBinary, []byte{1, 2, 3}, 2))
+}
@@ -0,0 +1,250 @@
+package gws
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// FrameDirection 帧的方向
+// direction of a frame
+type FrameDirection uint8
+
+const (
+	FrameInbound  FrameDirection = 0 // 收到的帧 / received frame
+	FrameOutbound FrameDirection = 1 // 发送的帧 / sent frame
+)
+
+// FrameInfo 帧的元数据
+// metadata of a frame
+type FrameInfo struct {
+	Direction     FrameDirection
+	Opcode        Opcode
+	Fin           bool
+	RSV1          bool
+	RSV2          bool
+	RSV3          bool
+	Compressed    bool
+	PayloadLength int
+
+	// 出站帧从入队(WriteAsync, Broadcast)到写入连接的时间, 包括在写协程中压缩的时间; 其他帧为0
+	// Time an outbound frame spent from being queued by WriteAsync or Broadcast until it is written,
+	// including compression in the write worker; 0 for other frames
+	QueueDelay time.Duration
+}
+
+// FrameObserver 帧观察者, 每读写一帧都会同步调用, 不要在OnFrame里做耗时操作
+// Frame observer, called synchronously for every frame read or written, do not block in OnFrame
+type FrameObserver interface {
+	OnFrame(socket *Conn, frame FrameInfo)
+}
+
+// MessageObserver 消息观察者, 收发每条数据消息时同步调用, 不要在ObserveMessage里做耗时操作, 也不要持有payload
+// 收到的消息在解压之后, OnMessage之前通知, 落盘的消息payload为nil;
+// 发送的消息在WriteMessage, WriteAsync和Broadcast时通知, 压缩之前; 不包括NewMessageWriter流式写入的消息
+// Message observer, called synchronously for every data message sent or received.
+// Do not block in ObserveMessage and do not retain payload.
+// Received messages are reported after decompression and before OnMessage, payload is nil for spilled messages.
+// Sent messages are reported by WriteMessage, WriteAsync and Broadcast before compression,
+// messages streamed by NewMessageWriter are not included
+type MessageObserver interface {
+	ObserveMessage(socket *Conn, direction FrameDirection, opcode Opcode, payload []byte)
+}
+
+// 通知收发的数据消息
+// notify a data message sent or received
+func (c *Conn) observeMessage(direction FrameDirection, opcode Opcode, payload []byte) {
+	if c.config.MessageObserver != nil && opcode.isDataFrame() {
+		c.config.MessageObserver.ObserveMessage(c, direction, opcode, payload)
+	}
+}
+
+// ConnStats 连接统计, 字节数为帧载荷的长度(压缩后), 不含帧头
+// Statistics of a connection, bytes are frame payload lengths (after compression) without frame headers
+type ConnStats struct {
+	BytesIn     uint64 // 收到的字节数 / bytes received
+	BytesOut    uint64 // 发送的字节数 / bytes sent
+	FramesIn    uint64 // 收到的帧数 / frames received
+	FramesOut   uint64 // 发送的帧数 / frames sent
+	MessagesIn  uint64 // 收到的数据消息数 / data messages received
+	MessagesOut uint64 // 发送的数据消息数 / data messages sent
+
+	// 读取的批次数, 每批是一次读取后缓冲区中能完整解析的帧, 见ReadBatchSize
+	// number of read batches, each being the frames fully parsed from the buffer after one read, see ReadBatchSize
+	ReadBatches uint64
+
+	// 连接建立的时间
+	// time the connection was established
+	OpenedAt time.Time
+
+	// 最后一次收到和发送帧的时间
+	// time of the last frame received and sent
+	LastReadAt  time.Time
+	LastWriteAt time.Time
+
+	// 出站消息的压缩统计, 见CompressionStats.Ratio
+	// compression statistics of outgoing messages, see CompressionStats.Ratio
+	Compression CompressionStats
+
+	// 写队列中等待发送的消息数
+	// number of messages waiting in the write queue
+	WriteQueueLen int
+
+	// 读队列和写队列的并发和积压, 读队列只在ReadAsyncEnabled时使用, 用于调整ReadAsyncGoLimit
+	// concurrency and backlog of the read and write queues. The read queue is only used with ReadAsyncEnabled,
+	// this helps sizing ReadAsyncGoLimit
+	ReadQueue  QueueStats
+	WriteQueue QueueStats
+}
+
+// ReadBatchSize 平均每批读取的帧数, 小消息密集时大于1, 没有读取过时为0
+// ReadBatchSize returns the average number of frames per read batch; it exceeds 1 under bursts of small messages
+// and is 0 if nothing has been read
+func (c ConnStats) ReadBatchSize() float64 {
+	if c.ReadBatches == 0 {
+		return 0
+	}
+	return float64(c.FramesIn) / float64(c.ReadBatches)
+}
+
+// 连接统计计数器
+// counters of the connection statistics
+type connCounter struct {
+	bytesIn     uint64
+	bytesOut    uint64
+	framesIn    uint64
+	framesOut   uint64
+	messagesIn  uint64
+	messagesOut uint64
+	readBatches uint64
+	openedAt    int64
+	lastRead    int64
+	lastWrite   int64
+}
+
+// 收到的帧的时间按批次记录, 同一批的帧是一起到达的
+// the time of received frames is recorded per batch, since the frames of a batch arrive together
+func (c *connCounter) add(direction FrameDirection, isMessage bool, payloadLength int) {
+	if direction == FrameInbound {
+		atomic.AddUint64(&c.bytesIn, uint64(payloadLength))
+		atomic.AddUint64(&c.framesIn, 1)
+		if isMessage {
+			atomic.AddUint64(&c.messagesIn, 1)
+		}
+		return
+	}
+	atomic.AddUint64(&c.bytesOut, uint64(payloadLength))
+	atomic.AddUint64(&c.framesOut, 1)
+	if isMessage {
+		atomic.AddUint64(&c.messagesOut, 1)
+	}
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+}
+
+// 开始一批读取
+// start a read batch
+func (c *connCounter) addReadBatch() {
+	atomic.AddUint64(&c.readBatches, 1)
+	atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+}
+
+// 计入连接统计, 服务端连接的消息数同时计入汇总统计
+// count a frame in the connection statistics, messages of server connections are also counted in the aggregate
+func (c *Conn) countFrame(direction FrameDirection, opcode Opcode, fin bool, payloadLength int) {
+	var isMessage = fin && (opcode.isDataFrame() || opcode == OpcodeContinuation)
+	c.counter.add(direction, isMessage, payloadLength)
+	if isMessage && c.config.serverStats != nil {
+		c.config.serverStats.addMessage(direction)
+	}
+}
+
+// 服务端连接按类别计入协议错误, 原样返回err
+// count a protocol error of a server connection by category, err is returned unchanged
+func (c *Conn) protocolError(kind protocolErrorKind, err error) error {
+	if c.config.serverStats != nil {
+		atomic.AddUint64(&c.config.serverStats.protocolErrors[kind], 1)
+	}
+	return err
+}
+
+// Stats 连接统计快照, OnClose收到的CloseError中也包含关闭时的快照
+// Stats returns a snapshot of the connection statistics.
+// The CloseError delivered to OnClose carries the snapshot taken at close
+func (c *Conn) Stats() ConnStats {
+	var stats = ConnStats{
+		BytesIn:     atomic.LoadUint64(&c.counter.bytesIn),
+		BytesOut:    atomic.LoadUint64(&c.counter.bytesOut),
+		FramesIn:    atomic.LoadUint64(&c.counter.framesIn),
+		FramesOut:   atomic.LoadUint64(&c.counter.framesOut),
+		MessagesIn:  atomic.LoadUint64(&c.counter.messagesIn),
+		MessagesOut: atomic.LoadUint64(&c.counter.messagesOut),
+		ReadBatches: atomic.LoadUint64(&c.counter.readBatches),
+		Compression: c.CompressionStats(),
+		ReadQueue:   c.readQueue.Stats(),
+		WriteQueue:  c.writeQueue.Stats(),
+	}
+	stats.WriteQueueLen = stats.WriteQueue.Backlog
+	if c.counter.openedAt > 0 {
+		stats.OpenedAt = time.Unix(0, c.counter.openedAt)
+	}
+	if t := atomic.LoadInt64(&c.counter.lastRead); t > 0 {
+		stats.LastReadAt = time.Unix(0, t)
+	}
+	if t := atomic.LoadInt64(&c.counter.lastWrite); t > 0 {
+		stats.LastWriteAt = time.Unix(0, t)
+	}
+	return stats
+}
+
+// 通知收到的帧
+// notify the frame header just parsed
+func (c *Conn) observeInbound(payloadLength int) {
+	c.countFrame(FrameInbound, c.fh.GetOpcode(), c.fh.GetFIN(), payloadLength)
+	if c.config.FrameObserver == nil {
+		return
+	}
+	var rsv1 = c.fh.GetRSV1()
+	c.config.FrameObserver.OnFrame(c, FrameInfo{
+		Direction:     FrameInbound,
+		Opcode:        c.fh.GetOpcode(),
+		Fin:           c.fh.GetFIN(),
+		RSV1:          rsv1,
+		RSV2:          c.fh.GetRSV2(),
+		RSV3:          c.fh.GetRSV3(),
+		Compressed:    c.compressEnabled && rsv1,
+		PayloadLength: payloadLength,
+	})
+}
+
+// 从编码好的帧中解析头部并通知
+// decode the header of an encoded frame and notify
+func (c *Conn) observeOutbound(frame []byte, enqueued time.Time) {
+	if len(frame) < 2 {
+		return
+	}
+	var payloadLength = int(frame[1] & 127)
+	switch payloadLength {
+	case 126:
+		payloadLength = int(binary.BigEndian.Uint16(frame[2:4]))
+	case 127:
+		payloadLength = int(binary.BigEndian.Uint64(frame[2:10]))
+	}
+	c.countFrame(FrameOutbound, Opcode(frame[0]&15), frame[0]&128 != 0, payloadLength)
+	if c.config.FrameObserver == nil {
+		return
+	}
+	var rsv1 = frame[0]&64 != 0
+	c.config.FrameObserver.OnFrame(c, FrameInfo{
+		Direction:     FrameOutbound,
+		Opcode:        Opcode(frame[0] & 15),
+		Fin:           frame[0]&128 != 0,
+		RSV1:          rsv1,
+		RSV2:          frame[0]&32 != 0,
+		RSV3:          frame[0]&16 != 0,
+		Compressed:    rsv1,
+		PayloadLength: payloadLength,
+		QueueDelay:    internal.SelectValue(enqueued.IsZero(), 0, time.Since(enqueued)),
+	})
+}
@@ -0,0 +1,195 @@
+package gws
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+type frameRecorder struct {
+	sync.Mutex
+	frames []FrameInfo
+}
+
+func (c *frameRecorder) OnFrame(socket *Conn, frame FrameInfo) {
+	c.Lock()
+	c.frames = append(c.frames, frame)
+	c.Unlock()
+}
+
+func TestFrameObserver(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+
+	var recorder = new(frameRecorder)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{FrameObserver: recorder, CompressEnabled: true, CompressThreshold: 1}
+	var clientOption = &ClientOption{CompressEnabled: true}
+	var payload = internal.AlphabetNumeric.Generate(1024)
+
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(OpcodeBinary, message.Bytes())
+		wg.Done()
+	}
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		wg.Done()
+	}
+
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteMessage(OpcodeText, payload))
+	wg.Wait()
+
+	recorder.Lock()
+	defer recorder.Unlock()
+	as.Equal(2, len(recorder.frames))
+	as.Equal(FrameInbound, recorder.frames[0].Direction)
+	as.Equal(OpcodeText, recorder.frames[0].Opcode)
+	as.True(recorder.frames[0].Fin)
+	as.True(recorder.frames[0].Compressed)
+	as.Greater(recorder.frames[0].PayloadLength, 0)
+	as.Equal(FrameOutbound, recorder.frames[1].Direction)
+	as.Equal(OpcodeBinary, recorder.frames[1].Opcode)
+	as.True(recorder.frames[1].Compressed)
+	as.True(recorder.frames[1].RSV1)
+	as.Equal(time.Duration(0), recorder.frames[1].QueueDelay)
+}
+
+func TestFrameObserver_QueueDelay(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var recorder = new(frameRecorder)
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) { wg.Done() }
+	var serverOption = &ServerOption{FrameObserver: recorder, CompressEnabled: true}
+	server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{CompressEnabled: true})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(server.WriteAsync(OpcodeText, []byte("hello")))
+	var broadcaster = NewBroadcaster(OpcodeText, internal.AlphabetNumeric.Generate(1024))
+	as.NoError(broadcaster.Broadcast(server))
+	broadcaster.Release()
+	wg.Wait()
+
+	recorder.Lock()
+	defer recorder.Unlock()
+	as.Equal(2, len(recorder.frames))
+	for _, frame := range recorder.frames {
+		as.Equal(FrameOutbound, frame.Direction)
+		as.Greater(frame.QueueDelay, time.Duration(0))
+	}
+}
+
+func TestObserveOutbound(t *testing.T) {
+	var as = assert.New(t)
+	var recorder = new(frameRecorder)
+	var socket = &Conn{config: &Config{FrameObserver: recorder, WriteMaxPayloadSize: 1024 * 1024}, isServer: true}
+	for _, n := range []int{10, 1000, 70000} {
+		frame, _, err := socket.genFrame(OpcodeBinary, make([]byte, n))
+		as.NoError(err)
+		socket.observeOutbound(frame.Bytes(), time.Time{})
+	}
+	as.Equal(10, recorder.frames[0].PayloadLength)
+	as.Equal(1000, recorder.frames[1].PayloadLength)
+	as.Equal(70000, recorder.frames[2].PayloadLength)
+}
+
+func TestConn_Stats(t *testing.T) {
+	var as = assert.New(t)
+	var messages, closed = &sync.WaitGroup{}, &sync.WaitGroup{}
+	messages.Add(2)
+	closed.Add(1)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var closeErr *CloseError
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.True(errors.As(err, &closeErr))
+		closed.Done()
+	}
+	clientHandler.onMessage = func(socket *Conn, message *Message) { messages.Done() }
+	var serverOption = &ServerOption{CompressEnabled: true, CompressThreshold: 512}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{CompressEnabled: true})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var initial = server.Stats()
+	as.Equal(ConnStats{OpenedAt: initial.OpenedAt, ReadQueue: initial.ReadQueue, WriteQueue: QueueStats{MaxConcurrency: 1}}, initial)
+	as.Equal(QueueStats{MaxConcurrency: int(server.config.ReadAsyncGoLimit)}, initial.ReadQueue)
+	as.False(server.Stats().OpenedAt.IsZero())
+	as.Equal(1.0, server.Stats().Compression.Ratio())
+	as.NoError(server.WriteString("hello"))
+	as.NoError(server.WriteMessage(OpcodeBinary, bytes.Repeat([]byte("hello"), 200)))
+	messages.Wait()
+
+	var stats = server.Stats()
+	as.Equal(uint64(2), stats.MessagesOut)
+	as.Equal(uint64(2), stats.FramesOut)
+	as.Equal(uint64(1), stats.Compression.Compressed)
+	as.Less(stats.Compression.Ratio(), 0.5)
+	as.False(stats.LastWriteAt.IsZero())
+	as.True(stats.LastReadAt.IsZero())
+
+	var clientStats = client.Stats()
+	as.Equal(uint64(2), clientStats.MessagesIn)
+	as.Equal(stats.BytesOut, clientStats.BytesIn)
+	as.Equal(uint64(5)+stats.Compression.BytesOut, clientStats.BytesIn)
+
+	client.WriteClose(1000, nil)
+	closed.Wait()
+	as.Equal(uint64(1), closeErr.Stats.FramesIn)
+	as.Equal(uint64(0), closeErr.Stats.MessagesIn)
+	as.Equal(uint64(3), closeErr.Stats.FramesOut)
+	as.Equal(uint64(2), closeErr.Stats.MessagesOut)
+
+	var summary = closeErr.Summary()
+	as.Equal(uint16(1000), summary.CloseCode)
+	as.NoError(summary.LastError)
+	as.Equal(uint64(2), summary.MessagesOut)
+	as.Equal(closeErr.Stats.BytesOut, summary.BytesOut)
+	as.Equal(closeErr.ClosedAt.Sub(closeErr.Stats.OpenedAt), summary.Duration)
+	as.Greater(summary.Duration, time.Duration(0))
+}
+
+type messageRecorder chan string
+
+func (c messageRecorder) ObserveMessage(socket *Conn, direction FrameDirection, opcode Opcode, payload []byte) {
+	c <- fmt.Sprintf("%d %d %s", direction, opcode, payload)
+}
+
+func TestMessageObserver(t *testing.T) {
+	var as = assert.New(t)
+	var recorder = make(messageRecorder, 8)
+	var serverHandler = new(webSocketMocker)
+	var received = make(chan struct{}, 3)
+	serverHandler.onMessage = func(socket *Conn, message *Message) { received <- struct{}{} }
+	server, client := newPeer(serverHandler, &ServerOption{MessageObserver: recorder}, new(webSocketMocker), &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 控制帧不通知
+	as.NoError(client.WritePing(nil))
+	as.NoError(client.WriteString("hello"))
+	<-received
+	as.Equal("0 1 hello", <-recorder)
+
+	as.NoError(server.WriteMessage(OpcodeBinary, []byte("a")))
+	as.Equal("1 2 a", <-recorder)
+	as.NoError(server.WriteAsync(OpcodeText, []byte("b")))
+	as.Equal("1 1 b", <-recorder)
+	var broadcaster = NewBroadcaster(OpcodeText, []byte("c"))
+	as.NoError(broadcaster.Broadcast(server))
+	broadcaster.Release()
+	as.Equal("1 1 c", <-recorder)
+	as.Empty(recorder)
+}
@@ -7,25 +7,50 @@ import (
 	"net"
 	"net/http"
 	"time"
+	"unicode/utf8"
 )
 
 const (
-	defaultReadAsyncGoLimit    = 8
-	defaultCompressLevel       = flate.BestSpeed
-	defaultReadMaxPayloadSize  = 16 * 1024 * 1024
-	defaultWriteMaxPayloadSize = 16 * 1024 * 1024
-	defaultCompressThreshold   = 512
-	defaultCompressorNum       = 64
-	defaultReadBufferSize      = 4 * 1024
-	defaultWriteBufferSize     = 4 * 1024
-	defaultHandshakeTimeout    = 5 * time.Second
-	defaultDialTimeout         = 5 * time.Second
+	defaultReadAsyncGoLimit      = 8
+	defaultCompressLevel         = flate.BestSpeed
+	defaultReadMaxPayloadSize    = 16 * 1024 * 1024
+	defaultWriteMaxPayloadSize   = 16 * 1024 * 1024
+	defaultCompressThreshold     = 512
+	defaultCompressorNum         = 64
+	defaultDecompressWindowBits  = maxWindowBits
+	defaultCompressProbeInterval = 16
+	defaultClassCompressorNum    = 8
+	defaultReadBufferSize        = 4 * 1024
+	defaultWriteBufferSize       = 4 * 1024
+	defaultHandshakeTimeout      = 5 * time.Second
+	defaultDialTimeout           = 5 * time.Second
 )
 
 type (
 	Config struct {
 		compressors   *compressors
 		decompressors *decompressors
+		// 按压缩类别划分的压缩器池, 没有单独配置级别的类别为nil
+		// compressor pools per compression class, nil for classes without a level of their own
+		classCompressors [compressClassNum]*compressors
+		// 所有连接汇总的压缩统计
+		// compression statistics aggregated over all connections
+		compressionStats *compressionCounter
+		// 服务端汇总统计, 客户端为nil
+		// statistics aggregated by the server, nil for clients
+		serverStats *serverCounter
+		// Server.OnConnClosed的转发, 客户端为nil
+		// forwards to Server.OnConnClosed, nil for clients
+		onConnClosed func(socket *Conn, err error)
+		// 驱动IdleTimeout的时间轮, 服务端独享, 客户端按刻度共享; 没有开启IdleTimeout时为nil
+		// timer wheel driving IdleTimeout, owned by the server and shared by tick among clients; nil if IdleTimeout is disabled
+		timerWheel *timerWheel
+		// 读缓冲区和队列占用的近似内存, 设置了MemoryWatermark的服务端才有
+		// approximate memory held by buffers and queues, only on servers with MemoryWatermark set
+		memory *memoryCounter
+		// 写关闭帧的超时时间, 0表示defaultCloseFrameTimeout
+		// timeout for writing the close frame, 0 means defaultCloseFrameTimeout
+		closeFrameTimeout time.Duration
 
 		// 是否开启异步读, 开启的话会并行调用OnMessage
 		// Whether to enable asynchronous reading, if enabled OnMessage will be called in parallel
@@ -35,10 +60,48 @@ type (
 		// Maximum number of parallel concurrent processes for asynchronous reads
 		ReadAsyncGoLimit int
 
-		// 最大读取的消息内容长度
-		// Maximum read message content length
+		// 异步读时保持单个连接的消息顺序, 开启后每个连接串行调用OnMessage, 不同连接之间仍然并行
+		// Preserve per-connection message order with asynchronous reads. If enabled OnMessage is called serially
+		// for each connection, while different connections are still processed in parallel
+		ReadAsyncOrdered bool
+
+		// 服务端所有连接同时运行的OnMessage协程总数上限, 连接之间公平轮转, 仅在开启异步读时生效; 0表示不限制
+		// Server side: cap on OnMessage goroutines running at the same time across all connections, shared fairly
+		// between connections. Only applies with asynchronous reads; 0 means no cap
+		ReadAsyncGlobalLimit int
+
+		// 服务端近似内存占用超过MemoryWatermark时, 写队列积压超过该字节数的连接被视为慢消费者, 以1013关闭; 0表示不关闭
+		// Server side: when the approximate memory in use exceeds MemoryWatermark, connections with more than this many bytes
+		// waiting in the write queue are considered slow consumers and closed with 1013. 0 never sheds connections
+		MemorySlowConsumerBytes int
+
+		// 异步读的全局并发预算, 由ReadAsyncGlobalLimit生成, 客户端为nil
+		// global async read budget built from ReadAsyncGlobalLimit, nil for clients
+		readScheduler *readScheduler
+
+		// 最大读取的帧内容长度
+		// Maximum read frame payload length
 		ReadMaxPayloadSize int
 
+		// 消息的最大长度(分片重组和解压之后), 对单帧消息同样生效, 默认等于ReadMaxPayloadSize
+		// Maximum message length after reassembly of fragments and decompression, also applies to single frame messages.
+		// Defaults to ReadMaxPayloadSize
+		ReadMaxMessageSize int
+
+		// 解压后消息的最大长度, 解压过程中超过即以1009关闭连接, 默认等于ReadMaxMessageSize
+		// Maximum message length after decompression. The connection is closed with 1009 as soon as decompression
+		// exceeds it. Defaults to ReadMaxMessageSize
+		ReadMaxDecompressedSize int
+
+		// 解压后与解压前长度的最大比值, 防止解压炸弹, 超过即以1009关闭连接. 默认为0, 不限制
+		// Maximum ratio of the decompressed length to the compressed length, which guards against decompression bombs.
+		// The connection is closed with 1009 when exceeded. Defaults to 0, unlimited
+		ReadMaxExpansionRatio int
+
+		// 单条消息最多的分片数量, 0表示不限制
+		// Maximum number of fragments of a single message, 0 means unlimited
+		ReadMaxFragments int
+
 		// 读缓冲区的大小
 		// Size of the read buffer
 		ReadBufferSize int
@@ -51,6 +114,14 @@ type (
 		// Deprecated: Size of the write buffer, v1.4.5 version of this parameter is deprecated
 		WriteBufferSize int
 
+		// 每个连接预分配的写缓冲区大小, 按常见消息的大小设置. 放得下的未压缩帧直接在其中编码, 不经过共享内存池;
+		// 缓冲区正被占用(例如并发写入)或者帧更大时回退到内存池. 以每个连接的常驻内存换取关键路径上没有分配, 0表示不开启
+		// Size of a write buffer preallocated for every connection, set it to the typical message size. Uncompressed
+		// frames that fit are encoded in it without touching the shared buffer pool; when it is in use (e.g. concurrent
+		// writes) or the frame is larger the pool is used. Trades resident memory per connection for no allocator
+		// traffic on latency critical paths, 0 disables it
+		WriteArenaSize int
+
 		// 是否开启数据压缩
 		// Whether to turn on data compression
 		CompressEnabled bool
@@ -63,15 +134,248 @@ type (
 		// Compression threshold, messages below the threshold will not be compressed
 		CompressThreshold int
 
+		// 实时类消息(CompressClassRealtime)的压缩级别, 为0时使用CompressLevel
+		// 设置后该类别使用单独的小型压缩器池
+		// Compress level of realtime messages (CompressClassRealtime), 0 means CompressLevel.
+		// If set, the class uses a small compressor pool of its own
+		CompressLevelRealtime int
+
+		// 大块类消息(CompressClassBulk)的压缩级别, 为0时使用CompressLevel
+		// 设置后该类别使用单独的小型压缩器池
+		// Compress level of bulk messages (CompressClassBulk), 0 means CompressLevel.
+		// If set, the class uses a small compressor pool of its own
+		CompressLevelBulk int
+
 		// CompressorNum 压缩器数量
 		// 数值越大竞争的概率越小, 但是会耗费大量内存, 注意取舍
 		// Number of compressors
 		// The higher the value the lower the probability of competition, but it will consume a lot of memory, so be careful about the trade-off
 		CompressorNum int
 
+		// DecompressorNum 解压器数量, 默认与CompressorNum相同
+		// Number of decompressors, defaults to CompressorNum
+		DecompressorNum int
+
+		// 是否为每个连接分配独占的解压器, 读路径不再竞争解压器池, 但每个连接会额外占用一个解压器的内存
+		// Whether to give every connection a dedicated decompressor. The read path no longer competes for the pool,
+		// at the cost of one decompressor's memory per connection
+		DecompressorPinned bool
+
+		// 是否为每个连接分配独占的压缩器, 写路径不再竞争压缩器池, 但每个连接会额外占用一个压缩器的内存.
+		// 只作用于使用CompressLevel的消息, 设置了单独压缩级别的类别仍然使用各自的压缩器池
+		// Whether to give every connection a dedicated compressor. The write path no longer competes for the pool,
+		// at the cost of one compressor's memory per connection. Only applies to messages compressed with CompressLevel,
+		// classes with a compress level of their own keep using their pools
+		CompressorPinned bool
+
+		// 是否开启压缩上下文接管, 滑动窗口跨消息保留, 连续的相似消息压缩率更高, 但每个连接需要独占一个压缩器
+		// 需要双方都开启, 否则退化为无上下文接管
+		// Whether to enable compression context takeover. The sliding window is kept across messages, which improves
+		// the ratio for streams of similar messages, at the cost of a dedicated compressor per connection.
+		// Both sides have to enable it, otherwise compression falls back to no context takeover
+		ContextTakeoverEnabled bool
+
+		// 要求对端压缩时使用的滑动窗口位数, 取值8~15, 默认15(32KB). 减小可以降低上下文接管时解压的内存占用
+		// 本端压缩器固定使用32KB窗口, 对端要求更小的窗口时不会开启压缩
+		// Sliding window bits the peer is asked to compress with, 8~15, defaults to 15 (32KB).
+		// Smaller values reduce the memory used for decompression with context takeover.
+		// The local compressor always uses a 32KB window, so compression is declined if the peer asks for a smaller one
+		DecompressWindowBits int
+
+		// 创建压缩器, 默认使用内置的flate实现
+		// Creates a compressor, defaults to the built-in flate implementation
+		NewCompressor func(level int) Compressor
+
+		// 预设压缩字典, 两端必须完全一致(例如通过子协议约定), 可以显著提升小型结构化消息(例如JSON)的压缩率
+		// 只有最后32KB有效; 使用自定义压缩器时需要自行处理字典
+		// Preset compression dictionary, which must be identical on both endpoints (e.g. agreed via the subprotocol).
+		// It dramatically improves the compression of small structured messages like JSON.
+		// Only the last 32KB take effect; custom compressors have to handle the dictionary themselves
+		CompressDictionary []byte
+
+		// 自适应跳过压缩的压缩率阈值(压缩后大小/原始大小), 近期消息的平均压缩率高于该值时跳过压缩, 节省CPU
+		// 适用于已经压缩过的图片, 加密数据等. 默认为0, 不开启
+		// Compression ratio threshold (compressed size / original size) of the adaptive compression skip.
+		// Compression is bypassed while the recent average ratio is above it, which saves CPU on already compressed
+		// images, encrypted blobs and so on. Defaults to 0, disabled
+		CompressSkipRatio float64
+
+		// 跳过压缩期间, 每隔多少条消息压缩一次以重新评估压缩率, 默认16
+		// While compression is skipped, one message in every CompressProbeInterval is compressed to re-measure the ratio.
+		// Defaults to 16
+		CompressProbeInterval int
+
+		// 允许压缩的操作码, 例如只压缩文本可以设置为[]Opcode{OpcodeText}; 默认为空, 压缩所有数据帧
+		// 二进制消息经常是已经压缩过的媒体数据, 再次压缩只会浪费CPU
+		// Opcodes eligible for compression, e.g. []Opcode{OpcodeText} to compress text only; defaults to empty,
+		// which compresses all data frames. Binary payloads are often pre-compressed media where deflate wastes CPU
+		CompressOpcodes []Opcode
+
+		// 创建解压器, 默认使用内置的flate实现
+		// Creates a decompressor, defaults to the built-in flate implementation
+		NewDecompressor func() Decompressor
+
 		// 是否检查文本utf8编码, 关闭性能会好点
 		// Whether to check the text utf8 encoding, turn off the performance will be better
 		CheckUtf8Enabled bool
+
+		// utf8校验函数, 读写两端共用, 默认为utf8.Valid, 可以替换为SIMD等加速实现
+		// utf8 validator used by both read and write paths, defaults to utf8.Valid, can be replaced with accelerated implementations such as SIMD
+		Utf8Validator func(p []byte) bool
+
+		// 是否自动回复pong, 开启后收到ping会先回复相同payload的pong再调用OnPing, OnPing里不需要再回复
+		// Whether to reply pong automatically, if enabled a pong echoing the payload is written before OnPing is called,
+		// so OnPing must not write another pong
+		AutoPongEnabled bool
+
+		// 空闲超时时间, 每收到一帧都会刷新; 超时后以1001状态码关闭连接, OnClose收到ErrIdleTimeout
+		// 由Server共享的时间轮检测, 不再每帧设置读超时, 精度约为超时时间的1/16(至少10ms); 开启后任何读超时都会被当作空闲超时
+		// Idle timeout, refreshed on every inbound frame; on expiry the connection is closed with 1001
+		// and OnClose receives ErrIdleTimeout.
+		// It is checked by a timer wheel shared per Server instead of setting a read deadline per frame, with a precision
+		// of about 1/16 of the timeout (at least 10ms). When enabled any read timeout is reported as an idle timeout.
+		IdleTimeout time.Duration
+
+		// 慢处理阈值, OnMessage耗时超过该值时通过Logger告警, 并调用SlowMessageHandler; 为0时不检测
+		// Slow handler threshold. If OnMessage takes longer, a warning is logged and SlowMessageHandler is called.
+		// 0 disables the detection
+		SlowHandlerThreshold time.Duration
+
+		// 写入卡住的阈值, 一次写入超过该值没有完成(例如对端零窗口)时通过Logger告警, 并调用WriteStallHandler; 为0时不检测
+		// Write stall threshold. If a single write has not completed after this long (e.g. the peer advertises
+		// a zero window), a warning is logged and WriteStallHandler is called. 0 disables the detection
+		WriteStallThreshold time.Duration
+
+		// 写入卡住时是否强制关闭连接, 关闭时OnClose收到ErrWriteStalled
+		// Whether to force-close the connection when a write stalls, OnClose receives ErrWriteStalled
+		WriteStallCloseEnabled bool
+
+		// 每秒最多接收的消息数量, 0表示不限制
+		// Maximum number of data messages received per second, 0 means unlimited
+		ReadMessageRate int
+
+		// 每秒最多接收的数据帧字节数(解压前), 0表示不限制
+		// 桶满时单条超过该值的消息也能通过, 之后的消息需要等待配额恢复
+		// Maximum number of data frame bytes received per second (before decompression), 0 means unlimited.
+		// A single message larger than this value passes when the bucket is full, later messages wait for the quota to recover.
+		ReadByteRate int
+
+		// 超出读速率限制后的处理策略, 默认延迟读取
+		// Policy when the read rate limit is exceeded, delay reads by default
+		ReadRatePolicy RatePolicy
+
+		// 帧观察者, 用于调试和自定义帧统计
+		// Frame observer, for wire-level debugging and custom frame metrics
+		FrameObserver FrameObserver
+
+		// 消息观察者, 用于记录或者采样收发的数据消息, 见MessageObserver
+		// Message observer, for logging or sampling the data messages sent and received, see MessageObserver
+		MessageObserver MessageObserver
+
+		// 自定义扩展, 按顺序协商
+		// Custom extensions, negotiated in order
+		Extensions []Extension
+
+		// 服务端接受客户端发送的未掩码帧, 违反RFC6455, 仅用于兼容不规范的嵌入式设备和内部服务
+		// Server side: accept unmasked frames from clients. This violates RFC6455 and is meant only for
+		// non-compliant embedded devices and internal services
+		UnmaskedFramesAllowed bool
+
+		// 客户端接受服务端发送的掩码帧, 违反RFC6455
+		// Client side: accept masked frames from servers. This violates RFC6455
+		MaskedFramesAllowed bool
+
+		// 容忍旧浏览器和类库已知的不规范permessage-deflate行为并输出Warn日志, 而不是关闭连接或者握手失败:
+		// 消息结尾没有去掉00 00 ff ff, 握手参数重复或者取值无效, 服务端响应回显client_max_window_bits=15或者超出请求的server_max_window_bits
+		// Tolerate known non-conforming permessage-deflate behavior of older browsers and libraries with a Warn log
+		// instead of closing the connection or failing the handshake: messages still ending with 00 00 ff ff,
+		// duplicate or invalid window bits parameters, and servers echoing client_max_window_bits=15 or exceeding
+		// the requested server_max_window_bits
+		DeflateQuirksAllowed bool
+
+		// 禁止的数据帧操作码, 例如只接受文本的接口可以设置为[]Opcode{OpcodeBinary}; 收到时以1003状态码关闭连接, 不会调用OnMessage
+		// Disallowed data opcodes, e.g. []Opcode{OpcodeBinary} for a text-only API; such messages close the connection
+		// with 1003 Unsupported Data instead of reaching OnMessage
+		DisallowedOpcodes []Opcode
+
+		// 分片重组时消息超过该长度会转存到临时文件, Message.Data为空, 通过Message.Reader读取; 0表示不开启
+		// 压缩和自定义扩展处理的消息不会转存; 总长度仍然受ReadMaxMessageSize限制, 可以将其设置得比ReadMaxPayloadSize大
+		// 调用Message.Close删除临时文件
+		// Reassembled messages larger than this are spilled to a temp file, Message.Data is then empty and the content
+		// is read through Message.Reader; 0 disables spilling.
+		// Compressed messages and messages handled by custom extensions are never spilled. The total length is still
+		// bounded by ReadMaxMessageSize, which may be set larger than ReadMaxPayloadSize.
+		// Call Message.Close to remove the temp file.
+		ReadSpillThreshold int
+
+		// 临时文件目录, 默认为os.TempDir()
+		// Directory of the temp files, defaults to os.TempDir()
+		ReadSpillDir string
+
+		// 每读完一条消息把读缓冲区归还到池中, 有新数据时再取回; 适用于大量空闲连接的场景, 以少量开销换取内存
+		// Return the read buffer to a pool after each complete message and reacquire it when new data arrives.
+		// Trades a little overhead for memory when holding many mostly idle connections
+		ReadBufferReleaseEnabled bool
+
+		// 不使用bufio.Reader, 直接从连接读取帧头(存放在连接内固定大小的数组中)和负载(读入内存池的缓冲区)
+		// 省去每个连接的读缓冲区, 代价是每帧多几次系统调用; 开启后ReadBufferSize和ReadBufferReleaseEnabled只作用于握手
+		// Read without bufio.Reader: frame headers are parsed from a small fixed per-connection array and payloads are read
+		// straight into pooled buffers. Saves the per-connection read buffer at the cost of a few more syscalls per frame;
+		// ReadBufferSize only applies to the handshake and ReadBufferReleaseEnabled has no effect
+		RawReadEnabled bool
+
+		// 单帧数据消息载荷的分配器, 替换内置的内存池, 用于堆外或者按区域分配等策略; 为nil时使用内存池.
+		// 缓冲区在Message.Close时归还, 调用Message.Retain后不再归还; 分片重组和解压后的消息仍然使用内置的缓冲区
+		// Allocator of the payloads of single frame data messages, replacing the built-in pool for off-heap or
+		// region-based strategies; nil uses the pool. Buffers are given back on Message.Close, and not at all after
+		// Message.Retain. Reassembled and decompressed messages still use the built-in buffers
+		ReadPayloadAllocator PayloadAllocator
+
+		// 套接字的内核接收和发送缓冲区大小(SO_RCVBUF/SO_SNDBUF), 0表示使用系统默认值; 只作用于TCP连接(包括TLS)
+		// 高带宽的推送需要调大, 连接数很多时调小可以节省内核内存
+		// Kernel receive and send buffer sizes of the socket (SO_RCVBUF/SO_SNDBUF), 0 keeps the system default.
+		// Only applies to TCP connections, TLS included. High-bandwidth feeds benefit from larger buffers,
+		// smaller ones save kernel memory with many connections
+		SocketReadBufferSize  int
+		SocketWriteBufferSize int
+
+		// 开启TCP保活, 即使不发送应用层的ping, 内核也能发现失效的对端(例如NAT映射已经过期的连接); 只作用于TCP连接(包括TLS)
+		// TCPKeepAliveInterval是开始探测前的空闲时间和探测间隔, TCPKeepAliveCount是判定失效前的探测次数, 0表示使用系统默认值.
+		// 关闭时不改变连接的设置(Go的监听器和拨号器默认已开启保活). 见Conn.SetKeepAlive
+		// Enable TCP keepalive, so that dead peers (e.g. behind expired NAT mappings) are detected by the kernel even
+		// when no application pings are sent. Only applies to TCP connections, TLS included.
+		// TCPKeepAliveInterval is both the idle time before probing starts and the interval between probes,
+		// TCPKeepAliveCount is the number of unanswered probes before the connection is dropped, 0 keeps the system default.
+		// When disabled the connection is left as is (Go listeners and dialers enable keepalive by default).
+		// See Conn.SetKeepAlive
+		TCPKeepAliveEnabled  bool
+		TCPKeepAliveInterval time.Duration
+		TCPKeepAliveCount    int
+
+		// 收到保留操作码时的处理策略, 默认以1002状态码关闭连接
+		// Policy for frames with reserved opcodes, close with 1002 by default
+		UnknownOpcodePolicy UnknownOpcodePolicy
+
+		// 把导致连接关闭的错误映射为关闭帧的状态码和原因, 例如把超时映射为1001, 把业务校验错误映射为4xxx; 默认为DefaultCloseCode.
+		// 只作用于出错关闭的连接, WriteClose指定的状态码不受影响
+		// Maps the error closing a connection to the close frame code and reason, e.g. timeouts to 1001 or validation
+		// errors to 4xxx application codes; DefaultCloseCode by default.
+		// Only applies to connections closed by an error, the code given to WriteClose is kept as is
+		CloseCodeMapper CloseCodeMapper
+
+		// 严格遵守RFC6455和RFC7692: 强制校验文本和关闭原因的utf8编码, 收到保留操作码和掩码错误的帧时关闭连接,
+		// 并拒绝设置了保留位的控制帧和设置了RSV1的后续分片; 覆盖CheckUtf8Enabled, UnknownOpcodePolicy, 掩码和permessage-deflate的容忍选项.
+		// 用于Autobahn测试和需要证明合规的部署
+		// Enforce RFC6455 and RFC7692 to the letter: utf8 of text messages and close reasons is always validated,
+		// reserved opcodes and masking violations close the connection, and control frames with reserved bits or
+		// continuation frames with RSV1 are rejected. Overrides CheckUtf8Enabled, UnknownOpcodePolicy and the masking
+		// and permessage-deflate tolerance options. Meant for the Autobahn suite and deployments that have to demonstrate compliance
+		StrictProtocol bool
+
+		// 日志, 默认输出到标准库log, 不输出Debug级别; 容忍掩码错误时每个连接记录一次
+		// Logger, defaults to the standard library log without the Debug level;
+		// tolerated masking violations are logged once per connection
+		Logger Logger
 	}
 
 	ServerOption struct {
@@ -81,20 +385,121 @@ type (
 		// Deprecated: Size of the write buffer, v1.4.5 version of this parameter is deprecated
 		WriteBufferSize int
 
-		ReadAsyncEnabled    bool
-		ReadAsyncGoLimit    int
-		ReadMaxPayloadSize  int
-		ReadBufferSize      int
-		WriteMaxPayloadSize int
-		CompressEnabled     bool
-		CompressLevel       int
-		CompressThreshold   int
-		CompressorNum       int
-		CheckUtf8Enabled    bool
+		ReadAsyncEnabled        bool
+		ReadAsyncGoLimit        int
+		ReadAsyncOrdered        bool
+		ReadMaxPayloadSize      int
+		ReadMaxMessageSize      int
+		ReadMaxDecompressedSize int
+		ReadMaxExpansionRatio   int
+		ReadMaxFragments        int
+		ReadBufferSize          int
+		WriteMaxPayloadSize     int
+		WriteArenaSize          int
+		CompressEnabled         bool
+		CompressLevel           int
+		CompressThreshold       int
+		CompressLevelRealtime   int
+		CompressLevelBulk       int
+		CompressorNum           int
+		DecompressorNum         int
+		DecompressorPinned      bool
+		CompressorPinned        bool
+		ContextTakeoverEnabled  bool
+		DecompressWindowBits    int
+		NewCompressor           func(level int) Compressor
+		NewDecompressor         func() Decompressor
+		CompressDictionary      []byte
+		CompressSkipRatio       float64
+		CompressProbeInterval   int
+		CompressOpcodes         []Opcode
+		CheckUtf8Enabled        bool
+		Utf8Validator           func(p []byte) bool
+		AutoPongEnabled         bool
+		IdleTimeout             time.Duration
+		SlowHandlerThreshold    time.Duration
+		WriteStallThreshold     time.Duration
+		WriteStallCloseEnabled  bool
+		ReadMessageRate         int
+		ReadByteRate            int
+		ReadRatePolicy          RatePolicy
+		FrameObserver           FrameObserver
+		MessageObserver         MessageObserver
+		Extensions              []Extension
+		DisallowedOpcodes       []Opcode
+		UnknownOpcodePolicy     UnknownOpcodePolicy
+		CloseCodeMapper         CloseCodeMapper
+		StrictProtocol          bool
+		ReadSpillThreshold      int
+		ReadSpillDir            string
+		SocketReadBufferSize    int
+		SocketWriteBufferSize   int
+		TCPKeepAliveEnabled     bool
+		TCPKeepAliveInterval    time.Duration
+		TCPKeepAliveCount       int
+		Logger                  Logger
+
+		// 空闲时归还读缓冲区
+		// Release the read buffer while idle
+		ReadBufferReleaseEnabled bool
+
+		// 不使用bufio读取
+		// Read without bufio
+		RawReadEnabled bool
+
+		// 入站载荷的分配器
+		// Allocator of inbound payloads
+		ReadPayloadAllocator PayloadAllocator
+
+		// 接受客户端发送的未掩码帧
+		// Accept unmasked frames from clients
+		UnmaskedFramesAllowed bool
+
+		// 容忍不规范的permessage-deflate实现
+		// Tolerate non-conforming permessage-deflate implementations
+		DeflateQuirksAllowed bool
+
+		// 所有连接同时运行的OnMessage协程总数上限, 0表示不限制
+		// Cap on OnMessage goroutines running at the same time across all connections, 0 means no cap
+		ReadAsyncGlobalLimit int
+
+		// 读缓冲区, 写队列和异步读队列占用的近似内存的水位线(字节). 超过后新的握手返回503, 就绪探针返回503,
+		// 并按MemorySlowConsumerBytes关闭慢消费者; 0表示不统计
+		// Watermark in bytes of the approximate memory held by read buffers, write queues and async read queues.
+		// Above it new handshakes and the readiness probe get 503, and slow consumers are shed according to
+		// MemorySlowConsumerBytes. 0 disables the accounting
+		MemoryWatermark int
+
+		// 超过MemoryWatermark时, 写队列积压超过该字节数的连接以1013关闭; 0表示不关闭
+		// Above MemoryWatermark, connections with more than this many bytes queued for writing are closed with 1013.
+		// 0 never sheds connections
+		MemorySlowConsumerBytes int
+
+		// Server.RunTLS接受的TLS 1.3连接在握手之后把发送方向的加密交给Linux内核(kTLS), 帧的写入不再经过用户态加密,
+		// 读取仍然由crypto/tls解密. 需要内核加载tls模块; 其他平台, 没有tls模块的内核, TLS 1.2以及内核不支持的密码套件
+		// 回退到用户态TLS. 开启后不发送会话票据, 也不发送close_notify; 对端请求更新密钥(KeyUpdate)的连接会被关闭
+		// Hand the encryption of outbound records to the Linux kernel (kTLS) after the handshake on TLS 1.3 connections
+		// accepted by Server.RunTLS, so that frame writes skip userspace encryption; reads are still decrypted by
+		// crypto/tls. Requires the kernel tls module. Other platforms, kernels without it, TLS 1.2 and cipher suites
+		// the kernel lacks fall back to userspace TLS. When enabled neither session tickets nor close_notify are sent,
+		// and connections whose peer requests a KeyUpdate are closed
+		KernelTLSEnabled bool
 
 		// 握手超时时间
 		HandshakeTimeout time.Duration
 
+		// 保留握手请求和响应的原始字节, 每个方向最多保留该长度, 通过Conn.Handshake获取; 0表示不保留.
+		// 用于审计和调试对原始握手签名的鉴权方案
+		// Retain the raw bytes of the upgrade request and response, at most this many bytes each, see Conn.Handshake.
+		// 0 retains nothing. For audit trails and debugging auth schemes that sign the raw handshake
+		HandshakeCaptureSize int
+
+		// 除13之外额外接受的Sec-WebSocket-Version, 例如草案客户端使用的"8";
+		// 不支持的版本返回426, 并通过Sec-WebSocket-Version响应头列出支持的版本
+		// Sec-WebSocket-Version values accepted in addition to 13, e.g. "8" used by draft clients.
+		// Unsupported versions are answered with 426 and the supported versions listed in Sec-WebSocket-Version
+		AcceptedVersions []string
+
 		// WebSocket子协议, 一般不需要设置
 		// WebSocket subprotocol, usually no need to set
 		Subprotocols []string
@@ -107,6 +512,20 @@ type (
 		// 鉴权
 		// Authentication of requests for connection establishment
 		Authorize func(r *http.Request, session SessionStorage) bool
+
+		// 握手完成回调, 在101响应发出之后、进入读循环之前调用, 可通过socket.CompressionParams()获取协商结果
+		// Called after the 101 response has been sent and before the read loop starts.
+		// responseHeader is the header that was sent, socket.CompressionParams() reports the negotiated parameters
+		OnHandshake func(socket *Conn, r *http.Request, responseHeader http.Header)
+
+		// 访问日志, 每次握手尝试(成功或失败)之后调用, 适合输出到JSON日志
+		// Access log, called after each upgrade attempt, successful or not. Suitable for JSON log pipelines
+		AccessLog func(entry AccessLogEntry)
+
+		// 连接表, 设置后由服务端自动维护; Server.Connections需要设置它, 默认不开启
+		// Connection registry, maintained automatically by the server if set.
+		// Server.Connections requires it, it is off by default
+		ConnMap *ConnMap
 	}
 )
 
@@ -117,6 +536,12 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.ReadMaxPayloadSize <= 0 {
 		c.ReadMaxPayloadSize = defaultReadMaxPayloadSize
 	}
+	if c.ReadMaxMessageSize <= 0 {
+		c.ReadMaxMessageSize = c.ReadMaxPayloadSize
+	}
+	if c.ReadMaxDecompressedSize <= 0 {
+		c.ReadMaxDecompressedSize = c.ReadMaxMessageSize
+	}
 	if c.ReadAsyncGoLimit <= 0 {
 		c.ReadAsyncGoLimit = defaultReadAsyncGoLimit
 	}
@@ -135,9 +560,33 @@ func initServerOption(c *ServerOption) *ServerOption {
 	if c.CompressThreshold <= 0 {
 		c.CompressThreshold = defaultCompressThreshold
 	}
+	if c.DecompressWindowBits < minWindowBits || c.DecompressWindowBits > maxWindowBits {
+		c.DecompressWindowBits = defaultDecompressWindowBits
+	}
+	if c.CompressProbeInterval <= 0 {
+		c.CompressProbeInterval = defaultCompressProbeInterval
+	}
 	if c.CompressorNum <= 0 {
 		c.CompressorNum = defaultCompressorNum
 	}
+	if c.DecompressorNum <= 0 {
+		c.DecompressorNum = c.CompressorNum
+	}
+	if c.Utf8Validator == nil {
+		c.Utf8Validator = utf8.Valid
+	}
+	if c.NewCompressor == nil {
+		c.NewCompressor = flateCompressorFunc(c.CompressDictionary)
+	}
+	if c.NewDecompressor == nil {
+		c.NewDecompressor = flateDecompressorFunc(c.CompressDictionary)
+	}
+	if c.Logger == nil {
+		c.Logger = defaultLogger
+	}
+	if c.StrictProtocol {
+		c.CheckUtf8Enabled, c.UnknownOpcodePolicy, c.UnmaskedFramesAllowed, c.DeflateQuirksAllowed = true, UnknownOpcodeClose, false, false
+	}
 	if c.Authorize == nil {
 		c.Authorize = func(r *http.Request, session SessionStorage) bool {
 			return true
@@ -150,23 +599,85 @@ func initServerOption(c *ServerOption) *ServerOption {
 		c.HandshakeTimeout = defaultHandshakeTimeout
 	}
 	c.CompressorNum = internal.ToBinaryNumber(c.CompressorNum)
+	c.DecompressorNum = internal.ToBinaryNumber(c.DecompressorNum)
 
 	c.config = &Config{
-		ReadAsyncEnabled:    c.ReadAsyncEnabled,
-		ReadAsyncGoLimit:    c.ReadAsyncGoLimit,
-		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
-		ReadBufferSize:      c.ReadBufferSize,
-		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
-		WriteBufferSize:     c.WriteBufferSize,
-		CompressEnabled:     c.CompressEnabled,
-		CompressLevel:       c.CompressLevel,
-		CompressThreshold:   c.CompressThreshold,
-		CheckUtf8Enabled:    c.CheckUtf8Enabled,
-		CompressorNum:       c.CompressorNum,
+		ReadAsyncEnabled:         c.ReadAsyncEnabled,
+		ReadAsyncGoLimit:         c.ReadAsyncGoLimit,
+		ReadAsyncOrdered:         c.ReadAsyncOrdered,
+		ReadMaxPayloadSize:       c.ReadMaxPayloadSize,
+		ReadMaxMessageSize:       c.ReadMaxMessageSize,
+		ReadMaxDecompressedSize:  c.ReadMaxDecompressedSize,
+		ReadMaxExpansionRatio:    c.ReadMaxExpansionRatio,
+		ReadMaxFragments:         c.ReadMaxFragments,
+		ReadBufferSize:           c.ReadBufferSize,
+		WriteMaxPayloadSize:      c.WriteMaxPayloadSize,
+		WriteBufferSize:          c.WriteBufferSize,
+		WriteArenaSize:           c.WriteArenaSize,
+		CompressEnabled:          c.CompressEnabled,
+		CompressLevel:            c.CompressLevel,
+		CompressThreshold:        c.CompressThreshold,
+		CompressLevelRealtime:    c.CompressLevelRealtime,
+		CompressLevelBulk:        c.CompressLevelBulk,
+		ContextTakeoverEnabled:   c.ContextTakeoverEnabled,
+		DecompressWindowBits:     c.DecompressWindowBits,
+		NewCompressor:            c.NewCompressor,
+		NewDecompressor:          c.NewDecompressor,
+		CompressDictionary:       c.CompressDictionary,
+		CompressSkipRatio:        c.CompressSkipRatio,
+		CompressProbeInterval:    c.CompressProbeInterval,
+		CompressOpcodes:          c.CompressOpcodes,
+		CheckUtf8Enabled:         c.CheckUtf8Enabled,
+		Utf8Validator:            c.Utf8Validator,
+		CompressorNum:            c.CompressorNum,
+		DecompressorNum:          c.DecompressorNum,
+		DecompressorPinned:       c.DecompressorPinned,
+		CompressorPinned:         c.CompressorPinned,
+		AutoPongEnabled:          c.AutoPongEnabled,
+		IdleTimeout:              c.IdleTimeout,
+		SlowHandlerThreshold:     c.SlowHandlerThreshold,
+		WriteStallThreshold:      c.WriteStallThreshold,
+		WriteStallCloseEnabled:   c.WriteStallCloseEnabled,
+		ReadMessageRate:          c.ReadMessageRate,
+		ReadByteRate:             c.ReadByteRate,
+		ReadRatePolicy:           c.ReadRatePolicy,
+		FrameObserver:            c.FrameObserver,
+		MessageObserver:          c.MessageObserver,
+		Extensions:               c.Extensions,
+		DisallowedOpcodes:        c.DisallowedOpcodes,
+		UnknownOpcodePolicy:      c.UnknownOpcodePolicy,
+		CloseCodeMapper:          c.CloseCodeMapper,
+		StrictProtocol:           c.StrictProtocol,
+		ReadSpillThreshold:       c.ReadSpillThreshold,
+		ReadSpillDir:             c.ReadSpillDir,
+		ReadBufferReleaseEnabled: c.ReadBufferReleaseEnabled,
+		RawReadEnabled:           c.RawReadEnabled,
+		ReadPayloadAllocator:     c.ReadPayloadAllocator,
+		SocketReadBufferSize:     c.SocketReadBufferSize,
+		SocketWriteBufferSize:    c.SocketWriteBufferSize,
+		TCPKeepAliveEnabled:      c.TCPKeepAliveEnabled,
+		TCPKeepAliveInterval:     c.TCPKeepAliveInterval,
+		TCPKeepAliveCount:        c.TCPKeepAliveCount,
+		Logger:                   c.Logger,
+		UnmaskedFramesAllowed:    c.UnmaskedFramesAllowed,
+		DeflateQuirksAllowed:     c.DeflateQuirksAllowed,
+		ReadAsyncGlobalLimit:     c.ReadAsyncGlobalLimit,
+		MemorySlowConsumerBytes:  c.MemorySlowConsumerBytes,
+	}
+	c.config.compressionStats = new(compressionCounter)
+	c.config.serverStats = new(serverCounter)
+	if c.config.ReadAsyncEnabled && c.config.ReadAsyncGlobalLimit > 0 {
+		c.config.readScheduler = newReadScheduler(c.config.ReadAsyncGlobalLimit)
+	}
+	if c.MemoryWatermark > 0 {
+		c.config.memory = newMemoryCounter(c.MemoryWatermark)
+	}
+	if c.config.IdleTimeout > 0 {
+		c.config.timerWheel = newTimerWheel(idleTick(c.config.IdleTimeout))
 	}
 	if c.config.CompressEnabled {
-		c.config.compressors = new(compressors).initialize(c.CompressorNum, c.config.CompressLevel)
-		c.config.decompressors = new(decompressors).initialize(c.CompressorNum, c.config.CompressLevel)
+		c.config.initCompressors(c.CompressorNum, internal.SelectValue(c.CompressorNum < defaultClassCompressorNum, c.CompressorNum, defaultClassCompressorNum))
+		c.config.decompressors = new(decompressors).initialize(c.DecompressorNum, c.NewDecompressor)
 	}
 
 	return c
@@ -175,20 +686,102 @@ func initServerOption(c *ServerOption) *ServerOption {
 // 获取通用配置
 func (c *ServerOption) getConfig() *Config { return c.config }
 
+// 初始化默认压缩器池和各压缩类别的压缩器池
+// initialize the default compressor pool and the pools of the compression classes
+func (c *Config) initCompressors(num int, classNum int) {
+	c.compressors = new(compressors).initialize(num, c.CompressLevel, c.NewCompressor)
+	for class, level := range map[CompressClass]int{CompressClassRealtime: c.CompressLevelRealtime, CompressClassBulk: c.CompressLevelBulk} {
+		if level != 0 {
+			c.classCompressors[class] = new(compressors).initialize(classNum, level, c.NewCompressor)
+		}
+	}
+}
+
+// 按压缩类别选择压缩器池
+// select the compressor pool of a compression class
+func (c *Config) getCompressors(class CompressClass) *compressors {
+	if class < compressClassNum && c.classCompressors[class] != nil {
+		return c.classCompressors[class]
+	}
+	return c.compressors
+}
+
 type ClientOption struct {
 	// 写缓冲区的大小, v1.4.5版本此参数被废弃
 	// Deprecated: Size of the write buffer, v1.4.5 version of this parameter is deprecated
 	WriteBufferSize int
 
-	ReadAsyncEnabled    bool
-	ReadAsyncGoLimit    int
-	ReadMaxPayloadSize  int
-	ReadBufferSize      int
-	WriteMaxPayloadSize int
-	CompressEnabled     bool
-	CompressLevel       int
-	CompressThreshold   int
-	CheckUtf8Enabled    bool
+	ReadAsyncEnabled        bool
+	ReadAsyncGoLimit        int
+	ReadAsyncOrdered        bool
+	ReadMaxPayloadSize      int
+	ReadMaxMessageSize      int
+	ReadMaxDecompressedSize int
+	ReadMaxExpansionRatio   int
+	ReadMaxFragments        int
+	ReadBufferSize          int
+	WriteMaxPayloadSize     int
+	WriteArenaSize          int
+	CompressEnabled         bool
+	CompressLevel           int
+	CompressThreshold       int
+	CompressLevelRealtime   int
+	CompressLevelBulk       int
+	DecompressorPinned      bool
+	CompressorPinned        bool
+	ContextTakeoverEnabled  bool
+	DecompressWindowBits    int
+	NewCompressor           func(level int) Compressor
+	NewDecompressor         func() Decompressor
+	CompressDictionary      []byte
+	CompressSkipRatio       float64
+	CompressProbeInterval   int
+	CompressOpcodes         []Opcode
+	CheckUtf8Enabled        bool
+	Utf8Validator           func(p []byte) bool
+	AutoPongEnabled         bool
+	IdleTimeout             time.Duration
+	SlowHandlerThreshold    time.Duration
+	WriteStallThreshold     time.Duration
+	WriteStallCloseEnabled  bool
+	ReadMessageRate         int
+	ReadByteRate            int
+	ReadRatePolicy          RatePolicy
+	FrameObserver           FrameObserver
+	MessageObserver         MessageObserver
+	Extensions              []Extension
+	DisallowedOpcodes       []Opcode
+	UnknownOpcodePolicy     UnknownOpcodePolicy
+	CloseCodeMapper         CloseCodeMapper
+	StrictProtocol          bool
+	ReadSpillThreshold      int
+	ReadSpillDir            string
+	SocketReadBufferSize    int
+	SocketWriteBufferSize   int
+	TCPKeepAliveEnabled     bool
+	TCPKeepAliveInterval    time.Duration
+	TCPKeepAliveCount       int
+	Logger                  Logger
+
+	// 空闲时归还读缓冲区
+	// Release the read buffer while idle
+	ReadBufferReleaseEnabled bool
+
+	// 不使用bufio读取
+	// Read without bufio
+	RawReadEnabled bool
+
+	// 入站载荷的分配器
+	// Allocator of inbound payloads
+	ReadPayloadAllocator PayloadAllocator
+
+	// 接受服务端发送的掩码帧
+	// Accept masked frames from servers
+	MaskedFramesAllowed bool
+
+	// 容忍不规范的permessage-deflate实现
+	// Tolerate non-conforming permessage-deflate implementations
+	DeflateQuirksAllowed bool
 
 	// 连接地址, 例如 wss://example.com/connect
 	// server address, eg: wss://example.com/connect
@@ -201,6 +794,11 @@ type ClientOption struct {
 	// 握手超时时间
 	HandshakeTimeout time.Duration
 
+	// 保留握手请求和响应的原始字节, 每个方向最多保留该长度, 通过Conn.Handshake获取; 0表示不保留
+	// Retain the raw bytes of the upgrade request and response, at most this many bytes each, see Conn.Handshake.
+	// 0 retains nothing
+	HandshakeCaptureSize int
+
 	// TLS设置
 	TlsConfig *tls.Config
 
@@ -221,6 +819,12 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.ReadMaxPayloadSize <= 0 {
 		c.ReadMaxPayloadSize = defaultReadMaxPayloadSize
 	}
+	if c.ReadMaxMessageSize <= 0 {
+		c.ReadMaxMessageSize = c.ReadMaxPayloadSize
+	}
+	if c.ReadMaxDecompressedSize <= 0 {
+		c.ReadMaxDecompressedSize = c.ReadMaxMessageSize
+	}
 	if c.ReadAsyncGoLimit <= 0 {
 		c.ReadAsyncGoLimit = defaultReadAsyncGoLimit
 	}
@@ -239,9 +843,30 @@ func initClientOption(c *ClientOption) *ClientOption {
 	if c.CompressThreshold <= 0 {
 		c.CompressThreshold = defaultCompressThreshold
 	}
+	if c.DecompressWindowBits < minWindowBits || c.DecompressWindowBits > maxWindowBits {
+		c.DecompressWindowBits = defaultDecompressWindowBits
+	}
+	if c.CompressProbeInterval <= 0 {
+		c.CompressProbeInterval = defaultCompressProbeInterval
+	}
 	if c.HandshakeTimeout <= 0 {
 		c.HandshakeTimeout = defaultHandshakeTimeout
 	}
+	if c.Utf8Validator == nil {
+		c.Utf8Validator = utf8.Valid
+	}
+	if c.NewCompressor == nil {
+		c.NewCompressor = flateCompressorFunc(c.CompressDictionary)
+	}
+	if c.NewDecompressor == nil {
+		c.NewDecompressor = flateDecompressorFunc(c.CompressDictionary)
+	}
+	if c.Logger == nil {
+		c.Logger = defaultLogger
+	}
+	if c.StrictProtocol {
+		c.CheckUtf8Enabled, c.UnknownOpcodePolicy, c.MaskedFramesAllowed, c.DeflateQuirksAllowed = true, UnknownOpcodeClose, false, false
+	}
 	if c.RequestHeader == nil {
 		c.RequestHeader = http.Header{}
 	}
@@ -253,21 +878,73 @@ func initClientOption(c *ClientOption) *ClientOption {
 
 func (c *ClientOption) getConfig() *Config {
 	config := &Config{
-		ReadAsyncEnabled:    c.ReadAsyncEnabled,
-		ReadAsyncGoLimit:    c.ReadAsyncGoLimit,
-		ReadMaxPayloadSize:  c.ReadMaxPayloadSize,
-		ReadBufferSize:      c.ReadBufferSize,
-		WriteMaxPayloadSize: c.WriteMaxPayloadSize,
-		WriteBufferSize:     c.WriteBufferSize,
-		CompressEnabled:     c.CompressEnabled,
-		CompressLevel:       c.CompressLevel,
-		CompressThreshold:   c.CompressThreshold,
-		CheckUtf8Enabled:    c.CheckUtf8Enabled,
-		CompressorNum:       1,
+		ReadAsyncEnabled:         c.ReadAsyncEnabled,
+		ReadAsyncGoLimit:         c.ReadAsyncGoLimit,
+		ReadAsyncOrdered:         c.ReadAsyncOrdered,
+		ReadMaxPayloadSize:       c.ReadMaxPayloadSize,
+		ReadMaxMessageSize:       c.ReadMaxMessageSize,
+		ReadMaxDecompressedSize:  c.ReadMaxDecompressedSize,
+		ReadMaxExpansionRatio:    c.ReadMaxExpansionRatio,
+		ReadMaxFragments:         c.ReadMaxFragments,
+		ReadBufferSize:           c.ReadBufferSize,
+		WriteMaxPayloadSize:      c.WriteMaxPayloadSize,
+		WriteBufferSize:          c.WriteBufferSize,
+		WriteArenaSize:           c.WriteArenaSize,
+		CompressEnabled:          c.CompressEnabled,
+		CompressLevel:            c.CompressLevel,
+		CompressThreshold:        c.CompressThreshold,
+		CompressLevelRealtime:    c.CompressLevelRealtime,
+		CompressLevelBulk:        c.CompressLevelBulk,
+		DecompressorPinned:       c.DecompressorPinned,
+		CompressorPinned:         c.CompressorPinned,
+		ContextTakeoverEnabled:   c.ContextTakeoverEnabled,
+		DecompressWindowBits:     c.DecompressWindowBits,
+		NewCompressor:            internal.SelectValue(c.NewCompressor == nil, flateCompressorFunc(c.CompressDictionary), c.NewCompressor),
+		NewDecompressor:          internal.SelectValue(c.NewDecompressor == nil, flateDecompressorFunc(c.CompressDictionary), c.NewDecompressor),
+		CompressDictionary:       c.CompressDictionary,
+		CompressSkipRatio:        c.CompressSkipRatio,
+		CompressProbeInterval:    c.CompressProbeInterval,
+		CompressOpcodes:          c.CompressOpcodes,
+		CheckUtf8Enabled:         c.CheckUtf8Enabled,
+		Utf8Validator:            internal.SelectValue(c.Utf8Validator == nil, utf8.Valid, c.Utf8Validator),
+		CompressorNum:            1,
+		DecompressorNum:          1,
+		AutoPongEnabled:          c.AutoPongEnabled,
+		IdleTimeout:              c.IdleTimeout,
+		SlowHandlerThreshold:     c.SlowHandlerThreshold,
+		WriteStallThreshold:      c.WriteStallThreshold,
+		WriteStallCloseEnabled:   c.WriteStallCloseEnabled,
+		ReadMessageRate:          c.ReadMessageRate,
+		ReadByteRate:             c.ReadByteRate,
+		ReadRatePolicy:           c.ReadRatePolicy,
+		FrameObserver:            c.FrameObserver,
+		MessageObserver:          c.MessageObserver,
+		Extensions:               c.Extensions,
+		DisallowedOpcodes:        c.DisallowedOpcodes,
+		UnknownOpcodePolicy:      c.UnknownOpcodePolicy,
+		CloseCodeMapper:          c.CloseCodeMapper,
+		StrictProtocol:           c.StrictProtocol,
+		ReadSpillThreshold:       c.ReadSpillThreshold,
+		ReadSpillDir:             c.ReadSpillDir,
+		ReadBufferReleaseEnabled: c.ReadBufferReleaseEnabled,
+		RawReadEnabled:           c.RawReadEnabled,
+		ReadPayloadAllocator:     c.ReadPayloadAllocator,
+		SocketReadBufferSize:     c.SocketReadBufferSize,
+		SocketWriteBufferSize:    c.SocketWriteBufferSize,
+		TCPKeepAliveEnabled:      c.TCPKeepAliveEnabled,
+		TCPKeepAliveInterval:     c.TCPKeepAliveInterval,
+		TCPKeepAliveCount:        c.TCPKeepAliveCount,
+		Logger:                   internal.SelectValue[Logger](c.Logger == nil, defaultLogger, c.Logger),
+		MaskedFramesAllowed:      c.MaskedFramesAllowed,
+		DeflateQuirksAllowed:     c.DeflateQuirksAllowed,
+		compressionStats:         new(compressionCounter),
+	}
+	if config.IdleTimeout > 0 {
+		config.timerWheel = sharedTimerWheel(idleTick(config.IdleTimeout))
 	}
 	if config.CompressEnabled {
-		config.compressors = new(compressors).initialize(1, config.CompressLevel)
-		config.decompressors = new(decompressors).initialize(1, config.CompressLevel)
+		config.initCompressors(1, 1)
+		config.decompressors = new(decompressors).initialize(1, config.NewDecompressor)
 	}
 	return config
 }
@@ -13,29 +13,120 @@ func validateServerOption(as *assert.Assertions, u *Upgrader) {
 	var config = u.option.getConfig()
 	as.Equal(config.ReadAsyncEnabled, option.ReadAsyncEnabled)
 	as.Equal(config.ReadAsyncGoLimit, option.ReadAsyncGoLimit)
+	as.Equal(config.ReadAsyncOrdered, option.ReadAsyncOrdered)
 	as.Equal(config.ReadMaxPayloadSize, option.ReadMaxPayloadSize)
+	as.Equal(config.ReadMaxMessageSize, option.ReadMaxMessageSize)
+	as.Equal(config.ReadMaxFragments, option.ReadMaxFragments)
 	as.Equal(config.WriteMaxPayloadSize, option.WriteMaxPayloadSize)
 	as.Equal(config.CompressEnabled, option.CompressEnabled)
 	as.Equal(config.CompressLevel, option.CompressLevel)
 	as.Equal(config.CompressThreshold, option.CompressThreshold)
+	as.Equal(config.CompressLevelRealtime, option.CompressLevelRealtime)
+	as.Equal(config.CompressLevelBulk, option.CompressLevelBulk)
+	as.Equal(config.ReadMaxDecompressedSize, option.ReadMaxDecompressedSize)
+	as.Equal(config.ReadMaxExpansionRatio, option.ReadMaxExpansionRatio)
+	as.Equal(config.ContextTakeoverEnabled, option.ContextTakeoverEnabled)
+	as.Equal(config.DecompressWindowBits, option.DecompressWindowBits)
 	as.Equal(config.CheckUtf8Enabled, option.CheckUtf8Enabled)
 	as.Equal(config.ReadBufferSize, option.ReadBufferSize)
 	as.Equal(config.WriteBufferSize, option.WriteBufferSize)
 	as.Equal(config.CompressorNum, option.CompressorNum)
+	as.Equal(config.DecompressorNum, option.DecompressorNum)
+	as.Equal(config.DecompressorPinned, option.DecompressorPinned)
+	as.Equal(config.CompressorPinned, option.CompressorPinned)
+	as.NotNil(config.Utf8Validator)
+	as.NotNil(config.NewCompressor)
+	as.NotNil(config.NewDecompressor)
+	as.Equal(config.CompressDictionary, option.CompressDictionary)
+	as.Equal(config.CompressSkipRatio, option.CompressSkipRatio)
+	as.Equal(config.CompressProbeInterval, option.CompressProbeInterval)
+	as.Equal(config.CompressOpcodes, option.CompressOpcodes)
+	as.Equal(config.AutoPongEnabled, option.AutoPongEnabled)
+	as.Equal(config.IdleTimeout, option.IdleTimeout)
+	as.Equal(config.SlowHandlerThreshold, option.SlowHandlerThreshold)
+	as.Equal(config.WriteStallThreshold, option.WriteStallThreshold)
+	as.Equal(config.WriteStallCloseEnabled, option.WriteStallCloseEnabled)
+	as.Equal(config.ReadMessageRate, option.ReadMessageRate)
+	as.Equal(config.ReadByteRate, option.ReadByteRate)
+	as.Equal(config.ReadRatePolicy, option.ReadRatePolicy)
+	as.Equal(config.FrameObserver, option.FrameObserver)
+	as.Equal(config.MessageObserver, option.MessageObserver)
+	as.Equal(len(config.Extensions), len(option.Extensions))
+	as.Equal(config.DisallowedOpcodes, option.DisallowedOpcodes)
+	as.Equal(config.UnknownOpcodePolicy, option.UnknownOpcodePolicy)
+	as.Equal(config.ReadSpillThreshold, option.ReadSpillThreshold)
+	as.Equal(config.ReadSpillDir, option.ReadSpillDir)
+	as.Equal(config.ReadBufferReleaseEnabled, option.ReadBufferReleaseEnabled)
+	as.Equal(config.RawReadEnabled, option.RawReadEnabled)
+	as.Equal(config.ReadPayloadAllocator, option.ReadPayloadAllocator)
+	as.Equal(config.SocketReadBufferSize, option.SocketReadBufferSize)
+	as.Equal(config.SocketWriteBufferSize, option.SocketWriteBufferSize)
+	as.Equal(config.WriteArenaSize, option.WriteArenaSize)
+	as.Equal(config.TCPKeepAliveEnabled, option.TCPKeepAliveEnabled)
+	as.Equal(config.TCPKeepAliveInterval, option.TCPKeepAliveInterval)
+	as.Equal(config.TCPKeepAliveCount, option.TCPKeepAliveCount)
+	as.Equal(config.UnmaskedFramesAllowed, option.UnmaskedFramesAllowed)
+	as.Equal(config.ReadAsyncGlobalLimit, option.ReadAsyncGlobalLimit)
+	as.Equal(config.MemorySlowConsumerBytes, option.MemorySlowConsumerBytes)
+	as.NotNil(config.Logger)
 }
 
 func validateClientOption(as *assert.Assertions, option *ClientOption) {
 	var config = option.getConfig()
 	as.Equal(config.ReadAsyncEnabled, option.ReadAsyncEnabled)
 	as.Equal(config.ReadAsyncGoLimit, option.ReadAsyncGoLimit)
+	as.Equal(config.ReadAsyncOrdered, option.ReadAsyncOrdered)
 	as.Equal(config.ReadMaxPayloadSize, option.ReadMaxPayloadSize)
+	as.Equal(config.ReadMaxMessageSize, option.ReadMaxMessageSize)
+	as.Equal(config.ReadMaxFragments, option.ReadMaxFragments)
 	as.Equal(config.WriteMaxPayloadSize, option.WriteMaxPayloadSize)
 	as.Equal(config.CompressEnabled, option.CompressEnabled)
 	as.Equal(config.CompressLevel, option.CompressLevel)
 	as.Equal(config.CompressThreshold, option.CompressThreshold)
+	as.Equal(config.CompressLevelRealtime, option.CompressLevelRealtime)
+	as.Equal(config.CompressLevelBulk, option.CompressLevelBulk)
+	as.Equal(config.ReadMaxDecompressedSize, option.ReadMaxDecompressedSize)
+	as.Equal(config.ReadMaxExpansionRatio, option.ReadMaxExpansionRatio)
+	as.Equal(config.ContextTakeoverEnabled, option.ContextTakeoverEnabled)
+	as.Equal(config.DecompressWindowBits, option.DecompressWindowBits)
 	as.Equal(config.CheckUtf8Enabled, option.CheckUtf8Enabled)
 	as.Equal(config.ReadBufferSize, option.ReadBufferSize)
 	as.Equal(config.WriteBufferSize, option.WriteBufferSize)
+	as.Equal(config.DecompressorPinned, option.DecompressorPinned)
+	as.Equal(config.CompressorPinned, option.CompressorPinned)
+	as.NotNil(config.Utf8Validator)
+	as.NotNil(config.NewCompressor)
+	as.NotNil(config.NewDecompressor)
+	as.Equal(config.CompressDictionary, option.CompressDictionary)
+	as.Equal(config.CompressSkipRatio, option.CompressSkipRatio)
+	as.Equal(config.CompressProbeInterval, option.CompressProbeInterval)
+	as.Equal(config.CompressOpcodes, option.CompressOpcodes)
+	as.Equal(config.AutoPongEnabled, option.AutoPongEnabled)
+	as.Equal(config.IdleTimeout, option.IdleTimeout)
+	as.Equal(config.SlowHandlerThreshold, option.SlowHandlerThreshold)
+	as.Equal(config.WriteStallThreshold, option.WriteStallThreshold)
+	as.Equal(config.WriteStallCloseEnabled, option.WriteStallCloseEnabled)
+	as.Equal(config.ReadMessageRate, option.ReadMessageRate)
+	as.Equal(config.ReadByteRate, option.ReadByteRate)
+	as.Equal(config.ReadRatePolicy, option.ReadRatePolicy)
+	as.Equal(config.FrameObserver, option.FrameObserver)
+	as.Equal(config.MessageObserver, option.MessageObserver)
+	as.Equal(len(config.Extensions), len(option.Extensions))
+	as.Equal(config.DisallowedOpcodes, option.DisallowedOpcodes)
+	as.Equal(config.UnknownOpcodePolicy, option.UnknownOpcodePolicy)
+	as.Equal(config.ReadSpillThreshold, option.ReadSpillThreshold)
+	as.Equal(config.ReadSpillDir, option.ReadSpillDir)
+	as.Equal(config.ReadBufferReleaseEnabled, option.ReadBufferReleaseEnabled)
+	as.Equal(config.RawReadEnabled, option.RawReadEnabled)
+	as.Equal(config.ReadPayloadAllocator, option.ReadPayloadAllocator)
+	as.Equal(config.SocketReadBufferSize, option.SocketReadBufferSize)
+	as.Equal(config.SocketWriteBufferSize, option.SocketWriteBufferSize)
+	as.Equal(config.WriteArenaSize, option.WriteArenaSize)
+	as.Equal(config.TCPKeepAliveEnabled, option.TCPKeepAliveEnabled)
+	as.Equal(config.TCPKeepAliveInterval, option.TCPKeepAliveInterval)
+	as.Equal(config.TCPKeepAliveCount, option.TCPKeepAliveCount)
+	as.Equal(config.MaskedFramesAllowed, option.MaskedFramesAllowed)
+	as.NotNil(config.Logger)
 }
 
 // 检查默认配置
@@ -50,6 +141,7 @@ func TestDefaultUpgrader(t *testing.T) {
 	as.Equal(defaultReadMaxPayloadSize, config.ReadMaxPayloadSize)
 	as.Equal(defaultWriteMaxPayloadSize, config.WriteMaxPayloadSize)
 	as.Equal(defaultCompressorNum, config.CompressorNum)
+	as.Equal(defaultCompressorNum, config.DecompressorNum)
 	as.Equal(defaultHandshakeTimeout, updrader.option.HandshakeTimeout)
 	as.NotNil(updrader.eventHandler)
 	as.NotNil(config)
@@ -67,12 +159,15 @@ func TestCompressServerOption(t *testing.T) {
 		var updrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
 			CompressEnabled: true,
 			CompressorNum:   60,
+			DecompressorNum: 5,
 		})
 		var config = updrader.option.getConfig()
 		as.Equal(true, config.CompressEnabled)
 		as.Equal(defaultCompressLevel, config.CompressLevel)
 		as.Equal(defaultCompressThreshold, config.CompressThreshold)
 		as.Equal(64, config.CompressorNum)
+		as.Equal(8, config.DecompressorNum)
+		as.Equal(8, len(config.decompressors.decompressors))
 		validateServerOption(as, updrader)
 	})
 
@@ -120,6 +215,7 @@ func TestDefaultClientOption(t *testing.T) {
 	as.Equal(defaultReadMaxPayloadSize, config.ReadMaxPayloadSize)
 	as.Equal(defaultWriteMaxPayloadSize, config.WriteMaxPayloadSize)
 	as.Equal(1, config.CompressorNum)
+	as.Equal(1, config.DecompressorNum)
 	as.NotNil(config)
 	as.Equal(0, len(option.RequestHeader))
 	validateClientOption(as, option)
@@ -140,14 +236,35 @@ func TestCompressClientOption(t *testing.T) {
 
 	t.Run("", func(t *testing.T) {
 		var option = &ClientOption{
-			CompressEnabled:   true,
-			CompressLevel:     flate.BestCompression,
-			CompressThreshold: 1024,
+			CompressEnabled:    true,
+			CompressLevel:      flate.BestCompression,
+			CompressThreshold:  1024,
+			DecompressorPinned: true,
+			CompressorPinned:   true,
 		}
 		var config = option.getConfig()
 		as.Equal(true, config.CompressEnabled)
 		as.Equal(flate.BestCompression, config.CompressLevel)
 		as.Equal(1024, config.CompressThreshold)
+		as.True(config.DecompressorPinned)
+		as.True(config.CompressorPinned)
 		validateClientOption(as, option)
 	})
 }
+
+func TestPreset(t *testing.T) {
+	var as = assert.New(t)
+	for _, item := range []func() Preset{PresetLowLatency, PresetHighThroughput, PresetLowMemory} {
+		var preset = item()
+		validateServerOption(as, NewUpgrader(new(BuiltinEventHandler), preset.Server))
+		validateClientOption(as, initClientOption(preset.Client))
+
+		// 每次返回新的配置
+		var another = item()
+		as.NotSame(preset.Server, another.Server)
+		as.NotSame(preset.Client, another.Client)
+		as.Nil(another.Server.config)
+	}
+	as.True(initServerOption(PresetHighThroughput().Server).getConfig().ReadAsyncOrdered)
+	as.False(initServerOption(PresetLowLatency().Server).getConfig().CompressEnabled)
+}
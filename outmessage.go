@@ -0,0 +1,117 @@
+package gws
+
+import "sync"
+
+// 放回池中的OutMessage保留的最大容量, 超过的缓冲区被丢弃, 避免偶尔的大消息让池常驻大量内存
+// largest capacity kept by an OutMessage returned to the pool. Bigger buffers are dropped,
+// so that an occasional large message does not pin memory in the pool
+const outMessageMaxCap = 64 * 1024
+
+var outMessagePool = sync.Pool{New: func() any { return new(OutMessage) }}
+
+// OutMessage 可复用的出站消息, 用于在载荷缓冲区上拼装消息后发送, 避免每次发送都分配载荷切片.
+// 同一个OutMessage可以反复Reset, 写入和发送, 也可以发送给多个连接; 用完后调用Release放回池中.
+// 不是并发安全的
+// OutMessage is a reusable outbound message: the payload is assembled in a buffer of its own and sent,
+// avoiding a payload slice allocation per send. The same OutMessage can be reset, written and sent again and again,
+// and sent to several connections; call Release to put it back into the pool when done.
+// It is not safe for concurrent use
+//
+// Example:
+//
+//	var msg = gws.NewOutMessage(gws.OpcodeText)
+//	defer msg.Release()
+//	for _, item := range updates {
+//		msg.Reset()
+//		_, _ = msg.WriteString(item.Name)
+//		_ = msg.WriteByte(':')
+//		_, _ = msg.Write(item.Payload)
+//		_ = msg.Send(socket)
+//	}
+type OutMessage struct {
+	opcode Opcode
+	buf    []byte
+}
+
+// NewOutMessage 从池中获取一个空的出站消息
+// NewOutMessage takes an empty outbound message from the pool
+func NewOutMessage(opcode Opcode) *OutMessage {
+	var c = outMessagePool.Get().(*OutMessage)
+	c.opcode = opcode
+	c.buf = c.buf[:0]
+	return c
+}
+
+// Reset 清空载荷, 保留操作码和缓冲区
+// Reset empties the payload, keeping the opcode and the buffer
+func (c *OutMessage) Reset() {
+	c.buf = c.buf[:0]
+}
+
+// SetOpcode 设置操作码
+// SetOpcode sets the opcode
+func (c *OutMessage) SetOpcode(opcode Opcode) {
+	c.opcode = opcode
+}
+
+// Opcode 操作码
+// Opcode returns the opcode
+func (c *OutMessage) Opcode() Opcode {
+	return c.opcode
+}
+
+// Write 追加载荷, 实现io.Writer
+// Write appends to the payload, implementing io.Writer
+func (c *OutMessage) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	return len(p), nil
+}
+
+// WriteString 追加字符串载荷
+// WriteString appends a string to the payload
+func (c *OutMessage) WriteString(s string) (int, error) {
+	c.buf = append(c.buf, s...)
+	return len(s), nil
+}
+
+// WriteByte 追加一个字节
+// WriteByte appends a byte to the payload
+func (c *OutMessage) WriteByte(b byte) error {
+	c.buf = append(c.buf, b)
+	return nil
+}
+
+// Bytes 当前的载荷, 在下一次修改之前有效
+// Bytes returns the current payload, valid until the next modification
+func (c *OutMessage) Bytes() []byte {
+	return c.buf
+}
+
+// Len 载荷长度
+// Len returns the payload length
+func (c *OutMessage) Len() int {
+	return len(c.buf)
+}
+
+// Send 同步发送消息, 返回后可以立即修改或者复用
+// Send writes the message synchronously, it can be modified or reused as soon as Send returns
+func (c *OutMessage) Send(socket *Conn) error {
+	return socket.WriteMessage(c.opcode, c.buf)
+}
+
+// SendAsync 异步发送消息, 载荷在入队时被复制或者编码, 返回后可以立即修改或者复用
+// SendAsync writes the message asynchronously. The payload is copied or encoded when queued,
+// so the message can be modified or reused as soon as SendAsync returns
+func (c *OutMessage) SendAsync(socket *Conn) error {
+	return socket.WriteAsync(c.opcode, c.buf)
+}
+
+// Release 放回池中, 之后不能再使用
+// Release puts the message back into the pool, it must not be used afterwards
+func (c *OutMessage) Release() {
+	if cap(c.buf) > outMessageMaxCap {
+		c.buf = nil
+	}
+	c.buf = c.buf[:0]
+	outMessagePool.Put(c)
+}
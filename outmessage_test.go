@@ -0,0 +1,71 @@
+package gws
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutMessage(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("send", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var received = make(chan *Message, 4)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message }
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var msg = NewOutMessage(OpcodeText)
+		defer msg.Release()
+		_, _ = msg.WriteString("hello")
+		_ = msg.WriteByte(',')
+		_, _ = msg.Write([]byte("world"))
+		as.Equal(11, msg.Len())
+		as.Equal(OpcodeText, msg.Opcode())
+		as.NoError(msg.Send(server))
+		var message = <-received
+		as.Equal(OpcodeText, message.Opcode)
+		as.Equal("hello,world", message.Data.String())
+
+		// 复用同一个消息
+		msg.Reset()
+		msg.SetOpcode(OpcodeBinary)
+		_, _ = msg.Write([]byte{1, 2, 3})
+		as.NoError(msg.SendAsync(server))
+		msg.Reset()
+		_, _ = msg.Write([]byte{4})
+		message = <-received
+		as.Equal(OpcodeBinary, message.Opcode)
+		as.Equal([]byte{1, 2, 3}, message.Bytes())
+	})
+
+	t.Run("pool", func(t *testing.T) {
+		var msg = NewOutMessage(OpcodeText)
+		_, _ = msg.Write(make([]byte, outMessageMaxCap+1))
+		msg.Release()
+		as.Nil(msg.buf)
+
+		msg = NewOutMessage(OpcodeBinary)
+		as.Equal(0, msg.Len())
+		as.Equal(OpcodeBinary, msg.Opcode())
+		msg.Release()
+	})
+
+	// 复用时发送不分配内存
+	t.Run("allocs", func(t *testing.T) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+		var conn = &Conn{conn: &benchConn{}, config: upgrader.option.getConfig()}
+		var msg = NewOutMessage(OpcodeText)
+		defer msg.Release()
+		var allocs = testing.AllocsPerRun(100, func() {
+			msg.Reset()
+			_, _ = msg.WriteString("price:")
+			_, _ = msg.Write(testdata[:256])
+			_ = msg.Send(conn)
+		})
+		as.Equal(0.0, allocs)
+	})
+}
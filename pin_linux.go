@@ -0,0 +1,34 @@
+//go:build linux
+
+package gws
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// 把当前线程绑定到第index个可用的CPU上, 调用方已经执行runtime.LockOSThread
+// pin the current thread to the index-th available CPU, the caller has called runtime.LockOSThread
+func pinThread(index int) error {
+	var mask [16]uint64
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask))); errno != 0 {
+		return os.NewSyscallError("sched_getaffinity", errno)
+	}
+	var cpus []int
+	for i := 0; i < len(mask)*64; i++ {
+		if mask[i/64]&(1<<(uint(i)%64)) != 0 {
+			cpus = append(cpus, i)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil
+	}
+	var cpu = cpus[index%len(cpus)]
+	var pinned [16]uint64
+	pinned[cpu/64] = 1 << (uint(cpu) % 64)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(pinned), uintptr(unsafe.Pointer(&pinned))); errno != 0 {
+		return os.NewSyscallError("sched_setaffinity", errno)
+	}
+	return nil
+}
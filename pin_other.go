@@ -0,0 +1,7 @@
+//go:build !linux
+
+package gws
+
+// 其他平台只绑定系统线程, 不绑定CPU
+// other platforms only lock the OS thread without pinning it to a CPU
+func pinThread(index int) error { return nil }
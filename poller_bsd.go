@@ -0,0 +1,95 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package gws
+
+import (
+	"os"
+	"syscall"
+)
+
+// 基于kqueue的poller, EV_ONESHOT在每次通知后自动删除事件, 通过管道唤醒
+// kqueue based poller. EV_ONESHOT deletes the event after every notification, woken up through a pipe
+type poller struct {
+	fd     int
+	pipe   [2]int
+	events [pollerBatchSize]syscall.Kevent_t
+}
+
+func newPoller() (*poller, error) {
+	fd, err := syscall.Kqueue()
+	if err != nil {
+		return nil, os.NewSyscallError("kqueue", err)
+	}
+	syscall.CloseOnExec(fd)
+	var c = &poller{fd: fd}
+	if err = syscall.Pipe(c.pipe[:]); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("pipe", err)
+	}
+	for _, item := range c.pipe {
+		syscall.CloseOnExec(item)
+		_ = syscall.SetNonblock(item, true)
+	}
+	if err = c.ctl(c.pipe[0], syscall.EV_ADD); err != nil {
+		c.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *poller) ctl(fd int, flags int) error {
+	var changes = make([]syscall.Kevent_t, 1)
+	syscall.SetKevent(&changes[0], fd, syscall.EVFILT_READ, flags)
+	_, err := syscall.Kevent(c.fd, changes, nil, nil)
+	return os.NewSyscallError("kevent", err)
+}
+
+func (c *poller) add(fd int) error {
+	return c.ctl(fd, syscall.EV_ADD|syscall.EV_ONESHOT)
+}
+
+func (c *poller) rearm(fd int) error {
+	return c.ctl(fd, syscall.EV_ADD|syscall.EV_ONESHOT)
+}
+
+// 已经触发的EV_ONESHOT事件已被删除, 忽略ENOENT
+// a fired EV_ONESHOT event is already deleted, ENOENT is ignored
+func (c *poller) remove(fd int) error {
+	if err := c.ctl(fd, syscall.EV_DELETE); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 等待可读的文件描述符, 追加到fds
+// wait for readable descriptors and append them to fds
+func (c *poller) wait(fds []int) ([]int, error) {
+	n, err := syscall.Kevent(c.fd, nil, c.events[:], nil)
+	if err == syscall.EINTR {
+		return fds, nil
+	}
+	if err != nil {
+		return fds, os.NewSyscallError("kevent", err)
+	}
+	for i := 0; i < n; i++ {
+		var fd = int(c.events[i].Ident)
+		if fd == c.pipe[0] {
+			return fds, errPollerClosed
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// 唤醒轮询协程, 使其退出
+// wake the polling goroutine up so that it exits
+func (c *poller) close() error {
+	_, err := syscall.Write(c.pipe[1], []byte{0})
+	return os.NewSyscallError("write", err)
+}
+
+func (c *poller) release() {
+	_ = syscall.Close(c.fd)
+	_ = syscall.Close(c.pipe[0])
+	_ = syscall.Close(c.pipe[1])
+}
@@ -0,0 +1,87 @@
+//go:build linux
+
+package gws
+
+import (
+	"os"
+	"syscall"
+)
+
+// 水平触发加EPOLLONESHOT, 每次通知后需要重新注册
+// level triggered with EPOLLONESHOT, the descriptor has to be rearmed after every notification
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// 基于epoll的poller, 通过管道唤醒
+// epoll based poller, woken up through a pipe
+type poller struct {
+	fd     int
+	pipe   [2]int
+	events [pollerBatchSize]syscall.EpollEvent
+}
+
+func newPoller() (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	var c = &poller{fd: fd}
+	if err = syscall.Pipe2(c.pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	if err = c.ctl(syscall.EPOLL_CTL_ADD, c.pipe[0], syscall.EPOLLIN); err != nil {
+		c.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *poller) ctl(op int, fd int, events uint32) error {
+	var ev = syscall.EpollEvent{Events: events, Fd: int32(fd)}
+	return os.NewSyscallError("epoll_ctl", syscall.EpollCtl(c.fd, op, fd, &ev))
+}
+
+func (c *poller) add(fd int) error {
+	return c.ctl(syscall.EPOLL_CTL_ADD, fd, pollEvents)
+}
+
+func (c *poller) rearm(fd int) error {
+	return c.ctl(syscall.EPOLL_CTL_MOD, fd, pollEvents)
+}
+
+func (c *poller) remove(fd int) error {
+	return c.ctl(syscall.EPOLL_CTL_DEL, fd, 0)
+}
+
+// 等待可读的文件描述符, 追加到fds
+// wait for readable descriptors and append them to fds
+func (c *poller) wait(fds []int) ([]int, error) {
+	n, err := syscall.EpollWait(c.fd, c.events[:], -1)
+	if err == syscall.EINTR {
+		return fds, nil
+	}
+	if err != nil {
+		return fds, os.NewSyscallError("epoll_wait", err)
+	}
+	for i := 0; i < n; i++ {
+		var fd = int(c.events[i].Fd)
+		if fd == c.pipe[0] {
+			return fds, errPollerClosed
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+// 唤醒轮询协程, 使其退出
+// wake the polling goroutine up so that it exits
+func (c *poller) close() error {
+	_, err := syscall.Write(c.pipe[1], []byte{0})
+	return os.NewSyscallError("write", err)
+}
+
+func (c *poller) release() {
+	_ = syscall.Close(c.fd)
+	_ = syscall.Close(c.pipe[0])
+	_ = syscall.Close(c.pipe[1])
+}
@@ -0,0 +1,29 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package gws
+
+import (
+	"net"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 不支持事件循环的平台
+// platforms without event loop support
+type poller struct{}
+
+func newPoller() (*poller, error) { return nil, internal.ErrReactorUnsupported }
+
+func (c *poller) add(fd int) error { return internal.ErrReactorUnsupported }
+
+func (c *poller) rearm(fd int) error { return internal.ErrReactorUnsupported }
+
+func (c *poller) remove(fd int) error { return nil }
+
+func (c *poller) wait(fds []int) ([]int, error) { return fds, errPollerClosed }
+
+func (c *poller) close() error { return nil }
+
+func (c *poller) release() {}
+
+func connFd(conn net.Conn) (int, error) { return 0, internal.ErrReactorUnsupported }
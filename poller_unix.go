@@ -0,0 +1,28 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package gws
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 获取连接的文件描述符, TLS等没有实现syscall.Conn的连接不支持
+// get the file descriptor of a connection, those not implementing syscall.Conn such as TLS are not supported
+func connFd(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, internal.ErrReactorUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd = -1
+	if err = raw.Control(func(v uintptr) { fd = int(v) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
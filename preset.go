@@ -0,0 +1,113 @@
+package gws
+
+import (
+	"time"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// Preset 调优预设, 作为配置的起点; 每次调用预设函数都返回新的配置, 可以在此基础上修改.
+// 各预设的读写开销可以用 go test -bench BenchmarkPreset 对比
+// Preset is a tuned starting point for the options. Every call of a preset function returns fresh options
+// that may be modified further. Compare the read and write costs of the presets with go test -bench BenchmarkPreset
+//
+// Example:
+//
+//	var preset = gws.PresetHighThroughput()
+//	preset.Server.Authorize = authorize
+//	gws.NewServer(handler, preset.Server).Run(":6666")
+type Preset struct {
+	Server *ServerOption
+	Client *ClientOption
+}
+
+// PresetLowLatency 低延迟: 不压缩, 在读协程中直接调用OnMessage, 预分配写缓冲区避免写路径上的内存池访问,
+// 写入卡住时尽快关闭连接, 适用于游戏, 交易等小消息实时场景
+// PresetLowLatency favours latency: no compression, OnMessage is called inline on the read goroutine,
+// a preallocated write buffer keeps the buffer pool off the write path and stalled writes close the connection
+// quickly. Suited to real-time traffic of small messages such as games and trading
+func PresetLowLatency() Preset {
+	return Preset{
+		Server: &ServerOption{
+			ReadBufferSize:         4 * 1024,
+			WriteArenaSize:         4 * 1024,
+			ReadMaxPayloadSize:     1024 * 1024,
+			WriteMaxPayloadSize:    1024 * 1024,
+			AutoPongEnabled:        true,
+			WriteStallThreshold:    time.Second,
+			WriteStallCloseEnabled: true,
+		},
+		Client: &ClientOption{
+			ReadBufferSize:      4 * 1024,
+			WriteArenaSize:      4 * 1024,
+			ReadMaxPayloadSize:  1024 * 1024,
+			WriteMaxPayloadSize: 1024 * 1024,
+			AutoPongEnabled:     true,
+		},
+	}
+}
+
+// PresetHighThroughput 高吞吐: 大的读缓冲区和内核缓冲区, 并行且保持连接内顺序地处理消息,
+// 开启压缩并自适应跳过压缩效果差的数据, 每个连接独占解压器, 适用于推送, 数据同步等大流量场景
+// PresetHighThroughput favours throughput: large read and kernel buffers, messages handled in parallel
+// while keeping the order within a connection, compression with the adaptive skip of poorly compressing data
+// and a dedicated decompressor per connection. Suited to heavy traffic such as feeds and data sync
+func PresetHighThroughput() Preset {
+	return Preset{
+		Server: &ServerOption{
+			ReadAsyncEnabled:      true,
+			ReadAsyncGoLimit:      16,
+			ReadAsyncOrdered:      true,
+			ReadBufferSize:        64 * 1024,
+			SocketReadBufferSize:  1024 * 1024,
+			SocketWriteBufferSize: 1024 * 1024,
+			CompressEnabled:       true,
+			CompressLevel:         flate.BestSpeed,
+			CompressThreshold:     1024,
+			CompressorNum:         128,
+			CompressSkipRatio:     0.9,
+			DecompressorPinned:    true,
+			AutoPongEnabled:       true,
+		},
+		Client: &ClientOption{
+			ReadAsyncEnabled:      true,
+			ReadAsyncGoLimit:      16,
+			ReadAsyncOrdered:      true,
+			ReadBufferSize:        64 * 1024,
+			SocketReadBufferSize:  1024 * 1024,
+			SocketWriteBufferSize: 1024 * 1024,
+			CompressEnabled:       true,
+			CompressLevel:         flate.BestSpeed,
+			CompressThreshold:     1024,
+			CompressSkipRatio:     0.9,
+			AutoPongEnabled:       true,
+		},
+	}
+}
+
+// PresetLowMemory 低内存: 不压缩, 不使用bufio读取, 小的内核缓冲区和较低的消息长度上限,
+// 适用于大量空闲连接的场景, 例如通知和物联网
+// PresetLowMemory favours memory: no compression, reads without bufio, small kernel buffers and lower
+// message size limits. Suited to many mostly idle connections such as notifications and IoT
+func PresetLowMemory() Preset {
+	return Preset{
+		Server: &ServerOption{
+			ReadBufferSize:        1024,
+			RawReadEnabled:        true,
+			ReadMaxPayloadSize:    256 * 1024,
+			WriteMaxPayloadSize:   256 * 1024,
+			SocketReadBufferSize:  16 * 1024,
+			SocketWriteBufferSize: 16 * 1024,
+			AutoPongEnabled:       true,
+		},
+		Client: &ClientOption{
+			ReadBufferSize:        1024,
+			RawReadEnabled:        true,
+			ReadMaxPayloadSize:    256 * 1024,
+			WriteMaxPayloadSize:   256 * 1024,
+			SocketReadBufferSize:  16 * 1024,
+			SocketWriteBufferSize: 16 * 1024,
+			AutoPongEnabled:       true,
+		},
+	}
+}
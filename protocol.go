@@ -1,10 +1,13 @@
 package gws
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"os"
+	"time"
 
 	"github.com/lxzan/gws/internal"
 )
@@ -22,19 +25,134 @@ const (
 	OpcodePong            Opcode = 0xA
 )
 
+// StatusCode 关闭状态码, 参考RFC6455 7.4
+// close status code, see RFC6455 section 7.4
+type StatusCode = internal.StatusCode
+
+const (
+	CloseNormalClosure     = internal.CloseNormalClosure
+	CloseGoingAway         = internal.CloseGoingAway
+	CloseProtocolError     = internal.CloseProtocolError
+	CloseUnsupported       = internal.CloseUnsupported
+	CloseNoStatusReceived  = internal.CloseNoStatusReceived
+	CloseAbnormalClosure   = internal.CloseAbnormalClosure
+	CloseUnsupportedData   = internal.CloseUnsupportedData
+	ClosePolicyViolation   = internal.ClosePolicyViolation
+	CloseMessageTooLarge   = internal.CloseMessageTooLarge
+	CloseMissingExtension  = internal.CloseMissingExtension
+	CloseInternalServerErr = internal.CloseInternalServerErr
+	CloseServiceRestart    = internal.CloseServiceRestart
+	CloseTryAgainLater     = internal.CloseTryAgainLater
+	CloseTLSHandshake      = internal.CloseTLSHandshake
+)
+
 func (c Opcode) isDataFrame() bool {
 	return c <= OpcodeBinary
 }
 
+// 保留的操作码 0x3-0x7, 0xB-0xF
+// reserved opcodes 0x3-0x7, 0xB-0xF
+func (c Opcode) isReserved() bool {
+	return (c > OpcodeBinary && c < OpcodeCloseConnection) || c > OpcodePong
+}
+
+// UnknownOpcodePolicy 收到保留操作码时的处理策略
+// Handling policy for frames with reserved opcodes
+type UnknownOpcodePolicy uint8
+
+const (
+	// UnknownOpcodeClose 以1002状态码关闭连接
+	// Close the connection with 1002
+	UnknownOpcodeClose UnknownOpcodePolicy = 0
+
+	// UnknownOpcodeSkip 丢弃该帧
+	// Silently skip the frame
+	UnknownOpcodeSkip UnknownOpcodePolicy = 1
+
+	// UnknownOpcodeDeliver 交给UnknownFrameHandler处理, Event没有实现该接口时丢弃
+	// Deliver the frame to UnknownFrameHandler, skip it if the Event does not implement the interface
+	UnknownOpcodeDeliver UnknownOpcodePolicy = 2
+)
+
+// CloseError OnClose收到的错误, 类型和字段保持稳定
+// The error delivered to OnClose, its type and fields are kept stable
 type CloseError struct {
-	Code   uint16
+	// 关闭状态码. 收到关闭帧时为对端发送的状态码, 否则为本端发送的状态码
+	// Close status code. The code sent by the peer if a close frame was received, otherwise the code sent by this side
+	Code uint16
+
+	// 关闭原因
+	// Close reason
 	Reason []byte
+
+	// 本端出错时的原始错误, 收到对端关闭帧时为nil
+	// The underlying error if this side failed, nil if the peer sent a close frame
+	Err error
+
+	// 关闭时的连接统计
+	// Statistics of the connection at close
+	Stats ConnStats
+
+	// 关闭的时间
+	// time the connection was closed
+	ClosedAt time.Time
+}
+
+// ConnSummary 连接关闭时的摘要, 用于计费和分析, 不需要在外部维护计数器
+// Summary of a closed connection for billing and analytics, without tracking counters externally
+type ConnSummary struct {
+	// 连接持续的时间
+	// how long the connection lasted
+	Duration time.Duration
+
+	BytesIn     uint64 // 收到的字节数 / bytes received
+	BytesOut    uint64 // 发送的字节数 / bytes sent
+	MessagesIn  uint64 // 收到的数据消息数 / data messages received
+	MessagesOut uint64 // 发送的数据消息数 / data messages sent
+
+	// 关闭状态码, 见CloseError.Code
+	// close status code, see CloseError.Code
+	CloseCode uint16
+
+	// 导致关闭的本端错误, 对端正常关闭时为nil
+	// the error on this side that closed the connection, nil if the peer closed it
+	LastError error
+}
+
+// Summary 连接摘要, OnClose收到的err总是*CloseError
+// Summary returns the summary of the connection. The err passed to OnClose is always a *CloseError
+//
+// Example:
+//
+//	func (c *Handler) OnClose(socket *gws.Conn, err error) {
+//		var closeErr *gws.CloseError
+//		if errors.As(err, &closeErr) {
+//			report(closeErr.Summary())
+//		}
+//	}
+func (c *CloseError) Summary() ConnSummary {
+	var summary = ConnSummary{
+		BytesIn:     c.Stats.BytesIn,
+		BytesOut:    c.Stats.BytesOut,
+		MessagesIn:  c.Stats.MessagesIn,
+		MessagesOut: c.Stats.MessagesOut,
+		CloseCode:   c.Code,
+		LastError:   c.Err,
+	}
+	if !c.Stats.OpenedAt.IsZero() && !c.ClosedAt.IsZero() {
+		summary.Duration = c.ClosedAt.Sub(c.Stats.OpenedAt)
+	}
+	return summary
 }
 
 func (c *CloseError) Error() string {
 	return fmt.Sprintf("gws: connection closed, code=%d, reason=%s", c.Code, string(c.Reason))
 }
 
+func (c *CloseError) Unwrap() error {
+	return c.Err
+}
+
 // WebSocket Event
 type Event interface {
 	// 建立连接事件
@@ -43,9 +161,9 @@ type Event interface {
 
 	// 关闭事件
 	// 接收到了网络连接另一端发送的关闭帧, 或者IO过程中出现错误主动断开连接
-	// 如果是前者, err可以断言为*CloseError
+	// err总是*CloseError, 可以用errors.Is/As检查原始错误
 	// Received a close frame from the other end of the network connection, or disconnected voluntarily due to an error in the IO process
-	// In the former case, err can be asserted as *CloseError
+	// err is always *CloseError, use errors.Is/As to inspect the underlying error
 	OnClose(socket *Conn, err error)
 
 	// 心跳探测事件
@@ -57,18 +175,56 @@ type Event interface {
 	OnPong(socket *Conn, payload []byte)
 
 	// 消息事件
-	// 如果开启了ReadAsyncEnabled, 会并行地调用OnMessage; 没有做recover处理.
-	// If ReadAsyncEnabled is enabled, OnMessage is called in parallel. No recover is done.
+	// 如果开启了ReadAsyncEnabled, 会并行地调用OnMessage, 开启ReadAsyncOrdered可以保持单个连接内的顺序; 没有做recover处理.
+	// If ReadAsyncEnabled is enabled, OnMessage is called in parallel, ReadAsyncOrdered keeps the order within a connection.
+	// No recover is done.
 	OnMessage(socket *Conn, message *Message)
 }
 
+// ErrorHandler 可选的错误事件, Event实现了该接口时生效
+// 协议错误, 解压失败, IO错误等导致连接关闭时, 在关闭流程(发送关闭帧和OnClose)之前调用; 主动调用WriteClose不会触发
+// Optional error event, takes effect if the Event implements it.
+// Called before the close path (the close frame and OnClose) runs when the connection fails due to protocol violations,
+// decompression failures, I/O errors, etc. WriteClose does not trigger it.
+type ErrorHandler interface {
+	OnError(socket *Conn, err error)
+}
+
+// UnknownFrameHandler 可选的事件, UnknownOpcodePolicy为UnknownOpcodeDeliver时接收保留操作码的帧
+// payload在回调返回后不能再使用
+// Optional event, receives frames with reserved opcodes under UnknownOpcodeDeliver.
+// The payload must not be used after the callback returns
+type UnknownFrameHandler interface {
+	OnUnknownFrame(socket *Conn, fin bool, opcode Opcode, payload []byte)
+}
+
+// SlowMessageHandler 可选的事件, OnMessage耗时超过SlowHandlerThreshold时调用
+// Optional event, called when OnMessage took longer than SlowHandlerThreshold
+type SlowMessageHandler interface {
+	OnSlowMessage(socket *Conn, opcode Opcode, payloadLength int, elapsed time.Duration)
+}
+
+// WriteStallHandler 可选的事件, 一次写入超过WriteStallThreshold没有完成时在定时器协程中调用
+// Optional event, called from a timer goroutine when a write has not completed after WriteStallThreshold
+type WriteStallHandler interface {
+	OnWriteStall(socket *Conn, elapsed time.Duration)
+}
+
 type BuiltinEventHandler struct{}
 
 func (b BuiltinEventHandler) OnOpen(socket *Conn) {}
 
 func (b BuiltinEventHandler) OnClose(socket *Conn, err error) {}
 
-func (b BuiltinEventHandler) OnPing(socket *Conn, payload []byte) { _ = socket.WritePong(nil) }
+func (b BuiltinEventHandler) OnError(socket *Conn, err error) {}
+
+// OnPing 开启AutoPongEnabled后由库自动回复pong, 这里不再重复回复
+// If AutoPongEnabled is on, the pong has already been written by the library
+func (b BuiltinEventHandler) OnPing(socket *Conn, payload []byte) {
+	if !socket.config.AutoPongEnabled {
+		_ = socket.WritePong(nil)
+	}
+}
 
 func (b BuiltinEventHandler) OnPong(socket *Conn, payload []byte) {}
 
@@ -109,18 +265,13 @@ func (c *frameHeader) SetMask() {
 }
 
 func (c *frameHeader) SetLength(n uint64) (offset int) {
-	if n <= internal.ThresholdV1 {
-		(*c)[1] += uint8(n)
-		return 0
-	} else if n <= internal.ThresholdV2 {
-		(*c)[1] += 126
-		binary.BigEndian.PutUint16((*c)[2:4], uint16(n))
-		return 2
-	} else {
-		(*c)[1] += 127
-		binary.BigEndian.PutUint64((*c)[2:10], n)
-		return 8
-	}
+	return internal.PutFrameLength((*c)[1:], n)
+}
+
+// SetRSV 设置RSV位, bits为RSV1Bit/RSV2Bit/RSV3Bit的组合
+// set the RSV bits, bits is a combination of RSV1Bit/RSV2Bit/RSV3Bit
+func (c *frameHeader) SetRSV(bits uint8) {
+	(*c)[0] |= bits & rsvMask
 }
 
 func (c *frameHeader) SetMaskKey(offset int, key [4]byte) {
@@ -157,23 +308,13 @@ func (c *frameHeader) Parse(reader io.Reader) (int, error) {
 		return 0, err
 	}
 
-	var payloadLength = 0
 	var lengthCode = c.GetLengthCode()
-	switch lengthCode {
-	case 126:
-		if err := internal.ReadN(reader, (*c)[2:4], 2); err != nil {
+	if n := internal.FrameLengthSize(lengthCode); n > 0 {
+		if err := internal.ReadN(reader, (*c)[2:2+n], n); err != nil {
 			return 0, err
 		}
-		payloadLength = int(binary.BigEndian.Uint16((*c)[2:4]))
-
-	case 127:
-		if err := internal.ReadN(reader, (*c)[2:10], 8); err != nil {
-			return 0, err
-		}
-		payloadLength = int(binary.BigEndian.Uint64((*c)[2:10]))
-	default:
-		payloadLength = int(lengthCode)
 	}
+	var payloadLength = int(internal.ParseFrameLength(lengthCode, (*c)[2:]))
 
 	var maskOn = c.GetMask()
 	if maskOn {
@@ -185,6 +326,44 @@ func (c *frameHeader) Parse(reader io.Reader) (int, error) {
 	return payloadLength, nil
 }
 
+// 窥视缓冲区中的帧头, 头部不完整时ok为false
+// peek at the frame header in the buffer, ok is false if the header is incomplete
+func peekHeader(br *bufio.Reader) (header []byte, payloadLength int, ok bool) {
+	var buffered = br.Buffered()
+	if buffered < 2 {
+		return nil, 0, false
+	}
+	var p, _ = br.Peek(2)
+	var headerLength = internal.FrameHeaderLength(p[1])
+	if buffered < headerLength {
+		return nil, 0, false
+	}
+	header, _ = br.Peek(headerLength)
+	return header, int(internal.ParseFrameLength(header[1], header[2:])), true
+}
+
+// 头部已经在缓冲区中时直接解析, 布局与Parse相同; complete为true时还要求负载也已经在缓冲区中
+// parse the header straight from the buffer if it is there, with the same layout as Parse;
+// if complete is true the payload has to be buffered as well
+func (c *frameHeader) parseBuffered(br *bufio.Reader, complete bool) (int, bool) {
+	header, payloadLength, ok := peekHeader(br)
+	if !ok {
+		return 0, false
+	}
+	if complete && (payloadLength < 0 || br.Buffered()-len(header) < payloadLength) {
+		return 0, false
+	}
+	var ext = header[2:]
+	if header[1]&128 != 0 {
+		copy((*c)[10:14], ext[len(ext)-4:])
+		ext = ext[:len(ext)-4]
+	}
+	copy((*c)[0:2], header[0:2])
+	copy((*c)[2:], ext)
+	_, _ = br.Discard(len(header))
+	return payloadLength, true
+}
+
 // GetMaskKey parser把maskKey放到了末尾
 func (c *frameHeader) GetMaskKey() []byte {
 	return (*c)[10:14]
@@ -194,38 +373,144 @@ type Message struct {
 	// 内存池下标索引
 	index int
 
+	// 载荷来自自定义分配器时为该分配器和原始缓冲区
+	// the allocator and the original buffer if the payload came from a custom allocator
+	alloc PayloadAllocator
+	raw   []byte
+
 	// 操作码
 	Opcode Opcode
 
-	// 消息内容
+	// 消息内容, 写入临时文件的消息为空, 请使用Reader读取
+	// Message content, empty for messages spilled to a temp file, use Reader instead
 	Data *bytes.Buffer
+
+	// 临时文件, 超过ReadSpillThreshold的消息写入此文件
+	file *os.File
+
+	// 临时文件中的内容长度
+	fileSize int
 }
 
 func (c *Message) Read(p []byte) (n int, err error) {
+	if c.file != nil {
+		return c.file.Read(p)
+	}
 	return c.Data.Read(p)
 }
 
+// Reader 返回消息内容的io.ReadSeeker, 对内存中和临时文件中的消息都适用
+// Reader returns an io.ReadSeeker over the message content, works for messages in memory and in a temp file
+func (c *Message) Reader() io.ReadSeeker {
+	if c.file != nil {
+		return c.file
+	}
+	return bytes.NewReader(c.Data.Bytes())
+}
+
+// Spilled 消息是否被写入了临时文件
+// Spilled reports whether the message was spilled to a temp file
+func (c *Message) Spilled() bool {
+	return c.file != nil
+}
+
 func (c *Message) Bytes() []byte {
 	return c.Data.Bytes()
 }
 
-// Close recycle buffer
+// Retain 将缓冲区从内存池中脱离, 之后Close不再回收它, 返回的字节在Close之后依然有效; 适用于零拷贝地把payload交给队列
+// 写入临时文件的消息不受影响, 临时文件仍然在Close时删除
+// Retain detaches the buffer from the pool: Close no longer recycles it, so the returned bytes stay valid after Close.
+// Use it to hand the payload over to queues without copying.
+// Spilled messages are not affected, their temp file is still removed on Close
+func (c *Message) Retain() []byte {
+	myBufferPool.Detach(c.index)
+	c.index = 0
+	c.alloc, c.raw = nil, nil
+	return c.Data.Bytes()
+}
+
+// Clone 复制出一条不使用内存池的消息, 原消息可以照常Close
+// 只复制内存中的内容, 写入临时文件的消息请通过Reader读取
+// Clone returns a copy that does not use the pool, the original message can be closed as usual.
+// Only the in-memory content is copied, read spilled messages through Reader
+func (c *Message) Clone() *Message {
+	var p = make([]byte, c.Data.Len())
+	copy(p, c.Data.Bytes())
+	return &Message{Opcode: c.Opcode, Data: bytes.NewBuffer(p)}
+}
+
+// Close recycle buffer, remove the temp file of a spilled message
 func (c *Message) Close() error {
-	myBufferPool.Put(c.Data, c.index)
+	c.release()
 	c.Data = nil
+	if c.file != nil {
+		_ = c.file.Close()
+		_ = os.Remove(c.file.Name())
+		c.file = nil
+	}
 	return nil
 }
 
+// 正在接收的分片消息, 只在第一个分片到达后存在
+// a fragmented message being received, only present after its first fragment arrives
 type continuationFrame struct {
-	initialized bool
-	compressed  bool
-	opcode      Opcode
-	buffer      *bytes.Buffer
+	rsv        uint8
+	opcode     Opcode
+	fragments  int
+	buffer     *bytes.Buffer
+	validating bool
+	utf8       internal.Utf8Checker
+	size       int
+	spillable  bool
+	file       *os.File
+}
+
+// 丢弃正在接收的分片消息
+// drop the fragmented message being received
+func (c *Conn) resetContinuation() {
+	if c.continuationFrame != nil {
+		c.continuationFrame.reset()
+		c.continuationFrame = nil
+	}
 }
 
 func (c *continuationFrame) reset() {
-	c.initialized = false
-	c.compressed = false
+	c.rsv = 0
 	c.opcode = 0
+	c.fragments = 0
 	c.buffer = nil
+	c.validating = false
+	c.utf8.Reset()
+	c.size = 0
+	c.spillable = false
+	if c.file != nil {
+		_ = c.file.Close()
+		_ = os.Remove(c.file.Name())
+		c.file = nil
+	}
+}
+
+// 写入分片, 超过阈值时转存到临时文件
+// write a fragment, move the message to a temp file once it exceeds the threshold
+func (c *continuationFrame) write(p []byte, config *Config) error {
+	c.size += len(p)
+	if c.file == nil && c.spillable && c.size > config.ReadSpillThreshold {
+		file, err := os.CreateTemp(config.ReadSpillDir, "gws-*")
+		if err != nil {
+			return internal.NewError(internal.CloseInternalServerErr, err)
+		}
+		c.file = file
+		if _, err := file.Write(c.buffer.Bytes()); err != nil {
+			return internal.NewError(internal.CloseInternalServerErr, err)
+		}
+		c.buffer = bytes.NewBuffer(nil)
+	}
+	if c.file != nil {
+		if _, err := c.file.Write(p); err != nil {
+			return internal.NewError(internal.CloseInternalServerErr, err)
+		}
+		return nil
+	}
+	return internal.WriteN(c.buffer, p, len(p))
 }
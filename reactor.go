@@ -0,0 +1,265 @@
+package gws
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 每次轮询最多返回的事件数
+// max events returned by one poll
+const pollerBatchSize = 128
+
+// 轮询协程被Close唤醒
+// the polling goroutine was woken up by Close
+var errPollerClosed = errors.New("gws: poller closed")
+
+// Reactor 事件循环模式, 空闲连接挂起在epoll/kqueue中, 不再各自阻塞在ReadLoop里;
+// 有数据可读时才启动协程读取, 读完缓冲的数据后协程退出, 连接重新挂起. 适合持有大量空闲连接的服务端,
+// 可以大幅减少协程和栈内存. 默认的每连接一个协程(ReadLoop)模式不受影响.
+// 只支持Linux和BSD(包括macOS)上的TCP/Unix连接, 不支持TLS连接和RawReadEnabled, 此时Serve返回ErrReactorUnsupported.
+// 挂起的连接同样由时间轮检测IdleTimeout. 不要直接关闭NetConn, 请使用WriteClose等方法关闭连接
+// Reactor is the event-loop mode: idle connections are parked in epoll/kqueue instead of each blocking in ReadLoop.
+// A goroutine is started only when data is readable; it exits once the buffered data is consumed
+// and the connection is parked again. It suits servers holding many idle connections, cutting goroutines and
+// stack memory drastically. The default goroutine-per-connection (ReadLoop) mode is unaffected.
+// Only TCP/Unix connections on Linux and BSD (including macOS) are supported, TLS connections and RawReadEnabled
+// are not, in which case Serve returns ErrReactorUnsupported.
+// IdleTimeout is enforced by the timer wheel for parked connections as well. Do not close NetConn directly, close with WriteClose and the like
+//
+// Example:
+//
+//	var reactor, _ = gws.NewReactor()
+//	server.OnRequest = func(socket *gws.Conn, request *http.Request) {
+//		if err := reactor.Serve(socket); err != nil {
+//			socket.ReadLoop()
+//		}
+//	}
+type Reactor struct {
+	closed uint32
+	shards []*reactorShard
+}
+
+// ReactorOption 事件循环的配置
+// ReactorOption configures the event loop
+type ReactorOption struct {
+	// 轮询协程的数量, 连接按文件描述符分配到各个轮询协程, 多核之间并行处理; 默认为1
+	// Number of polling goroutines. Connections are spread over them by file descriptor so that
+	// several cores process events in parallel. Defaults to 1
+	Pollers int
+
+	// 轮询协程绑定系统线程, 在Linux上还会依次绑定到可用的CPU上, 避免在核之间迁移
+	// Lock each polling goroutine to an OS thread. On Linux the threads are also pinned to the available CPUs
+	// in turn, so that they do not migrate between cores
+	LockOSThread bool
+}
+
+// 一个轮询协程及其接管的连接
+// one polling goroutine and the connections it has taken over
+type reactorShard struct {
+	reactor *Reactor
+	poller  *poller
+	index   int
+
+	mu    sync.Mutex
+	conns map[int]*Conn
+}
+
+// NewReactor 创建事件循环并启动轮询协程, 不支持的平台返回ErrReactorUnsupported
+// NewReactor creates an event loop and starts the polling goroutine.
+// It returns ErrReactorUnsupported on unsupported platforms
+func NewReactor() (*Reactor, error) {
+	return NewReactorWithOption(nil)
+}
+
+// NewReactorWithOption 按配置创建事件循环并启动轮询协程, option为nil时等同于NewReactor
+// NewReactorWithOption creates an event loop as configured and starts the polling goroutines.
+// A nil option is the same as NewReactor
+func NewReactorWithOption(option *ReactorOption) (*Reactor, error) {
+	if option == nil {
+		option = new(ReactorOption)
+	}
+	var n = internal.SelectValue(option.Pollers > 0, option.Pollers, 1)
+	var c = &Reactor{shards: make([]*reactorShard, 0, n)}
+	for i := 0; i < n; i++ {
+		p, err := newPoller()
+		if err != nil {
+			for _, shard := range c.shards {
+				shard.poller.release()
+			}
+			return nil, err
+		}
+		c.shards = append(c.shards, &reactorShard{reactor: c, poller: p, index: i, conns: make(map[int]*Conn)})
+	}
+	for _, shard := range c.shards {
+		go shard.run(option.LockOSThread)
+	}
+	return c, nil
+}
+
+// 连接所属的分片, 文件描述符经过乘法散列, 避免按固定步长分配的描述符集中在部分分片上
+// the shard a connection belongs to. The descriptor is hashed multiplicatively, so that descriptors
+// allocated with a fixed stride do not crowd into a few shards
+func (c *Reactor) shard(fd int) *reactorShard {
+	var h = (uint64(fd) * 0x9E3779B97F4A7C15) >> 32
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+// Serve 触发OnOpen并把连接交给事件循环, 代替ReadLoop; 返回错误时连接没有被接管, 可以继续调用ReadLoop
+// Serve fires OnOpen and hands the connection over to the event loop in place of ReadLoop.
+// On error the connection was not taken over and ReadLoop can still be called
+func (c *Reactor) Serve(socket *Conn) error {
+	if atomic.LoadUint32(&c.closed) == 1 {
+		return net.ErrClosed
+	}
+	if socket.config.RawReadEnabled {
+		return internal.ErrReactorUnsupported
+	}
+	fd, err := connFd(socket.conn)
+	if err != nil {
+		return err
+	}
+	socket.reactor, socket.reactorFd = c, fd
+
+	var shard = c.shard(fd)
+	socket.eventHandler().OnOpen(socket)
+	socket.startIdleTimer()
+	// 握手时读缓冲区中可能已经有数据, poller不会再通知
+	// data may already be in the read buffer from the handshake, the poller will not report it
+	if socket.rbuf != nil && socket.rbuf.Buffered() > 0 {
+		go shard.serve(socket)
+		return nil
+	}
+	shard.park(socket)
+	return nil
+}
+
+// Close 关闭事件循环和所有被接管的连接
+// Close closes the event loop and all connections taken over
+func (c *Reactor) Close() error {
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return nil
+	}
+	var err error
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		var list = make([]*Conn, 0, len(shard.conns))
+		for _, socket := range shard.conns {
+			list = append(list, socket)
+		}
+		shard.mu.Unlock()
+
+		for _, socket := range list {
+			socket.WriteClose(uint16(internal.CloseGoingAway), nil)
+		}
+		if e := shard.poller.close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// 接管的连接数
+// number of connections taken over
+func (c *Reactor) count() int {
+	var n = 0
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		n += len(shard.conns)
+		shard.mu.Unlock()
+	}
+	return n
+}
+
+// 连接关闭时从所属的分片中移除
+// remove the connection from its shard once closed
+func (c *Reactor) remove(socket *Conn) {
+	c.shard(socket.reactorFd).remove(socket)
+}
+
+// 轮询可读的连接, 每个可读的连接启动一个协程读取
+// poll readable connections and start a goroutine to read each of them
+func (c *reactorShard) run(lockOSThread bool) {
+	defer c.poller.release()
+
+	if lockOSThread {
+		// 不解除绑定, 协程退出时线程随之销毁, 绑定的CPU不会影响其他协程
+		// never unlocked: the thread is destroyed when the goroutine exits, so its CPU affinity does not leak to other goroutines
+		runtime.LockOSThread()
+		if err := pinThread(c.index); err != nil {
+			defaultLogger.Error("gws: failed to pin poller:", err.Error())
+		}
+	}
+
+	var fds = make([]int, 0, pollerBatchSize)
+	for {
+		var err error
+		if fds, err = c.poller.wait(fds[:0]); err != nil {
+			if err != errPollerClosed {
+				defaultLogger.Error("gws: reactor stopped:", err.Error())
+			}
+			return
+		}
+		for _, fd := range fds {
+			c.mu.Lock()
+			var socket = c.conns[fd]
+			c.mu.Unlock()
+			if socket != nil {
+				go c.serve(socket)
+			}
+		}
+	}
+}
+
+// 读取直到缓冲区中没有数据, 然后重新挂起
+// read until no data is buffered, then park again
+func (c *reactorShard) serve(socket *Conn) {
+	for {
+		if err := socket.readMessage(); err != nil {
+			socket.resetContinuation()
+			socket.emitError(socket.checkIdleTimeout(err))
+			return
+		}
+		socket.releaseReadBuffer()
+		if socket.rbuf == nil || socket.rbuf.Buffered() == 0 {
+			break
+		}
+	}
+	c.park(socket)
+}
+
+// 挂起连接, 等待可读
+// park the connection until it is readable
+func (c *reactorShard) park(socket *Conn) {
+	c.mu.Lock()
+	var err error
+	switch {
+	case socket.isClosed():
+	case atomic.LoadUint32(&c.reactor.closed) == 1:
+		err = net.ErrClosed
+	case c.conns[socket.reactorFd] == socket:
+		err = c.poller.rearm(socket.reactorFd)
+	default:
+		c.conns[socket.reactorFd] = socket
+		err = c.poller.add(socket.reactorFd)
+	}
+	c.mu.Unlock()
+	socket.emitError(err)
+}
+
+// 连接关闭时移除并关闭底层连接; 先从poller中移除, 避免文件描述符被复用后误操作新的连接
+// remove the connection once closed and close the underlying connection. It is removed from the poller first,
+// so that a reused file descriptor does not affect a new connection
+func (c *reactorShard) remove(socket *Conn) {
+	c.mu.Lock()
+	if c.conns[socket.reactorFd] == socket {
+		delete(c.conns, socket.reactorFd)
+		_ = c.poller.remove(socket.reactorFd)
+	}
+	c.mu.Unlock()
+	_ = socket.conn.Close()
+}
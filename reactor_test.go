@@ -0,0 +1,177 @@
+package gws
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func newReactorServer(t *testing.T, handler Event, option *ServerOption, reactorOption *ReactorOption) (*Reactor, string) {
+	reactor, err := NewReactorWithOption(reactorOption)
+	if errors.Is(err, ErrReactorUnsupported) {
+		t.Skip("reactor not supported")
+	}
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var server = NewServer(handler, option)
+	server.OnRequest = func(socket *Conn, request *http.Request) {
+		if err := reactor.Serve(socket); err != nil {
+			socket.ReadLoop()
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go server.RunListener(listener)
+	return reactor, "ws://" + listener.Addr().String()
+}
+
+func TestReactor(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("echo", func(t *testing.T) {
+		var opened = make(chan struct{}, 1)
+		var closed = make(chan error, 1)
+		var handler = new(webSocketMocker)
+		handler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		}
+		handler.onClose = func(socket *Conn, err error) { closed <- err }
+		var server = &openMocker{webSocketMocker: handler, opened: opened}
+		reactor, addr := newReactorServer(t, server, &ServerOption{ReadBufferReleaseEnabled: true}, nil)
+		defer reactor.Close()
+
+		var received = make(chan string, 8)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		client, _, err := NewClient(clientHandler, &ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		<-opened
+
+		// 多次挂起和唤醒
+		for _, item := range []string{"hello", "world", "!"} {
+			as.NoError(client.WriteString(item))
+			as.Equal(item, <-received)
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// 对端关闭后触发OnClose并移除连接
+		client.WriteClose(1000, nil)
+		var closeErr *CloseError
+		as.True(errors.As(<-closed, &closeErr))
+		as.Equal(uint16(1000), closeErr.Code)
+		as.Equal(0, reactor.count())
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		var closed = make(chan error, 1)
+		var handler = new(webSocketMocker)
+		handler.onClose = func(socket *Conn, err error) { closed <- err }
+		reactor, addr := newReactorServer(t, handler, &ServerOption{IdleTimeout: 50 * time.Millisecond}, nil)
+		defer reactor.Close()
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		select {
+		case err := <-closed:
+			as.ErrorIs(err, ErrIdleTimeout)
+		case <-time.After(time.Second):
+			as.Fail("idle timeout not fired")
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var closed = make(chan error, 1)
+		var opened = make(chan struct{}, 1)
+		var handler = new(webSocketMocker)
+		handler.onClose = func(socket *Conn, err error) { closed <- err }
+		reactor, addr := newReactorServer(t, &openMocker{webSocketMocker: handler, opened: opened}, nil, nil)
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		<-opened
+		as.NoError(reactor.Close())
+		as.NoError(reactor.Close())
+		<-closed
+
+		// 关闭后不再接管连接
+		as.ErrorIs(reactor.Serve(client), net.ErrClosed)
+	})
+}
+
+// 测试多个轮询协程
+func TestReactor_Pollers(t *testing.T) {
+	var as = assert.New(t)
+	var handler = new(webSocketMocker)
+	handler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	var opened = make(chan struct{}, 16)
+	reactor, addr := newReactorServer(t, &openMocker{webSocketMocker: handler, opened: opened}, nil, &ReactorOption{Pollers: 4, LockOSThread: true})
+	defer reactor.Close()
+	as.Equal(4, len(reactor.shards))
+
+	const count = 16
+	var received = make(chan string, count)
+	var clients []*Conn
+	for i := 0; i < count; i++ {
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		client, _, err := NewClient(clientHandler, &ClientOption{Addr: addr})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		<-opened
+		clients = append(clients, client)
+	}
+	as.Equal(count, reactor.count())
+
+	// 连接按文件描述符分散到多个分片
+	var used = 0
+	for _, shard := range reactor.shards {
+		shard.mu.Lock()
+		used += internal.SelectValue(len(shard.conns) > 0, 1, 0)
+		for fd := range shard.conns {
+			as.Equal(shard, reactor.shard(fd))
+		}
+		shard.mu.Unlock()
+	}
+	as.Greater(used, 1)
+
+	var list []string
+	for i, client := range clients {
+		as.NoError(client.WriteString(fmt.Sprintf("%d", i)))
+	}
+	for i := 0; i < count; i++ {
+		list = append(list, <-received)
+	}
+	as.Len(list, count)
+	for i := 0; i < count; i++ {
+		as.Contains(list, fmt.Sprintf("%d", i))
+	}
+}
+
+type openMocker struct {
+	*webSocketMocker
+	opened chan struct{}
+}
+
+func (c *openMocker) OnOpen(socket *Conn) { c.opened <- struct{}{} }
@@ -0,0 +1,109 @@
+package gws
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// 按缓冲区大小区分的bufio.Reader池
+// pools of bufio.Reader, keyed by buffer size
+var readerPools sync.Map
+
+func getReaderPool(size int) *sync.Pool {
+	if v, ok := readerPools.Load(size); ok {
+		return v.(*sync.Pool)
+	}
+	v, _ := readerPools.LoadOrStore(size, &sync.Pool{New: func() any {
+		return bufio.NewReaderSize(nil, size)
+	}})
+	return v.(*sync.Pool)
+}
+
+// 重新获取读缓冲区时, 用于放回已经读出的首字节
+// puts back the first byte read while waiting for data without a read buffer
+type prefixReader struct {
+	conn io.Reader
+	b    [1]byte
+	n    int
+}
+
+func (c *prefixReader) Read(p []byte) (int, error) {
+	if c.n > 0 && len(p) > 0 {
+		p[0] = c.b[0]
+		c.n = 0
+		return 1, nil
+	}
+	return c.conn.Read(p)
+}
+
+// 不使用bufio时, 握手阶段读缓冲区中剩余的数据需要先被读出
+// without bufio, the data left in the handshake read buffer has to be consumed first
+func newRawReader(src io.Reader, br *bufio.Reader) io.Reader {
+	if br == nil || br.Buffered() == 0 {
+		return src
+	}
+	var p, _ = br.Peek(br.Buffered())
+	return io.MultiReader(bytes.NewReader(p), src)
+}
+
+// 握手阶段的读缓冲区改为从src读取, 已经缓冲的数据先被读出
+// make the handshake read buffer read from src, the data it already buffered comes first
+func resetReaderSource(br *bufio.Reader, src io.Reader) {
+	if br.Buffered() == 0 {
+		br.Reset(src)
+		return
+	}
+	var p = make([]byte, br.Buffered())
+	_, _ = br.Read(p)
+	br.Reset(io.MultiReader(bytes.NewReader(p), src))
+}
+
+// 读取入站字节的来源, io_uring后端或者连接本身
+// where inbound bytes are read from, the io_uring backend or the connection itself
+func (c *Conn) netReader() io.Reader {
+	if c.reader != nil {
+		return c.reader
+	}
+	return c.conn
+}
+
+// 读取帧数据的来源
+// the reader frames are parsed from
+func (c *Conn) source() io.Reader {
+	if c.raw != nil {
+		return c.raw
+	}
+	return c.rbuf
+}
+
+// 一条消息读取完毕后归还读缓冲区
+// return the read buffer to the pool once a message has been read completely
+func (c *Conn) releaseReadBuffer() {
+	if !c.config.ReadBufferReleaseEnabled || c.rbuf == nil || c.continuationFrame != nil || c.rbuf.Buffered() > 0 {
+		return
+	}
+	if c.rbuf.Size() == c.config.ReadBufferSize {
+		c.rbuf.Reset(nil)
+		getReaderPool(c.config.ReadBufferSize).Put(c.rbuf)
+	}
+	c.rbuf = nil
+	c.dischargeReadBuffer()
+}
+
+// 有数据可读时重新获取读缓冲区
+// reacquire a read buffer when data becomes readable
+func (c *Conn) acquireReadBuffer() error {
+	if c.rbuf != nil || c.raw != nil {
+		return nil
+	}
+	if _, err := io.ReadFull(c.netReader(), c.prefix.b[:]); err != nil {
+		return err
+	}
+	c.prefix.conn, c.prefix.n = c.netReader(), 1
+	c.rbuf = getReaderPool(c.config.ReadBufferSize).Get().(*bufio.Reader)
+	c.rbuf.Reset(&c.prefix)
+	c.chargeReadBuffer()
+	return nil
+}
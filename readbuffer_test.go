@@ -0,0 +1,112 @@
+package gws
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBufferRelease(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{ReadBufferReleaseEnabled: true}
+	var messages []string
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		messages = append(messages, message.Data.String())
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+	go client.ReadLoop()
+
+	var payloads = []string{"hello", string(internal.AlphabetNumeric.Generate(8 * 1024)), "world"}
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		for _, item := range payloads {
+			as.NoError(client.WriteString(item))
+		}
+		wg.Done()
+	}()
+
+	for range payloads {
+		as.NoError(server.readMessage())
+		server.releaseReadBuffer()
+		as.Nil(server.rbuf)
+	}
+	wg.Wait()
+	as.Equal(payloads, messages)
+}
+
+func TestReadBufferRelease_Fragments(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{ReadBufferReleaseEnabled: true}
+	var messages []string
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		messages = append(messages, message.Data.String())
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+	go client.ReadLoop()
+	go func() {
+		_ = testWrite(client, false, OpcodeText, []byte("hel"))
+		_ = testWrite(client, true, OpcodeContinuation, []byte("lo"))
+	}()
+
+	as.NoError(server.readMessage())
+	server.releaseReadBuffer()
+	as.NotNil(server.rbuf)
+	as.NoError(server.readMessage())
+	server.releaseReadBuffer()
+	as.Nil(server.rbuf)
+	as.Equal([]string{"hello"}, messages)
+}
+
+func TestRawRead(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(3)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = initServerOption(&ServerOption{RawReadEnabled: true, CompressEnabled: true, CompressThreshold: 1})
+	var payloads = []string{"early", "hello", string(internal.AlphabetNumeric.Generate(16 * 1024))}
+	var messages []string
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		messages = append(messages, message.Data.String())
+		wg.Done()
+	}
+
+	s, c := net.Pipe()
+	var client = serveWebSocket(false, initClientOption(&ClientOption{CompressEnabled: true, CompressThreshold: 1}).getConfig(), new(sliceMap), c, bufio.NewReader(c), clientHandler, true)
+
+	// 模拟握手时已经被读入缓冲区的帧
+	var early = bytes.NewBuffer(nil)
+	client.conn = &writerConn{Conn: c, w: early}
+	as.NoError(client.WriteString(payloads[0]))
+	client.conn = c
+	go client.ReadLoop()
+	var br = bufio.NewReader(io.MultiReader(bytes.NewReader(early.Bytes()), s))
+	_, _ = br.Peek(early.Len())
+
+	var server = serveWebSocket(true, serverOption.getConfig(), new(sliceMap), s, br, serverHandler, true)
+	as.Nil(server.rbuf)
+	go server.ReadLoop()
+	for _, item := range payloads[1:] {
+		as.NoError(client.WriteString(item))
+	}
+	wg.Wait()
+	as.Equal(payloads, messages)
+}
+
+type writerConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c *writerConn) Write(p []byte) (int, error) { return c.w.Write(p) }
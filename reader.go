@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
 
 	"github.com/lxzan/gws/internal"
 )
@@ -11,11 +14,43 @@ import (
 func (c *Conn) checkMask(enabled bool) error {
 	// RFC6455: All frames sent from client to server have this bit set to 1.
 	if (c.isServer && !enabled) || (!c.isServer && enabled) {
-		return internal.CloseProtocolError
+		if !internal.SelectValue(c.isServer, c.config.UnmaskedFramesAllowed, c.config.MaskedFramesAllowed) {
+			return c.protocolError(protocolErrorMasking, internal.CloseProtocolError)
+		}
+		if !c.maskLogged {
+			c.maskLogged = true
+			c.config.Logger.Warn("gws: tolerated masking violation from", c.RemoteAddr().String())
+		}
 	}
 	return nil
 }
 
+// 对端没有去掉消息结尾的00 00 ff ff. 补上最后的空块结束压缩流, 解压器追加的结尾会被忽略;
+// 压缩流本身已经以最后的块结束时同样会被忽略
+// the peer did not remove the trailing 00 00 ff ff of the message. A final empty block is appended to end the stream,
+// so the tail appended by the decompressor is ignored; it is ignored as well if the stream already ends with a final block
+func (c *Conn) toleratedDeflateTail(src *bytes.Buffer) {
+	_, _ = src.Write(internal.FlateTail[4:])
+	if !c.deflateQuirkLogged {
+		c.deflateQuirkLogged = true
+		c.config.Logger.Warn("gws: tolerated unstripped permessage-deflate tail from", c.RemoteAddr().String())
+	}
+}
+
+// 严格模式下保留位的额外规则: 控制帧不能设置保留位, RSV1只能出现在消息的第一帧(RFC7692 6.1)
+// extra rules on reserved bits in strict mode: control frames carry none, and RSV1 is only set on the first frame
+// of a message (RFC7692 6.1)
+func (c *Conn) strictRSV(opcode Opcode, rsv uint8) bool {
+	switch {
+	case rsv == 0:
+		return true
+	case !opcode.isDataFrame():
+		return false
+	default:
+		return opcode != OpcodeContinuation || rsv&RSV1Bit == 0
+	}
+}
+
 // read control frame
 func (c *Conn) readControl() error {
 	//RFC6455:  Control frames themselves MUST NOT be fragmented.
@@ -33,7 +68,7 @@ func (c *Conn) readControl() error {
 	var payload []byte
 	if n > 0 {
 		payload = make([]byte, n)
-		if err := internal.ReadN(c.rbuf, payload, int(n)); err != nil {
+		if err := internal.ReadN(c.source(), payload, int(n)); err != nil {
 			return err
 		}
 		maskEnabled := c.fh.GetMask()
@@ -44,34 +79,101 @@ func (c *Conn) readControl() error {
 			internal.MaskXOR(payload, c.fh.GetMaskKey())
 		}
 	}
+	c.captureInbound(payload)
 
 	var opcode = c.fh.GetOpcode()
 	switch opcode {
 	case OpcodePing:
-		c.handler.OnPing(c, payload)
+		if c.config.AutoPongEnabled {
+			if err := c.WritePong(payload); err != nil {
+				return err
+			}
+		}
+		c.eventHandler().OnPing(c, payload)
 		return nil
 	case OpcodePong:
-		c.handler.OnPong(c, payload)
+		c.eventHandler().OnPong(c, payload)
 		return nil
 	case OpcodeCloseConnection:
 		return c.emitClose(bytes.NewBuffer(payload))
 	default:
-		var err = errors.New(fmt.Sprintf("unexpected opcode: %d", opcode))
+		var err = fmt.Errorf("%w: %d", internal.ErrUnexpectedOpcode, opcode)
 		return internal.NewError(internal.CloseProtocolError, err)
 	}
 }
 
+// 读取保留操作码的帧
+// read a frame with a reserved opcode
+func (c *Conn) readUnknown(opcode Opcode, contentLength int, maskEnabled bool) error {
+	if c.config.UnknownOpcodePolicy == UnknownOpcodeClose {
+		var err = fmt.Errorf("%w: %d", internal.ErrUnexpectedOpcode, opcode)
+		return internal.NewError(internal.CloseProtocolError, err)
+	}
+	var buf, index = myBufferPool.Get(contentLength)
+	defer myBufferPool.Put(buf, index)
+	var p = buf.Bytes()[:contentLength]
+	if err := internal.ReadN(c.source(), p, contentLength); err != nil {
+		return err
+	}
+	if maskEnabled {
+		internal.MaskXOR(p, c.fh.GetMaskKey())
+	}
+	c.captureInbound(p)
+	if h, ok := c.eventHandler().(UnknownFrameHandler); ok && c.config.UnknownOpcodePolicy == UnknownOpcodeDeliver {
+		h.OnUnknownFrame(c, c.fh.GetFIN(), opcode, p)
+	}
+	return nil
+}
+
+// 读取一批帧: 第一帧可能需要从连接读取, 之后只要缓冲区中还有完整的帧就继续解析和分发,
+// 不再经过刷新空闲超时和获取读缓冲区等每次读取的步骤
+// read a batch of frames: the first one may need a read from the connection, after that frames are parsed
+// and dispatched as long as complete ones are buffered, skipping the per-read steps such as refreshing
+// the idle timeout and acquiring the read buffer
 func (c *Conn) readMessage() error {
 	if c.isClosed() {
 		return internal.CloseNormalClosure
 	}
-
-	contentLength, err := c.fh.Parse(c.rbuf)
+	c.refreshIdleTimeout()
+	if err := c.acquireReadBuffer(); err != nil {
+		return err
+	}
+	contentLength, err := c.parseHeader()
 	if err != nil {
 		return err
 	}
+	c.counter.addReadBatch()
+	for {
+		if err := c.readFrame(contentLength); err != nil {
+			return err
+		}
+		if c.rbuf == nil || c.isClosed() {
+			return nil
+		}
+		var ok bool
+		if contentLength, ok = c.fh.parseBuffered(c.rbuf, true); !ok {
+			return nil
+		}
+	}
+}
+
+// 解析帧头, 头部已经在缓冲区中时直接从缓冲区复制
+// parse the frame header, copying it straight from the buffer when it is already there
+func (c *Conn) parseHeader() (int, error) {
+	if c.rbuf != nil {
+		if n, ok := c.fh.parseBuffered(c.rbuf, false); ok {
+			return n, nil
+		}
+	}
+	return c.fh.Parse(c.source())
+}
+
+// 读取帧头已经解析的一帧
+// read a frame whose header has been parsed
+func (c *Conn) readFrame(contentLength int) error {
+	c.observeInbound(contentLength)
 	if contentLength > c.config.ReadMaxPayloadSize {
-		return internal.CloseMessageTooLarge
+		return c.protocolError(protocolErrorOversize, internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge))
 	}
 
 	// RSV1, RSV2, RSV3:  1 bit each
@@ -81,8 +183,9 @@ func (c *Conn) readMessage() error {
 	//      the negotiated extensions defines the meaning of such a nonzero
 	//      value, the receiving endpoint MUST _Fail the WebSocket
 	//      Connection_.
-	if !c.compressEnabled && (c.fh.GetRSV1() || c.fh.GetRSV2() || c.fh.GetRSV3()) {
-		return internal.CloseProtocolError
+	var rsv = c.fh[0] & rsvMask
+	if rsv&^c.allowedRSV() != 0 {
+		return c.protocolError(protocolErrorReservedBits, internal.CloseProtocolError)
 	}
 
 	maskEnabled := c.fh.GetMask()
@@ -92,38 +195,88 @@ func (c *Conn) readMessage() error {
 
 	// read control frame
 	var opcode = c.fh.GetOpcode()
-	var compressed = c.compressEnabled && c.fh.GetRSV1()
+	if c.config.StrictProtocol && !c.strictRSV(opcode, rsv) {
+		return c.protocolError(protocolErrorReservedBits, internal.CloseProtocolError)
+	}
+	if opcode.isReserved() {
+		return c.readUnknown(opcode, contentLength, maskEnabled)
+	}
 	if !opcode.isDataFrame() {
 		return c.readControl()
 	}
 
+	if opcode != OpcodeContinuation && c.isOpcodeDisallowed(opcode) {
+		return internal.NewError(internal.CloseUnsupportedData, internal.ErrOpcodeDisallowed)
+	}
+
 	var fin = c.fh.GetFIN()
-	var buf, index = myBufferPool.Get(contentLength)
-	var p = buf.Bytes()
-	p = p[:contentLength]
-	if err := internal.ReadN(c.rbuf, p, contentLength); err != nil {
-		return err
+	if fin && opcode != OpcodeContinuation && contentLength > c.config.ReadMaxMessageSize {
+		return c.protocolError(protocolErrorOversize, internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge))
 	}
-	if maskEnabled {
-		internal.MaskXOR(p, c.fh.GetMaskKey())
+	var alloc = c.payloadAllocator(fin, opcode)
+	var index int
+	var p []byte
+	if alloc != nil {
+		p = alloc.Get(contentLength)[:contentLength]
+	} else {
+		var buf *bytes.Buffer
+		buf, index = myBufferPool.Get(contentLength)
+		p = buf.Bytes()[:contentLength]
+	}
+	if err := internal.ReadN(c.source(), p, contentLength); err != nil {
+		if alloc != nil {
+			alloc.Put(p)
+		}
+		return err
 	}
 
+	// 分片消息的状态在第一个分片到达时创建, 消息结束后释放
+	// the state of a fragmented message is created when the first fragment arrives and dropped once it completes
 	if !fin && (opcode == OpcodeText || opcode == OpcodeBinary) {
-		c.continuationFrame.initialized = true
-		c.continuationFrame.compressed = compressed
-		c.continuationFrame.opcode = opcode
-		c.continuationFrame.buffer = bytes.NewBuffer(make([]byte, 0, contentLength))
+		c.continuationFrame = &continuationFrame{
+			rsv:        rsv,
+			opcode:     opcode,
+			buffer:     bytes.NewBuffer(make([]byte, 0, contentLength)),
+			validating: c.config.CheckUtf8Enabled && opcode == OpcodeText && rsv == 0 && len(c.extensions) == 0,
+			spillable:  c.config.ReadSpillThreshold > 0 && rsv == 0 && len(c.extensions) == 0,
+		}
+	}
+
+	// 需要校验utf8编码时在解除掩码的同一遍中完成, 大文本消息只从内存读取一次
+	// utf8 validation, when needed, happens in the same pass as unmasking, so large text messages are read from memory once
+	var checker *internal.Utf8Checker
+	var valid = true
+	if maskEnabled {
+		if checker = c.unmaskChecker(opcode, fin, rsv); checker != nil {
+			valid = checker.MaskXORCheck(p, c.fh.GetMaskKey(), c.config.Utf8Validator) && (checker != &c.textChecker || checker.Done())
+		} else {
+			internal.MaskXOR(p, c.fh.GetMaskKey())
+		}
+	}
+	c.captureInbound(p)
+	if !valid {
+		if alloc != nil {
+			alloc.Put(p)
+		}
+		return c.protocolError(protocolErrorBadUTF8, internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding))
 	}
 
 	if !fin || (fin && opcode == OpcodeContinuation) {
-		if !c.continuationFrame.initialized {
+		if c.continuationFrame == nil {
 			return internal.CloseProtocolError
 		}
-		if err := internal.WriteN(c.continuationFrame.buffer, p, len(p)); err != nil {
+		c.continuationFrame.fragments++
+		if c.config.ReadMaxFragments > 0 && c.continuationFrame.fragments > c.config.ReadMaxFragments {
+			return c.protocolError(protocolErrorOversize, internal.NewError(internal.CloseMessageTooLarge, internal.ErrTooManyFragments))
+		}
+		if c.continuationFrame.size+len(p) > c.config.ReadMaxMessageSize {
+			return c.protocolError(protocolErrorOversize, internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge))
+		}
+		if err := c.continuationFrame.write(p, c.config); err != nil {
 			return err
 		}
-		if c.continuationFrame.buffer.Len() > c.config.ReadMaxPayloadSize {
-			return internal.CloseMessageTooLarge
+		if c.continuationFrame.validating && checker == nil && !c.continuationFrame.utf8.Check(p, c.config.Utf8Validator) {
+			return c.protocolError(protocolErrorBadUTF8, internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding))
 		}
 		if !fin {
 			return nil
@@ -131,39 +284,176 @@ func (c *Conn) readMessage() error {
 	}
 
 	// Send unfragmented Text Message after Continuation Frame with FIN = false
-	if c.continuationFrame.initialized && opcode != OpcodeContinuation {
+	if c.continuationFrame != nil && opcode != OpcodeContinuation {
 		return internal.CloseProtocolError
 	}
 	switch opcode {
 	case OpcodeContinuation:
+		var validated = c.continuationFrame.validating
+		if validated && !c.continuationFrame.utf8.Done() {
+			return c.protocolError(protocolErrorBadUTF8, internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding))
+		}
 		msg := &Message{Opcode: c.continuationFrame.opcode, Data: c.continuationFrame.buffer}
-		myerr := c.emitMessage(msg, c.continuationFrame.compressed)
-		c.continuationFrame.reset()
+		if file := c.continuationFrame.file; file != nil {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return internal.NewError(internal.CloseInternalServerErr, err)
+			}
+			msg.file, msg.fileSize = file, c.continuationFrame.size
+			c.continuationFrame.file = nil
+		}
+		myerr := c.emitMessage(msg, c.continuationFrame.rsv, validated)
+		c.resetContinuation()
 		return myerr
 	case OpcodeText, OpcodeBinary:
-		return c.emitMessage(&Message{index: index, Opcode: opcode, Data: bytes.NewBuffer(p)}, compressed)
+		return c.emitMessage(&Message{index: index, alloc: alloc, raw: p, Opcode: opcode, Data: bytes.NewBuffer(p)}, rsv, checker != nil)
 	default:
 		return internal.CloseNormalClosure
 	}
 }
 
-func (c *Conn) emitMessage(msg *Message, compressed bool) (err error) {
-	if compressed {
-		data, index := msg.Data, msg.index
-		msg.Data, msg.index, err = c.config.decompressors.Select().Decompress(msg.Data)
-		myBufferPool.Put(data, index)
+// 解除掩码时一并使用的utf8校验器, 不需要校验时返回nil. 分片使用消息的增量校验器, 单帧文本消息使用textChecker
+// the utf8 checker used while unmasking, nil if no validation is needed. Fragments use the incremental checker of
+// the message, single frame text messages use textChecker
+func (c *Conn) unmaskChecker(opcode Opcode, fin bool, rsv uint8) *internal.Utf8Checker {
+	switch {
+	case !fin || opcode == OpcodeContinuation:
+		if c.continuationFrame != nil && c.continuationFrame.validating {
+			return &c.continuationFrame.utf8
+		}
+	case opcode == OpcodeText && c.config.CheckUtf8Enabled && rsv == 0 && len(c.extensions) == 0 && c.continuationFrame == nil:
+		c.textChecker.Reset()
+		return &c.textChecker
+	}
+	return nil
+}
+
+func (c *Conn) isOpcodeDisallowed(opcode Opcode) bool {
+	for _, item := range c.config.DisallowedOpcodes {
+		if item == opcode {
+			return true
+		}
+	}
+	return false
+}
+
+// 选择解压器, 开启DecompressorPinned时使用连接独占的解压器
+// select a decompressor, the dedicated one of the connection if DecompressorPinned
+func (c *Conn) selectDecompressor() *decompressor {
+	if !c.config.DecompressorPinned {
+		return c.config.decompressors.Select()
+	}
+	if c.decompressor == nil {
+		c.decompressor = &decompressor{dps: c.config.NewDecompressor()}
+	}
+	return c.decompressor
+}
+
+// 解压后允许的最大长度, 取ReadMaxDecompressedSize和压缩前长度乘以ReadMaxExpansionRatio中较小的值
+// maximum decompressed length, the smaller of ReadMaxDecompressedSize and the compressed length multiplied
+// by ReadMaxExpansionRatio
+func (c *Conn) decompressLimit(compressedSize int) int {
+	var limit = c.config.ReadMaxDecompressedSize
+	if ratio := c.config.ReadMaxExpansionRatio; ratio > 0 && compressedSize*ratio < limit {
+		limit = compressedSize * ratio
+	}
+	return limit
+}
+
+// rsv: 消息首帧的RSV位; validated: 分片消息已经增量校验过utf8编码
+// rsv: RSV bits of the first frame; validated: the fragmented message has been checked incrementally for utf8 encoding
+func (c *Conn) emitMessage(msg *Message, rsv uint8, validated bool) (err error) {
+	if atomic.LoadUint32(&c.draining) == 1 {
+		return msg.Close()
+	}
+	var wireSize = msg.Data.Len() + msg.fileSize
+	if c.compressEnabled && rsv&RSV1Bit != 0 {
+		var compressed = Message{index: msg.index, alloc: msg.alloc, raw: msg.raw, Data: msg.Data}
+		msg.alloc, msg.raw = nil, nil
+		var limit = c.decompressLimit(wireSize)
+		if c.config.DeflateQuirksAllowed && bytes.HasSuffix(msg.Data.Bytes(), internal.FlateTail[:4]) {
+			c.toleratedDeflateTail(msg.Data)
+		}
+		if c.deflate != nil && c.deflate.readTakeover {
+			msg.Data, msg.index, err = c.deflate.Decompress(msg.Data, limit)
+		} else {
+			msg.Data, msg.index, err = c.selectDecompressor().Decompress(msg.Data, limit)
+		}
+		compressed.release()
+		if errors.Is(err, internal.ErrMessageTooLarge) {
+			_ = msg.Close()
+			return c.protocolError(protocolErrorOversize, internal.NewError(internal.CloseMessageTooLarge, err))
+		}
+		if err != nil {
+			_ = msg.Close()
+			return c.protocolError(protocolErrorDecompress, internal.NewError(internal.CloseInternalServerErr, err))
+		}
+		if msg.Data.Len() > c.config.ReadMaxMessageSize {
+			_ = msg.Close()
+			return c.protocolError(protocolErrorOversize, internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge))
+		}
+	}
+	if len(c.extensions) > 0 {
+		p, err := c.decodeExtensions(msg.Opcode, rsv, msg.Bytes())
 		if err != nil {
-			return internal.NewError(internal.CloseInternalServerErr, err)
+			_ = msg.Close()
+			return err
 		}
+		// 解码结果可能引用原来的缓冲区, 复制到新的缓冲区之后再归还原来的缓冲区
+		// the decoded payload may alias the original buffer, copy it into a new one before releasing the original
+		var decoded, index = myBufferPool.Get(len(p))
+		decoded.Write(p)
+		msg.release()
+		msg.Data, msg.index = decoded, index
+	}
+	if !validated && !c.isTextValid(msg.Opcode, msg.Bytes()) {
+		_ = msg.Close()
+		return c.protocolError(protocolErrorBadUTF8, internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding))
 	}
-	if !c.isTextValid(msg.Opcode, msg.Bytes()) {
-		return internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding)
+	if ok, err := c.limiter.check(wireSize); !ok {
+		_ = msg.Close()
+		return err
 	}
 
 	if c.config.ReadAsyncEnabled {
-		c.readQueue.Push(func() { c.handler.OnMessage(c, msg) })
+		var handler = c.eventHandler()
+		var n = msg.Data.Len()
+		c.chargeReadQueue(n)
+		c.readQueue.Push(func() {
+			c.chargeReadQueue(-n)
+			c.dispatchMessage(handler, msg)
+		})
 	} else {
-		c.handler.OnMessage(c, msg)
+		c.dispatchMessage(c.eventHandler(), msg)
 	}
 	return nil
 }
+
+// 调用OnMessage, 耗时超过SlowHandlerThreshold时告警
+// call OnMessage and warn if it took longer than SlowHandlerThreshold
+func (c *Conn) dispatchMessage(handler Event, msg *Message) {
+	if c.config.MessageObserver != nil {
+		var payload []byte
+		if !msg.Spilled() {
+			payload = msg.Bytes()
+		}
+		c.observeMessage(FrameInbound, msg.Opcode, payload)
+	}
+	if c.config.SlowHandlerThreshold <= 0 {
+		handler.OnMessage(c, msg)
+		return
+	}
+
+	// OnMessage可能回收消息, 提前记录
+	var opcode, payloadLength = msg.Opcode, msg.fileSize
+	if !msg.Spilled() {
+		payloadLength = msg.Data.Len()
+	}
+	var start = time.Now()
+	handler.OnMessage(c, msg)
+	if elapsed := time.Since(start); elapsed >= c.config.SlowHandlerThreshold {
+		c.config.Logger.Warn(fmt.Sprintf("gws: slow OnMessage, id=%d opcode=%d length=%d elapsed=%s", c.ID(), opcode, payloadLength, elapsed))
+		if h, ok := handler.(SlowMessageHandler); ok {
+			h.OnSlowMessage(c, opcode, payloadLength, elapsed)
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package gws
 
 import (
+	"bufio"
 	"bytes"
 	_ "embed"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"github.com/lxzan/gws/internal"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // 测试同步读
@@ -47,6 +53,39 @@ func TestReadSync(t *testing.T) {
 	assert.ElementsMatch(t, listA, listB)
 }
 
+// 测试保序的异步读
+func TestReadAsyncOrdered(t *testing.T) {
+	var listA []string
+	var listB []string
+	const count = 1000
+	var wg = &sync.WaitGroup{}
+	wg.Add(count)
+
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{ReadAsyncEnabled: true, ReadAsyncOrdered: true}
+	var clientOption = &ClientOption{}
+
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		listB = append(listB, message.Data.String())
+		wg.Done()
+	}
+
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	for i := 0; i < count; i++ {
+		var n = internal.AlphabetNumeric.Intn(1024)
+		var message = internal.AlphabetNumeric.Generate(n)
+		listA = append(listA, string(message))
+		_ = client.WriteAsync(OpcodeText, message)
+	}
+
+	wg.Wait()
+	assert.Equal(t, listA, listB)
+}
+
 //go:embed assets/read_test.json
 var testdata []byte
 
@@ -203,6 +242,158 @@ func TestSegments(t *testing.T) {
 		wg.Wait()
 	})
 
+	t.Run("too many fragments", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadMaxFragments: 2}
+		var clientOption = &ClientOption{}
+
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, internal.ErrTooManyFragments)
+			wg.Done()
+		}
+
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		go func() {
+			testWrite(client, false, OpcodeText, internal.AlphabetNumeric.Generate(8))
+			testWrite(client, false, OpcodeContinuation, internal.AlphabetNumeric.Generate(8))
+			testWrite(client, true, OpcodeContinuation, internal.AlphabetNumeric.Generate(8))
+		}()
+		wg.Wait()
+	})
+
+	t.Run("max message size", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadMaxPayloadSize: 16, ReadMaxMessageSize: 24}
+		var clientOption = &ClientOption{}
+
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal(24, message.Data.Len())
+			wg.Done()
+		}
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, ErrMessageTooLarge)
+			wg.Done()
+		}
+
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		go func() {
+			testWrite(client, false, OpcodeText, internal.AlphabetNumeric.Generate(16))
+			testWrite(client, true, OpcodeContinuation, internal.AlphabetNumeric.Generate(8))
+			testWrite(client, false, OpcodeText, internal.AlphabetNumeric.Generate(16))
+			testWrite(client, true, OpcodeContinuation, internal.AlphabetNumeric.Generate(16))
+		}()
+		wg.Wait()
+	})
+
+	t.Run("max message size single frame", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadMaxPayloadSize: 1024, ReadMaxMessageSize: 8}
+		var clientOption = &ClientOption{}
+
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, ErrMessageTooLarge)
+			wg.Done()
+		}
+
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		go testWrite(client, true, OpcodeText, internal.AlphabetNumeric.Generate(16))
+		wg.Wait()
+	})
+
+	t.Run("max message size after decompression", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{CompressEnabled: true, ReadMaxMessageSize: 1024}
+		var clientOption = &ClientOption{CompressEnabled: true, CompressThreshold: 1}
+
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, ErrMessageTooLarge)
+			wg.Done()
+		}
+
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		_ = client.WriteMessage(OpcodeText, bytes.Repeat([]byte("a"), 4096))
+		wg.Wait()
+	})
+
+	t.Run("invalid utf8 fragment", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{CheckUtf8Enabled: true}
+		var clientOption = &ClientOption{}
+
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, internal.ErrTextEncoding)
+			wg.Done()
+		}
+
+		server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		go func() {
+			testWrite(client, false, OpcodeText, []byte{0xce, 0xba, 0xe1})
+			testWrite(client, false, OpcodeContinuation, []byte{0xbd, 0xb9, 0xed, 0xa0})
+		}()
+		wg.Wait()
+	})
+
+	// 解除掩码时分块校验, 多字节字符跨越分块边界
+	t.Run("utf8 across chunks", func(t *testing.T) {
+		var received = make(chan string, 2)
+		var closed = make(chan error, 1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { received <- message.Data.String() }
+		serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		var serverOption = &ServerOption{CheckUtf8Enabled: true}
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var text = strings.Repeat("a你好世界", 1000)
+		go func() {
+			_ = client.WriteString(text)
+			testWrite(client, false, OpcodeText, []byte(text[:2049]))
+			testWrite(client, true, OpcodeContinuation, []byte(text[2049:]))
+		}()
+		as.Equal(text, <-received)
+		as.Equal(text, <-received)
+
+		// 第一个分块之后出现非法字节
+		var invalid = []byte(text)
+		invalid[3000] = 0xff
+		go testWrite(client, true, OpcodeText, invalid)
+		as.ErrorIs(<-closed, internal.ErrTextEncoding)
+	})
+
 	t.Run("invalid segments", func(t *testing.T) {
 		var wg = &sync.WaitGroup{}
 		wg.Add(1)
@@ -239,3 +430,523 @@ func TestMessage(t *testing.T) {
 	_, _ = msg.Read(make([]byte, 2))
 	msg.Close()
 }
+
+func TestMessage_Retain(t *testing.T) {
+	var as = assert.New(t)
+	var buf, index = myBufferPool.Get(1024)
+	buf.WriteString("hello")
+	var msg = &Message{index: index, Opcode: OpcodeText, Data: buf}
+	var p = msg.Retain()
+	as.Equal(0, msg.index)
+	as.NoError(msg.Close())
+	as.Equal("hello", string(p))
+}
+
+func TestMessage_Clone(t *testing.T) {
+	var as = assert.New(t)
+	var buf, index = myBufferPool.Get(1024)
+	buf.WriteString("hello")
+	var msg = &Message{index: index, Opcode: OpcodeBinary, Data: buf}
+	var clone = msg.Clone()
+	msg.Bytes()[0] = 'j'
+	as.NoError(msg.Close())
+	as.Equal(OpcodeBinary, clone.Opcode)
+	as.Equal("hello", clone.Data.String())
+	as.Equal(0, clone.index)
+}
+
+func TestAutoPong(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{AutoPongEnabled: true}
+	var clientOption = &ClientOption{}
+
+	serverHandler.onPing = func(socket *Conn, payload []byte) {
+		as.Equal("hello", string(payload))
+		wg.Done()
+	}
+	clientHandler.onPong = func(socket *Conn, payload []byte) {
+		as.Equal("hello", string(payload))
+		wg.Done()
+	}
+
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WritePing([]byte("hello")))
+	wg.Wait()
+}
+
+type autoPongHandler struct {
+	BuiltinEventHandler
+}
+
+func (c *autoPongHandler) OnMessage(socket *Conn, message *Message) {
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+}
+
+func TestAutoPong_BuiltinHandler(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+
+	var pongs []string
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onPong = func(socket *Conn, payload []byte) {
+		pongs = append(pongs, string(payload))
+	}
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal([]string{"hello"}, pongs)
+		wg.Done()
+	}
+
+	server, client := newPeer(new(autoPongHandler), &ServerOption{AutoPongEnabled: true}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WritePing([]byte("hello")))
+	as.NoError(client.WriteString("done"))
+	wg.Wait()
+}
+
+type countLogger struct {
+	sync.Mutex
+	n int
+}
+
+func (c *countLogger) Debug(v ...any) {}
+
+func (c *countLogger) Warn(v ...any) {
+	c.Lock()
+	c.n++
+	c.Unlock()
+}
+
+func (c *countLogger) Error(v ...any) {
+	c.Lock()
+	c.n++
+	c.Unlock()
+}
+
+// 以错误的掩码方式写入一帧
+func testWriteWrongMask(c *Conn, opcode Opcode, payload []byte) error {
+	var header = frameHeader{}
+	headerLength, maskBytes := header.GenerateHeader(!c.isServer, true, false, opcode, len(payload))
+	var p = append(testCloneBytes(header[:headerLength]), payload...)
+	if c.isServer {
+		internal.MaskXOR(p[headerLength:], maskBytes)
+	}
+	_, err := c.conn.Write(p)
+	return err
+}
+
+func TestMaskTolerance(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("unmasked from client", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var logger = new(countLogger)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{UnmaskedFramesAllowed: true, Logger: logger}
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(testWriteWrongMask(client, OpcodeText, []byte("hello")))
+		as.NoError(testWriteWrongMask(client, OpcodeText, []byte("hello")))
+		wg.Wait()
+		as.Equal(1, logger.n)
+	})
+
+	t.Run("masked from server", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var clientOption = &ClientOption{MaskedFramesAllowed: true, Logger: new(countLogger)}
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(testWriteWrongMask(server, OpcodeText, []byte("hello")))
+		wg.Wait()
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, internal.CloseProtocolError)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(testWriteWrongMask(client, OpcodeText, []byte("hello")))
+		wg.Wait()
+	})
+}
+
+func TestDisallowedOpcodes(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{DisallowedOpcodes: []Opcode{OpcodeBinary}}
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal(OpcodeText, message.Opcode)
+		wg.Done()
+	}
+	serverHandler.onClose = func(socket *Conn, err error) {
+		var closeErr *CloseError
+		as.ErrorAs(err, &closeErr)
+		as.Equal(CloseUnsupportedData.Uint16(), closeErr.Code)
+		as.ErrorIs(err, ErrOpcodeDisallowed)
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteString("hello"))
+	as.NoError(client.WriteMessage(OpcodeBinary, []byte("hello")))
+	wg.Wait()
+}
+
+func TestReadSpill(t *testing.T) {
+	var as = assert.New(t)
+	var dir = t.TempDir()
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{ReadSpillThreshold: 100, ReadSpillDir: dir, CheckUtf8Enabled: true}
+	var large = internal.AlphabetNumeric.Generate(300)
+	var small = internal.AlphabetNumeric.Generate(60)
+	var messages = make(chan *Message, 2)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(testWrite(client, false, OpcodeText, testCloneBytes(large[:100])))
+	as.NoError(testWrite(client, false, OpcodeContinuation, testCloneBytes(large[100:200])))
+	as.NoError(testWrite(client, true, OpcodeContinuation, testCloneBytes(large[200:])))
+	as.NoError(testWrite(client, false, OpcodeText, testCloneBytes(small[:30])))
+	as.NoError(testWrite(client, true, OpcodeContinuation, testCloneBytes(small[30:])))
+	wg.Wait()
+
+	var msg = <-messages
+	as.True(msg.Spilled())
+	as.Equal(0, msg.Data.Len())
+	content, err := io.ReadAll(msg.Reader())
+	as.NoError(err)
+	as.Equal(large, content)
+	entries, _ := os.ReadDir(dir)
+	as.Equal(1, len(entries))
+	as.NoError(msg.Close())
+	entries, _ = os.ReadDir(dir)
+	as.Equal(0, len(entries))
+
+	msg = <-messages
+	as.False(msg.Spilled())
+	content, err = io.ReadAll(msg.Reader())
+	as.NoError(err)
+	as.Equal(small, content)
+}
+
+func TestReadSpill_Abort(t *testing.T) {
+	var as = assert.New(t)
+	var dir = t.TempDir()
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{ReadSpillThreshold: 10, ReadSpillDir: dir, ReadMaxMessageSize: 50}
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.ErrorIs(err, ErrMessageTooLarge)
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(testWrite(client, false, OpcodeBinary, internal.AlphabetNumeric.Generate(40)))
+	_ = testWrite(client, true, OpcodeContinuation, internal.AlphabetNumeric.Generate(40))
+	wg.Wait()
+	entries, _ := os.ReadDir(dir)
+	as.Equal(0, len(entries))
+}
+
+type unknownFrameMocker struct {
+	webSocketMocker
+	frames []string
+}
+
+func (c *unknownFrameMocker) OnUnknownFrame(socket *Conn, fin bool, opcode Opcode, payload []byte) {
+	c.frames = append(c.frames, fmt.Sprintf("%v %d %s", fin, opcode, payload))
+}
+
+func TestUnknownOpcodePolicy(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(policy UnknownOpcodePolicy) *unknownFrameMocker {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(unknownFrameMocker)
+		var clientHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Equal("hello", message.Data.String())
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{UnknownOpcodePolicy: policy}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(testWrite(client, true, Opcode(3), []byte("draft")))
+		as.NoError(testWrite(client, false, Opcode(12), []byte("ctrl")))
+		as.NoError(client.WriteString("hello"))
+		wg.Wait()
+		return serverHandler
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		as.Equal(0, len(run(UnknownOpcodeSkip).frames))
+	})
+
+	t.Run("deliver", func(t *testing.T) {
+		as.Equal([]string{"true 3 draft", "false 12 ctrl"}, run(UnknownOpcodeDeliver).frames)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			as.ErrorIs(err, ErrUnexpectedOpcode)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		_ = testWrite(client, true, Opcode(3), []byte("draft"))
+		wg.Wait()
+	})
+}
+
+type slowMessageRecorder struct {
+	webSocketMocker
+	lengths chan int
+}
+
+func (c *slowMessageRecorder) OnSlowMessage(socket *Conn, opcode Opcode, payloadLength int, elapsed time.Duration) {
+	c.lengths <- payloadLength
+}
+
+func TestSlowHandler(t *testing.T) {
+	var as = assert.New(t)
+	var logger = &levelLogger{}
+	var serverHandler = &slowMessageRecorder{lengths: make(chan int, 2)}
+	var received = make(chan struct{}, 2)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		if message.Data.String() == "slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		_ = message.Close()
+		received <- struct{}{}
+	}
+	var serverOption = &ServerOption{SlowHandlerThreshold: 10 * time.Millisecond, Logger: logger}
+	server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	as.NoError(client.WriteString("fast"))
+	as.NoError(client.WriteString("slow"))
+	<-received
+	<-received
+	as.Equal(4, <-serverHandler.lengths)
+	as.Equal(0, len(serverHandler.lengths))
+	as.Equal([]string{"warn"}, logger.levels)
+}
+
+func TestProtocolErrors(t *testing.T) {
+	var as = assert.New(t)
+
+	// 写入掩码全为0的客户端帧, 载荷保持原样
+	var writeRaw = func(b0 byte, payload []byte) func(client *Conn) error {
+		return func(client *Conn) error {
+			var p = append([]byte{b0, 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+			_, err := client.conn.Write(p)
+			return err
+		}
+	}
+
+	var cases = []struct {
+		name     string
+		option   *ServerOption
+		write    func(client *Conn) error
+		expected ProtocolErrorStats
+	}{
+		{
+			name:     "bad utf8",
+			option:   &ServerOption{CheckUtf8Enabled: true},
+			write:    writeRaw(0x81, []byte{0xff, 0xfe}),
+			expected: ProtocolErrorStats{BadUTF8: 1},
+		},
+		{
+			name:     "oversize",
+			option:   &ServerOption{ReadMaxMessageSize: 4},
+			write:    func(client *Conn) error { return client.WriteString("hello, world") },
+			expected: ProtocolErrorStats{Oversize: 1},
+		},
+		{
+			name:     "masking",
+			option:   &ServerOption{},
+			write:    func(client *Conn) error { return testWriteWrongMask(client, OpcodeText, []byte("hello")) },
+			expected: ProtocolErrorStats{Masking: 1},
+		},
+		{
+			name:     "reserved bits",
+			option:   &ServerOption{},
+			write:    writeRaw(0xA2, []byte("hello")),
+			expected: ProtocolErrorStats{ReservedBits: 1},
+		},
+		{
+			name:     "decompress",
+			option:   &ServerOption{CompressEnabled: true},
+			write:    writeRaw(0xC2, []byte{0xff, 0xff, 0xff, 0xff}),
+			expected: ProtocolErrorStats{Decompress: 1},
+		},
+		{
+			name:     "timeout",
+			option:   &ServerOption{IdleTimeout: 50 * time.Millisecond},
+			write:    func(client *Conn) error { return nil },
+			expected: ProtocolErrorStats{Timeout: 1},
+		},
+	}
+
+	for _, item := range cases {
+		t.Run(item.name, func(t *testing.T) {
+			var closed = make(chan struct{})
+			var serverHandler = new(webSocketMocker)
+			serverHandler.onClose = func(socket *Conn, err error) { close(closed) }
+			item.option.Logger = new(countLogger)
+			server, client := newPeer(serverHandler, item.option, new(webSocketMocker), &ClientOption{})
+			go server.ReadLoop()
+			go client.ReadLoop()
+			as.NoError(item.write(client))
+			<-closed
+			as.Equal(item.expected, server.config.serverStats.snapshot().ProtocolErrors)
+		})
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	var as = assert.New(t)
+	var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+	var client = &Conn{conn: &benchConn{}, config: upgrader.option.getConfig()}
+
+	var payloads = []string{"a", "hello", string(internal.AlphabetNumeric.Generate(1000)), "world"}
+	var frames [][]byte
+	for _, item := range payloads {
+		frame, _, err := client.genFrame(OpcodeText, []byte(item))
+		as.NoError(err)
+		frames = append(frames, frame.Bytes())
+	}
+
+	// 一次读取返回三个完整的帧和第四个帧的头部, 前三个帧在同一批中分发
+	var first = bytes.Join(frames[:3], nil)
+	first = append(first, frames[3][:2]...)
+	var reader = io.MultiReader(bytes.NewReader(first), bytes.NewReader(frames[3][2:]))
+	var handler = new(webSocketMocker)
+	var received []string
+	handler.onMessage = func(socket *Conn, message *Message) { received = append(received, message.Data.String()) }
+	var server = &Conn{
+		isServer: true,
+		conn:     &benchConn{},
+		rbuf:     bufio.NewReader(reader),
+		config:   upgrader.option.getConfig(),
+		handler:  handler,
+	}
+	as.NoError(server.readMessage())
+	as.Equal(payloads[:3], received)
+	as.Equal(2, server.rbuf.Buffered())
+
+	// 头部不完整时回退到逐字段读取
+	as.NoError(server.readMessage())
+	as.Equal(payloads, received)
+
+	var stats = server.Stats()
+	as.Equal(uint64(4), stats.FramesIn)
+	as.Equal(uint64(2), stats.ReadBatches)
+	as.Equal(2.0, stats.ReadBatchSize())
+	as.Equal(0.0, ConnStats{}.ReadBatchSize())
+}
+
+func testWriteRSV(c *Conn, fin bool, opcode Opcode, rsv uint8, payload []byte) error {
+	var header = frameHeader{}
+	headerLength, maskBytes := header.GenerateHeader(c.isServer, fin, false, opcode, len(payload))
+	header.SetRSV(rsv)
+	var p = append(testCloneBytes(header[:headerLength]), payload...)
+	if !c.isServer {
+		internal.MaskXOR(p[headerLength:], maskBytes)
+	}
+	_, err := c.conn.Write(p)
+	return err
+}
+
+func TestStrictProtocol(t *testing.T) {
+	var as = assert.New(t)
+
+	var run = func(serverOption *ServerOption, write func(client *Conn)) error {
+		var ch = make(chan error, 2)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onPing = func(socket *Conn, payload []byte) { ch <- nil }
+		serverHandler.onMessage = func(socket *Conn, message *Message) { ch <- nil }
+		serverHandler.onClose = func(socket *Conn, err error) { ch <- err }
+		server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		write(client)
+		return <-ch
+	}
+
+	t.Run("control frame rsv", func(t *testing.T) {
+		var write = func(client *Conn) { _ = testWriteRSV(client, true, OpcodePing, RSV1Bit, nil) }
+		as.NoError(run(&ServerOption{CompressEnabled: true}, write))
+		as.ErrorIs(run(&ServerOption{CompressEnabled: true, StrictProtocol: true}, write), internal.CloseProtocolError)
+	})
+
+	t.Run("continuation rsv1", func(t *testing.T) {
+		var err = run(&ServerOption{CompressEnabled: true, StrictProtocol: true}, func(client *Conn) {
+			_ = testWriteRSV(client, false, OpcodeBinary, 0, []byte("ab"))
+			_ = testWriteRSV(client, true, OpcodeContinuation, RSV1Bit, []byte("cd"))
+		})
+		as.ErrorIs(err, internal.CloseProtocolError)
+	})
+
+	t.Run("overrides tolerance", func(t *testing.T) {
+		var option = initServerOption(&ServerOption{StrictProtocol: true, UnmaskedFramesAllowed: true, UnknownOpcodePolicy: UnknownOpcodeSkip})
+		as.True(option.CheckUtf8Enabled)
+		as.False(option.UnmaskedFramesAllowed)
+		as.Equal(UnknownOpcodeClose, option.UnknownOpcodePolicy)
+		var clientOption = initClientOption(&ClientOption{StrictProtocol: true, MaskedFramesAllowed: true})
+		as.True(clientOption.CheckUtf8Enabled)
+		as.False(clientOption.MaskedFramesAllowed)
+	})
+}
@@ -0,0 +1,215 @@
+package gws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// RelayFrame 中继的一帧, Payload已经去掉掩码; 压缩的消息不会被解压, RSV中保留RSV1
+// RelayFrame is a relayed frame with an unmasked Payload. Compressed messages are not decompressed, RSV keeps RSV1
+type RelayFrame struct {
+	Fin     bool
+	RSV     uint8
+	Opcode  Opcode
+	Payload []byte
+}
+
+// RelayOption 中继配置
+// Relay configuration
+type RelayOption struct {
+	// OnFrame 检查或者修改from发出的帧, 返回false丢弃该帧; 关闭帧不经过它. 在from的中继协程中调用, Payload在返回后被回收.
+	// 开启了上下文接管的压缩连接上修改或者丢弃压缩帧会破坏对端的解压
+	// Inspects or modifies a frame sent by from, returning false drops it; close frames bypass it.
+	// Called on the relay goroutine of from, Payload is recycled once it returns.
+	// Modifying or dropping compressed frames on connections with context takeover breaks decompression on the far end
+	OnFrame func(from *Conn, frame *RelayFrame) bool
+}
+
+// Relay 在两个连接之间原样转发帧, 不解压也不重新校验载荷, 只按方向重写掩码; 用于在gws之上构建反向代理.
+// 代替两个连接的ReadLoop运行, 阻塞到两个方向都结束, 期间不调用OnMessage, OnPing和OnPong; 一端关闭时另一端也被关闭.
+// 两个连接必须协商了相同的压缩参数和扩展, 否则返回ErrRelayIncompatible
+// Relay passes frames between two connections as they are, without decompressing or revalidating payloads,
+// only rewriting the masking as the direction requires. It is the building block of reverse proxies on top of gws.
+// It runs instead of ReadLoop on both connections and blocks until both directions finish; OnMessage, OnPing and
+// OnPong are not called meanwhile. When one side closes the other is closed too.
+// Both connections must have negotiated the same compression parameters and extensions,
+// ErrRelayIncompatible is returned otherwise
+//
+// Example:
+//
+//	func (c *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+//		upstream, _, err := gws.NewClient(new(gws.BuiltinEventHandler), &gws.ClientOption{Addr: c.backend})
+//		if err != nil {
+//			http.Error(w, err.Error(), http.StatusBadGateway)
+//			return
+//		}
+//		downstream, err := c.upgrader.Upgrade(w, r)
+//		if err != nil {
+//			upstream.WriteClose(1000, nil)
+//			return
+//		}
+//		_ = gws.Relay(downstream, upstream, nil)
+//	}
+func Relay(a, b *Conn, option *RelayOption) error {
+	if option == nil {
+		option = new(RelayOption)
+	}
+	if !relayCompatible(a, b) {
+		return ErrRelayIncompatible
+	}
+
+	var wg = &sync.WaitGroup{}
+	for _, pair := range [][2]*Conn{{a, b}, {b, a}} {
+		var src, dst = pair[0], pair[1]
+		src.eventHandler().OnOpen(src)
+		src.startIdleTimer()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src.relayLoop(dst, option)
+		}()
+	}
+	wg.Wait()
+	a.closeConn()
+	b.closeConn()
+	return nil
+}
+
+// 两个连接的帧可以原样转发
+// frames of the two connections can pass through unchanged
+func relayCompatible(a, b *Conn) bool {
+	if a.compressEnabled != b.compressEnabled || a.deflateParams != b.deflateParams || len(a.extensions) != len(b.extensions) {
+		return false
+	}
+	for i := range a.extensions {
+		if a.extensions[i].Name() != b.extensions[i].Name() {
+			return false
+		}
+	}
+	return true
+}
+
+// 从c读取帧转发给dst, 直到c关闭; 出错的一端以错误关闭, 另一端以1001关闭
+// read frames from c and pass them to dst until c closes. The failing side is closed with the error,
+// the other one with 1001
+func (c *Conn) relayLoop(dst *Conn, option *RelayOption) {
+	for {
+		dstFailed, err := c.relayFrame(dst, option)
+		if err == nil {
+			continue
+		}
+		if dstFailed {
+			dst.emitError(err)
+			c.closeWithError(internal.CloseGoingAway, false)
+		} else {
+			c.emitError(err)
+			dst.closeWithError(internal.CloseGoingAway, false)
+		}
+		return
+	}
+}
+
+// 读取并转发一帧, dstFailed表示错误来自写入dst
+// read and pass on a frame, dstFailed reports that the error comes from writing to dst
+func (c *Conn) relayFrame(dst *Conn, option *RelayOption) (dstFailed bool, err error) {
+	if c.isClosed() {
+		return false, internal.CloseNormalClosure
+	}
+	c.refreshIdleTimeout()
+	if err = c.acquireReadBuffer(); err != nil {
+		return false, err
+	}
+	contentLength, err := c.parseHeader()
+	if err != nil {
+		return false, err
+	}
+	c.observeInbound(contentLength)
+	if contentLength > c.config.ReadMaxPayloadSize {
+		return false, c.protocolError(protocolErrorOversize, internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge))
+	}
+	var rsv = c.fh[0] & rsvMask
+	if rsv&^c.allowedRSV() != 0 {
+		return false, c.protocolError(protocolErrorReservedBits, internal.CloseProtocolError)
+	}
+	var maskEnabled = c.fh.GetMask()
+	if err = c.checkMask(maskEnabled); err != nil {
+		return false, err
+	}
+	var opcode = c.fh.GetOpcode()
+	if !opcode.isDataFrame() && (!c.fh.GetFIN() || contentLength > internal.ThresholdV1) {
+		return false, internal.CloseProtocolError
+	}
+
+	var buf, index = myBufferPool.Get(contentLength)
+	defer myBufferPool.Put(buf, index)
+	var p = buf.Bytes()[:contentLength]
+	if err = internal.ReadN(c.source(), p, contentLength); err != nil {
+		return false, err
+	}
+	if maskEnabled {
+		internal.MaskXOR(p, c.fh.GetMaskKey())
+	}
+	c.captureInbound(p)
+	c.releaseReadBuffer()
+
+	if opcode == OpcodeCloseConnection {
+		var payload = append([]byte(nil), p...)
+		dst.relayClose(payload)
+		return false, c.emitClose(bytes.NewBuffer(payload))
+	}
+	var frame = RelayFrame{Fin: c.fh.GetFIN(), RSV: rsv, Opcode: opcode, Payload: p}
+	if option.OnFrame != nil && !option.OnFrame(c, &frame) {
+		return false, nil
+	}
+	if err = dst.writeRelayFrame(&frame); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// 编码并写出中继的帧, 按本端的角色设置掩码
+// encode and write a relayed frame, masked according to the role of this side
+func (c *Conn) writeRelayFrame(frame *RelayFrame) error {
+	if c.isClosed() {
+		return internal.ErrConnClosed
+	}
+	var n = len(frame.Payload)
+	var header = frameHeader{}
+	headerLength, maskBytes := header.GenerateHeader(c.isServer, frame.Fin, false, frame.Opcode, n)
+	header.SetRSV(frame.RSV)
+	var buf, index = c.getFrameBuffer(headerLength + n)
+	buf.Write(header[:headerLength])
+	buf.Write(frame.Payload)
+	if !c.isServer {
+		internal.MaskXOR(buf.Bytes()[headerLength:], maskBytes)
+	}
+	var err = c.writeFrame(buf)
+	c.putFrameBuffer(buf, index)
+	return err
+}
+
+// 把收到的关闭帧转给本端: 以同样的状态码和原因关闭连接; 与emitClose一样, 无效的状态码换成1002,
+// 原因不是合法的utf8编码时换成1007, 都不再转发原因
+// pass a received close frame on to this side: close the connection with the same code and reason. Like emitClose,
+// an invalid code is replaced with 1002 and a reason that is not valid utf8 with 1007, the reason is dropped for both
+func (c *Conn) relayClose(payload []byte) {
+	var code internal.StatusCode
+	var reason []byte
+	switch {
+	case len(payload) == 1:
+		code = internal.CloseProtocolError
+	case len(payload) >= 2:
+		code, reason = internal.StatusCode(binary.BigEndian.Uint16(payload)), payload[2:]
+		if !code.IsValid() {
+			code, reason = internal.CloseProtocolError, nil
+		} else if !utf8.Valid(reason) {
+			code, reason = internal.CloseUnsupportedData, nil
+		}
+	}
+	c.closeWithError(internal.NewError(code, errors.New(string(reason))), false)
+}
@@ -0,0 +1,174 @@
+package gws
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 后端原样回显, 代理把客户端的消息中继给后端; 返回连接到代理的地址
+func newRelayProxy(t *testing.T, backendOption, proxyOption *ServerOption, upstreamOption *ClientOption, backend Event, relayOption *RelayOption, relayErr chan error) string {
+	var backendUpgrader = NewUpgrader(backend, backendOption)
+	var backendServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := backendUpgrader.Upgrade(w, r); err == nil {
+			socket.ReadLoop()
+		}
+	}))
+	t.Cleanup(backendServer.Close)
+
+	var proxyUpgrader = NewUpgrader(new(BuiltinEventHandler), proxyOption)
+	var proxyServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamOption.Addr = "ws://" + strings.TrimPrefix(backendServer.URL, "http://")
+		upstream, _, err := NewClient(new(BuiltinEventHandler), upstreamOption)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		downstream, err := proxyUpgrader.Upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		relayErr <- Relay(downstream, upstream, relayOption)
+	}))
+	t.Cleanup(proxyServer.Close)
+	return "ws://" + strings.TrimPrefix(proxyServer.URL, "http://")
+}
+
+func newEchoBackend(closed chan error) *webSocketMocker {
+	var backend = new(webSocketMocker)
+	backend.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	backend.onClose = func(socket *Conn, err error) {
+		if closed != nil {
+			closed <- err
+		}
+	}
+	return backend
+}
+
+func TestRelay(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("echo", func(t *testing.T) {
+		var backendClosed = make(chan error, 1)
+		var relayErr = make(chan error, 1)
+		var frames = make(chan RelayFrame, 8)
+		var relayOption = &RelayOption{OnFrame: func(from *Conn, frame *RelayFrame) bool {
+			frames <- RelayFrame{Fin: frame.Fin, RSV: frame.RSV, Opcode: frame.Opcode}
+			if from.IsServer() {
+				frame.Payload = bytes.ToUpper(frame.Payload)
+			}
+			return string(frame.Payload) != "DROP"
+		}}
+		var addr = newRelayProxy(t, nil, nil, &ClientOption{}, newEchoBackend(backendClosed), relayOption, relayErr)
+
+		var messages = make(chan string, 4)
+		var client = new(webSocketMocker)
+		client.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		socket, _, err := NewClient(client, &ClientOption{Addr: addr})
+		as.NoError(err)
+		go socket.ReadLoop()
+
+		as.NoError(socket.WriteString("drop"))
+		as.NoError(socket.WriteString("hello"))
+		as.Equal("HELLO", <-messages)
+		as.Equal(RelayFrame{Fin: true, Opcode: OpcodeText}, <-frames)
+
+		// 分片逐帧转发
+		var w = socket.NewMessageWriter(OpcodeBinary)
+		_, _ = w.Write([]byte("ab"))
+		_, _ = w.Write([]byte("cd"))
+		as.NoError(w.Close())
+		as.Equal("ABCD", <-messages)
+
+		// 关闭帧转发给后端
+		socket.WriteClose(4000, []byte("bye"))
+		select {
+		case err := <-backendClosed:
+			var closeErr *CloseError
+			as.ErrorAs(err, &closeErr)
+			as.Equal(uint16(4000), closeErr.Code)
+			as.Equal("bye", string(closeErr.Reason))
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+		as.NoError(<-relayErr)
+	})
+
+	// 压缩的帧原样转发
+	t.Run("compressed", func(t *testing.T) {
+		var relayErr = make(chan error, 1)
+		var rsv = make(chan uint8, 4)
+		var relayOption = &RelayOption{OnFrame: func(from *Conn, frame *RelayFrame) bool {
+			rsv <- frame.RSV
+			return true
+		}}
+		var serverOption = &ServerOption{CompressEnabled: true, CompressThreshold: 1}
+		var addr = newRelayProxy(t, serverOption, &ServerOption{CompressEnabled: true, CompressThreshold: 1},
+			&ClientOption{CompressEnabled: true, CompressThreshold: 1}, newEchoBackend(nil), relayOption, relayErr)
+
+		var messages = make(chan string, 1)
+		var client = new(webSocketMocker)
+		client.onMessage = func(socket *Conn, message *Message) { messages <- message.Data.String() }
+		socket, _, err := NewClient(client, &ClientOption{Addr: addr, CompressEnabled: true, CompressThreshold: 1})
+		as.NoError(err)
+		go socket.ReadLoop()
+
+		var text = strings.Repeat("hello", 100)
+		as.NoError(socket.WriteString(text))
+		as.Equal(text, <-messages)
+		as.Equal(RSV1Bit, <-rsv)
+		as.Equal(RSV1Bit, <-rsv)
+		socket.WriteClose(1000, nil)
+	})
+
+	t.Run("incompatible", func(t *testing.T) {
+		var relayErr = make(chan error, 1)
+		var addr = newRelayProxy(t, nil, &ServerOption{CompressEnabled: true}, &ClientOption{}, newEchoBackend(nil), nil, relayErr)
+		socket, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: addr, CompressEnabled: true})
+		as.NoError(err)
+		as.ErrorIs(<-relayErr, ErrRelayIncompatible)
+		_ = socket.NetConn().Close()
+	})
+}
+
+// 转发的关闭帧与emitClose一样校验状态码和原因
+func TestConn_RelayClose(t *testing.T) {
+	var as = assert.New(t)
+	for _, item := range []struct {
+		payload []byte
+		code    uint16
+		reason  string
+	}{
+		{payload: []byte{0x0f, 0xa0, 'b', 'y', 'e'}, code: 4000, reason: "bye"},
+		{payload: []byte{0x03, 0xed}, code: 1002},
+		{payload: []byte{0x03, 0xf7}, code: 1002},
+		{payload: []byte{0x07, 0xd0}, code: 1002},
+		{payload: []byte{0x03}, code: 1002},
+		{payload: []byte{0x03, 0xe8, 0xff, 0xfe}, code: 1007},
+	} {
+		var closed = make(chan error, 1)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) { closed <- err }
+		server, client := newPeer(new(BuiltinEventHandler), nil, clientHandler, nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		server.relayClose(item.payload)
+		select {
+		case err := <-closed:
+			var closeErr *CloseError
+			as.ErrorAs(err, &closeErr)
+			as.Equal(item.code, closeErr.Code)
+			as.Equal(item.reason, string(closeErr.Reason))
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
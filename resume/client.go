@@ -0,0 +1,128 @@
+package resume
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/internal/envelope"
+)
+
+// SessionHandler 可选接口, 客户端的事件处理器实现后在收到欢迎帧时被调用;
+// resumed为false表示开始了新的会话, 之前的状态需要重新同步
+// SessionHandler is optional. If implemented by the client event handler, it is called when the welcome frame
+// arrives; resumed is false if a new session started and previous state has to be synchronized again
+type SessionHandler interface {
+	OnSession(socket *gws.Conn, resumed bool)
+}
+
+// ClientHandler 客户端的事件处理器包装: 记录会话令牌和最后收到的序号, 去掉协议头后把消息转发给next, 丢弃重复的消息.
+// 同一个ClientHandler用于同一会话的所有重连, 重连时把RequestHeader的结果设置为ClientOption.RequestHeader;
+// 收到没有协议头的消息时以协议错误关闭连接
+// ClientHandler wraps the client event handler: it records the session token and the last sequence seen, forwards
+// messages to next without the protocol header and drops duplicates. Use the same ClientHandler for every reconnection
+// of a session, setting ClientOption.RequestHeader to the result of RequestHeader when reconnecting.
+// A message without the protocol header closes the connection with a protocol error
+//
+// Example:
+//
+//	var handler = resume.NewClientHandler(app)
+//	for {
+//		socket, _, err := gws.NewClient(handler, &gws.ClientOption{Addr: addr, RequestHeader: handler.RequestHeader()})
+//		if err == nil {
+//			socket.ReadLoop()
+//		}
+//		time.Sleep(time.Second)
+//	}
+type ClientHandler struct {
+	envelope.Forward
+
+	mu    sync.Mutex
+	token string
+	seq   uint64
+}
+
+// NewClientHandler 创建客户端的事件处理器包装
+// NewClientHandler creates the client event handler wrapper
+func NewClientHandler(next gws.Event) *ClientHandler {
+	return &ClientHandler{Forward: envelope.Forward{Next: next}}
+}
+
+// Token 会话令牌, 收到欢迎帧之前为空
+// Token returns the session token, empty before the welcome frame arrives
+func (c *ClientHandler) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// LastSeq 最后收到的序号
+// LastSeq returns the last sequence seen
+func (c *ClientHandler) LastSeq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// RequestHeader 重连时携带的请求头, 还没有会话时为空
+// RequestHeader returns the request header to reconnect with, empty before a session exists
+func (c *ClientHandler) RequestHeader() http.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var header = http.Header{}
+	if c.token != "" {
+		header.Set(HeaderToken, c.token)
+		header.Set(HeaderSeq, strconv.FormatUint(c.seq, 10))
+	}
+	return header
+}
+
+func (c *ClientHandler) OnOpen(socket *gws.Conn) { c.Next.OnOpen(socket) }
+
+func (c *ClientHandler) OnClose(socket *gws.Conn, err error) { c.Next.OnClose(socket, err) }
+
+func (c *ClientHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	var frame, ok = envelope.Parse(message, magic)
+	if !ok {
+		envelope.Reject(socket, message, envelope.ErrUnframed)
+		return
+	}
+	var seq = frame.ID
+
+	switch frame.Kind {
+	case kindWelcome:
+		if len(frame.Body) < 1 {
+			envelope.Reject(socket, message, envelope.ErrMalformed)
+			return
+		}
+		var resumed = frame.Body[0] == 1
+		c.mu.Lock()
+		c.token, c.seq = string(frame.Body[1:]), seq
+		c.mu.Unlock()
+		_ = message.Close()
+		if h, ok := c.Next.(SessionHandler); ok {
+			h.OnSession(socket, resumed)
+		}
+		return
+	case kindData:
+		if len(frame.Body) < 1 {
+			envelope.Reject(socket, message, envelope.ErrMalformed)
+			return
+		}
+		c.mu.Lock()
+		var duplicate = seq <= c.seq
+		if !duplicate {
+			c.seq = seq
+		}
+		c.mu.Unlock()
+		if duplicate {
+			_ = message.Close()
+			return
+		}
+		envelope.Unwrap(message, frame)
+		c.Next.OnMessage(socket, message)
+		return
+	}
+	_ = message.Close()
+}
@@ -0,0 +1,439 @@
+// Package resume 可选的会话恢复协议: 服务端为每个会话保留有限的出站消息回放缓冲区, 以序号为键;
+// 重连的客户端出示会话令牌和最后收到的序号, 服务端补发错过的消息. 持久化通过Persistence接入
+// Package resume is an opt-in session resumption protocol. The server keeps a bounded replay buffer of the outbound
+// messages of every session keyed by sequence number; a reconnecting client presents its session token and the last
+// sequence it has seen, and the missed messages are replayed. Persistence plugs in through Persistence
+package resume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/internal/envelope"
+)
+
+// 服务端发往客户端的协议帧: 魔数(1) 类型(1) 序号(8, 大端), 欢迎帧之后是恢复标记(1)和令牌,
+// 数据帧之后是原始的操作码(1)和载荷; 协议帧总是以二进制帧发送
+// protocol frames from server to client: magic(1) kind(1) sequence(8, big endian); welcome frames continue with the
+// resumed flag(1) and the token, data frames with the original opcode(1) and the payload. Protocol frames are always
+// sent as binary frames
+const (
+	magic      byte = 0xB8
+	headerSize      = envelope.HeaderSize
+
+	kindWelcome byte = 1
+	kindData    byte = 2
+
+	// HeaderToken 重连时携带会话令牌的请求头
+	// HeaderToken is the request header carrying the session token when reconnecting
+	HeaderToken = "Gws-Resume-Token"
+
+	// HeaderSeq 重连时携带最后收到的序号的请求头
+	// HeaderSeq is the request header carrying the last sequence seen when reconnecting
+	HeaderSeq = "Gws-Resume-Seq"
+
+	defaultBufferSize = 256
+	defaultSessionTTL = time.Minute
+
+	// gws.SessionStorage的键
+	// keys of gws.SessionStorage
+	keyRequest = "gws/resume/request"
+	keySession = "gws/resume/session"
+)
+
+// ErrSessionClosed 会话已经过期
+// the session has expired
+var ErrSessionClosed = errors.New("resume: session closed")
+
+// Record 一条出站消息
+// Record is an outbound message
+type Record struct {
+	Seq     uint64
+	Opcode  gws.Opcode
+	Payload []byte
+}
+
+// Persistence 持久化回放缓冲区, 例如在服务重启之后恢复会话; 方法会被并发调用
+// Persistence persists the replay buffers, e.g. to resume sessions across server restarts.
+// The methods are called concurrently
+type Persistence interface {
+	// Save 保存一条出站消息, 在发送之前调用
+	// Save stores an outbound message, called before it is sent
+	Save(token string, record Record) error
+
+	// LoadSince 返回序号大于seq的消息, 按序号升序; 无法提供全部错过的消息时返回错误, 客户端会开始新的会话
+	// LoadSince returns the messages with a sequence greater than seq in ascending order. It returns an error if not
+	// every missed message can be provided, the client then starts a new session
+	LoadSince(token string, seq uint64) ([]Record, error)
+
+	// Delete 会话过期
+	// Delete is called when the session expires
+	Delete(token string) error
+}
+
+// Config 会话恢复配置
+// Session resumption configuration
+type Config struct {
+	// 每个会话在内存中保留的出站消息数量, 默认256
+	// Number of outbound messages kept in memory per session, 256 by default
+	BufferSize int
+
+	// 断开之后会话保留的时间, 默认1分钟
+	// How long a session is kept after its connection is gone, 1 minute by default
+	SessionTTL time.Duration
+
+	// 持久化, 可以为nil
+	// Persistence, may be nil
+	Persistence Persistence
+}
+
+// Manager 服务端的会话表
+// Manager is the session registry of a server
+type Manager struct {
+	conf     Config
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewManager 创建会话表
+// NewManager creates a session registry
+func NewManager(conf Config) *Manager {
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = defaultBufferSize
+	}
+	if conf.SessionTTL <= 0 {
+		conf.SessionTTL = defaultSessionTTL
+	}
+	return &Manager{conf: conf, sessions: make(map[string]*Session)}
+}
+
+// Get 按令牌查找会话
+// Get looks a session up by token
+func (c *Manager) Get(token string) (*Session, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.sessions[token]
+	return s, ok
+}
+
+// Len 会话数量
+// Len returns the number of sessions
+func (c *Manager) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sessions)
+}
+
+// 恢复令牌对应的会话并绑定连接; 内存中的缓冲区不足时从持久化取出序号大于seq的消息, 无法补全时返回false
+// resume the session of the token and attach the connection. If the buffer in memory falls short, the messages
+// after seq are loaded from the persistence; false if they cannot all be provided
+func (c *Manager) resume(socket *gws.Conn, token string, seq uint64) (*Session, bool) {
+	c.mu.Lock()
+	var s = c.sessions[token]
+	c.mu.Unlock()
+	if s != nil && s.attach(socket, true, seq, nil) {
+		return s, true
+	}
+	if c.conf.Persistence == nil {
+		return nil, false
+	}
+	records, err := c.conf.Persistence.LoadSince(token, seq)
+	if err != nil {
+		return nil, false
+	}
+	if s == nil {
+		s = c.newSession(token, seq)
+		for _, item := range records {
+			s.push(item)
+		}
+	}
+	if !s.attach(socket, true, seq, records) {
+		return nil, false
+	}
+	return s, true
+}
+
+func (c *Manager) newSession(token string, seq uint64) *Session {
+	var s = &Session{manager: c, token: token, seq: seq, records: make([]Record, c.conf.BufferSize)}
+	c.mu.Lock()
+	c.sessions[token] = s
+	c.mu.Unlock()
+	return s
+}
+
+func (c *Manager) remove(s *Session) {
+	c.mu.Lock()
+	if c.sessions[s.token] == s {
+		delete(c.sessions, s.token)
+	}
+	c.mu.Unlock()
+	if c.conf.Persistence != nil {
+		_ = c.conf.Persistence.Delete(s.token)
+	}
+}
+
+func newToken() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Session 可恢复的会话, 跨越多个连接; 通过Send发送的消息带有序号并进入回放缓冲区
+// Session is a resumable session spanning connections. Messages sent with Send carry a sequence number
+// and enter the replay buffer
+type Session struct {
+	manager *Manager
+	token   string
+
+	mu      sync.Mutex
+	seq     uint64
+	records []Record
+	head    int
+	size    int
+	conn    *gws.Conn
+	timer   *time.Timer
+	closed  bool
+}
+
+// Token 会话令牌
+// Token returns the session token
+func (c *Session) Token() string {
+	return c.token
+}
+
+// Seq 最后一条消息的序号
+// Seq returns the sequence of the last message
+func (c *Session) Seq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seq
+}
+
+// Send 分配序号, 放入回放缓冲区, 有连接时异步发送; 断开期间发送的消息在恢复时补发
+// Send assigns a sequence number, buffers the message and writes it asynchronously if a connection is attached.
+// Messages sent while disconnected are replayed on resumption
+func (c *Session) Send(opcode gws.Opcode, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrSessionClosed
+	}
+	var record = Record{Seq: c.seq + 1, Opcode: opcode, Payload: append([]byte(nil), payload...)}
+	if p := c.manager.conf.Persistence; p != nil {
+		if err := p.Save(c.token, record); err != nil {
+			return err
+		}
+	}
+	c.seq++
+	c.push(record)
+	if c.conn != nil {
+		return c.conn.WriteAsync(gws.OpcodeBinary, encodeData(record))
+	}
+	return nil
+}
+
+// 加入环形缓冲区, 满了之后覆盖最旧的
+// append to the ring, overwriting the oldest record when full
+func (c *Session) push(record Record) {
+	var n = len(c.records)
+	c.records[(c.head+c.size)%n] = record
+	if c.size < n {
+		c.size++
+	} else {
+		c.head = (c.head + 1) % n
+	}
+	if record.Seq > c.seq {
+		c.seq = record.Seq
+	}
+}
+
+// 缓冲区中是否还有序号大于seq的全部消息
+// whether the buffer still holds every message after seq
+func (c *Session) covers(seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.coversLocked(seq)
+}
+
+func (c *Session) coversLocked(seq uint64) bool {
+	return seq <= c.seq && c.seq-seq <= uint64(c.size)
+}
+
+// 绑定连接, 发送欢迎帧, 先补发从持久化取出的消息, 再补发缓冲区中更新的消息;
+// 持锁进行, 保证补发的消息排在新消息之前. 恢复时在同一个临界区内检查缓冲区是否仍然包含所有错过的消息,
+// 不包含时不绑定并返回false, 避免补发出现缺口
+// attach a connection and send the welcome frame, then replay the messages loaded from the persistence followed by
+// the newer ones in the buffer. The lock is held throughout so that replayed messages precede new ones.
+// When resuming, the same critical section checks that the buffer still holds every missed message; if not,
+// nothing is attached and false is returned so that the replay cannot have a gap
+func (c *Session) attach(socket *gws.Conn, resumed bool, seq uint64, records []Record) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if resumed {
+		var last = seq
+		for _, item := range records {
+			if item.Seq > last {
+				last = item.Seq
+			}
+		}
+		if !c.coversLocked(last) {
+			return false
+		}
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.closed {
+		// 恢复时恰好过期, 重新登记
+		// expired while being resumed, register it again
+		c.closed = false
+		c.manager.mu.Lock()
+		c.manager.sessions[c.token] = c
+		c.manager.mu.Unlock()
+	}
+	c.conn = socket
+	_ = socket.WriteAsync(gws.OpcodeBinary, encodeWelcome(c.token, resumed, seq))
+	for _, item := range records {
+		if item.Seq > seq {
+			_ = socket.WriteAsync(gws.OpcodeBinary, encodeData(item))
+			seq = item.Seq
+		}
+	}
+	for i := 0; i < c.size; i++ {
+		if item := c.records[(c.head+i)%len(c.records)]; item.Seq > seq {
+			_ = socket.WriteAsync(gws.OpcodeBinary, encodeData(item))
+		}
+	}
+	return true
+}
+
+// 连接断开, 会话在SessionTTL之后过期
+// the connection is gone, the session expires after SessionTTL
+func (c *Session) detach(socket *gws.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != socket {
+		return
+	}
+	c.conn = nil
+	c.timer = time.AfterFunc(c.manager.conf.SessionTTL, c.expire)
+}
+
+func (c *Session) expire() {
+	c.mu.Lock()
+	if c.conn != nil || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.manager.remove(c)
+}
+
+func encodeWelcome(token string, resumed bool, seq uint64) []byte {
+	var b = envelope.New(magic, kindWelcome, seq, 1+len(token))
+	if resumed {
+		b[headerSize] = 1
+	}
+	copy(b[headerSize+1:], token)
+	return b
+}
+
+func encodeData(record Record) []byte {
+	return envelope.Wrap(magic, kindData, record.Seq, record.Opcode, record.Payload)
+}
+
+// 握手请求中的恢复参数
+// resumption parameters of the handshake request
+type request struct {
+	token string
+	seq   uint64
+}
+
+// Authorize 记录握手请求中的令牌和序号, 用作ServerOption.Authorize; 已有鉴权函数时在其中调用它
+// Authorize records the token and sequence of the handshake request, use it as ServerOption.Authorize,
+// or call it from an existing one
+func Authorize(r *http.Request, session gws.SessionStorage) bool {
+	if token := r.Header.Get(HeaderToken); token != "" {
+		seq, _ := strconv.ParseUint(r.Header.Get(HeaderSeq), 10, 64)
+		session.Store(keyRequest, request{token: token, seq: seq})
+	}
+	return true
+}
+
+// 连接上的会话和是否为恢复的会话
+// the session of a connection and whether it was resumed
+type attachment struct {
+	session *Session
+	resumed bool
+}
+
+// SessionOf 连接上的会话, resumed表示恢复了之前的会话; 在OnOpen之前返回nil
+// SessionOf returns the session of a connection, resumed reports whether a previous session was resumed.
+// It returns nil before OnOpen
+func SessionOf(socket *gws.Conn) (session *Session, resumed bool) {
+	if v, ok := socket.SessionStorage.Load(keySession); ok {
+		var a = v.(attachment)
+		return a.session, a.resumed
+	}
+	return nil, false
+}
+
+// ServerHandler 服务端的事件处理器包装: 在next.OnOpen之前恢复或者创建会话, 连接关闭后会话进入过期倒计时.
+// 需要同时设置ServerOption.Authorize为Authorize; 发往客户端的消息都要通过Session.Send发送, 客户端收到没有协议头的消息时以协议错误关闭连接
+// ServerHandler wraps the server event handler: the session is resumed or created before next.OnOpen,
+// and starts expiring once the connection closes. ServerOption.Authorize has to call Authorize. Every message to
+// the client has to be sent with Session.Send, the client closes the connection with a protocol error on a message
+// without the protocol header
+//
+// Example:
+//
+//	var manager = resume.NewManager(resume.Config{})
+//	var server = gws.NewServer(resume.NewServerHandler(handler, manager), &gws.ServerOption{Authorize: resume.Authorize})
+//
+//	// in OnOpen or later
+//	session, _ := resume.SessionOf(socket)
+//	_ = session.Send(gws.OpcodeText, []byte("hello"))
+type ServerHandler struct {
+	envelope.Forward
+	manager *Manager
+}
+
+// NewServerHandler 创建服务端的事件处理器包装
+// NewServerHandler creates the server event handler wrapper
+func NewServerHandler(next gws.Event, manager *Manager) *ServerHandler {
+	return &ServerHandler{Forward: envelope.Forward{Next: next}, manager: manager}
+}
+
+func (c *ServerHandler) OnOpen(socket *gws.Conn) {
+	var session *Session
+	var resumed bool
+	if v, ok := socket.SessionStorage.Load(keyRequest); ok {
+		var req = v.(request)
+		session, resumed = c.manager.resume(socket, req.token, req.seq)
+	}
+	if session == nil {
+		session = c.manager.newSession(newToken(), 0)
+		session.attach(socket, false, 0, nil)
+	}
+	socket.SessionStorage.Store(keySession, attachment{session: session, resumed: resumed})
+	c.Next.OnOpen(socket)
+}
+
+func (c *ServerHandler) OnClose(socket *gws.Conn, err error) {
+	if session, _ := SessionOf(socket); session != nil {
+		session.detach(socket)
+	}
+	c.Next.OnClose(socket, err)
+}
+
+func (c *ServerHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	c.Next.OnMessage(socket, message)
+}
@@ -0,0 +1,291 @@
+package resume
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+type serverApp struct {
+	gws.BuiltinEventHandler
+	opened chan *gws.Conn
+	closed chan *gws.Conn
+}
+
+func (c *serverApp) OnOpen(socket *gws.Conn) { c.opened <- socket }
+
+func (c *serverApp) OnClose(socket *gws.Conn, err error) { c.closed <- socket }
+
+type clientApp struct {
+	gws.BuiltinEventHandler
+	messages chan string
+	sessions chan bool
+}
+
+func (c *clientApp) OnMessage(socket *gws.Conn, message *gws.Message) {
+	c.messages <- message.Data.String()
+	_ = message.Close()
+}
+
+func (c *clientApp) OnSession(socket *gws.Conn, resumed bool) { c.sessions <- resumed }
+
+type testServer struct {
+	*httptest.Server
+	manager *Manager
+	app     *serverApp
+}
+
+func newTestServer(t *testing.T, conf Config) *testServer {
+	var s = &testServer{
+		manager: NewManager(conf),
+		app:     &serverApp{opened: make(chan *gws.Conn, 4), closed: make(chan *gws.Conn, 4)},
+	}
+	var upgrader = gws.NewUpgrader(NewServerHandler(s.app, s.manager), &gws.ServerOption{Authorize: Authorize})
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			socket.ReadLoop()
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// 建立连接, 返回服务端的连接和客户端的连接
+func (c *testServer) connect(t *testing.T, handler *ClientHandler) (*gws.Conn, *gws.Conn) {
+	var option = &gws.ClientOption{
+		Addr:          "ws://" + strings.TrimPrefix(c.URL, "http://"),
+		RequestHeader: handler.RequestHeader(),
+	}
+	socket, _, err := gws.NewClient(handler, option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go socket.ReadLoop()
+	return <-c.app.opened, socket
+}
+
+// 断开连接并等待服务端感知
+func (c *testServer) disconnect(client *gws.Conn) {
+	_ = client.NetConn().Close()
+	<-c.app.closed
+}
+
+func newClientApp() *clientApp {
+	return &clientApp{messages: make(chan string, 16), sessions: make(chan bool, 4)}
+}
+
+func send(as *assert.Assertions, session *Session, texts ...string) {
+	for _, text := range texts {
+		as.NoError(session.Send(gws.OpcodeText, []byte(text)))
+	}
+}
+
+func TestResume(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("resume", func(t *testing.T) {
+		var server = newTestServer(t, Config{})
+		var app = newClientApp()
+		var handler = NewClientHandler(app)
+
+		conn, client := server.connect(t, handler)
+		as.False(<-app.sessions)
+		session, resumed := SessionOf(conn)
+		as.False(resumed)
+		as.Equal(session.Token(), handler.Token())
+
+		send(as, session, "a", "b", "c")
+		as.Equal("a", <-app.messages)
+		as.Equal("b", <-app.messages)
+		as.Equal("c", <-app.messages)
+		as.Equal(uint64(3), handler.LastSeq())
+
+		// 断开期间发送的消息在恢复后补发
+		server.disconnect(client)
+		send(as, session, "d", "e")
+		conn, client = server.connect(t, handler)
+		as.True(<-app.sessions)
+		resumedSession, resumed := SessionOf(conn)
+		as.True(resumed)
+		as.Same(session, resumedSession)
+		send(as, session, "f")
+		as.Equal("d", <-app.messages)
+		as.Equal("e", <-app.messages)
+		as.Equal("f", <-app.messages)
+		as.Equal(uint64(6), handler.LastSeq())
+		as.Equal(1, server.manager.Len())
+		_ = client.NetConn().Close()
+	})
+
+	// 错过的消息超出缓冲区, 开始新的会话
+	t.Run("overflow", func(t *testing.T) {
+		var server = newTestServer(t, Config{BufferSize: 2})
+		var app = newClientApp()
+		var handler = NewClientHandler(app)
+
+		conn, client := server.connect(t, handler)
+		as.False(<-app.sessions)
+		session, _ := SessionOf(conn)
+		var token = session.Token()
+		server.disconnect(client)
+		send(as, session, "a", "b", "c")
+
+		conn, client = server.connect(t, handler)
+		as.False(<-app.sessions)
+		session, resumed := SessionOf(conn)
+		as.False(resumed)
+		as.NotEqual(token, session.Token())
+		as.Equal(session.Token(), handler.Token())
+		as.Equal(uint64(0), handler.LastSeq())
+		send(as, session, "x")
+		as.Equal("x", <-app.messages)
+		_ = client.NetConn().Close()
+	})
+
+	// 不经过Session.Send的消息没有协议头, 客户端以协议错误关闭连接
+	t.Run("unframed", func(t *testing.T) {
+		var server = newTestServer(t, Config{})
+		var app = newClientApp()
+		conn, _ := server.connect(t, NewClientHandler(app))
+		<-app.sessions
+		as.NoError(conn.WriteString("raw"))
+		as.Same(conn, <-server.app.closed)
+		as.Len(app.messages, 0)
+	})
+
+	// 会话过期后删除, 持久化同时删除
+	t.Run("expire", func(t *testing.T) {
+		var persistence = newMemoryPersistence()
+		var server = newTestServer(t, Config{SessionTTL: 10 * time.Millisecond, Persistence: persistence})
+		var app = newClientApp()
+		conn, client := server.connect(t, NewClientHandler(app))
+		<-app.sessions
+		session, _ := SessionOf(conn)
+		send(as, session, "a")
+		<-app.messages
+		server.disconnect(client)
+		as.Eventually(func() bool { return server.manager.Len() == 0 }, time.Second, time.Millisecond)
+		as.ErrorIs(session.Send(gws.OpcodeText, nil), ErrSessionClosed)
+		as.Equal(0, persistence.len(session.Token()))
+	})
+}
+
+// 内存中的持久化, 模拟服务重启
+type memoryPersistence struct {
+	mu      sync.Mutex
+	records map[string][]Record
+}
+
+func newMemoryPersistence() *memoryPersistence {
+	return &memoryPersistence{records: make(map[string][]Record)}
+}
+
+func (c *memoryPersistence) Save(token string, record Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records[token] = append(c.records[token], record)
+	return nil
+}
+
+func (c *memoryPersistence) LoadSince(token string, seq uint64) ([]Record, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list = c.records[token]
+	if len(list) == 0 {
+		return nil, errors.New("unknown session")
+	}
+	var records []Record
+	for _, item := range list {
+		if item.Seq > seq {
+			records = append(records, item)
+		}
+	}
+	return records, nil
+}
+
+func (c *memoryPersistence) Delete(token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.records, token)
+	return nil
+}
+
+func (c *memoryPersistence) len(token string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.records[token])
+}
+
+func TestResume_Persistence(t *testing.T) {
+	var as = assert.New(t)
+	var persistence = newMemoryPersistence()
+	var app = newClientApp()
+	var handler = NewClientHandler(app)
+
+	var server1 = newTestServer(t, Config{BufferSize: 2, Persistence: persistence})
+	conn, client := server1.connect(t, handler)
+	<-app.sessions
+	session, _ := SessionOf(conn)
+	send(as, session, "a")
+	as.Equal("a", <-app.messages)
+	server1.disconnect(client)
+	send(as, session, "b", "c", "d")
+
+	// 服务重启, 内存中的会话丢失, 从持久化恢复
+	var server2 = newTestServer(t, Config{BufferSize: 2, Persistence: persistence})
+	conn, client = server2.connect(t, handler)
+	as.True(<-app.sessions)
+	restored, resumed := SessionOf(conn)
+	as.True(resumed)
+	as.Equal(session.Token(), restored.Token())
+	as.Equal(uint64(4), restored.Seq())
+	send(as, restored, "e")
+	for _, text := range []string{"b", "c", "d", "e"} {
+		as.Equal(text, <-app.messages)
+	}
+	_ = client.NetConn().Close()
+}
+
+func TestSession_Buffer(t *testing.T) {
+	var as = assert.New(t)
+	var manager = NewManager(Config{BufferSize: 3})
+	var session = manager.newSession("token", 0)
+	for i := 1; i <= 5; i++ {
+		as.NoError(session.Send(gws.OpcodeText, []byte(fmt.Sprint(i))))
+	}
+	as.Equal(uint64(5), session.Seq())
+	as.True(session.covers(5))
+	as.True(session.covers(2))
+	as.False(session.covers(1))
+	as.False(session.covers(6))
+
+	var seqs []uint64
+	for i := 0; i < session.size; i++ {
+		seqs = append(seqs, session.records[(session.head+i)%len(session.records)].Seq)
+	}
+	as.Equal([]uint64{3, 4, 5}, seqs)
+}
+
+// 检查和绑定在同一个临界区内, 缓冲区不再包含错过的消息时不绑定
+func TestSession_AttachGap(t *testing.T) {
+	var as = assert.New(t)
+	var manager = NewManager(Config{BufferSize: 2})
+	var session = manager.newSession("token", 0)
+	for i := 1; i <= 3; i++ {
+		as.NoError(session.Send(gws.OpcodeText, []byte(fmt.Sprint(i))))
+	}
+	as.False(session.attach(nil, true, 0, nil))
+	as.Nil(session.conn)
+
+	s, resumed := manager.resume(nil, "token", 0)
+	as.Nil(s)
+	as.False(resumed)
+}
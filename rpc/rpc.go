@@ -0,0 +1,414 @@
+// Package rpc 在gws连接上实现双向的请求/响应调用: 关联ID, 超时, 方法注册以及并发的在途调用
+// Package rpc implements bidirectional request/response calls on top of gws connections:
+// correlation ids, timeouts, method registration and concurrent in-flight calls
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/internal"
+	"github.com/lxzan/gws/internal/envelope"
+)
+
+// RPC帧格式: 魔数(1) 类型(1) 关联ID(8, 大端), 请求帧之后是方法名长度(1)和方法名, 最后是载荷;
+// 应用消息同样带有协议头, 见Peer.WriteMessage
+// RPC frame layout: magic(1) kind(1) correlation id(8, big endian); requests continue with the method length(1)
+// and the method name; the payload comes last. Application messages carry the header too, see Peer.WriteMessage
+const (
+	magic      byte = 0xB7
+	headerSize      = envelope.HeaderSize
+
+	kindRequest  byte = 1
+	kindReply    byte = 2
+	kindError    byte = 3
+	kindNotFound byte = 4
+	kindBusy     byte = 5
+
+	// 方法名的最大长度
+	// maximum length of a method name
+	maxMethodLength = 255
+
+	// 默认调用超时
+	// default call timeout
+	defaultTimeout = 10 * time.Second
+
+	// 每个Peer默认同时处理的请求数
+	// default number of requests a peer serves at the same time
+	defaultMaxConcurrency = 64
+
+	// 存放Peer的SessionStorage键
+	// SessionStorage key of the peer
+	sessionKey = "gws/rpc"
+)
+
+var (
+	// ErrClosed 连接已经关闭, 在途的调用失败
+	// the connection was closed, in-flight calls fail
+	ErrClosed = errors.New("rpc: connection closed")
+
+	// ErrMethodNotFound 对端没有注册该方法
+	// the method is not registered by the remote side
+	ErrMethodNotFound = errors.New("rpc: method not found")
+
+	// ErrMethodTooLong 方法名超过255字节
+	// the method name is longer than 255 bytes
+	ErrMethodTooLong = errors.New("rpc: method name too long")
+
+	// ErrBusy 对端同时处理的请求数达到了Config.MaxConcurrency
+	// the remote side is serving Config.MaxConcurrency requests already
+	ErrBusy = errors.New("rpc: too many concurrent requests")
+)
+
+// Error 对端处理器返回的错误
+// Error is an error returned by the remote handler
+type Error struct {
+	Method  string
+	Message string
+}
+
+func (c *Error) Error() string {
+	return "rpc: " + c.Method + ": " + c.Message
+}
+
+// HandlerFunc 方法处理器, ctx派生自连接的context, 连接关闭时取消, 可以用gws.ConnFromContext取回连接
+// HandlerFunc handles a method. ctx derives from the connection context, is cancelled when the connection closes
+// and carries the connection, see gws.ConnFromContext
+type HandlerFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+// Router 方法注册表, 可以被多个连接共享
+// Router is the method registry, it may be shared by many connections
+type Router struct {
+	mu      sync.RWMutex
+	methods map[string]HandlerFunc
+}
+
+// NewRouter 创建方法注册表
+// NewRouter creates a method registry
+func NewRouter() *Router {
+	return &Router{methods: make(map[string]HandlerFunc)}
+}
+
+// Register 注册方法, 同名方法会被替换; 方法名超过255字节时panic
+// Register registers a method, replacing one of the same name. It panics if the name is longer than 255 bytes
+func (c *Router) Register(method string, handler HandlerFunc) {
+	if len(method) > maxMethodLength {
+		panic(ErrMethodTooLong)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.methods[method] = handler
+}
+
+func (c *Router) lookup(method string) HandlerFunc {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.methods[method]
+}
+
+// Config 调用配置
+// Call configuration
+type Config struct {
+	// ctx没有截止时间时的调用超时, 默认10秒, 负数表示不设置超时
+	// Timeout of calls whose ctx has no deadline, 10s by default; a negative value means no timeout
+	Timeout time.Duration
+
+	// 每个Peer同时处理的最大请求数, 默认64, 负数表示不限制; 超出的请求不会执行, 调用方收到ErrBusy
+	// Maximum number of requests a peer serves at the same time, 64 by default; a negative value means no limit.
+	// Requests above the limit are not run and the caller gets ErrBusy
+	MaxConcurrency int
+}
+
+type result struct {
+	payload []byte
+	err     error
+}
+
+// Peer 一个连接上的RPC端点, 两端都可以发起调用和处理请求
+// Peer is the RPC endpoint of a connection, both ends can make calls and serve requests
+type Peer struct {
+	conn    *gws.Conn
+	router  *Router
+	timeout time.Duration
+
+	// 正在处理的请求的信号量, 为nil时不限制
+	// semaphore of the requests being served, nil for no limit
+	serving chan struct{}
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan result
+	closed  bool
+}
+
+func newPeer(socket *gws.Conn, router *Router, conf Config) *Peer {
+	var timeout = conf.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	var peer = &Peer{conn: socket, router: router, timeout: timeout, pending: make(map[uint64]chan result)}
+	if n := conf.MaxConcurrency; n >= 0 {
+		peer.serving = make(chan struct{}, internal.SelectValue(n == 0, defaultMaxConcurrency, n))
+	}
+	return peer
+}
+
+// Conn 底层连接
+// Conn returns the underlying connection
+func (c *Peer) Conn() *gws.Conn {
+	return c.conn
+}
+
+// Pending 在途的调用数量
+// Pending returns the number of in-flight calls
+func (c *Peer) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending)
+}
+
+// Call 调用对端的方法并等待响应, 可以并发调用. ctx没有截止时间时使用Config.Timeout
+// 对端处理器返回的错误为*Error, 对端没有注册该方法时返回ErrMethodNotFound
+// Call invokes a method of the remote side and waits for the reply, safe for concurrent use.
+// Config.Timeout applies if ctx has no deadline. Errors of the remote handler are *Error,
+// ErrMethodNotFound is returned if the remote side has not registered the method
+func (c *Peer) Call(ctx context.Context, method string, payload []byte) ([]byte, error) {
+	if len(method) > maxMethodLength {
+		return nil, ErrMethodTooLong
+	}
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var ch = make(chan result, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.seq++
+	var id = c.seq
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	var frame = envelope.New(magic, kindRequest, id, 1+len(method)+len(payload))
+	frame[headerSize] = byte(len(method))
+	copy(frame[headerSize+1:], method)
+	copy(frame[headerSize+1+len(method):], payload)
+	if err := c.conn.WriteMessage(gws.OpcodeBinary, frame); err != nil {
+		c.remove(id)
+		return nil, err
+	}
+
+	select {
+	case r := <-ch:
+		if r.err == ErrMethodNotFound || r.err == ErrBusy {
+			return nil, fmt.Errorf("%w: %s", r.err, method)
+		}
+		if e, ok := r.err.(*Error); ok {
+			e.Method = method
+		}
+		return r.payload, r.err
+	case <-ctx.Done():
+		c.remove(id)
+		return nil, ctx.Err()
+	}
+}
+
+// WriteMessage 发送一条应用消息, 对端的EventHandler去掉协议头后转发给应用的处理器.
+// 被包装的连接上不能直接调用gws.Conn的写方法发送应用消息, 对端会以协议错误关闭连接
+// WriteMessage sends an application message, the EventHandler of the remote side forwards it to the application
+// handler without the protocol header. Application messages must not be written with the methods of gws.Conn
+// on a wrapped connection, the remote side closes the connection with a protocol error
+func (c *Peer) WriteMessage(opcode gws.Opcode, payload []byte) error {
+	return c.conn.WriteMessage(gws.OpcodeBinary, envelope.Wrap(magic, envelope.KindMessage, 0, opcode, payload))
+}
+
+func (c *Peer) remove(id uint64) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// 处理RPC帧, 应用消息去掉协议头后返回, 由调用方转发; 不是RPC帧或者内容不完整时以协议错误关闭连接
+// handle an RPC frame. Application messages are returned without the header for the caller to forward,
+// messages that are not RPC frames or are incomplete close the connection with a protocol error
+func (c *Peer) handle(message *gws.Message) *gws.Message {
+	var frame, ok = envelope.Parse(message, magic)
+	if !ok {
+		envelope.Reject(c.conn, message, envelope.ErrUnframed)
+		return nil
+	}
+	var id, p = frame.ID, frame.Body
+
+	switch frame.Kind {
+	case envelope.KindMessage:
+		if !envelope.Unwrap(message, frame) {
+			envelope.Reject(c.conn, message, envelope.ErrMalformed)
+			return nil
+		}
+		return message
+	case kindRequest:
+		if len(p) < 1 || len(p) < 1+int(p[0]) {
+			envelope.Reject(c.conn, message, envelope.ErrMalformed)
+			return nil
+		}
+		if !c.acquire() {
+			c.reply(kindBusy, id, nil)
+			break
+		}
+		var method = string(p[1 : 1+p[0]])
+		var payload = append([]byte(nil), p[1+p[0]:]...)
+		go c.serve(id, method, payload)
+	case kindReply, kindError, kindNotFound, kindBusy:
+		c.mu.Lock()
+		var ch = c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch == nil {
+			break
+		}
+		var r = result{payload: append([]byte(nil), p...)}
+		if frame.Kind == kindError {
+			r = result{err: &Error{Message: string(p)}}
+		} else if frame.Kind == kindNotFound {
+			r = result{err: ErrMethodNotFound}
+		} else if frame.Kind == kindBusy {
+			r = result{err: ErrBusy}
+		}
+		ch <- r
+	}
+	_ = message.Close()
+	return nil
+}
+
+// 占用一个处理请求的名额, 已满时返回false; 不阻塞读循环, 否则处理器等待的响应将无法被读取
+// take a slot for serving a request, false if none is left. The read loop is not blocked, otherwise the replies
+// the handlers are waiting for could not be read
+func (c *Peer) acquire() bool {
+	if c.serving == nil {
+		return true
+	}
+	select {
+	case c.serving <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Peer) release() {
+	if c.serving != nil {
+		<-c.serving
+	}
+}
+
+// 在独立的协程中处理请求, 处理器可以在其中发起调用而不会阻塞读循环
+// serve a request on a goroutine of its own, so that handlers may make calls without blocking the read loop
+func (c *Peer) serve(id uint64, method string, payload []byte) {
+	defer c.release()
+	var handler = c.router.lookup(method)
+	if handler == nil {
+		c.reply(kindNotFound, id, nil)
+		return
+	}
+	reply, err := c.invoke(handler, payload)
+	if err != nil {
+		c.reply(kindError, id, []byte(err.Error()))
+		return
+	}
+	c.reply(kindReply, id, reply)
+}
+
+func (c *Peer) invoke(handler HandlerFunc, payload []byte) (reply []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("panic: %v", e)
+		}
+	}()
+	return handler(c.conn.Context(), payload)
+}
+
+func (c *Peer) reply(kind byte, id uint64, payload []byte) {
+	var frame = envelope.New(magic, kind, id, len(payload))
+	copy(frame[headerSize:], payload)
+	_ = c.conn.WriteMessage(gws.OpcodeBinary, frame)
+}
+
+// 连接关闭, 在途的调用返回ErrClosed
+// the connection closed, in-flight calls return ErrClosed
+func (c *Peer) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, ch := range c.pending {
+		ch <- result{err: ErrClosed}
+		delete(c.pending, id)
+	}
+}
+
+// PeerOf 取回连接上的RPC端点, 连接不是由EventHandler处理的或者还没有打开时返回nil
+// PeerOf returns the RPC endpoint of a connection, nil if the connection is not handled by an EventHandler
+// or has not been opened yet
+func PeerOf(socket *gws.Conn) *Peer {
+	return envelope.Load[*Peer](socket, sessionKey)
+}
+
+// EventHandler 包装应用的事件处理器: 消费RPC帧, 应用消息和其他事件转发给next. 两端都需要使用EventHandler,
+// 应用消息通过Peer.WriteMessage发送, 没有协议头的消息会以协议错误关闭连接
+// EventHandler wraps the event handler of the application: RPC frames are consumed, application messages and
+// other events are forwarded to next. Both ends have to use an EventHandler and send application messages with
+// Peer.WriteMessage, a message without the protocol header closes the connection with a protocol error
+//
+// Example:
+//
+//	var router = rpc.NewRouter()
+//	router.Register("echo", func(ctx context.Context, payload []byte) ([]byte, error) { return payload, nil })
+//	var server = gws.NewServer(rpc.NewEventHandler(handler, router, rpc.Config{}), nil)
+//
+//	// in OnOpen or later
+//	reply, err := rpc.PeerOf(socket).Call(ctx, "echo", []byte("hello"))
+type EventHandler struct {
+	envelope.Forward
+	router *Router
+	conf   Config
+}
+
+// NewEventHandler router为nil时只能发起调用, 不处理请求
+// NewEventHandler creates the wrapper. With a nil router the peers only make calls and serve nothing
+func NewEventHandler(next gws.Event, router *Router, conf Config) *EventHandler {
+	return &EventHandler{Forward: envelope.Forward{Next: next}, router: router, conf: conf}
+}
+
+// Peer 取回或者创建连接上的RPC端点; 客户端可以在ReadLoop之前用它取得端点
+// Peer returns the RPC endpoint of a connection, creating it if needed. Clients may use it before ReadLoop
+func (c *EventHandler) Peer(socket *gws.Conn) *Peer {
+	return envelope.LoadOrStore(socket, sessionKey, func() *Peer { return newPeer(socket, c.router, c.conf) })
+}
+
+func (c *EventHandler) OnOpen(socket *gws.Conn) {
+	c.Peer(socket)
+	c.Next.OnOpen(socket)
+}
+
+func (c *EventHandler) OnClose(socket *gws.Conn, err error) {
+	if peer := PeerOf(socket); peer != nil {
+		peer.close()
+	}
+	c.Next.OnClose(socket, err)
+}
+
+func (c *EventHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	if forward := c.Peer(socket).handle(message); forward != nil {
+		c.Next.OnMessage(socket, forward)
+	}
+}
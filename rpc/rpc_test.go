@@ -0,0 +1,229 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/lxzan/gws/internal/envelope"
+	"github.com/stretchr/testify/assert"
+)
+
+type appHandler struct {
+	gws.BuiltinEventHandler
+	messages chan string
+	opened   chan *gws.Conn
+}
+
+func (c *appHandler) OnOpen(socket *gws.Conn) {
+	if c.opened != nil {
+		c.opened <- socket
+	}
+}
+
+func (c *appHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	c.messages <- message.Data.String()
+	_ = message.Close()
+}
+
+// 建立一对经过EventHandler的连接, 返回客户端和服务端的Peer
+func newPeers(t *testing.T, serverRouter, clientRouter *Router, conf Config) (*Peer, *Peer, *appHandler) {
+	var app = &appHandler{messages: make(chan string, 1), opened: make(chan *gws.Conn, 1)}
+	var upgrader = gws.NewUpgrader(NewEventHandler(app, serverRouter, conf), &gws.ServerOption{ReadAsyncEnabled: true})
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			socket.ReadLoop()
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	var handler = NewEventHandler(&appHandler{messages: make(chan string, 1)}, clientRouter, conf)
+	socket, _, err := gws.NewClient(handler, &gws.ClientOption{Addr: "ws://" + strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = socket.NetConn().Close() })
+	var peer = handler.Peer(socket)
+	go socket.ReadLoop()
+	return peer, PeerOf(<-app.opened), app
+}
+
+func TestPeer_Call(t *testing.T) {
+	var as = assert.New(t)
+	var router = NewRouter()
+	router.Register("echo", func(ctx context.Context, payload []byte) ([]byte, error) { return payload, nil })
+	router.Register("fail", func(ctx context.Context, payload []byte) ([]byte, error) { return nil, errors.New("boom") })
+	router.Register("panic", func(ctx context.Context, payload []byte) ([]byte, error) { panic("oops") })
+	router.Register("conn", func(ctx context.Context, payload []byte) ([]byte, error) {
+		var socket, ok = gws.ConnFromContext(ctx)
+		as.True(ok)
+		return []byte(fmt.Sprint(socket.IsServer())), nil
+	})
+	router.Register("sleep", func(ctx context.Context, payload []byte) ([]byte, error) {
+		time.Sleep(100 * time.Millisecond)
+		return nil, nil
+	})
+	client, server, app := newPeers(t, router, nil, Config{MaxConcurrency: -1})
+
+	t.Run("echo", func(t *testing.T) {
+		reply, err := client.Call(context.Background(), "echo", []byte("hello"))
+		as.NoError(err)
+		as.Equal("hello", string(reply))
+
+		reply, err = client.Call(context.Background(), "conn", nil)
+		as.NoError(err)
+		as.Equal("true", string(reply))
+	})
+
+	t.Run("remote error", func(t *testing.T) {
+		_, err := client.Call(context.Background(), "fail", nil)
+		var e *Error
+		as.True(errors.As(err, &e))
+		as.Equal("fail", e.Method)
+		as.Equal("boom", e.Message)
+
+		_, err = client.Call(context.Background(), "panic", nil)
+		as.True(errors.As(err, &e))
+		as.Equal("panic: oops", e.Message)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := client.Call(context.Background(), "missing", nil)
+		as.ErrorIs(err, ErrMethodNotFound)
+
+		// 客户端没有注册方法, 服务端调用失败
+		_, err = server.Call(context.Background(), "echo", nil)
+		as.ErrorIs(err, ErrMethodNotFound)
+
+		_, err = client.Call(context.Background(), strings.Repeat("a", 256), nil)
+		as.ErrorIs(err, ErrMethodTooLong)
+		as.Panics(func() { router.Register(strings.Repeat("a", 256), nil) })
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var text = fmt.Sprintf("call %d", i)
+				reply, err := client.Call(context.Background(), "echo", []byte(text))
+				as.NoError(err)
+				as.Equal(text, string(reply))
+			}(i)
+		}
+		wg.Wait()
+		as.Equal(0, client.Pending())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := client.Call(ctx, "sleep", nil)
+		as.ErrorIs(err, context.DeadlineExceeded)
+		as.Equal(0, client.Pending())
+	})
+
+	// 应用消息去掉协议头后转发给应用的处理器, 以魔数开头的载荷不会被误认为RPC帧
+	t.Run("forward", func(t *testing.T) {
+		as.NoError(client.WriteMessage(gws.OpcodeText, []byte("hello")))
+		as.Equal("hello", <-app.messages)
+
+		var payload = string([]byte{magic, kindRequest, 0, 0, 0, 0, 0, 0, 0, 1, 4, 'e', 'c', 'h', 'o'})
+		as.NoError(client.WriteMessage(gws.OpcodeBinary, []byte(payload)))
+		as.Equal(payload, <-app.messages)
+	})
+
+	// 没有协议头的消息以协议错误关闭连接
+	t.Run("unframed", func(t *testing.T) {
+		as.NoError(client.Conn().WriteString("hello"))
+		as.Eventually(func() bool {
+			_, err := client.Call(context.Background(), "echo", nil)
+			return errors.Is(err, ErrClosed)
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func TestPeer_Close(t *testing.T) {
+	var as = assert.New(t)
+	var router = NewRouter()
+	var called = make(chan struct{})
+	router.Register("block", func(ctx context.Context, payload []byte) ([]byte, error) {
+		close(called)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	client, _, _ := newPeers(t, router, nil, Config{Timeout: -1})
+
+	go func() {
+		<-called
+		client.Conn().WriteClose(1000, nil)
+	}()
+	_, err := client.Call(context.Background(), "block", nil)
+	as.ErrorIs(err, ErrClosed)
+
+	_, err = client.Call(context.Background(), "block", nil)
+	as.ErrorIs(err, ErrClosed)
+}
+
+func TestPeer_DefaultTimeout(t *testing.T) {
+	var as = assert.New(t)
+	var router = NewRouter()
+	router.Register("block", func(ctx context.Context, payload []byte) ([]byte, error) {
+		<-ctx.Done()
+		return nil, nil
+	})
+	client, _, _ := newPeers(t, router, nil, Config{Timeout: 20 * time.Millisecond})
+	_, err := client.Call(context.Background(), "block", nil)
+	as.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func TestPeer_MaxConcurrency(t *testing.T) {
+	var as = assert.New(t)
+	var router = NewRouter()
+	var called = make(chan struct{}, 1)
+	var unblock = make(chan struct{})
+	router.Register("block", func(ctx context.Context, payload []byte) ([]byte, error) {
+		called <- struct{}{}
+		<-unblock
+		return nil, nil
+	})
+	client, _, _ := newPeers(t, router, nil, Config{MaxConcurrency: 1})
+
+	var done = make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), "block", nil)
+		done <- err
+	}()
+	<-called
+
+	// 名额用尽, 请求不会执行
+	_, err := client.Call(context.Background(), "block", nil)
+	as.ErrorIs(err, ErrBusy)
+	as.Len(called, 0)
+
+	close(unblock)
+	as.NoError(<-done)
+	_, err = client.Call(context.Background(), "block", nil)
+	as.NoError(err)
+}
+
+// 方法名长度超出请求的内容, 以协议错误关闭连接
+func TestPeer_Malformed(t *testing.T) {
+	var as = assert.New(t)
+	client, _, _ := newPeers(t, NewRouter(), nil, Config{})
+	var frame = envelope.New(magic, kindRequest, 1, 1)
+	frame[headerSize] = 10
+	as.NoError(client.Conn().WriteMessage(gws.OpcodeBinary, frame))
+	as.Eventually(func() bool {
+		_, err := client.Call(context.Background(), "echo", nil)
+		return errors.Is(err, ErrClosed)
+	}, time.Second, time.Millisecond)
+}
@@ -3,6 +3,7 @@ package gws
 import (
 	"github.com/lxzan/gws/internal"
 	"sync"
+	"time"
 )
 
 // SessionStorage because sync.Map is not easy to debug, so I implemented my own map.
@@ -14,16 +15,37 @@ type SessionStorage interface {
 	Range(f func(key string, value interface{}) bool)
 }
 
+// ExpirableStorage 支持过期时间的SessionStorage, 默认的SessionStorage实现了该接口
+// 连接关闭后未到期的条目不再触发回调
+// SessionStorage with per-key TTLs, implemented by the default SessionStorage.
+// Entries that have not expired when the connection is closed never fire the hook
+type ExpirableStorage interface {
+	SessionStorage
+
+	// StoreWithTTL 存储一个ttl之后自动删除的值, 再次Store或Delete会取消过期
+	// stores a value that is deleted automatically after ttl, a later Store or Delete cancels the expiry
+	StoreWithTTL(key string, value interface{}, ttl time.Duration)
+
+	// OnExpire 设置过期回调, 在删除之后调用, 回调运行在计时器协程中
+	// sets the expiry hook, called after the entry is deleted, on the timer goroutine
+	OnExpire(f func(key string, value interface{}))
+}
+
 type (
 	sliceMap struct {
 		sync.RWMutex
-		data []kv
+		data     []kv
+		onExpire func(key string, value interface{})
+		stopped  bool
+		seq      uint64
 	}
 
 	kv struct {
 		deleted bool
 		key     string
 		value   interface{}
+		timer   *time.Timer
+		seq     uint64
 	}
 )
 
@@ -55,6 +77,7 @@ func (c *sliceMap) Delete(key string) {
 	defer c.Unlock()
 	for i, v := range c.data {
 		if v.key == key {
+			c.data[i].stopTimer()
 			c.data[i].value = nil
 			c.data[i].deleted = true
 			return
@@ -65,11 +88,17 @@ func (c *sliceMap) Delete(key string) {
 func (c *sliceMap) Store(key string, value interface{}) {
 	c.Lock()
 	defer c.Unlock()
+	c.doStore(key, value, nil, 0)
+}
 
+func (c *sliceMap) doStore(key string, value interface{}, timer *time.Timer, seq uint64) {
 	for i, v := range c.data {
 		if v.key == key {
+			c.data[i].stopTimer()
 			c.data[i].value = value
 			c.data[i].deleted = false
+			c.data[i].timer = timer
+			c.data[i].seq = seq
 			return
 		}
 	}
@@ -78,9 +107,69 @@ func (c *sliceMap) Store(key string, value interface{}) {
 		deleted: false,
 		key:     key,
 		value:   value,
+		timer:   timer,
+		seq:     seq,
 	})
 }
 
+func (c *sliceMap) StoreWithTTL(key string, value interface{}, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped {
+		return
+	}
+	c.seq++
+	var seq = c.seq
+	c.doStore(key, value, time.AfterFunc(ttl, func() { c.expire(key, seq) }), seq)
+}
+
+func (c *sliceMap) OnExpire(f func(key string, value interface{})) {
+	c.Lock()
+	c.onExpire = f
+	c.Unlock()
+}
+
+// 只有计时器未被替换时才删除, 避免误删重新存储的值
+// only delete the entry if its timer has not been replaced, so a value stored again is kept
+func (c *sliceMap) expire(key string, seq uint64) {
+	c.Lock()
+	var value interface{}
+	var expired = false
+	for i, v := range c.data {
+		if v.key == key && v.seq == seq && v.timer != nil && !v.deleted && !c.stopped {
+			value, expired = v.value, true
+			c.data[i].value = nil
+			c.data[i].deleted = true
+			c.data[i].timer = nil
+			break
+		}
+	}
+	var f = c.onExpire
+	c.Unlock()
+
+	if expired && f != nil {
+		f(key, value)
+	}
+}
+
+// 连接关闭时停止所有计时器
+// stop all timers when the connection is closed
+func (c *sliceMap) stopTimers() {
+	c.Lock()
+	defer c.Unlock()
+	c.stopped = true
+	for i := range c.data {
+		c.data[i].stopTimer()
+	}
+}
+
+func (c *kv) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
 func (c *sliceMap) Range(f func(key string, value interface{}) bool) {
 	c.Lock()
 	defer c.Unlock()
@@ -94,6 +183,92 @@ func (c *sliceMap) Range(f func(key string, value interface{}) bool) {
 	}
 }
 
+// LoadOrStore 如果key存在返回已有的值, 否则存储value; loaded表示值是否已经存在
+// returns the existing value for the key if present, otherwise stores value. loaded reports whether the value existed
+func (c *sliceMap) LoadOrStore(key string, value interface{}) (actual interface{}, loaded bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	for i, v := range c.data {
+		if v.key == key {
+			if !v.deleted {
+				return v.value, true
+			}
+			c.data[i].value = value
+			c.data[i].deleted = false
+			return value, false
+		}
+	}
+
+	c.data = append(c.data, kv{key: key, value: value})
+	return value, false
+}
+
+// TypedStorage SessionStorage的泛型包装, 省去类型断言; 类型不匹配的值视为不存在
+// Generic wrapper of SessionStorage that saves the type assertions; values of other types are treated as absent
+type TypedStorage[T any] struct {
+	storage SessionStorage
+}
+
+func NewTypedStorage[T any](storage SessionStorage) TypedStorage[T] {
+	return TypedStorage[T]{storage: storage}
+}
+
+func (c TypedStorage[T]) Load(key string) (value T, exist bool) {
+	v, ok := c.storage.Load(key)
+	if !ok {
+		return value, false
+	}
+	value, exist = v.(T)
+	return
+}
+
+func (c TypedStorage[T]) Store(key string, value T) {
+	c.storage.Store(key, value)
+}
+
+func (c TypedStorage[T]) Delete(key string) {
+	c.storage.Delete(key)
+}
+
+// LoadOrStore 默认的SessionStorage上是原子操作, 自定义实现需要提供LoadOrStore方法才能保证原子性
+// Atomic on the default SessionStorage, custom implementations need a LoadOrStore method to be atomic
+func (c TypedStorage[T]) LoadOrStore(key string, value T) (actual T, loaded bool) {
+	var v interface{}
+	if s, ok := c.storage.(interface {
+		LoadOrStore(key string, value interface{}) (interface{}, bool)
+	}); ok {
+		v, loaded = s.LoadOrStore(key, value)
+	} else if v, loaded = c.storage.Load(key); !loaded {
+		c.storage.Store(key, value)
+		v = value
+	}
+	actual, _ = v.(T)
+	return actual, loaded
+}
+
+// Range 只遍历类型为T的值
+// Range only visits values of type T
+func (c TypedStorage[T]) Range(f func(key string, value T) bool) {
+	c.storage.Range(func(key string, value interface{}) bool {
+		if v, ok := value.(T); ok {
+			return f(key, v)
+		}
+		return true
+	})
+}
+
+// Len 类型为T的值的数量
+// number of values of type T
+func (c TypedStorage[T]) Len() int {
+	var n = 0
+	c.Range(func(key string, value T) bool {
+		n++
+		return true
+	})
+	return n
+}
+
 /*
 ConcurrentMap
 used to store websocket connections in the IM server
@@ -1,9 +1,13 @@
 package gws
 
 import (
+	"fmt"
 	"github.com/lxzan/gws/internal"
 	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMap(t *testing.T) {
@@ -181,3 +185,118 @@ func TestHash(t *testing.T) {
 	m = NewConcurrentMap[string, uint32](0)
 	assert.Equal(t, uint64(16), m.segments)
 }
+
+func TestSliceMap_LoadOrStore(t *testing.T) {
+	var as = assert.New(t)
+	var m = new(sliceMap)
+	v, loaded := m.LoadOrStore("a", 1)
+	as.False(loaded)
+	as.Equal(1, v)
+	v, loaded = m.LoadOrStore("a", 2)
+	as.True(loaded)
+	as.Equal(1, v)
+	m.Delete("a")
+	v, loaded = m.LoadOrStore("a", 3)
+	as.False(loaded)
+	as.Equal(3, v)
+	as.Equal(1, m.Len())
+}
+
+type plainStorage struct {
+	m map[string]interface{}
+}
+
+func (c *plainStorage) Load(key string) (interface{}, bool) { v, ok := c.m[key]; return v, ok }
+
+func (c *plainStorage) Delete(key string) { delete(c.m, key) }
+
+func (c *plainStorage) Store(key string, value interface{}) { c.m[key] = value }
+
+func (c *plainStorage) Range(f func(key string, value interface{}) bool) {
+	for k, v := range c.m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func TestTypedStorage(t *testing.T) {
+	var as = assert.New(t)
+	for _, storage := range []SessionStorage{new(sliceMap), &plainStorage{m: map[string]interface{}{}}} {
+		var s = NewTypedStorage[int](storage)
+		s.Store("a", 1)
+		storage.Store("b", "text")
+		v, ok := s.Load("a")
+		as.True(ok)
+		as.Equal(1, v)
+		_, ok = s.Load("b")
+		as.False(ok)
+		_, ok = s.Load("c")
+		as.False(ok)
+
+		v, loaded := s.LoadOrStore("a", 2)
+		as.True(loaded)
+		as.Equal(1, v)
+		v, loaded = s.LoadOrStore("c", 3)
+		as.False(loaded)
+		as.Equal(3, v)
+		as.Equal(2, s.Len())
+
+		var sum = 0
+		s.Range(func(key string, value int) bool {
+			sum += value
+			return true
+		})
+		as.Equal(4, sum)
+
+		s.Delete("a")
+		_, ok = s.Load("a")
+		as.False(ok)
+	}
+}
+
+func TestSliceMap_TTL(t *testing.T) {
+	var as = assert.New(t)
+	var storage ExpirableStorage = new(sliceMap)
+	var expired = make(chan string, 4)
+	storage.OnExpire(func(key string, value interface{}) {
+		expired <- fmt.Sprintf("%s=%v", key, value)
+	})
+	storage.StoreWithTTL("token", 1, 10*time.Millisecond)
+	storage.StoreWithTTL("kept", 2, 10*time.Millisecond)
+	storage.Store("kept", 3)
+	storage.StoreWithTTL("deleted", 4, 10*time.Millisecond)
+	storage.Delete("deleted")
+
+	as.Equal("token=1", <-expired)
+	_, ok := storage.Load("token")
+	as.False(ok)
+	time.Sleep(30 * time.Millisecond)
+	as.Equal(0, len(expired))
+	v, ok := storage.Load("kept")
+	as.True(ok)
+	as.Equal(3, v)
+}
+
+func TestSliceMap_StopTimers(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var fired = int32(0)
+	serverHandler.onClose = func(socket *Conn, err error) {
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	var storage = server.SessionStorage.(ExpirableStorage)
+	storage.OnExpire(func(key string, value interface{}) { atomic.AddInt32(&fired, 1) })
+	storage.StoreWithTTL("presence", true, 20*time.Millisecond)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	client.WriteClose(1000, nil)
+	wg.Wait()
+	storage.StoreWithTTL("late", true, time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+	as.Equal(int32(0), atomic.LoadInt32(&fired))
+}
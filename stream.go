@@ -0,0 +1,147 @@
+package gws
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// Stream 可靠有序的双向字节流, 例如一个QUIC流; 实现了SetDeadline, SetReadDeadline, SetWriteDeadline, LocalAddr,
+// RemoteAddr的流会用到这些方法. gws不依赖任何QUIC或者WebTransport实现
+// Stream is a reliable, ordered, bidirectional byte stream, e.g. a QUIC stream. SetDeadline, SetReadDeadline,
+// SetWriteDeadline, LocalAddr and RemoteAddr are used if implemented. gws depends on no QUIC or WebTransport
+// implementation
+type Stream interface {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// 把Stream适配为net.Conn, 流没有实现的方法什么也不做
+// adapts a Stream to net.Conn, methods the stream does not implement do nothing
+type streamConn struct {
+	Stream
+}
+
+func (c streamConn) LocalAddr() net.Addr {
+	if v, ok := c.Stream.(interface{ LocalAddr() net.Addr }); ok {
+		return v.LocalAddr()
+	}
+	return streamAddr{}
+}
+
+func (c streamConn) RemoteAddr() net.Addr {
+	if v, ok := c.Stream.(interface{ RemoteAddr() net.Addr }); ok {
+		return v.RemoteAddr()
+	}
+	return streamAddr{}
+}
+
+func (c streamConn) SetDeadline(t time.Time) error {
+	if v, ok := c.Stream.(interface{ SetDeadline(time.Time) error }); ok {
+		return v.SetDeadline(t)
+	}
+	return nil
+}
+
+func (c streamConn) SetReadDeadline(t time.Time) error {
+	if v, ok := c.Stream.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return v.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (c streamConn) SetWriteDeadline(t time.Time) error {
+	if v, ok := c.Stream.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return v.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "stream" }
+
+func (streamAddr) String() string { return "stream" }
+
+// UpgradeStream 在任意可靠有序的双向字节流上完成websocket握手, 与Upgrade一样读取升级请求, 调用Authorize和OnHandshake,
+// 协商压缩, 扩展和子协议. 只是一个适配器: QUIC连接, WebTransport会话等传输层的建立不在gws的范围内, 由调用方完成后传入流;
+// 握手失败时流被关闭. 返回的连接需要调用ReadLoop
+// UpgradeStream performs the websocket handshake over any reliable, ordered, bidirectional byte stream. Like Upgrade
+// it reads the upgrade request, calls Authorize and OnHandshake and negotiates compression, extensions and the
+// subprotocol. It is only an adapter: setting up the transport, such as a QUIC connection or a WebTransport
+// session, is outside the scope of gws and is left to the caller, who passes the stream in. The stream is closed
+// if the handshake fails. Call ReadLoop on the returned connection
+//
+// Example:
+//
+//	stream, err := transport.AcceptStream(ctx)
+//	if err == nil {
+//		if socket, err := upgrader.UpgradeStream(stream); err == nil {
+//			go socket.ReadLoop()
+//		}
+//	}
+func (c *Upgrader) UpgradeStream(stream Stream) (*Conn, error) {
+	var start = time.Now()
+	var netConn = streamConn{Stream: stream}
+	socket, r, status, err := c.upgradeStream(netConn)
+	if err != nil {
+		atomic.AddUint64(&c.option.config.serverStats.handshakeErrors, 1)
+		if status > 0 {
+			c.writeErrorResponse(netConn, status)
+		}
+		c.logAccess(start, r, netConn, nil, status, err)
+		_ = netConn.Close()
+		return nil, err
+	}
+	c.logAccess(start, r, netConn, socket, http.StatusSwitchingProtocols, nil)
+	return socket, nil
+}
+
+// 读取升级请求并完成握手, 失败时返回需要写出的HTTP状态码, 0表示不写出响应
+// read the upgrade request and complete the handshake; on failure the HTTP status to respond with is returned,
+// 0 means no response
+func (c *Upgrader) upgradeStream(netConn net.Conn) (*Conn, *http.Request, int, error) {
+	if c.option.config.memory.exceeded() {
+		return nil, nil, http.StatusServiceUnavailable, internal.ErrMemoryWatermark
+	}
+	if err := netConn.SetDeadline(time.Now().Add(c.option.HandshakeTimeout)); err != nil {
+		return nil, nil, 0, err
+	}
+	var br = newStreamReader(netConn, c.option.ReadBufferSize)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, nil, internal.SelectValue(errors.Is(err, io.EOF), 0, http.StatusBadRequest), err
+	}
+	socket, err := c.doUpgrade(r, nil, netConn, br)
+	return socket, r, handshakeStatus(err), err
+}
+
+// NewClientFromStream 客户端版本的UpgradeStream, 与NewClientFromConn一样在流上发送升级请求;
+// ClientOption.Addr提供请求的路径和Host, 不用于拨号
+// NewClientFromStream is the client side of UpgradeStream. Like NewClientFromConn it sends the upgrade request over
+// the stream; ClientOption.Addr supplies the path and Host of the request and is not dialed
+//
+// Example:
+//
+//	stream, err := transport.OpenStreamSync(ctx)
+//	if err == nil {
+//		if socket, _, err := gws.NewClientFromStream(handler, &gws.ClientOption{Addr: "ws://example.com/chat"}, stream); err == nil {
+//			go socket.ReadLoop()
+//		}
+//	}
+func NewClientFromStream(handler Event, option *ClientOption, stream Stream) (*Conn, *http.Response, error) {
+	return NewClientFromConn(handler, option, streamConn{Stream: stream})
+}
+
+func newStreamReader(conn net.Conn, size int) *bufio.Reader {
+	var br = getReaderPool(size).Get().(*bufio.Reader)
+	br.Reset(conn)
+	return br
+}
@@ -0,0 +1,130 @@
+package gws
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 只有Read, Write, Close的流
+type pipeStream struct {
+	io.ReadWriteCloser
+}
+
+func TestUpgradeStream(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var handshakes = make(chan string, 1)
+	var upgrader = NewUpgrader(serverHandler, &ServerOption{
+		ConnMap:      NewConnMap(0),
+		Subprotocols: []string{"chat"},
+		OnHandshake: func(socket *Conn, r *http.Request, responseHeader http.Header) {
+			handshakes <- r.URL.Path
+		},
+	})
+	var messages = make(chan string, 1)
+	var closed = make(chan error, 1)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		messages <- message.Data.String()
+	}
+	clientHandler.onClose = func(socket *Conn, err error) {
+		closed <- err
+	}
+
+	s, c := net.Pipe()
+	type result struct {
+		socket *Conn
+		err    error
+	}
+	var servers = make(chan result, 1)
+	go func() {
+		socket, err := upgrader.UpgradeStream(pipeStream{s})
+		servers <- result{socket, err}
+	}()
+	client, resp, err := NewClientFromStream(clientHandler, &ClientOption{
+		Addr:          "ws://example.com/chat",
+		RequestHeader: http.Header{"Sec-Websocket-Protocol": []string{"chat"}},
+	}, pipeStream{c})
+	if !as.NoError(err) {
+		return
+	}
+	var r = <-servers
+	if !as.NoError(r.err) {
+		return
+	}
+	var server = r.socket
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 与Upgrade一样完成握手和协商
+	as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	as.Equal("/chat", <-handshakes)
+	as.Equal("chat", server.SubProtocol())
+	as.Equal("chat", client.SubProtocol())
+	as.True(server.IsServer())
+	as.False(client.IsServer())
+	as.Equal("stream", client.RemoteAddr().String())
+	as.Equal(1, upgrader.option.ConnMap.Len())
+
+	as.NoError(client.WriteString("hello"))
+	select {
+	case text := <-messages:
+		as.Equal("hello", text)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+
+	server.WriteClose(1000, nil)
+	select {
+	case err := <-closed:
+		var e *CloseError
+		as.ErrorAs(err, &e)
+		as.Equal(uint16(1000), e.Code)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestUpgradeStream_Unauthorized(t *testing.T) {
+	var as = assert.New(t)
+	var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{
+		Authorize: func(r *http.Request, session SessionStorage) bool { return false },
+	})
+	s, c := net.Pipe()
+	var errs = make(chan error, 1)
+	go func() {
+		_, err := upgrader.UpgradeStream(pipeStream{s})
+		errs <- err
+	}()
+	_, resp, err := NewClientFromStream(new(BuiltinEventHandler), &ClientOption{Addr: "ws://example.com/"}, pipeStream{c})
+	as.Error(err)
+	as.Equal(http.StatusUnauthorized, resp.StatusCode)
+	as.ErrorIs(<-errs, ErrUnauthorized)
+	as.Equal(uint64(1), upgrader.option.config.serverStats.handshakeErrors)
+}
+
+func TestStreamConn(t *testing.T) {
+	var as = assert.New(t)
+	s, c := net.Pipe()
+	defer c.Close()
+
+	// net.Conn实现了全部可选方法, 会被使用
+	var conn = streamConn{Stream: s}
+	as.Equal(s.LocalAddr(), conn.LocalAddr())
+	as.NoError(conn.SetReadDeadline(time.Now().Add(-time.Second)))
+	_, err := conn.Read(make([]byte, 1))
+	as.Error(err)
+
+	conn = streamConn{Stream: pipeStream{s}}
+	as.Equal("stream", conn.LocalAddr().Network())
+	as.NoError(conn.SetDeadline(time.Now()))
+	as.NoError(conn.SetWriteDeadline(time.Now()))
+}
@@ -1,15 +1,20 @@
 package gws
 
 import (
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
 type (
 	workerQueue struct {
-		mu             sync.Mutex // 锁
-		q              []asyncJob // 任务队列
-		maxConcurrency int32      // 最大并发
-		curConcurrency int32      // 当前并发
+		mu             sync.Mutex     // 锁
+		q              []asyncJob     // 任务队列
+		maxConcurrency int32          // 最大并发
+		curConcurrency int32          // 当前并发
+		sched          *readScheduler // 所有连接共享的并发预算, 为nil时不限制
+		waiting        bool           // 是否在sched中排队, 由sched.mu保护
 	}
 
 	asyncJob func()
@@ -37,18 +42,142 @@ func (c *workerQueue) getJob(delta int32) asyncJob {
 	if len(c.q) == 0 {
 		return nil
 	}
+	if c.sched != nil && !c.sched.acquire(c) {
+		return nil
+	}
+	return c.pop()
+}
+
+// 取出队首的任务并占用一个并发, 调用方持有锁
+// pop the first job and take a concurrency slot, the caller holds the lock
+func (c *workerQueue) pop() asyncJob {
 	var result = c.q[0]
+	c.q[0] = nil
 	c.q = c.q[1:]
+	// 队列清空后释放底层数组, 空闲连接不再持有突发写入时扩容的内存
+	// release the backing array once drained, so that idle connections do not keep the memory grown by a burst
+	if len(c.q) == 0 {
+		c.q = nil
+	}
 	c.curConcurrency++
 	return result
 }
 
-// 循环执行任务
+// 循环执行任务; 共享并发预算时每个任务之后交出令牌, 协程转去执行得到令牌的连接的任务
+// run jobs in a loop. With a shared budget the token is handed over after every job and the goroutine
+// moves on to the jobs of the connection that receives it
 func (c *workerQueue) do(job asyncJob) {
+	var q = c
 	for job != nil {
 		job()
-		job = c.getJob(-1)
+		if q.sched == nil {
+			job = q.getJob(-1)
+		} else {
+			q, job = q.sched.next(q)
+		}
+	}
+}
+
+// 一个任务执行完毕, 返回是否还有可以执行的任务
+// a job has finished, reports whether more jobs can run
+func (c *workerQueue) finish() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.curConcurrency--
+	return len(c.q) > 0 && c.curConcurrency < c.maxConcurrency
+}
+
+// 用转交来的令牌取出一个任务, 没有可以执行的任务时返回nil
+// take a job with a token handed over, nil if no job can run
+func (c *workerQueue) take() asyncJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.q) == 0 || c.curConcurrency >= c.maxConcurrency {
+		return nil
+	}
+	return c.pop()
+}
+
+// 所有连接共享的异步读并发预算. 令牌按排队顺序分配给连接, 每执行完一个任务就交给下一个排队的连接,
+// 繁忙的连接排到队尾, 因此大量连接之间公平轮转, 同时运行的OnMessage协程数不超过limit
+// async read concurrency budget shared by all connections. Tokens are granted to connections in the order they queued
+// and passed on to the next queued connection after every job, a busy connection going to the back of the queue.
+// Connections thus take turns fairly and no more than limit OnMessage goroutines run at the same time
+type readScheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	waiting []*workerQueue
+}
+
+func newReadScheduler(limit int) *readScheduler {
+	return &readScheduler{limit: limit}
+}
+
+// 申请一个令牌, 没有空闲令牌时连接排队
+// acquire a token, queueing the connection if none is free
+func (c *readScheduler) acquire(q *workerQueue) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running < c.limit {
+		c.running++
+		return true
 	}
+	c.enqueue(q)
+	return false
+}
+
+func (c *readScheduler) enqueue(q *workerQueue) {
+	if !q.waiting {
+		q.waiting = true
+		c.waiting = append(c.waiting, q)
+	}
+}
+
+// q的一个任务执行完毕, 把令牌交给排在最前面的连接并取出它的任务; 没有排队的连接时归还令牌
+// a job of q has finished: hand the token to the first queued connection and take its job,
+// or give the token back if nobody is queued
+func (c *readScheduler) next(q *workerQueue) (*workerQueue, asyncJob) {
+	var runnable = q.finish()
+	for {
+		c.mu.Lock()
+		if runnable {
+			c.enqueue(q)
+			runnable = false
+		}
+		if len(c.waiting) == 0 {
+			c.running--
+			c.mu.Unlock()
+			return nil, nil
+		}
+		var w = c.waiting[0]
+		c.waiting[0] = nil
+		c.waiting = c.waiting[1:]
+		if len(c.waiting) == 0 {
+			c.waiting = nil
+		}
+		w.waiting = false
+		c.mu.Unlock()
+
+		// 排队期间任务可能已经被执行, 这时继续交给下一个
+		// the jobs may have run while queued, then pass the token on
+		if job := w.take(); job != nil {
+			// 还有积压的话再申请令牌, 申请不到就重新排队
+			// apply for another token if more jobs are pending, queueing again if none is free
+			if extra := w.getJob(0); extra != nil {
+				go w.do(extra)
+			}
+			return w, job
+		}
+	}
+}
+
+// 正在执行的任务数和排队的连接数
+// number of jobs running and of connections queued
+func (c *readScheduler) stats() (running int, waiting int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running, len(c.waiting)
 }
 
 // Push 追加任务, 有资源空闲的话会立即执行
@@ -60,3 +189,115 @@ func (c *workerQueue) Push(job asyncJob) {
 		go c.do(job)
 	}
 }
+
+// Len 等待执行的任务数量
+func (c *workerQueue) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.q)
+}
+
+// QueueStats 任务队列的快照
+// Snapshot of a worker queue
+type QueueStats struct {
+	// 正在执行的任务数
+	// number of jobs running
+	Running int
+
+	// 最大并发
+	// maximum number of jobs running concurrently
+	MaxConcurrency int
+
+	// 等待执行的任务数
+	// number of jobs waiting to run
+	Backlog int
+}
+
+// Stats 当前并发和积压的任务数
+func (c *workerQueue) Stats() QueueStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return QueueStats{Running: int(c.curConcurrency), MaxConcurrency: int(c.maxConcurrency), Backlog: len(c.q)}
+}
+
+// 写队列使用的无锁多生产者单消费者队列. 生产者用CAS压入一个栈, 消费者每次取走整个栈并反转成先进先出的顺序;
+// 同一时刻最多一个消费者协程, 没有任务时退出. 许多协程同时WriteAsync同一个连接时避免锁竞争. 零值可以直接使用
+// lock-free multi-producer single-consumer queue used for writes. Producers push onto a stack with CAS, the consumer
+// takes the whole stack at once and reverses it into FIFO order; at most one consumer goroutine runs at a time and it
+// exits when no job is left. It avoids lock contention when many goroutines WriteAsync to the same connection.
+// The zero value is ready to use
+type mpscQueue struct {
+	top unsafe.Pointer // *mpscNode
+
+	// 使用32位计数, 队列嵌入在Conn中, 在32位平台上无法保证64位原子操作需要的对齐
+	// a 32-bit counter: the queue is embedded in Conn, so the alignment 64-bit atomics need on 32-bit platforms
+	// is not guaranteed
+	size    int32
+	running int32
+}
+
+type mpscNode struct {
+	job  asyncJob
+	next *mpscNode
+}
+
+// Push 追加任务, 没有消费者时启动一个
+func (c *mpscQueue) Push(job asyncJob) {
+	var node = &mpscNode{job: job}
+	atomic.AddInt32(&c.size, 1)
+	for {
+		var top = atomic.LoadPointer(&c.top)
+		node.next = (*mpscNode)(top)
+		if atomic.CompareAndSwapPointer(&c.top, top, unsafe.Pointer(node)) {
+			break
+		}
+		runtime.Gosched()
+	}
+	if atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+		go c.do()
+	}
+}
+
+// 取走所有任务, 按压入顺序返回
+// take all the jobs, returned in the order they were pushed
+func (c *mpscQueue) takeAll() *mpscNode {
+	var node = (*mpscNode)(atomic.SwapPointer(&c.top, nil))
+	var list *mpscNode
+	for node != nil {
+		var next = node.next
+		node.next = list
+		list, node = node, next
+	}
+	return list
+}
+
+// 循环执行任务. 退出前重新检查, 避免与刚压入任务但没有抢到消费者的生产者错过
+// run the jobs in a loop. Check again before exiting, so that a producer that pushed but did not become
+// the consumer is not missed
+func (c *mpscQueue) do() {
+	for {
+		for list := c.takeAll(); list != nil; list = c.takeAll() {
+			for node := list; node != nil; node = node.next {
+				atomic.AddInt32(&c.size, -1)
+				node.job()
+			}
+		}
+		atomic.StoreInt32(&c.running, 0)
+		if atomic.LoadPointer(&c.top) == nil || !atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+			return
+		}
+	}
+}
+
+// Len 等待执行的任务数量
+func (c *mpscQueue) Len() int {
+	if n := atomic.LoadInt32(&c.size); n > 0 {
+		return int(n)
+	}
+	return 0
+}
+
+// Stats 当前并发和积压的任务数
+func (c *mpscQueue) Stats() QueueStats {
+	return QueueStats{Running: int(atomic.LoadInt32(&c.running)), MaxConcurrency: 1, Backlog: c.Len()}
+}
@@ -242,6 +242,214 @@ func TestTaskQueue(t *testing.T) {
 		wg.Wait()
 		as.Equal(sum, int64(500500))
 	})
+
+	t.Run("len", func(t *testing.T) {
+		var w = newWorkerQueue(1)
+		var release = make(chan struct{})
+		var wg = &sync.WaitGroup{}
+		wg.Add(3)
+		for i := 0; i < 3; i++ {
+			w.Push(func() {
+				<-release
+				wg.Done()
+			})
+		}
+		as.Equal(2, w.Len())
+		close(release)
+		wg.Wait()
+		as.Equal(0, w.Len())
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		var w = newWorkerQueue(2)
+		var release = make(chan struct{})
+		for i := 0; i < 5; i++ {
+			w.Push(func() { <-release })
+		}
+		as.Equal(QueueStats{Running: 2, MaxConcurrency: 2, Backlog: 3}, w.Stats())
+		close(release)
+		as.Eventually(func() bool { return w.Stats() == QueueStats{MaxConcurrency: 2} }, time.Second, time.Millisecond)
+	})
+}
+
+// 测试全局异步读并发预算
+func TestReadScheduler(t *testing.T) {
+	var as = assert.New(t)
+
+	// 多个连接同时运行的任务总数不超过上限
+	t.Run("limit", func(t *testing.T) {
+		var sched = newReadScheduler(4)
+		var running, peak int64
+		var wg = &sync.WaitGroup{}
+		var queues []*workerQueue
+		for i := 0; i < 16; i++ {
+			queues = append(queues, &workerQueue{maxConcurrency: 8, sched: sched})
+		}
+		for i := 0; i < 50; i++ {
+			for _, q := range queues {
+				wg.Add(1)
+				q.Push(func() {
+					defer wg.Done()
+					var n = atomic.AddInt64(&running, 1)
+					for {
+						var p = atomic.LoadInt64(&peak)
+						if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+							break
+						}
+					}
+					time.Sleep(time.Duration(internal.AlphabetNumeric.Intn(100)) * time.Microsecond)
+					atomic.AddInt64(&running, -1)
+				})
+			}
+		}
+		wg.Wait()
+		as.LessOrEqual(atomic.LoadInt64(&peak), int64(4))
+		as.Eventually(func() bool {
+			r, w := sched.stats()
+			return r == 0 && w == 0
+		}, time.Second, time.Millisecond)
+	})
+
+	// 繁忙的连接不会饿死其他连接
+	t.Run("fair", func(t *testing.T) {
+		var sched = newReadScheduler(1)
+		var busy = &workerQueue{maxConcurrency: 8, sched: sched}
+		var idle = &workerQueue{maxConcurrency: 8, sched: sched}
+		var release = make(chan struct{})
+		var mu = &sync.Mutex{}
+		var order []string
+		var wg = &sync.WaitGroup{}
+		var record = func(name string) {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			wg.Done()
+		}
+
+		wg.Add(7)
+		busy.Push(func() { <-release; record("busy") })
+		for i := 0; i < 5; i++ {
+			busy.Push(func() { record("busy") })
+		}
+		idle.Push(func() { record("idle") })
+		// busy先于idle排队, 之后两者轮流执行
+		r, w := sched.stats()
+		as.Equal(1, r)
+		as.Equal(2, w)
+		close(release)
+		wg.Wait()
+		as.Equal([]string{"busy", "busy", "idle", "busy", "busy", "busy", "busy"}, order)
+	})
+
+	// 保持单个连接的消息顺序
+	t.Run("ordered", func(t *testing.T) {
+		var sched = newReadScheduler(2)
+		var queues []*workerQueue
+		var lists = make([][]int, 8)
+		var wg = &sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			queues = append(queues, &workerQueue{maxConcurrency: 1, sched: sched})
+		}
+		for j := 0; j < 100; j++ {
+			for i, q := range queues {
+				i, j := i, j
+				wg.Add(1)
+				q.Push(func() {
+					lists[i] = append(lists[i], j)
+					wg.Done()
+				})
+			}
+		}
+		wg.Wait()
+		for i := range lists {
+			as.Equal(100, len(lists[i]))
+			for j, v := range lists[i] {
+				as.Equal(j, v)
+			}
+		}
+	})
+
+	t.Run("option", func(t *testing.T) {
+		var option = initServerOption(&ServerOption{ReadAsyncEnabled: true, ReadAsyncGlobalLimit: 16})
+		as.NotNil(option.getConfig().readScheduler)
+		option = initServerOption(&ServerOption{ReadAsyncGlobalLimit: 16})
+		as.Nil(option.getConfig().readScheduler)
+
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var serverOption = &ServerOption{ReadAsyncEnabled: true, ReadAsyncGlobalLimit: 1}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{})
+		as.NotNil(server.readQueue.sched)
+		as.Nil(client.readQueue.sched)
+
+		const count = 100
+		var wg = &sync.WaitGroup{}
+		wg.Add(count)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { wg.Done() }
+		go server.ReadLoop()
+		go client.ReadLoop()
+		for i := 0; i < count; i++ {
+			as.NoError(client.WriteString("hello"))
+		}
+		wg.Wait()
+	})
+}
+
+func TestMpscQueue(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("order", func(t *testing.T) {
+		// 多个生产者并发写入, 每个生产者的任务保持顺序, 且同一时刻只有一个任务在执行
+		const producers, count = 16, 1000
+		var q mpscQueue
+		var wg = &sync.WaitGroup{}
+		wg.Add(producers * count)
+		var running int32
+		var last [producers]int
+		for i := 0; i < producers; i++ {
+			go func(p int) {
+				for j := 1; j <= count; j++ {
+					var v = j
+					q.Push(func() {
+						as.Equal(int32(1), atomic.AddInt32(&running, 1))
+						as.Equal(last[p]+1, v)
+						last[p] = v
+						atomic.AddInt32(&running, -1)
+						wg.Done()
+					})
+				}
+			}(i)
+		}
+		wg.Wait()
+		as.Eventually(func() bool { return q.Stats() == QueueStats{MaxConcurrency: 1} }, time.Second, time.Millisecond)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		var q mpscQueue
+		var release = make(chan struct{})
+		var started = make(chan struct{})
+		q.Push(func() {
+			close(started)
+			<-release
+		})
+		<-started
+		q.Push(func() {})
+		q.Push(func() {})
+		as.Equal(2, q.Len())
+		as.Equal(QueueStats{Running: 1, MaxConcurrency: 1, Backlog: 2}, q.Stats())
+		close(release)
+		as.Eventually(func() bool { return q.Len() == 0 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		// 消费者退出后再次写入会重新启动
+		var q mpscQueue
+		for i := 0; i < 100; i++ {
+			var done = make(chan struct{})
+			q.Push(func() { close(done) })
+			<-done
+		}
+	})
 }
 
 func TestWriteAsyncBlocking(t *testing.T) {
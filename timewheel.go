@@ -0,0 +1,194 @@
+package gws
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 时间轮的槽位数, 超过一圈的定时器记录剩余圈数
+	// number of slots, timers beyond one revolution record the remaining rounds
+	wheelSlots = 512
+
+	// 时间轮的最小和最大刻度
+	// bounds of the tick
+	wheelMinTick = 10 * time.Millisecond
+	wheelMaxTick = time.Second
+)
+
+// 哈希时间轮, 用一个协程和一个Ticker驱动大量低精度的定时器, 代替每个连接各自的runtime定时器.
+// 没有定时器时协程退出, 下次添加时重新启动
+// hashed timer wheel, one goroutine and one ticker drive a large number of coarse timers,
+// instead of a runtime timer per connection. The goroutine exits when no timer is left and restarts on the next one
+type timerWheel struct {
+	tick time.Duration
+	// 最近一次刻度的时间, UnixNano
+	// time of the last tick, in UnixNano
+	clock int64
+
+	mu      sync.Mutex
+	slots   [wheelSlots]*wheelTimer
+	cursor  int
+	size    int
+	running bool
+}
+
+// 时间轮中的定时器, 回调在时间轮的协程中执行, 不能阻塞
+// a timer in the wheel, the callback runs on the goroutine of the wheel and must not block
+type wheelTimer struct {
+	wheel      *timerWheel
+	fn         func()
+	slot       int
+	rounds     int
+	prev, next *wheelTimer
+}
+
+func newTimerWheel(tick time.Duration) *timerWheel {
+	return &timerWheel{tick: tick}
+}
+
+var (
+	sharedWheelsMu sync.Mutex
+	sharedWheels   = make(map[time.Duration]*timerWheel)
+)
+
+// 按刻度共享的时间轮, 供没有Server的客户端连接使用
+// wheels shared by tick, used by client connections that have no server
+func sharedTimerWheel(tick time.Duration) *timerWheel {
+	sharedWheelsMu.Lock()
+	defer sharedWheelsMu.Unlock()
+	if c, ok := sharedWheels[tick]; ok {
+		return c
+	}
+	var c = newTimerWheel(tick)
+	sharedWheels[tick] = c
+	return c
+}
+
+// 空闲超时使用的刻度, 精度为超时时间的1/16, 取整到最小刻度
+// tick used for the idle timeout, 1/16 of the timeout rounded to the minimum tick
+func idleTick(timeout time.Duration) time.Duration {
+	var tick = timeout / 16 / wheelMinTick * wheelMinTick
+	if tick < wheelMinTick {
+		return wheelMinTick
+	}
+	if tick > wheelMaxTick {
+		return wheelMaxTick
+	}
+	return tick
+}
+
+// 当前时间, 时间轮运行时返回最近一次刻度的时间, 开销只有一次原子读
+// the current time; while the wheel is running it is the time of the last tick, costing a single atomic load
+func (c *timerWheel) now() int64 {
+	if t := atomic.LoadInt64(&c.clock); t > 0 {
+		return t
+	}
+	return time.Now().UnixNano()
+}
+
+// 创建定时器, 调用reset之后才开始计时
+// create a timer, it does not run until reset is called
+func (c *timerWheel) newTimer(fn func()) *wheelTimer {
+	return &wheelTimer{wheel: c, fn: fn, slot: -1}
+}
+
+// 添加定时器, 在d之后(按刻度向上取整)执行fn
+// add a timer that runs fn after d, rounded up to the tick
+func (c *timerWheel) schedule(d time.Duration, fn func()) *wheelTimer {
+	var t = c.newTimer(fn)
+	t.reset(d)
+	return t
+}
+
+func (c *timerWheel) add(t *wheelTimer, d time.Duration) {
+	var ticks = int((d + c.tick - 1) / c.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	t.slot = (c.cursor + ticks) % wheelSlots
+	t.rounds = (ticks - 1) / wheelSlots
+	t.prev, t.next = nil, c.slots[t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	c.slots[t.slot] = t
+	c.size++
+
+	if !c.running {
+		c.running = true
+		atomic.StoreInt64(&c.clock, time.Now().UnixNano())
+		go c.run()
+	}
+}
+
+func (c *timerWheel) remove(t *wheelTimer) {
+	if t.slot < 0 {
+		return
+	}
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		c.slots[t.slot] = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+	t.slot, t.prev, t.next = -1, nil, nil
+	c.size--
+}
+
+func (c *timerWheel) run() {
+	var ticker = time.NewTicker(c.tick)
+	defer ticker.Stop()
+
+	var expired []*wheelTimer
+	for now := range ticker.C {
+		c.mu.Lock()
+		atomic.StoreInt64(&c.clock, now.UnixNano())
+		c.cursor = (c.cursor + 1) % wheelSlots
+		for t := c.slots[c.cursor]; t != nil; {
+			var next = t.next
+			if t.rounds == 0 {
+				c.remove(t)
+				expired = append(expired, t)
+			} else {
+				t.rounds--
+			}
+			t = next
+		}
+		var stopped = c.size == 0
+		if stopped {
+			c.running = false
+			atomic.StoreInt64(&c.clock, 0)
+		}
+		c.mu.Unlock()
+
+		for i, t := range expired {
+			t.fn()
+			expired[i] = nil
+		}
+		expired = expired[:0]
+		if stopped {
+			return
+		}
+	}
+}
+
+// 重新设置定时器, 在d之后执行
+// reschedule the timer to run after d
+func (c *wheelTimer) reset(d time.Duration) {
+	c.wheel.mu.Lock()
+	c.wheel.remove(c)
+	c.wheel.add(c, d)
+	c.wheel.mu.Unlock()
+}
+
+// 停止定时器
+// stop the timer
+func (c *wheelTimer) stop() {
+	c.wheel.mu.Lock()
+	c.wheel.remove(c)
+	c.wheel.mu.Unlock()
+}
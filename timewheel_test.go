@@ -0,0 +1,103 @@
+package gws
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimerWheel(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("schedule", func(t *testing.T) {
+		var wheel = newTimerWheel(wheelMinTick)
+		var fired = make(chan time.Time, 1)
+		var start = time.Now()
+		wheel.schedule(50*time.Millisecond, func() { fired <- time.Now() })
+		var elapsed = (<-fired).Sub(start)
+		as.GreaterOrEqual(elapsed, 50*time.Millisecond)
+		as.Less(elapsed, time.Second)
+	})
+
+	t.Run("stop and reset", func(t *testing.T) {
+		var wheel = newTimerWheel(wheelMinTick)
+		var num int64
+		var t1 = wheel.schedule(20*time.Millisecond, func() { atomic.AddInt64(&num, 1) })
+		t1.stop()
+		t1.stop()
+
+		var fired = make(chan struct{})
+		var t2 = wheel.schedule(20*time.Millisecond, func() { close(fired) })
+		t2.reset(60 * time.Millisecond)
+		select {
+		case <-fired:
+			as.Fail("reset timer fired early")
+		case <-time.After(40 * time.Millisecond):
+		}
+		<-fired
+		as.Equal(int64(0), atomic.LoadInt64(&num))
+	})
+
+	t.Run("rounds", func(t *testing.T) {
+		// 超过一圈的定时器在剩余圈数用完后才执行
+		var wheel = newTimerWheel(time.Millisecond)
+		var fired = make(chan struct{})
+		var start = time.Now()
+		wheel.schedule(wheelSlots*time.Millisecond+30*time.Millisecond, func() { close(fired) })
+		<-fired
+		as.GreaterOrEqual(time.Since(start), wheelSlots*time.Millisecond)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		// 没有定时器时协程退出, 再次添加时重新启动
+		var wheel = newTimerWheel(wheelMinTick)
+		var wg = &sync.WaitGroup{}
+		wg.Add(8)
+		for i := 0; i < 8; i++ {
+			wheel.schedule(time.Duration(i)*wheelMinTick, wg.Done)
+		}
+		wg.Wait()
+		time.Sleep(3 * wheelMinTick)
+		wheel.mu.Lock()
+		as.False(wheel.running)
+		as.Equal(0, wheel.size)
+		wheel.mu.Unlock()
+
+		var fired = make(chan struct{})
+		wheel.schedule(wheelMinTick, func() { close(fired) })
+		<-fired
+	})
+
+	t.Run("tick", func(t *testing.T) {
+		as.Equal(wheelMinTick, idleTick(50*time.Millisecond))
+		as.Equal(100*time.Millisecond, idleTick(1600*time.Millisecond))
+		as.Equal(wheelMaxTick, idleTick(time.Hour))
+		as.Equal(sharedTimerWheel(wheelMinTick), sharedTimerWheel(wheelMinTick))
+	})
+}
+
+func TestConn_IdleTimeoutRefresh(t *testing.T) {
+	var as = assert.New(t)
+	var closed = make(chan error, 1)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+	var serverOption = &ServerOption{IdleTimeout: 100 * time.Millisecond}
+	server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// 持续收到数据的连接不会超时
+	var start = time.Now()
+	for i := 0; i < 10; i++ {
+		as.NoError(client.WritePing(nil))
+		time.Sleep(30 * time.Millisecond)
+	}
+	as.Len(closed, 0)
+
+	as.ErrorIs(<-closed, ErrIdleTimeout)
+	as.GreaterOrEqual(time.Since(start), 300*time.Millisecond)
+	as.Equal(uint64(1), server.config.serverStats.snapshot().ProtocolErrors.Timeout)
+}
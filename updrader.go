@@ -3,11 +3,18 @@ package gws
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
-	"log"
+	"expvar"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lxzan/gws/internal"
@@ -25,7 +32,25 @@ func NewUpgrader(eventHandler Event, option *ServerOption) *Upgrader {
 	}
 }
 
-func (c *Upgrader) connectHandshake(r *http.Request, responseHeader http.Header, conn net.Conn, websocketKey string) error {
+// CompressionStats 该Upgrader接受的所有连接汇总的压缩统计, 包括压缩器池的锁等待次数
+// CompressionStats returns the compression statistics aggregated over all connections accepted by the upgrader,
+// including the lock contention of the compressor pool
+func (c *Upgrader) CompressionStats() CompressionStats {
+	var stats = c.option.config.compressionStats.snapshot()
+	if c.option.config.compressors != nil {
+		stats.Contention = c.option.config.compressors.contention()
+	}
+	for _, item := range c.option.config.classCompressors {
+		if item != nil {
+			stats.Contention += item.contention()
+		}
+	}
+	return stats
+}
+
+// 写出101响应, 返回响应的字节
+// write the 101 response and return its bytes
+func (c *Upgrader) connectHandshake(r *http.Request, responseHeader http.Header, conn net.Conn, websocketKey string) ([]byte, error) {
 	if r.Header.Get(internal.SecWebSocketProtocol.Key) != "" {
 		var subprotocolsUsed = ""
 		var arr = internal.Split(r.Header.Get(internal.SecWebSocketProtocol.Key), ",")
@@ -55,28 +80,134 @@ func (c *Upgrader) connectHandshake(r *http.Request, responseHeader http.Header,
 	}
 	buf = append(buf, "\r\n"...)
 	_, err := conn.Write(buf)
-	return err
+	return buf, err
+}
+
+// AccessLogEntry 一次握手尝试的访问日志
+// Access log entry of an upgrade attempt
+type AccessLogEntry struct {
+	RemoteAddr string
+	Path       string
+	Origin     string
+
+	// 协商的子协议
+	// negotiated subprotocol
+	SubProtocol string
+
+	// 协商的压缩扩展, 例如permessage-deflate, 未压缩时为空
+	// negotiated compression extension such as permessage-deflate, empty if uncompressed
+	Compression string
+
+	// 返回给客户端的HTTP状态码, 成功时为101, 为0表示没有返回响应
+	// HTTP status code returned to the client, 101 on success, 0 if no response was sent
+	Status int
+
+	// 握手耗时
+	// time spent on the handshake
+	Duration time.Duration
+
+	// 握手失败的原因
+	// why the handshake failed, nil on success
+	Err error
+}
+
+// 输出访问日志, r为nil表示请求无法解析
+// write the access log, r is nil if the request could not be parsed
+func (c *Upgrader) logAccess(start time.Time, r *http.Request, netConn net.Conn, socket *Conn, status int, err error) {
+	if c.option.AccessLog == nil {
+		return
+	}
+	var entry = AccessLogEntry{Status: status, Duration: time.Since(start), Err: err}
+	if netConn != nil {
+		entry.RemoteAddr = netConn.RemoteAddr().String()
+	}
+	if r != nil {
+		entry.Path = r.URL.Path
+		entry.Origin = r.Header.Get("Origin")
+		if entry.RemoteAddr == "" {
+			entry.RemoteAddr = r.RemoteAddr
+		}
+	}
+	if socket != nil {
+		entry.SubProtocol = socket.SubProtocol()
+		if socket.compressEnabled {
+			entry.Compression = extensionDeflate
+		}
+		for _, item := range socket.extensions {
+			if item.RSV()&RSV1Bit != 0 {
+				entry.Compression = item.Name()
+			}
+		}
+	}
+	c.option.AccessLog(entry)
+}
+
+// 是否接受该Sec-WebSocket-Version
+// reports whether the Sec-WebSocket-Version is accepted
+func (c *Upgrader) acceptVersion(version string) bool {
+	if version == internal.SecWebSocketVersion.Val {
+		return true
+	}
+	for _, item := range c.option.AcceptedVersions {
+		if version == item {
+			return true
+		}
+	}
+	return false
+}
+
+// 握手失败时写出HTTP错误响应, 426响应通过Sec-WebSocket-Version列出支持的版本
+// write the HTTP error response of a failed handshake, a 426 lists the supported versions in Sec-WebSocket-Version
+func (c *Upgrader) writeErrorResponse(conn net.Conn, status int) {
+	var header = "Connection: close\r\n"
+	if status == http.StatusUpgradeRequired {
+		var versions = append([]string{internal.SecWebSocketVersion.Val}, c.option.AcceptedVersions...)
+		header += internal.SecWebSocketVersion.Key + ": " + strings.Join(versions, ", ") + "\r\n"
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(c.option.HandshakeTimeout))
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%s\r\n", status, http.StatusText(status), header)
 }
 
 // Upgrade http upgrade to websocket protocol
+// 近似内存占用超过MemoryWatermark时返回503和ErrMemoryWatermark
+// 不支持的Sec-WebSocket-Version返回426和ErrVersionNotSupported
+// Responds with 503 and returns ErrMemoryWatermark if the approximate memory in use exceeds MemoryWatermark.
+// Responds with 426 and returns ErrVersionNotSupported if the Sec-WebSocket-Version is not supported
 func (c *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	var start = time.Now()
+	if c.option.config.memory.exceeded() {
+		atomic.AddUint64(&c.option.config.serverStats.handshakeErrors, 1)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		c.logAccess(start, r, nil, nil, http.StatusServiceUnavailable, internal.ErrMemoryWatermark)
+		return nil, internal.ErrMemoryWatermark
+	}
 	netConn, br, err := c.hijack(w)
 	if err != nil {
+		atomic.AddUint64(&c.option.config.serverStats.handshakeErrors, 1)
+		c.logAccess(start, r, nil, nil, 0, err)
 		return nil, err
 	}
 
-	socket, err := c.doUpgrade(r, netConn, br)
+	socket, err := c.doUpgrade(r, nil, netConn, br)
 	if err != nil {
+		atomic.AddUint64(&c.option.config.serverStats.handshakeErrors, 1)
+		var status = 0
+		if errors.Is(err, internal.ErrVersionNotSupported) {
+			status = http.StatusUpgradeRequired
+			c.writeErrorResponse(netConn, status)
+		}
+		c.logAccess(start, r, netConn, nil, status, err)
 		_ = netConn.Close()
 		return nil, err
 	}
+	c.logAccess(start, r, netConn, socket, http.StatusSwitchingProtocols, nil)
 	return socket, err
 }
 
 func (c *Upgrader) hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error) {
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		return nil, nil, internal.CloseInternalServerErr
+		return nil, nil, internal.ErrHijackNotSupported
 	}
 	netConn, brw, err := hj.Hijack()
 	if err != nil {
@@ -84,13 +215,31 @@ func (c *Upgrader) hijack(w http.ResponseWriter) (net.Conn, *bufio.Reader, error
 	}
 
 	brw.Writer = nil
-	if brw.Reader.Size() != c.option.ReadBufferSize {
-		brw.Reader = bufio.NewReaderSize(netConn, c.option.ReadBufferSize)
+	return netConn, c.adoptReader(netConn, brw.Reader), nil
+}
+
+// 接管net/http的读缓冲区作为连接的读缓冲区. 缓冲区为空时直接读取连接, 绕过net/http每次读取都要加锁的connReader;
+// 大小不符时从池中获取; 已经缓冲了客户端数据时原样保留, 避免丢失这些数据
+// adopt the read buffer of net/http as the read buffer of the connection. When it is empty it is switched to read
+// the connection directly, bypassing the connReader of net/http which locks on every read; if the size does not
+// match a pooled reader is used instead. A buffer already holding client data is kept as is so that nothing is lost
+func (c *Upgrader) adoptReader(netConn net.Conn, br *bufio.Reader) *bufio.Reader {
+	switch {
+	case br.Buffered() > 0:
+		return br
+	case br.Size() == c.option.ReadBufferSize:
+		br.Reset(netConn)
+		return br
+	default:
+		br = getReaderPool(c.option.ReadBufferSize).Get().(*bufio.Reader)
+		br.Reset(netConn)
+		return br
 	}
-	return netConn, brw.Reader, nil
 }
 
-func (c *Upgrader) doUpgrade(r *http.Request, netConn net.Conn, br *bufio.Reader) (*Conn, error) {
+// rawRequest为线路上的原始请求, 未记录时为nil
+// rawRequest holds the request as on the wire, nil if it was not recorded
+func (c *Upgrader) doUpgrade(r *http.Request, rawRequest []byte, netConn net.Conn, br *bufio.Reader) (*Conn, error) {
 	if err := netConn.SetDeadline(time.Now().Add(c.option.HandshakeTimeout)); err != nil {
 		return nil, err
 	}
@@ -105,9 +254,8 @@ func (c *Upgrader) doUpgrade(r *http.Request, netConn net.Conn, br *bufio.Reader
 	if r.Method != http.MethodGet {
 		return nil, internal.ErrGetMethodRequired
 	}
-	if !strings.EqualFold(r.Header.Get(internal.SecWebSocketVersion.Key), internal.SecWebSocketVersion.Val) {
-		msg := "websocket version not supported"
-		return nil, errors.New(msg)
+	if !c.acceptVersion(r.Header.Get(internal.SecWebSocketVersion.Key)) {
+		return nil, internal.ErrVersionNotSupported
 	}
 	if !internal.HttpHeaderContains(r.Header.Get(internal.Connection.Key), internal.Connection.Val) {
 		return nil, internal.ErrHandshake
@@ -115,44 +263,416 @@ func (c *Upgrader) doUpgrade(r *http.Request, netConn net.Conn, br *bufio.Reader
 	if !strings.EqualFold(r.Header.Get(internal.Upgrade.Key), internal.Upgrade.Val) {
 		return nil, internal.ErrHandshake
 	}
-	if val := r.Header.Get(internal.SecWebSocketExtensions.Key); strings.Contains(val, "permessage-deflate") && c.option.CompressEnabled {
-		header.Set(internal.SecWebSocketExtensions.Key, internal.SecWebSocketExtensions.Val)
-		compressEnabled = true
+	var offers = parseExtensions(r.Header.Get(internal.SecWebSocketExtensions.Key))
+	// 自定义扩展优先协商, 占用了RSV1的扩展(例如permessage-zstd)会取代permessage-deflate; 响应按处理数据的顺序排列
+	// custom extensions are negotiated first, one claiming RSV1 (e.g. permessage-zstd) replaces permessage-deflate.
+	// The responses follow the order the extensions process data in
+	extensions, responses := negotiateExtensions(offers, c.option.Extensions, 0)
+	var deflate deflateParams
+	if c.option.CompressEnabled && !claimsRSV(extensions, RSV1Bit) {
+		var response extensionResponse
+		if deflate, response, compressEnabled = negotiateDeflate(offers, c.option.ContextTakeoverEnabled, c.option.DecompressWindowBits, c.option.DeflateQuirksAllowed); compressEnabled {
+			responses = append(responses, response)
+			if c.option.DeflateQuirksAllowed {
+				var offer = offers[response.index]
+				if _, err := parseDeflateParams(offer.params, false); err != nil {
+					c.option.Logger.Warn("gws: tolerated permessage-deflate offer from", netConn.RemoteAddr().String()+":", offer.String())
+				}
+			}
+		}
+	}
+	if len(responses) > 0 {
+		header.Set(internal.SecWebSocketExtensions.Key, formatExtensions(responses))
 	}
 	var websocketKey = r.Header.Get(internal.SecWebSocketKey.Key)
 	if websocketKey == "" {
 		return nil, internal.ErrHandshake
 	}
 
-	if err := c.connectHandshake(r, header, netConn, websocketKey); err != nil {
+	response, err := c.connectHandshake(r, header, netConn, websocketKey)
+	if err != nil {
 		return nil, err
 	}
 	if err := netConn.SetDeadline(time.Time{}); err != nil {
 		return nil, err
 	}
-	return serveWebSocket(true, c.option.getConfig(), session, netConn, br, c.eventHandler, compressEnabled), nil
+	var socket = serveWebSocket(true, c.option.getConfig(), session, netConn, br, c.eventHandler, compressEnabled)
+	socket.extensions = extensions
+	socket.subprotocol = header.Get(internal.SecWebSocketProtocol.Key)
+	if compressEnabled {
+		socket.deflateParams = deflate
+		socket.deflate = newDeflateState(true, deflate, socket.config)
+	}
+	if n := c.option.HandshakeCaptureSize; n > 0 {
+		if rawRequest == nil {
+			rawRequest = dumpRequest(r)
+		}
+		socket.handshakeRequest, socket.handshakeResponse = truncateHandshake(rawRequest, n), truncateHandshake(response, n)
+	}
+	if c.option.OnHandshake != nil {
+		c.option.OnHandshake(socket, r, header)
+	}
+	if c.option.ConnMap != nil {
+		socket.registry = c.option.ConnMap
+		socket.registry.Add(socket)
+	}
+	atomic.AddUint64(&c.option.config.serverStats.accepted, 1)
+	return socket, nil
 }
 
 type Server struct {
 	upgrader *Upgrader
 
-	// OnError 接收握手过程中产生的错误回调
-	// Receive error callbacks generated during the handshake
+	// 上一次Stats的快照和时间, 用于计算速率
+	// snapshot and time of the previous Stats call, used to compute rates
+	mu            sync.Mutex
+	lastStats     ServerStats
+	lastStatsTime time.Time
+
+	// 是否正在排空, 见StartDraining
+	// whether the server is draining, see StartDraining
+	draining uint32
+
+	// HealthPath 存活探针的路径, 总是返回200, 例如/healthz; 默认为空, 即禁用
+	// 只处理不带Upgrade头的GET请求, 不影响相同路径上的websocket握手
+	// Path of the liveness probe which always returns 200, e.g. /healthz. Empty by default, which disables it.
+	// Only GET requests without an Upgrade header are served, websocket handshakes on the same path are unaffected
+	HealthPath string
+
+	// ReadyPath 就绪探针的路径, 例如/readyz, 返回200, 调用StartDraining之后或者超过MemoryWatermark时返回503; 默认为空, 即禁用
+	// Path of the readiness probe, e.g. /readyz, which returns 200, or 503 after StartDraining or above MemoryWatermark.
+	// Empty by default, which disables it
+	ReadyPath string
+
+	// OnError 接收握手过程中产生的错误回调, 默认输出到ServerOption.Logger
+	// Receive error callbacks generated during the handshake, logged to ServerOption.Logger by default
 	OnError func(conn net.Conn, err error)
 
-	// OnRequest
+	// OnRequest 握手成功后在连接的协程中调用, 默认执行ReadLoop; 发生的panic会被恢复并记录到ServerOption.Logger
+	// Called in the goroutine of the connection after the handshake, runs ReadLoop by default.
+	// Panics are recovered and logged to ServerOption.Logger
 	OnRequest func(socket *Conn, request *http.Request)
+
+	// OnAccept 审计钩子, 接受TCP连接后在连接的协程中调用, 早于读取握手请求
+	// Audit hook, called in the goroutine of the connection after it was accepted, before the handshake request is read
+	OnAccept func(conn net.Conn)
+
+	// OnHandshakeFailed 审计钩子, 握手失败时调用; 请求无法解析时r为nil
+	// status是返回给客户端的HTTP状态码, 为0表示因为IO错误没有返回响应
+	// Audit hook, called when a handshake fails; r is nil if the request could not be parsed.
+	// status is the HTTP status code returned to the client, 0 if no response was sent because of an IO error
+	OnHandshakeFailed func(r *http.Request, err error, status int)
+
+	// OnConnClosed 审计钩子, 在连接的OnClose之后调用, err总是*CloseError, 其中的Stats包含连接的统计
+	// Audit hook, called after OnClose of the connection. err is always *CloseError whose Stats describe the connection
+	OnConnClosed func(socket *Conn, err error)
 }
 
 // NewServer 创建websocket服务器
 // create a websocket server
 func NewServer(eventHandler Event, option *ServerOption) *Server {
-	var c = &Server{upgrader: NewUpgrader(eventHandler, option)}
-	c.OnError = func(conn net.Conn, err error) { log.Println("gws: " + err.Error()) }
+	var c = &Server{
+		upgrader:      NewUpgrader(eventHandler, option),
+		lastStatsTime: time.Now(),
+	}
+	c.OnError = func(conn net.Conn, err error) { c.upgrader.option.Logger.Error("gws: " + err.Error()) }
 	c.OnRequest = func(socket *Conn, request *http.Request) { socket.ReadLoop() }
+	c.upgrader.option.config.onConnClosed = func(socket *Conn, err error) {
+		if c.OnConnClosed != nil {
+			c.OnConnClosed(socket, err)
+		}
+	}
 	return c
 }
 
+// 握手失败时返回给客户端的HTTP状态码, 0表示IO错误, 不返回响应
+// HTTP status code returned to the client for a failed handshake, 0 means an IO error and no response
+func handshakeStatus(err error) int {
+	var gwsErr internal.GwsError
+	switch {
+	case errors.Is(err, internal.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, internal.ErrGetMethodRequired):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, internal.ErrVersionNotSupported):
+		return http.StatusUpgradeRequired
+	case errors.Is(err, internal.ErrServerDraining), errors.Is(err, internal.ErrMemoryWatermark):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &gwsErr):
+		return http.StatusBadRequest
+	default:
+		return 0
+	}
+}
+
+// StartDraining 开始排空: 就绪探针返回503, 新的握手被拒绝并返回503, 已建立的连接不受影响
+// 可以配合Conn.StopReadingAndDrain关闭已建立的连接
+// StartDraining starts draining: the readiness probe returns 503 and new handshakes are rejected with 503,
+// established connections are unaffected. Combine it with Conn.StopReadingAndDrain to close them
+func (c *Server) StartDraining() {
+	atomic.StoreUint32(&c.draining, 1)
+}
+
+// IsDraining 是否已经调用StartDraining
+// Reports whether StartDraining has been called
+func (c *Server) IsDraining() bool {
+	return atomic.LoadUint32(&c.draining) == 1
+}
+
+// 处理存活和就绪探针, 返回true表示请求已经处理
+// serve the liveness and readiness probes, returns true if the request was handled
+func (c *Server) serveProbe(conn net.Conn, r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get(internal.Upgrade.Key) != "" {
+		return false
+	}
+
+	var status, body = http.StatusOK, "ok\n"
+	switch r.URL.Path {
+	case "":
+		return false
+	case c.HealthPath:
+	case c.ReadyPath:
+		if c.IsDraining() {
+			status, body = http.StatusServiceUnavailable, "draining\n"
+		} else if c.upgrader.option.config.memory.exceeded() {
+			status, body = http.StatusServiceUnavailable, "overloaded\n"
+		}
+	default:
+		return false
+	}
+
+	_ = conn.SetWriteDeadline(time.Now().Add(c.upgrader.option.HandshakeTimeout))
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+	_ = conn.Close()
+	return true
+}
+
+// 握手失败, 返回HTTP错误响应并通知
+// a handshake failed, write the HTTP error response and notify
+func (c *Server) onHandshakeFailed(start time.Time, conn net.Conn, r *http.Request, err error, status int) {
+	atomic.AddUint64(&c.upgrader.option.config.serverStats.handshakeErrors, 1)
+	if status > 0 {
+		c.upgrader.writeErrorResponse(conn, status)
+	}
+	c.upgrader.logAccess(start, r, conn, nil, status, err)
+	c.OnError(conn, err)
+	if c.OnHandshakeFailed != nil {
+		c.OnHandshakeFailed(r, err, status)
+	}
+	_ = conn.Close()
+}
+
+// ServerStats 服务端汇总统计
+// Statistics aggregated by the server
+type ServerStats struct {
+	// 当前连接数
+	// number of open connections
+	Connections uint64
+
+	// 握手成功的次数
+	// number of successful handshakes
+	Handshakes uint64
+
+	// 握手失败的次数
+	// number of failed handshakes
+	HandshakeErrors uint64
+
+	// 因本端错误关闭的连接数
+	// number of connections closed because of an error on this side
+	Errors uint64
+
+	// 收到和发送的数据消息数
+	// data messages received and sent
+	MessagesIn  uint64
+	MessagesOut uint64
+
+	// 按类别统计的协议错误
+	// protocol errors by category
+	ProtocolErrors ProtocolErrorStats
+
+	// 读缓冲区和队列占用的近似内存(字节), 只在设置了MemoryWatermark时统计
+	// approximate memory in bytes held by buffers and queues, only tracked with MemoryWatermark set
+	Memory int64
+
+	// 自上一次调用Stats(首次调用时自创建Server)以来的速率
+	// rates since the previous call to Stats, or since the server was created on the first call
+	HandshakesPerSecond float64
+	MessagesPerSecond   float64
+}
+
+// ProtocolErrorStats 按类别统计的协议错误, 用于判断客户端的异常行为
+// Protocol errors by category, to see what kind of clients are misbehaving
+type ProtocolErrorStats struct {
+	BadUTF8      uint64 // 文本不是合法的utf8编码 / text payload is not valid utf8
+	Oversize     uint64 // 帧, 消息或者分片数超过限制 / frame, message or fragment count exceeds the limit
+	Masking      uint64 // 掩码不符合规范 / masking violation
+	ReservedBits uint64 // 设置了未协商的RSV位 / reserved bits set without a negotiated extension
+	Decompress   uint64 // 解压失败 / decompression failed
+	Timeout      uint64 // 读超时 / read timed out
+}
+
+// 协议错误的类别
+// category of protocol errors
+type protocolErrorKind uint8
+
+const (
+	protocolErrorBadUTF8 protocolErrorKind = iota
+	protocolErrorOversize
+	protocolErrorMasking
+	protocolErrorReservedBits
+	protocolErrorDecompress
+	protocolErrorTimeout
+	protocolErrorNum
+)
+
+// 服务端汇总统计计数器
+// counters of the server statistics
+type serverCounter struct {
+	accepted        uint64
+	closed          uint64
+	handshakeErrors uint64
+	errors          uint64
+	messagesIn      uint64
+	messagesOut     uint64
+	protocolErrors  [protocolErrorNum]uint64
+}
+
+func (c *serverCounter) addMessage(direction FrameDirection) {
+	if direction == FrameInbound {
+		atomic.AddUint64(&c.messagesIn, 1)
+	} else {
+		atomic.AddUint64(&c.messagesOut, 1)
+	}
+}
+
+func (c *serverCounter) snapshot() ServerStats {
+	var accepted, closed = atomic.LoadUint64(&c.accepted), atomic.LoadUint64(&c.closed)
+	return ServerStats{
+		Connections:     internal.SelectValue(accepted > closed, accepted-closed, 0),
+		Handshakes:      accepted,
+		HandshakeErrors: atomic.LoadUint64(&c.handshakeErrors),
+		Errors:          atomic.LoadUint64(&c.errors),
+		MessagesIn:      atomic.LoadUint64(&c.messagesIn),
+		MessagesOut:     atomic.LoadUint64(&c.messagesOut),
+		ProtocolErrors: ProtocolErrorStats{
+			BadUTF8:      atomic.LoadUint64(&c.protocolErrors[protocolErrorBadUTF8]),
+			Oversize:     atomic.LoadUint64(&c.protocolErrors[protocolErrorOversize]),
+			Masking:      atomic.LoadUint64(&c.protocolErrors[protocolErrorMasking]),
+			ReservedBits: atomic.LoadUint64(&c.protocolErrors[protocolErrorReservedBits]),
+			Decompress:   atomic.LoadUint64(&c.protocolErrors[protocolErrorDecompress]),
+			Timeout:      atomic.LoadUint64(&c.protocolErrors[protocolErrorTimeout]),
+		},
+	}
+}
+
+// Stats 服务端汇总统计快照, 适合定期采集; 速率按两次调用之间的增量计算
+// Stats returns a snapshot of the aggregate statistics, suitable for periodic scraping.
+// Rates are computed from the increase between two calls
+func (c *Server) Stats() ServerStats {
+	var stats = c.upgrader.option.config.serverStats.snapshot()
+	stats.Memory = c.upgrader.option.config.memory.load()
+	var now = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seconds := now.Sub(c.lastStatsTime).Seconds(); seconds > 0 {
+		var messages = stats.MessagesIn + stats.MessagesOut - c.lastStats.MessagesIn - c.lastStats.MessagesOut
+		stats.HandshakesPerSecond = float64(stats.Handshakes-c.lastStats.Handshakes) / seconds
+		stats.MessagesPerSecond = float64(messages) / seconds
+	}
+	c.lastStats, c.lastStatsTime = stats, now
+	return stats
+}
+
+// PublishExpvar 将汇总计数以name发布到expvar, 可以通过/debug/vars查看; 不包含速率, 不影响Stats的速率计算
+// name重复时expvar.Publish会panic
+// PublishExpvar publishes the aggregate counters to expvar under name, visible at /debug/vars.
+// Rates are not included, so it does not interfere with the rates of Stats.
+// expvar.Publish panics if name is already in use
+func (c *Server) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		var stats = c.upgrader.option.config.serverStats.snapshot()
+		return struct {
+			Connections     uint64
+			Handshakes      uint64
+			HandshakeErrors uint64
+			Errors          uint64
+			MessagesIn      uint64
+			MessagesOut     uint64
+			ProtocolErrors  ProtocolErrorStats
+			Compression     CompressionStats
+		}{
+			Connections:     stats.Connections,
+			Handshakes:      stats.Handshakes,
+			HandshakeErrors: stats.HandshakeErrors,
+			Errors:          stats.Errors,
+			MessagesIn:      stats.MessagesIn,
+			MessagesOut:     stats.MessagesOut,
+			ProtocolErrors:  stats.ProtocolErrors,
+			Compression:     c.upgrader.CompressionStats(),
+		}
+	}))
+}
+
+// ConnInfo 连接信息, 用于排查卡住或者泄漏的连接
+// Information about a connection, for debugging stuck or leaking connections
+type ConnInfo struct {
+	ID          uint64
+	RemoteAddr  string
+	SubProtocol string
+
+	// 自连接建立以来的时长
+	// time since the connection was established
+	Uptime time.Duration
+
+	// 连接统计, 包括字节数和写队列深度
+	// statistics of the connection, including bytes and the write queue depth
+	Stats ConnStats
+}
+
+// Connections 当前连接的信息, 按ID排序; 需要设置ServerOption.ConnMap, 未设置时返回空列表
+// Connections returns information about the open connections sorted by ID.
+// It is backed by ServerOption.ConnMap and returns an empty list if that is not set
+func (c *Server) Connections() []ConnInfo {
+	var registry = c.upgrader.option.ConnMap
+	if registry == nil {
+		return []ConnInfo{}
+	}
+	var list = make([]ConnInfo, 0, registry.Len())
+	var now = time.Now()
+	registry.Range(func(socket *Conn) bool {
+		var stats = socket.Stats()
+		list = append(list, ConnInfo{
+			ID:          socket.ID(),
+			RemoteAddr:  socket.RemoteAddr().String(),
+			SubProtocol: socket.SubProtocol(),
+			Uptime:      internal.SelectValue(stats.OpenedAt.IsZero(), 0, now.Sub(stats.OpenedAt)),
+			Stats:       stats,
+		})
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// ConnectionsHandler 以JSON格式输出Connections, 用于挂载到管理端口的路由上, 不要暴露在公网; 需要设置ServerOption.ConnMap
+// ConnectionsHandler serves Connections as JSON. Mount it on an admin mux, do not expose it publicly.
+// Requires ServerOption.ConnMap
+//
+// Example:
+//
+//	var server = gws.NewServer(handler, &gws.ServerOption{ConnMap: gws.NewConnMap(0)})
+//	var mux = http.NewServeMux()
+//	mux.Handle("/debug/gws/connections", server.ConnectionsHandler())
+//	go http.ListenAndServe("127.0.0.1:6060", mux)
+func (c *Server) ConnectionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(c.Connections())
+	})
+}
+
 // Run runs ws server
 // addr: Address of the listener
 func (c *Server) Run(addr string) error {
@@ -176,6 +696,9 @@ func (c *Server) RunTLS(addr string, certFile, keyFile string) error {
 	if err != nil {
 		return err
 	}
+	if c.upgrader.option.KernelTLSEnabled && kernelTLSSupported {
+		return c.RunListener(&kernelTLSListener{Listener: listener, config: config, logger: c.upgrader.option.Logger})
+	}
 	return c.RunListener(tls.NewListener(listener, config))
 }
 
@@ -190,20 +713,59 @@ func (c *Server) RunListener(listener net.Listener) error {
 		}
 
 		go func(conn net.Conn) {
-			br := bufio.NewReaderSize(conn, c.upgrader.option.ReadBufferSize)
+			defer func() {
+				if e := recover(); e != nil {
+					c.upgrader.option.Logger.Error("gws: panic serving", conn.RemoteAddr().String()+":", e, "\n"+string(debug.Stack()))
+					_ = conn.Close()
+				}
+			}()
+
+			if c.OnAccept != nil {
+				c.OnAccept(conn)
+			}
+			var start = time.Now()
+
+			// 需要保留原始请求时记录读到的字节
+			// record the bytes read when the raw request is retained
+			var recorder *handshakeRecorder
+			var reader io.Reader = conn
+			if n := c.upgrader.option.HandshakeCaptureSize; n > 0 {
+				recorder = &handshakeRecorder{reader: conn, limit: n}
+				reader = recorder
+			}
+			br := bufio.NewReaderSize(reader, c.upgrader.option.ReadBufferSize)
 			r, err := http.ReadRequest(br)
 			if err != nil {
-				c.OnError(conn, err)
-				_ = conn.Close()
+				c.onHandshakeFailed(start, conn, nil, err, internal.SelectValue(errors.Is(err, io.EOF), 0, http.StatusBadRequest))
+				return
+			}
+			var rawRequest []byte
+			if recorder != nil {
+				if rawRequest = recorder.stop(br.Buffered()); br.Buffered() == 0 {
+					br.Reset(conn)
+				}
+			}
+
+			if c.serveProbe(conn, r) {
+				return
+			}
+
+			if c.IsDraining() {
+				c.onHandshakeFailed(start, conn, r, internal.ErrServerDraining, http.StatusServiceUnavailable)
+				return
+			}
+
+			if c.upgrader.option.config.memory.exceeded() {
+				c.onHandshakeFailed(start, conn, r, internal.ErrMemoryWatermark, http.StatusServiceUnavailable)
 				return
 			}
 
-			socket, err := c.upgrader.doUpgrade(r, conn, br)
+			socket, err := c.upgrader.doUpgrade(r, rawRequest, conn, br)
 			if err != nil {
-				c.OnError(conn, err)
-				_ = conn.Close()
+				c.onHandshakeFailed(start, conn, r, err, handshakeStatus(err))
 				return
 			}
+			c.upgrader.logAccess(start, r, conn, socket, http.StatusSwitchingProtocols, nil)
 			c.OnRequest(socket, r)
 		}(netConn)
 	}
@@ -5,12 +5,17 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -99,6 +104,56 @@ func TestNoDelay(t *testing.T) {
 	})
 }
 
+func TestSocketBuffers(t *testing.T) {
+	var as = assert.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	var accept = func() net.Conn {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		as.NoError(err)
+		t.Cleanup(func() { _ = client.Close() })
+		server, err := listener.Accept()
+		as.NoError(err)
+		return server
+	}
+
+	t.Run("tcp conn", func(t *testing.T) {
+		var socket = &Conn{conn: accept()}
+		as.NoError(socket.SetSocketBuffers(64*1024, 64*1024))
+		as.NoError(socket.SetSocketBuffers(0, 0))
+		_ = socket.conn.Close()
+		as.Error(socket.SetSocketBuffers(64*1024, 0))
+		as.Error(socket.SetSocketBuffers(0, 64*1024))
+	})
+
+	t.Run("tls conn", func(t *testing.T) {
+		var socket = &Conn{conn: tls.Client(accept(), nil)}
+		as.NoError(socket.SetSocketBuffers(64*1024, 64*1024))
+	})
+
+	t.Run("other", func(t *testing.T) {
+		conn, _ := net.Pipe()
+		as.NoError((&Conn{conn: conn}).SetSocketBuffers(64*1024, 64*1024))
+	})
+
+	t.Run("option", func(t *testing.T) {
+		// 设置失败时记录错误, 不影响连接的建立
+		var logger = &levelLogger{}
+		var option = initServerOption(&ServerOption{SocketReadBufferSize: 64 * 1024, Logger: logger})
+		var conn = accept()
+		var socket = serveWebSocket(true, option.getConfig(), new(sliceMap), conn, nil, new(webSocketMocker), false)
+		as.NotNil(socket)
+		as.Empty(logger.levels)
+
+		_ = conn.Close()
+		serveWebSocket(true, option.getConfig(), new(sliceMap), conn, nil, new(webSocketMocker), false)
+		as.Equal([]string{"error"}, logger.levels)
+	})
+}
+
 func TestAccept(t *testing.T) {
 	var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{
 		ReadBufferSize:  1024,
@@ -136,7 +191,7 @@ func TestAccept(t *testing.T) {
 		request.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
 		request.Header.Set("Sec-WebSocket-Extensions", "client_max_window_bits")
 		_, err := upgrader.Upgrade(newHttpWriter(), request)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrVersionNotSupported)
 	})
 
 	t.Run("fail method", func(t *testing.T) {
@@ -223,6 +278,44 @@ func TestFailHijack(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUpgrader_AdoptReader(t *testing.T) {
+	var as = assert.New(t)
+	var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{ReadBufferSize: 4096})
+	var eofConn = func() net.Conn {
+		server, client := net.Pipe()
+		_ = client.Close()
+		return server
+	}
+
+	t.Run("same size", func(t *testing.T) {
+		// 大小一致时直接接管, 改为从连接读取
+		var br = bufio.NewReaderSize(strings.NewReader("http"), 4096)
+		var adopted = upgrader.adoptReader(eofConn(), br)
+		as.True(adopted == br)
+		_, err := adopted.Peek(1)
+		as.ErrorIs(err, io.EOF)
+	})
+
+	t.Run("size mismatch", func(t *testing.T) {
+		var br = bufio.NewReaderSize(strings.NewReader("http"), 8192)
+		var adopted = upgrader.adoptReader(eofConn(), br)
+		as.False(adopted == br)
+		as.Equal(4096, adopted.Size())
+	})
+
+	t.Run("buffered", func(t *testing.T) {
+		// 已经缓冲的客户端数据不能丢失
+		var br = bufio.NewReaderSize(strings.NewReader("GET / HTTP/1.1\r\n\r\nhello"), 8192)
+		_, err := http.ReadRequest(br)
+		as.NoError(err)
+		var adopted = upgrader.adoptReader(eofConn(), br)
+		as.True(adopted == br)
+		p, err := io.ReadAll(adopted)
+		as.NoError(err)
+		as.Equal("hello", string(p))
+	})
+}
+
 func TestNewServer(t *testing.T) {
 	var as = assert.New(t)
 
@@ -313,3 +406,450 @@ func TestBuiltinEventEngine(t *testing.T) {
 		ev.OnPong(nil, nil)
 	}
 }
+
+type levelLogger struct {
+	sync.Mutex
+	levels []string
+	ch     chan string
+}
+
+func (c *levelLogger) log(level string) {
+	c.Lock()
+	c.levels = append(c.levels, level)
+	c.Unlock()
+	select {
+	case c.ch <- level:
+	default:
+	}
+}
+
+func (c *levelLogger) Debug(v ...any) { c.log("debug") }
+
+func (c *levelLogger) Warn(v ...any) { c.log("warn") }
+
+func (c *levelLogger) Error(v ...any) { c.log("error") }
+
+func TestLogger(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("protocol violation", func(t *testing.T) {
+		var logger = &levelLogger{}
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) { wg.Done() }
+		server, client := newPeer(serverHandler, &ServerOption{Logger: logger}, new(webSocketMocker), nil)
+		go server.ReadLoop()
+		go client.ReadLoop()
+		as.NoError(testWriteWrongMask(client, OpcodeText, []byte("hello")))
+		wg.Wait()
+
+		server.emitError(errors.New("dropped"))
+		as.Equal([]string{"warn", "debug"}, logger.levels)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		var logger = &levelLogger{ch: make(chan string, 1)}
+		var handler = new(webSocketMocker)
+		handler.onMessage = func(socket *Conn, message *Message) { panic("test") }
+		var server = NewServer(handler, &ServerOption{Logger: logger})
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if !as.NoError(err) {
+			return
+		}
+		go server.RunListener(listener)
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + listener.Addr().String()})
+		if !as.NoError(err) {
+			return
+		}
+		as.NoError(client.WriteString("hello"))
+		as.Equal("error", <-logger.ch)
+	})
+}
+
+func TestServer_Stats(t *testing.T) {
+	var as = assert.New(t)
+	var closed = make(chan struct{}, 2)
+	var handler = new(webSocketMocker)
+	handler.onMessage = func(socket *Conn, message *Message) {
+		_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	}
+	handler.onClose = func(socket *Conn, err error) { closed <- struct{}{} }
+	var server = NewServer(handler, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	go server.RunListener(listener)
+
+	// 非WebSocket请求, 握手失败
+	if resp, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		_ = resp.Body.Close()
+	}
+
+	var received = make(chan struct{}, 2)
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onMessage = func(socket *Conn, message *Message) { received <- struct{}{} }
+	client, _, err := NewClient(clientHandler, &ClientOption{Addr: "ws://" + listener.Addr().String()})
+	if !as.NoError(err) {
+		return
+	}
+	go client.ReadLoop()
+	as.NoError(client.WriteString("hello"))
+	as.NoError(client.WriteString("world"))
+	<-received
+	<-received
+	as.Equal(uint64(1), server.Stats().Connections)
+
+	violator, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + listener.Addr().String()})
+	if !as.NoError(err) {
+		return
+	}
+	go violator.ReadLoop()
+	as.NoError(testWriteWrongMask(violator, OpcodeText, []byte("hello")))
+	client.WriteClose(1000, nil)
+	<-closed
+	<-closed
+
+	var stats = server.Stats()
+	as.Equal(uint64(0), stats.Connections)
+	as.Equal(uint64(2), stats.Handshakes)
+	as.Equal(uint64(1), stats.HandshakeErrors)
+	as.Equal(uint64(1), stats.Errors)
+	// 帧头解析后即计入, 包括违规的帧
+	as.Equal(uint64(3), stats.MessagesIn)
+	as.Equal(uint64(2), stats.MessagesOut)
+	as.Greater(stats.HandshakesPerSecond, 0.0)
+	as.Greater(stats.MessagesPerSecond, 0.0)
+
+	stats = server.Stats()
+	as.Equal(uint64(2), stats.Handshakes)
+	as.Equal(0.0, stats.MessagesPerSecond)
+}
+
+func TestServer_PublishExpvar(t *testing.T) {
+	var as = assert.New(t)
+	var server = NewServer(new(BuiltinEventHandler), nil)
+	server.PublishExpvar("gws_test_server")
+	var v = expvar.Get("gws_test_server")
+	if !as.NotNil(v) {
+		return
+	}
+	var stats = make(map[string]interface{})
+	as.NoError(json.Unmarshal([]byte(v.String()), &stats))
+	as.Equal(0.0, stats["Connections"])
+	as.Contains(stats, "Compression")
+	as.NotContains(stats, "MessagesPerSecond")
+	as.Panics(func() { server.PublishExpvar("gws_test_server") })
+}
+
+func TestServer_AuditHooks(t *testing.T) {
+	var as = assert.New(t)
+	var accepted int64
+	var statuses = make(chan int, 4)
+	var closed = make(chan *CloseError, 1)
+	var server = NewServer(new(BuiltinEventHandler), &ServerOption{
+		Authorize: func(r *http.Request, session SessionStorage) bool { return r.Header.Get("X-Deny") == "" },
+		Logger:    new(levelLogger),
+	})
+	server.OnAccept = func(conn net.Conn) { atomic.AddInt64(&accepted, 1) }
+	server.OnHandshakeFailed = func(r *http.Request, err error, status int) { statuses <- status }
+	server.OnConnClosed = func(socket *Conn, err error) {
+		var closeErr *CloseError
+		as.True(errors.As(err, &closeErr))
+		closed <- closeErr
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	go server.RunListener(listener)
+	var addr = listener.Addr().String()
+
+	var rawRequest = func(request string) *http.Response {
+		conn, err := net.Dial("tcp", addr)
+		if !as.NoError(err) {
+			return nil
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte(request))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !as.NoError(err) {
+			return nil
+		}
+		return resp
+	}
+
+	t.Run("version", func(t *testing.T) {
+		var resp = rawRequest("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if as.NotNil(resp) {
+			as.Equal(http.StatusUpgradeRequired, resp.StatusCode)
+			as.Equal("13", resp.Header.Get("Sec-WebSocket-Version"))
+		}
+		as.Equal(http.StatusUpgradeRequired, <-statuses)
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		var resp = rawRequest("hello\r\n\r\n")
+		if as.NotNil(resp) {
+			as.Equal(http.StatusBadRequest, resp.StatusCode)
+		}
+		as.Equal(http.StatusBadRequest, <-statuses)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:          "ws://" + addr,
+			RequestHeader: http.Header{"X-Deny": []string{"1"}},
+		})
+		as.Error(err)
+		if as.NotNil(resp) {
+			as.Equal(http.StatusUnauthorized, resp.StatusCode)
+		}
+		as.Equal(http.StatusUnauthorized, <-statuses)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr})
+		if !as.NoError(err) {
+			return
+		}
+		go client.ReadLoop()
+		client.WriteClose(1000, nil)
+		var closeErr = <-closed
+		as.Equal(uint16(1000), closeErr.Code)
+		as.False(closeErr.Stats.OpenedAt.IsZero())
+		as.Equal(int64(4), atomic.LoadInt64(&accepted))
+	})
+}
+
+func TestServer_Probes(t *testing.T) {
+	var as = assert.New(t)
+	var statuses = make(chan int, 1)
+	var server = NewServer(new(BuiltinEventHandler), &ServerOption{Logger: new(levelLogger)})
+	server.OnHandshakeFailed = func(r *http.Request, err error, status int) {
+		as.ErrorIs(err, ErrServerDraining)
+		statuses <- status
+	}
+
+	// 默认不开启探针
+	as.Empty(server.HealthPath)
+	as.Empty(server.ReadyPath)
+	server.HealthPath, server.ReadyPath = "/healthz", "/readyz"
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	go server.RunListener(listener)
+	var addr = listener.Addr().String()
+
+	var probe = func(path string) (int, string) {
+		resp, err := http.Get("http://" + addr + path)
+		if !as.NoError(err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		var buf = bytes.NewBuffer(nil)
+		_, _ = buf.ReadFrom(resp.Body)
+		return resp.StatusCode, buf.String()
+	}
+
+	// 探针不计入握手失败
+	code, body := probe("/healthz")
+	as.Equal(http.StatusOK, code)
+	as.Equal("ok\n", body)
+	code, _ = probe("/readyz")
+	as.Equal(http.StatusOK, code)
+	as.Equal(uint64(0), server.Stats().HandshakeErrors)
+
+	// 探针路径上的websocket握手不受影响
+	client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr + "/healthz"})
+	if as.NoError(err) {
+		client.WriteClose(1000, nil)
+	}
+
+	// 排空之后存活探针仍然返回200, 就绪探针和新的握手返回503
+	server.StartDraining()
+	as.True(server.IsDraining())
+	code, _ = probe("/healthz")
+	as.Equal(http.StatusOK, code)
+	code, body = probe("/readyz")
+	as.Equal(http.StatusServiceUnavailable, code)
+	as.Equal("draining\n", body)
+	_, resp, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + addr})
+	as.Error(err)
+	if as.NotNil(resp) {
+		as.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	as.Equal(http.StatusServiceUnavailable, <-statuses)
+
+	// 路径为空时禁用探针
+	server.HealthPath = ""
+	code, _ = probe("/healthz")
+	as.Equal(http.StatusServiceUnavailable, code)
+}
+
+func TestServer_Connections(t *testing.T) {
+	var as = assert.New(t)
+	var serverHandler = &webSocketMocker{}
+	var received = make(chan struct{})
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		message.Close()
+		received <- struct{}{}
+	}
+	// 默认不创建连接表
+	as.Nil(NewServer(serverHandler, nil).upgrader.option.ConnMap)
+	as.Empty(NewServer(serverHandler, nil).Connections())
+
+	var server = NewServer(serverHandler, &ServerOption{Subprotocols: []string{"chat"}, ConnMap: NewConnMap(0)})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	go server.RunListener(listener)
+	as.Empty(server.Connections())
+
+	client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+		Addr:          "ws://" + listener.Addr().String(),
+		RequestHeader: http.Header{"Sec-WebSocket-Protocol": []string{"chat"}},
+	})
+	if !as.NoError(err) {
+		return
+	}
+	defer client.NetConn().Close()
+	as.Equal("chat", client.SubProtocol())
+	as.NoError(client.WriteString("hello"))
+	<-received
+
+	var list = server.Connections()
+	if as.Len(list, 1) {
+		as.Equal("chat", list[0].SubProtocol)
+		as.Equal(client.LocalAddr().String(), list[0].RemoteAddr)
+		as.Equal(uint64(5), list[0].Stats.BytesIn)
+		as.Equal(0, list[0].Stats.WriteQueueLen)
+		as.Greater(list[0].Uptime, time.Duration(0))
+	}
+
+	// JSON输出
+	var recorder = httptest.NewRecorder()
+	server.ConnectionsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	as.Equal("application/json; charset=utf-8", recorder.Header().Get("Content-Type"))
+	var decoded []ConnInfo
+	as.NoError(json.Unmarshal(recorder.Body.Bytes(), &decoded))
+	if as.Len(decoded, 1) {
+		as.Equal(list[0].ID, decoded[0].ID)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var as = assert.New(t)
+	var entries = make(chan AccessLogEntry, 4)
+	var option = &ServerOption{
+		CompressEnabled: true,
+		Subprotocols:    []string{"chat"},
+		Logger:          new(levelLogger),
+		AccessLog:       func(entry AccessLogEntry) { entries <- entry },
+	}
+
+	t.Run("server", func(t *testing.T) {
+		var server = NewServer(new(BuiltinEventHandler), option)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if !as.NoError(err) {
+			return
+		}
+		go server.RunListener(listener)
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{
+			Addr:            "ws://" + listener.Addr().String() + "/chat",
+			CompressEnabled: true,
+			RequestHeader:   http.Header{"Sec-WebSocket-Protocol": []string{"chat"}, "Origin": []string{"http://example.com"}},
+		})
+		if !as.NoError(err) {
+			return
+		}
+		var entry = <-entries
+		as.Equal(client.LocalAddr().String(), entry.RemoteAddr)
+		as.Equal("/chat", entry.Path)
+		as.Equal("http://example.com", entry.Origin)
+		as.Equal("chat", entry.SubProtocol)
+		as.Equal("permessage-deflate", entry.Compression)
+		as.Equal(http.StatusSwitchingProtocols, entry.Status)
+		as.Greater(entry.Duration, time.Duration(0))
+		as.NoError(entry.Err)
+		_ = client.NetConn().Close()
+
+		// 握手失败同样记录
+		resp, err := http.Get("http://" + listener.Addr().String() + "/chat")
+		if as.NoError(err) {
+			_ = resp.Body.Close()
+		}
+		entry = <-entries
+		as.Equal("/chat", entry.Path)
+		as.Equal(http.StatusUpgradeRequired, entry.Status)
+		as.ErrorIs(entry.Err, ErrVersionNotSupported)
+		as.Empty(entry.Compression)
+	})
+
+	t.Run("upgrader", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(BuiltinEventHandler), option)
+		var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if socket, err := upgrader.Upgrade(w, r); err == nil {
+				_ = socket.NetConn().Close()
+			}
+		}))
+		defer server.Close()
+
+		client, _, err := NewClient(new(BuiltinEventHandler), &ClientOption{Addr: "ws://" + strings.TrimPrefix(server.URL, "http://")})
+		if !as.NoError(err) {
+			return
+		}
+		_ = client.NetConn().Close()
+		var entry = <-entries
+		as.Equal(http.StatusSwitchingProtocols, entry.Status)
+		as.Empty(entry.SubProtocol)
+		as.Empty(entry.Compression)
+		as.NotEmpty(entry.RemoteAddr)
+	})
+}
+
+func TestUpgrader_Version(t *testing.T) {
+	var as = assert.New(t)
+	var upgrader = NewUpgrader(new(BuiltinEventHandler), &ServerOption{AcceptedVersions: []string{"8"}})
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			_ = socket.NetConn().Close()
+		}
+	}))
+	defer server.Close()
+
+	var dial = func(version string) *http.Response {
+		r, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Key", "3tTS/Y+YGaM7TTnPuafHng==")
+		if version != "" {
+			r.Header.Set("Sec-WebSocket-Version", version)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if !as.NoError(err) {
+			return nil
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// 额外接受的版本
+	if resp := dial("8"); as.NotNil(resp) {
+		as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	// 不支持的版本返回426并列出支持的版本
+	for _, version := range []string{"", "7", "14"} {
+		if resp := dial(version); as.NotNil(resp) {
+			as.Equal(http.StatusUpgradeRequired, resp.StatusCode)
+			as.Equal("13, 8", resp.Header.Get("Sec-WebSocket-Version"))
+		}
+	}
+}
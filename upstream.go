@@ -0,0 +1,234 @@
+package gws
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// UpstreamPolicy 选择上游的策略
+// Policy of picking an upstream
+type UpstreamPolicy uint8
+
+const (
+	// UpstreamRoundRobin 轮询
+	// Take turns
+	UpstreamRoundRobin UpstreamPolicy = iota
+
+	// UpstreamLeastConns 选择由该拨号器建立的连接数最少的上游
+	// Pick the upstream with the fewest connections established by this dialer
+	UpstreamLeastConns
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultUpstreamMaxFails    = 1
+)
+
+// UpstreamOption 上游拨号器配置
+// Upstream dialer configuration
+type UpstreamOption struct {
+	// 上游地址, 例如wss://10.0.0.1:8443/ws
+	// Upstream addresses, e.g. wss://10.0.0.1:8443/ws
+	Addrs []string
+
+	// 选择策略, 默认轮询
+	// Picking policy, round robin by default
+	Policy UpstreamPolicy
+
+	// 拨号使用的客户端配置模板, Addr会被替换; 可以为nil
+	// Template of the client options used to dial, Addr is replaced. May be nil
+	Client *ClientOption
+
+	// 连续拨号失败多少次之后把上游标记为不健康, 默认1
+	// Consecutive dial failures after which an upstream is marked unhealthy, 1 by default
+	MaxFails int
+
+	// 健康检查的间隔, 只检查不健康的上游, 通过后恢复; 默认10秒, 负数表示不检查, 不健康的上游不再恢复
+	// Interval of the health checks. Only unhealthy upstreams are checked and revived once they pass.
+	// 10s by default; a negative value disables them and unhealthy upstreams never come back
+	HealthCheckInterval time.Duration
+
+	// 健康检查, 默认完成一次websocket握手后以1000关闭
+	// The health check, by default a websocket handshake followed by closing with 1000
+	HealthCheck func(addr string) error
+}
+
+// UpstreamStatus 上游的状态
+// Status of an upstream
+type UpstreamStatus struct {
+	Addr    string
+	Healthy bool
+	Conns   int
+}
+
+type upstream struct {
+	addr  string
+	conns *ConnMap
+	fails int32
+}
+
+func (c *upstream) healthy(maxFails int32) bool {
+	return atomic.LoadInt32(&c.fails) < maxFails
+}
+
+// UpstreamDialer 在多个上游之间负载均衡的拨号器, 用于建立中继的后端连接, 见Relay.
+// 拨号失败的上游被跳过, 达到MaxFails后标记为不健康, 直到通过健康检查; 所有上游都不健康时依次尝试全部上游
+// UpstreamDialer balances dials across several upstreams, for the backend leg of relayed connections, see Relay.
+// A failed dial moves on to the next upstream, which is marked unhealthy after MaxFails until it passes a health check.
+// When every upstream is unhealthy all of them are tried in turn
+//
+// Example:
+//
+//	var dialer = gws.NewUpstreamDialer(&gws.UpstreamOption{
+//		Addrs:  []string{"ws://10.0.0.1:8080/ws", "ws://10.0.0.2:8080/ws"},
+//		Policy: gws.UpstreamLeastConns,
+//	})
+//	defer dialer.Close()
+//	upstream, _, err := dialer.Dial(new(gws.BuiltinEventHandler), r.Header)
+type UpstreamDialer struct {
+	next      uint64 // 64位原子操作, 放在开头保证对齐 / 64-bit atomic, first to keep it aligned
+	option    *UpstreamOption
+	upstreams []*upstream
+	maxFails  int32
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewUpstreamDialer 创建上游拨号器, 不再使用时调用Close停止健康检查
+// NewUpstreamDialer creates an upstream dialer, call Close to stop the health checks once it is no longer used
+func NewUpstreamDialer(option *UpstreamOption) *UpstreamDialer {
+	if option == nil {
+		option = new(UpstreamOption)
+	}
+	if option.MaxFails <= 0 {
+		option.MaxFails = defaultUpstreamMaxFails
+	}
+	if option.HealthCheckInterval == 0 {
+		option.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	var c = &UpstreamDialer{option: option, maxFails: int32(option.MaxFails), done: make(chan struct{})}
+	if option.HealthCheck == nil {
+		option.HealthCheck = c.handshakeCheck
+	}
+	for _, addr := range option.Addrs {
+		c.upstreams = append(c.upstreams, &upstream{addr: addr, conns: NewConnMap(0)})
+	}
+	if option.HealthCheckInterval > 0 {
+		go c.checkLoop()
+	}
+	return c
+}
+
+// Dial 选择上游并建立连接, requestHeader会作为ClientOption.RequestHeader发送, 可以为nil.
+// 所有上游都失败时返回最后一个错误
+// Dial picks an upstream and connects to it, requestHeader is sent as ClientOption.RequestHeader and may be nil.
+// If every upstream fails the last error is returned
+func (c *UpstreamDialer) Dial(handler Event, requestHeader http.Header) (*Conn, *http.Response, error) {
+	if len(c.upstreams) == 0 {
+		return nil, nil, internal.ErrNoUpstream
+	}
+	var resp *http.Response
+	var err error
+	for _, item := range c.candidates() {
+		var socket *Conn
+		if socket, resp, err = NewClient(handler, c.clientOption(item.addr, requestHeader)); err != nil {
+			atomic.AddInt32(&item.fails, 1)
+			continue
+		}
+		atomic.StoreInt32(&item.fails, 0)
+		// 复用连接表的注册机制统计连接数, 连接关闭时自动移除
+		// count connections through the registry of ConnMap, they are removed automatically on close
+		socket.registry = item.conns
+		socket.registry.Add(socket)
+		return socket, resp, nil
+	}
+	return nil, resp, err
+}
+
+// 按策略排好序的候选上游, 健康的在前; 都不健康时按原顺序返回全部上游
+// candidate upstreams ordered by the policy, healthy ones first; all of them in order if none is healthy
+func (c *UpstreamDialer) candidates() []*upstream {
+	var n = len(c.upstreams)
+	var list = make([]*upstream, 0, n)
+	var start = int(atomic.AddUint64(&c.next, 1) % uint64(n))
+	for i := 0; i < n; i++ {
+		if item := c.upstreams[(start+i)%n]; item.healthy(c.maxFails) {
+			list = append(list, item)
+		}
+	}
+	if len(list) == 0 {
+		return append(list, c.upstreams...)
+	}
+	if c.option.Policy == UpstreamLeastConns {
+		for i := 1; i < len(list); i++ {
+			if list[i].conns.Len() < list[0].conns.Len() {
+				list[0], list[i] = list[i], list[0]
+			}
+		}
+	}
+	return list
+}
+
+func (c *UpstreamDialer) clientOption(addr string, requestHeader http.Header) *ClientOption {
+	var option ClientOption
+	if c.option.Client != nil {
+		option = *c.option.Client
+	}
+	option.Addr = addr
+	if requestHeader != nil {
+		option.RequestHeader = requestHeader
+	}
+	return &option
+}
+
+func (c *UpstreamDialer) handshakeCheck(addr string) error {
+	socket, _, err := NewClient(new(BuiltinEventHandler), c.clientOption(addr, nil))
+	if err != nil {
+		return err
+	}
+	socket.WriteClose(1000, nil)
+	return socket.NetConn().Close()
+}
+
+func (c *UpstreamDialer) checkLoop() {
+	var ticker = time.NewTicker(c.option.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkHealth()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 检查不健康的上游, 通过后恢复
+// check the unhealthy upstreams, reviving those that pass
+func (c *UpstreamDialer) checkHealth() {
+	for _, item := range c.upstreams {
+		if !item.healthy(c.maxFails) && c.option.HealthCheck(item.addr) == nil {
+			atomic.StoreInt32(&item.fails, 0)
+		}
+	}
+}
+
+// Upstreams 各个上游的状态
+// Upstreams returns the status of every upstream
+func (c *UpstreamDialer) Upstreams() []UpstreamStatus {
+	var list = make([]UpstreamStatus, 0, len(c.upstreams))
+	for _, item := range c.upstreams {
+		list = append(list, UpstreamStatus{Addr: item.addr, Healthy: item.healthy(c.maxFails), Conns: item.conns.Len()})
+	}
+	return list
+}
+
+// Close 停止健康检查, 已经建立的连接不受影响
+// Close stops the health checks, established connections are not affected
+func (c *UpstreamDialer) Close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
@@ -0,0 +1,115 @@
+package gws
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 启动一个上游, 握手成功后把name发送到hits
+func newTestUpstream(t *testing.T, name string, hits chan string) string {
+	var upgrader = NewUpgrader(new(BuiltinEventHandler), nil)
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if socket, err := upgrader.Upgrade(w, r); err == nil {
+			if hits != nil {
+				hits <- name
+			}
+			socket.ReadLoop()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws://" + strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("round robin", func(t *testing.T) {
+		var hits = make(chan string, 4)
+		var dialer = NewUpstreamDialer(&UpstreamOption{
+			Addrs: []string{newTestUpstream(t, "a", hits), newTestUpstream(t, "b", hits)},
+		})
+		defer dialer.Close()
+		var seen = map[string]int{}
+		for i := 0; i < 4; i++ {
+			socket, _, err := dialer.Dial(new(BuiltinEventHandler), nil)
+			as.NoError(err)
+			seen[<-hits]++
+			socket.WriteClose(1000, nil)
+		}
+		as.Equal(map[string]int{"a": 2, "b": 2}, seen)
+	})
+
+	t.Run("least conns", func(t *testing.T) {
+		var hits = make(chan string, 4)
+		var dialer = NewUpstreamDialer(&UpstreamOption{
+			Addrs:  []string{newTestUpstream(t, "a", hits), newTestUpstream(t, "b", hits)},
+			Policy: UpstreamLeastConns,
+		})
+		defer dialer.Close()
+		first, _, err := dialer.Dial(new(BuiltinEventHandler), nil)
+		as.NoError(err)
+		var busy = <-hits
+		for i := 0; i < 2; i++ {
+			socket, _, err := dialer.Dial(new(BuiltinEventHandler), nil)
+			as.NoError(err)
+			as.NotEqual(busy, <-hits)
+			socket.WriteClose(1000, nil)
+		}
+		as.Equal(1, dialer.Upstreams()[0].Conns+dialer.Upstreams()[1].Conns)
+		first.WriteClose(1000, nil)
+		as.Equal(0, dialer.Upstreams()[0].Conns+dialer.Upstreams()[1].Conns)
+	})
+
+	// 失败的上游被跳过, 健康检查通过后恢复
+	t.Run("health", func(t *testing.T) {
+		var down = int32(1)
+		var checked = make(chan struct{}, 1)
+		var dialer = NewUpstreamDialer(&UpstreamOption{
+			Addrs:               []string{"ws://127.0.0.1:1", newTestUpstream(t, "b", nil)},
+			HealthCheckInterval: 10 * time.Millisecond,
+			HealthCheck: func(addr string) error {
+				select {
+				case checked <- struct{}{}:
+				default:
+				}
+				if atomic.LoadInt32(&down) == 1 {
+					return errors.New("down")
+				}
+				return nil
+			},
+		})
+		defer dialer.Close()
+		for i := 0; i < 2; i++ {
+			socket, _, err := dialer.Dial(new(BuiltinEventHandler), nil)
+			as.NoError(err)
+			socket.WriteClose(1000, nil)
+		}
+		as.False(dialer.Upstreams()[0].Healthy)
+		as.True(dialer.Upstreams()[1].Healthy)
+
+		<-checked
+		atomic.StoreInt32(&down, 0)
+		as.Eventually(func() bool { return dialer.Upstreams()[0].Healthy }, time.Second, time.Millisecond)
+	})
+
+	t.Run("no upstream", func(t *testing.T) {
+		var dialer = NewUpstreamDialer(&UpstreamOption{HealthCheckInterval: -1})
+		_, _, err := dialer.Dial(new(BuiltinEventHandler), nil)
+		as.ErrorIs(err, ErrNoUpstream)
+
+		dialer = NewUpstreamDialer(&UpstreamOption{Addrs: []string{"ws://127.0.0.1:1"}, HealthCheckInterval: -1})
+		_, _, err = dialer.Dial(new(BuiltinEventHandler), nil)
+		as.Error(err)
+		_, _, err = dialer.Dial(new(BuiltinEventHandler), nil)
+		as.Error(err)
+		dialer.Close()
+		dialer.Close()
+	})
+}
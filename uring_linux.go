@@ -0,0 +1,450 @@
+//go:build linux && gws_iouring
+
+package gws
+
+import (
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// io_uring读写后端, 使用-tags gws_iouring编译时启用. 所有连接共享一个环, 并发的读写请求(例如广播)合并成一次io_uring_enter提交.
+// 收发都使用MSG_DONTWAIT, 没有数据或者套接字缓冲区满时返回EAGAIN, 由Go的netpoller等待就绪后重试,
+// 因此读写超时, WriteStallThreshold和连接关闭的行为不变.
+// 内核不支持(低于5.6)或者连接没有实现syscall.Conn(例如TLS)时使用net.Conn; 环出错后所有在途请求失败, 之后的读写回退到net.Conn
+// io_uring read/write backend, enabled by building with -tags gws_iouring. All connections share one ring and requests
+// issued concurrently (e.g. broadcasts) are submitted in a single io_uring_enter.
+// Sends and receives use MSG_DONTWAIT: when no data is available or the socket buffer is full EAGAIN is returned and the
+// Go netpoller waits for readiness before retrying, so deadlines, WriteStallThreshold and closing behave as before.
+// Without kernel support (older than 5.6) or for connections not implementing syscall.Conn (e.g. TLS) net.Conn is used.
+// Once the ring fails, the requests in flight fail and later reads and writes fall back to net.Conn
+
+const (
+	sysIoUringSetup = 425
+	sysIoUringEnter = 426
+
+	uringOffSqRing = 0
+	uringOffCqRing = 0x8000000
+	uringOffSqes   = 0x10000000
+
+	uringOpSend         = 26
+	uringOpRecv         = 27
+	uringEnterGetEvents = 1
+
+	uringEntries = 256
+	uringSqeSize = 64
+	uringCqeSize = 16
+
+	// 环出错时在途请求的结果, 不会与内核返回的结果冲突
+	// result of the requests in flight when the ring fails, never returned by the kernel
+	uringFailed = math.MinInt32
+)
+
+type uringSqOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCqOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCpu, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSqOffsets
+	cqOff                                                                  uringCqOffsets
+}
+
+type uringSqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	msgFlags    uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// 一次收发请求, 槽位号作为user_data
+// a send or receive request, its slot number is used as user_data
+type uringRequest struct {
+	buf  []byte
+	done chan int32
+}
+
+type uringRing struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqeMem  []byte
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray unsafe.Pointer
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    unsafe.Pointer
+
+	// 空闲槽位, 同时限制在途请求数不超过SQ容量, 保证CQ不会溢出
+	// free slots, which also bounds in-flight requests by the SQ size so that the CQ cannot overflow
+	free     chan uint32
+	requests [uringEntries]*uringRequest
+
+	mu      sync.Mutex
+	pending uint32
+	wake    chan struct{}
+	// 已提交尚未完成的槽位
+	// slots submitted and not completed yet
+	busy [uringEntries]bool
+	// 环是否已经出错
+	// whether the ring has failed
+	broken uint32
+}
+
+var (
+	uringOnce     sync.Once
+	uringInstance *uringRing
+)
+
+// 懒加载共享的环, 创建失败或者已经出错时返回nil
+// lazily set up the shared ring, nil if setup failed or the ring has failed
+func sharedRing() *uringRing {
+	uringOnce.Do(func() {
+		ring, err := newUringRing(uringEntries)
+		if err != nil {
+			defaultLogger.Error("gws: io_uring unavailable, falling back to net.Conn:", err.Error())
+			return
+		}
+		uringInstance = ring
+	})
+	if uringInstance == nil || uringInstance.isBroken() {
+		return nil
+	}
+	return uringInstance
+}
+
+func newUringRing(entries uint32) (*uringRing, error) {
+	var params uringParams
+	fd, _, errno := syscall.Syscall(sysIoUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	var c = &uringRing{fd: int(fd), free: make(chan uint32, entries), wake: make(chan struct{}, 1)}
+	var err error
+	var sqSize = int(params.sqOff.array + params.sqEntries*4)
+	var cqSize = int(params.cqOff.cqes + params.cqEntries*uringCqeSize)
+	if c.sqRing, err = c.mmap(uringOffSqRing, sqSize); err != nil {
+		return nil, err
+	}
+	if c.cqRing, err = c.mmap(uringOffCqRing, cqSize); err != nil {
+		return nil, err
+	}
+	if c.sqeMem, err = c.mmap(uringOffSqes, int(params.sqEntries)*uringSqeSize); err != nil {
+		return nil, err
+	}
+
+	c.sqHead = (*uint32)(unsafe.Pointer(&c.sqRing[params.sqOff.head]))
+	c.sqTail = (*uint32)(unsafe.Pointer(&c.sqRing[params.sqOff.tail]))
+	c.sqMask = *(*uint32)(unsafe.Pointer(&c.sqRing[params.sqOff.ringMask]))
+	c.sqArray = unsafe.Pointer(&c.sqRing[params.sqOff.array])
+	c.cqHead = (*uint32)(unsafe.Pointer(&c.cqRing[params.cqOff.head]))
+	c.cqTail = (*uint32)(unsafe.Pointer(&c.cqRing[params.cqOff.tail]))
+	c.cqMask = *(*uint32)(unsafe.Pointer(&c.cqRing[params.cqOff.ringMask]))
+	c.cqes = unsafe.Pointer(&c.cqRing[params.cqOff.cqes])
+
+	for i := uint32(0); i < entries && i < params.sqEntries; i++ {
+		c.requests[i] = &uringRequest{done: make(chan int32, 1)}
+		c.free <- i
+	}
+	go c.submitLoop()
+	go c.reapLoop()
+	return c, nil
+}
+
+func (c *uringRing) mmap(offset int64, size int) ([]byte, error) {
+	b, err := syscall.Mmap(c.fd, offset, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	return b, os.NewSyscallError("mmap", err)
+}
+
+func (c *uringRing) enter(toSubmit, minComplete, flags uint32) (int, syscall.Errno) {
+	n, _, errno := syscall.Syscall6(sysIoUringEnter, uintptr(c.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+	return int(n), errno
+}
+
+func (c *uringRing) isBroken() bool {
+	return atomic.LoadUint32(&c.broken) == 1
+}
+
+// 环出错, 在途请求以uringFailed结束, 之后的请求直接返回uringFailed
+// the ring failed: the requests in flight end with uringFailed, later requests return uringFailed at once
+func (c *uringRing) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !atomic.CompareAndSwapUint32(&c.broken, 0, 1) {
+		return
+	}
+	defaultLogger.Error("gws: io_uring failed, falling back to net.Conn:", err.Error())
+	for i, busy := range c.busy {
+		if busy {
+			c.busy[i] = false
+			c.requests[i].done <- uringFailed
+		}
+	}
+	c.pending = 0
+}
+
+// 提交一次收发请求, 返回内核的结果: 传输的字节数或者负的errno; 环出错时返回uringFailed
+// submit a send or receive and return the kernel result: bytes transferred or a negative errno,
+// uringFailed if the ring has failed
+func (c *uringRing) submit(opcode uint8, fd int, b []byte) int32 {
+	if c.isBroken() {
+		return uringFailed
+	}
+	var slot = <-c.free
+	var req = c.requests[slot]
+	req.buf = b
+
+	c.mu.Lock()
+	if c.isBroken() {
+		c.mu.Unlock()
+		req.buf = nil
+		c.free <- slot
+		return uringFailed
+	}
+	var tail = atomic.LoadUint32(c.sqTail)
+	var index = tail & c.sqMask
+	var sqe = (*uringSqe)(unsafe.Pointer(&c.sqeMem[index*uringSqeSize]))
+	*sqe = uringSqe{
+		opcode:   opcode,
+		fd:       int32(fd),
+		addr:     uint64(uintptr(unsafe.Pointer(&b[0]))),
+		len:      uint32(len(b)),
+		msgFlags: syscall.MSG_DONTWAIT | syscall.MSG_NOSIGNAL,
+		userData: uint64(slot),
+	}
+	*(*uint32)(unsafe.Add(c.sqArray, index*4)) = index
+	atomic.StoreUint32(c.sqTail, tail+1)
+	c.busy[slot] = true
+	c.pending++
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	var res = <-req.done
+	req.buf = nil
+	c.free <- slot
+	return res
+}
+
+// 提交协程, 在io_uring_enter期间到达的请求在下一轮合并提交; 不可重试的错误使环失败, 未被内核取走的请求没有执行
+// submitting goroutine, requests arriving during io_uring_enter are batched into the next round. A non-retryable
+// error fails the ring, the requests the kernel did not consume were never executed
+func (c *uringRing) submitLoop() {
+	for range c.wake {
+		c.mu.Lock()
+		var n = c.pending
+		c.pending = 0
+		c.mu.Unlock()
+		for n > 0 {
+			submitted, errno := c.enter(n, 0, 0)
+			if errno == syscall.EINTR || errno == syscall.EAGAIN || errno == syscall.EBUSY {
+				continue
+			}
+			if errno != 0 {
+				c.fail(os.NewSyscallError("io_uring_enter", errno))
+				return
+			}
+			n -= uint32(submitted)
+		}
+	}
+}
+
+// 收割协程, 阻塞等待完成事件并唤醒请求方. 出错时先取走已经完成的事件, 再使其余的在途请求失败
+// reaping goroutine, blocks for completions and wakes up the requesters. On error the completions already posted
+// are delivered before the remaining requests in flight fail
+func (c *uringRing) reapLoop() {
+	for {
+		var _, errno = c.enter(0, 1, uringEnterGetEvents)
+		if errno != 0 && errno != syscall.EINTR {
+			c.reap()
+			c.fail(os.NewSyscallError("io_uring_enter", errno))
+			return
+		}
+		c.reap()
+	}
+}
+
+// 取走完成队列中的事件
+// deliver the events in the completion queue
+func (c *uringRing) reap() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var head = atomic.LoadUint32(c.cqHead)
+	var tail = atomic.LoadUint32(c.cqTail)
+	for ; head != tail; head++ {
+		var cqe = (*uringCqe)(unsafe.Add(c.cqes, (head&c.cqMask)*uringCqeSize))
+		if c.busy[cqe.userData] {
+			c.busy[cqe.userData] = false
+			c.requests[cqe.userData].done <- cqe.res
+		}
+	}
+	atomic.StoreUint32(c.cqHead, head)
+}
+
+// 通过共享环读写的连接, 环出错后回退到conn
+// a connection read and written through the shared ring, falls back to conn once the ring fails
+type uringConn struct {
+	conn net.Conn
+	raw  syscall.RawConn
+	ring *uringRing
+}
+
+func newUringConn(conn net.Conn) *uringConn {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ring = sharedRing()
+	if ring == nil {
+		return nil
+	}
+	return &uringConn{conn: conn, raw: raw, ring: ring}
+}
+
+// 创建帧写入目标, 不支持时返回nil, 直接写入连接
+// create the destination of encoded frames, nil to write to the connection directly when unsupported
+func newConnWriter(conn net.Conn) io.Writer {
+	if c := newUringConn(conn); c != nil {
+		return (*uringWriter)(c)
+	}
+	return nil
+}
+
+// 创建帧读取来源, 不支持时返回nil, 直接读取连接
+// create the source of inbound bytes, nil to read from the connection directly when unsupported
+func newConnReader(conn net.Conn) io.Reader {
+	if c := newUringConn(conn); c != nil {
+		return (*uringReader)(c)
+	}
+	return nil
+}
+
+type uringWriter uringConn
+
+// RawConn.Write在回调期间持有文件描述符的引用, 回调返回false时等待可写并遵守写超时.
+// 回调持有写锁, 回退到conn.Write需要在回调返回之后
+// RawConn.Write holds a reference to the descriptor during the callback and, when it returns false,
+// waits for writability honoring the write deadline. The callback holds the write lock,
+// so falling back to conn.Write has to wait until it returned
+func (c *uringWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if c.ring.isBroken() {
+		return c.conn.Write(b)
+	}
+	var n int
+	var err error
+	var fallback bool
+	var werr = c.raw.Write(func(fd uintptr) bool {
+		for n < len(b) {
+			var res = c.ring.submit(uringOpSend, int(fd), b[n:])
+			switch {
+			case res == uringFailed:
+				fallback = true
+				return true
+			case res >= 0:
+				n += int(res)
+			case syscall.Errno(-res) == syscall.EAGAIN:
+				return false
+			case syscall.Errno(-res) == syscall.EINTR:
+			default:
+				err = os.NewSyscallError("send", syscall.Errno(-res))
+				return true
+			}
+		}
+		return true
+	})
+	if fallback && werr == nil {
+		m, err := c.conn.Write(b[n:])
+		return n + m, err
+	}
+	if err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+type uringReader uringConn
+
+// RawConn.Read在回调返回false时等待可读并遵守读超时; 对端关闭时recv返回0, 即io.EOF
+// RawConn.Read waits for readability honoring the read deadline when the callback returns false.
+// recv returns 0 once the peer closed, i.e. io.EOF
+func (c *uringReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.ring.isBroken() {
+		return c.conn.Read(p)
+	}
+	var n int
+	var err error
+	var fallback bool
+	var rerr = c.raw.Read(func(fd uintptr) bool {
+		for {
+			var res = c.ring.submit(uringOpRecv, int(fd), p)
+			switch {
+			case res == uringFailed:
+				fallback = true
+				return true
+			case res > 0:
+				n = int(res)
+				return true
+			case res == 0:
+				err = io.EOF
+				return true
+			case syscall.Errno(-res) == syscall.EAGAIN:
+				return false
+			case syscall.Errno(-res) == syscall.EINTR:
+			default:
+				err = os.NewSyscallError("recv", syscall.Errno(-res))
+				return true
+			}
+		}
+	})
+	if fallback && rerr == nil {
+		return c.conn.Read(p)
+	}
+	if err == nil {
+		err = rerr
+	}
+	return n, err
+}
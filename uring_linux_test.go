@@ -0,0 +1,210 @@
+//go:build linux && gws_iouring
+
+package gws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUringWriter(t *testing.T) {
+	var as = assert.New(t)
+	if sharedRing() == nil {
+		t.Skip("io_uring unavailable")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	defer listener.Close()
+
+	t.Run("eagain", func(t *testing.T) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if !as.NoError(err) {
+			return
+		}
+		defer client.Close()
+		server, err := listener.Accept()
+		if !as.NoError(err) {
+			return
+		}
+		defer server.Close()
+
+		var writer = newConnWriter(server)
+		as.NotNil(writer)
+
+		// 超过套接字缓冲区, 慢速读取触发EAGAIN
+		var content = make([]byte, 8*1024*1024)
+		for i := range content {
+			content[i] = byte(i)
+		}
+		var received = make(chan []byte, 1)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			var buf = make([]byte, len(content))
+			_, _ = io.ReadFull(client, buf)
+			received <- buf
+		}()
+		n, err := writer.Write(content)
+		as.NoError(err)
+		as.Equal(len(content), n)
+		as.Equal(content, <-received)
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if !as.NoError(err) {
+			return
+		}
+		defer client.Close()
+		server, err := listener.Accept()
+		if !as.NoError(err) {
+			return
+		}
+		defer server.Close()
+
+		// 对端不读取时遵守写超时
+		as.NoError(server.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)))
+		_, err = newConnWriter(server).Write(make([]byte, 64*1024*1024))
+		var netErr net.Error
+		as.ErrorAs(err, &netErr)
+		as.True(netErr.Timeout())
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		const num = 32
+		var wg sync.WaitGroup
+		for i := 0; i < num; i++ {
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if !as.NoError(err) {
+				return
+			}
+			server, err := listener.Accept()
+			if !as.NoError(err) {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer client.Close()
+				defer server.Close()
+				var writer = newConnWriter(server)
+				for j := 0; j < 100; j++ {
+					_, err := writer.Write([]byte("hello"))
+					as.NoError(err)
+				}
+				var buf = make([]byte, 500)
+				_, err := io.ReadFull(client, buf)
+				as.NoError(err)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestUringReader(t *testing.T) {
+	var as = assert.New(t)
+	if sharedRing() == nil {
+		t.Skip("io_uring unavailable")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if !as.NoError(err) {
+		return
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if !as.NoError(err) {
+		return
+	}
+	defer server.Close()
+	var reader = newConnReader(server)
+	as.NotNil(reader)
+
+	// 没有数据时等待可读
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = client.Write([]byte("hello"))
+	}()
+	var buf = make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	as.NoError(err)
+	as.Equal("hello", string(buf))
+
+	// 遵守读超时
+	as.NoError(server.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+	_, err = reader.Read(buf)
+	var netErr net.Error
+	as.ErrorAs(err, &netErr)
+	as.True(netErr.Timeout())
+	as.NoError(server.SetReadDeadline(time.Time{}))
+
+	// 对端关闭时返回io.EOF
+	_ = client.Close()
+	_, err = reader.Read(buf)
+	as.ErrorIs(err, io.EOF)
+}
+
+func TestUringRing_Fail(t *testing.T) {
+	var as = assert.New(t)
+	ring, err := newUringRing(8)
+	if err != nil {
+		t.Skip("io_uring unavailable")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !as.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if !as.NoError(err) {
+		return
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if !as.NoError(err) {
+		return
+	}
+	defer server.Close()
+	raw, err := server.(*net.TCPConn).SyscallConn()
+	if !as.NoError(err) {
+		return
+	}
+	var conn = &uringConn{conn: server, raw: raw, ring: ring}
+
+	// 在途请求以uringFailed结束
+	var slot = <-ring.free
+	ring.mu.Lock()
+	ring.busy[slot] = true
+	ring.mu.Unlock()
+	ring.fail(errors.New("test"))
+	as.True(ring.isBroken())
+	as.Equal(int32(uringFailed), <-ring.requests[slot].done)
+	ring.free <- slot
+	as.Equal(int32(uringFailed), ring.submit(uringOpSend, 0, []byte("hello")))
+
+	// 之后的读写回退到net.Conn
+	n, err := (*uringWriter)(conn).Write([]byte("hello"))
+	as.NoError(err)
+	as.Equal(5, n)
+	var buf = make([]byte, 5)
+	_, err = io.ReadFull(client, buf)
+	as.NoError(err)
+	as.Equal("hello", string(buf))
+
+	_, _ = client.Write([]byte("world"))
+	_, err = io.ReadFull((*uringReader)(conn), buf)
+	as.NoError(err)
+	as.Equal("world", string(buf))
+}
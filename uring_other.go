@@ -0,0 +1,14 @@
+//go:build !linux || !gws_iouring
+
+package gws
+
+import (
+	"io"
+	"net"
+)
+
+// 没有使用gws_iouring标签编译时直接读写连接
+// the connection is read and written directly unless built with the gws_iouring tag
+func newConnWriter(conn net.Conn) io.Writer { return nil }
+
+func newConnReader(conn net.Conn) io.Reader { return nil }
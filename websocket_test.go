@@ -3,9 +3,12 @@ package gws
 import (
 	"bytes"
 	"compress/flate"
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -152,3 +155,468 @@ func TestConn_Close(t *testing.T) {
 	assert.Error(t, socket.SetReadDeadline(time.Time{}))
 	assert.Error(t, socket.SetWriteDeadline(time.Time{}))
 }
+
+func TestConn_IdleTimeout(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{IdleTimeout: 100 * time.Millisecond}
+	var clientOption = &ClientOption{}
+
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.ErrorIs(err, ErrIdleTimeout)
+		wg.Done()
+	}
+
+	server, client := newPeer(serverHandler, serverOption, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WritePing(nil))
+	wg.Wait()
+}
+
+func TestConn_Utf8Validator(t *testing.T) {
+	var as = assert.New(t)
+	var called = false
+	var serverOption = &ServerOption{
+		CheckUtf8Enabled: true,
+		Utf8Validator: func(p []byte) bool {
+			called = true
+			return false
+		},
+	}
+	server, client := newPeer(new(webSocketMocker), serverOption, new(webSocketMocker), &ClientOption{})
+	go client.ReadLoop()
+	as.ErrorIs(server.WriteString("hello"), internal.ErrTextEncoding)
+	as.True(called)
+}
+
+func TestConn_Utf8ValidatorRead(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+
+	var serverHandler = new(webSocketMocker)
+	var serverOption = &ServerOption{
+		CheckUtf8Enabled: true,
+		Utf8Validator:    func(p []byte) bool { return false },
+	}
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.ErrorIs(err, internal.ErrTextEncoding)
+		wg.Done()
+	}
+
+	server, client := newPeer(serverHandler, serverOption, new(webSocketMocker), &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteString("hello"))
+	wg.Wait()
+}
+
+type errorEventMocker struct {
+	webSocketMocker
+	onError func(socket *Conn, err error)
+}
+
+func (c *errorEventMocker) OnError(socket *Conn, err error) {
+	c.onError(socket, err)
+}
+
+func TestConn_OnError(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("protocol error", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var steps []string
+		var serverHandler = new(errorEventMocker)
+		serverHandler.onError = func(socket *Conn, err error) {
+			as.ErrorIs(err, internal.ErrTooManyFragments)
+			steps = append(steps, "error")
+			wg.Done()
+		}
+		serverHandler.onClose = func(socket *Conn, err error) {
+			steps = append(steps, "close")
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{ReadMaxFragments: 1}, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		go func() {
+			testWrite(client, false, OpcodeText, internal.AlphabetNumeric.Generate(8))
+			testWrite(client, true, OpcodeContinuation, internal.AlphabetNumeric.Generate(8))
+		}()
+		wg.Wait()
+		as.Equal([]string{"error", "close"}, steps)
+	})
+
+	// OnError在关闭帧发出之前调用, 回调中调用WriteClose不会死锁
+	t.Run("before close frame", func(t *testing.T) {
+		var mu sync.Mutex
+		var steps []string
+		var closed = make(chan struct{})
+		var serverHandler = new(errorEventMocker)
+		serverHandler.onError = func(socket *Conn, err error) {
+			mu.Lock()
+			steps = append(steps, "error")
+			mu.Unlock()
+			socket.WriteClose(1000, nil)
+		}
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			mu.Lock()
+			steps = append(steps, "close frame")
+			mu.Unlock()
+			close(closed)
+		}
+		server, client := newPeer(serverHandler, &ServerOption{ReadMaxFragments: 1}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		go func() {
+			testWrite(client, false, OpcodeText, internal.AlphabetNumeric.Generate(8))
+			testWrite(client, true, OpcodeContinuation, internal.AlphabetNumeric.Generate(8))
+		}()
+		<-closed
+		mu.Lock()
+		as.Equal([]string{"error", "close frame"}, steps)
+		mu.Unlock()
+	})
+
+	t.Run("write close", func(t *testing.T) {
+		var serverHandler = new(errorEventMocker)
+		serverHandler.onError = func(socket *Conn, err error) {
+			as.Fail("unexpected OnError")
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		go client.ReadLoop()
+		server.WriteClose(1000, nil)
+		as.True(server.isClosed())
+	})
+}
+
+// 对端不再读取时关闭帧的写入超时, 连接和读协程不会泄漏
+func TestConn_CloseStalledPeer(t *testing.T) {
+	var as = assert.New(t)
+	var closed = make(chan error, 1)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onClose = func(socket *Conn, err error) { closed <- err }
+	server, client := newPeer(serverHandler, &ServerOption{}, new(webSocketMocker), &ClientOption{})
+	server.config.closeFrameTimeout = 50 * time.Millisecond
+	var done = make(chan struct{})
+	go func() {
+		server.ReadLoop()
+		close(done)
+	}()
+	// 客户端不读取, 写入一直阻塞
+	go func() { _ = server.WriteMessage(OpcodeBinary, make([]byte, 64*1024)) }()
+	time.Sleep(10 * time.Millisecond)
+	go server.emitError(internal.NewError(internal.CloseGoingAway, internal.ErrIdleTimeout))
+
+	select {
+	case err := <-closed:
+		as.ErrorIs(err, internal.ErrIdleTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ReadLoop did not exit")
+	}
+	_ = client.NetConn().Close()
+}
+
+func TestConn_CloseError(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("local error", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			as.True(errors.As(err, &closeErr))
+			as.Equal(internal.CloseMessageTooLarge.Uint16(), closeErr.Code)
+			as.Equal(ErrMessageTooLarge.Error(), string(closeErr.Reason))
+			as.ErrorIs(err, ErrMessageTooLarge)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{ReadMaxMessageSize: 4}, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		_ = client.WriteString("hello")
+		wg.Wait()
+	})
+
+	t.Run("bare status code", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			as.True(errors.As(err, &closeErr))
+			as.Equal(internal.CloseProtocolError.Uint16(), closeErr.Code)
+			as.ErrorIs(err, internal.CloseProtocolError)
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		go testWrite(client, true, OpcodeContinuation, []byte("hello"))
+		wg.Wait()
+	})
+
+	t.Run("remote close", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(1)
+		var clientHandler = new(webSocketMocker)
+		clientHandler.onClose = func(socket *Conn, err error) {
+			var closeErr *CloseError
+			as.True(errors.As(err, &closeErr))
+			as.Equal(uint16(1001), closeErr.Code)
+			as.Equal("bye", string(closeErr.Reason))
+			as.Nil(closeErr.Err)
+			wg.Done()
+		}
+		server, client := newPeer(new(webSocketMocker), &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		server.WriteClose(1001, []byte("bye"))
+		wg.Wait()
+	})
+
+	// 过长的原因被截断到关闭帧的长度限制
+	t.Run("long reason", func(t *testing.T) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+		var closed = make(chan error, 1)
+		var handler = new(webSocketMocker)
+		handler.onClose = func(socket *Conn, err error) { closed <- err }
+		var conn = &Conn{conn: &benchConn{}, config: upgrader.option.getConfig(), handler: handler}
+		var text = strings.Repeat("x", 200)
+		conn.emitError(internal.NewError(internal.CloseInternalServerErr, errors.New(text)))
+		var closeErr *CloseError
+		as.True(errors.As(<-closed, &closeErr))
+		as.Equal(internal.CloseInternalServerErr.Uint16(), closeErr.Code)
+		as.Equal(text[:internal.ThresholdV1-2], string(closeErr.Reason))
+		as.Equal("gws: abnormal closure", internal.CloseAbnormalClosure.Error())
+	})
+
+	// 大量连接关闭时每个连接只分配一次
+	t.Run("allocs", func(t *testing.T) {
+		var upgrader = NewUpgrader(&BuiltinEventHandler{}, nil)
+		var config = upgrader.option.getConfig()
+		var err = internal.NewError(internal.CloseGoingAway, io.EOF)
+		var conns = make([]*Conn, 0, 101)
+		for i := 0; i < 101; i++ {
+			var conn = &Conn{conn: &benchConn{}, config: config, handler: &BuiltinEventHandler{}}
+			conn.smallFrame = new([smallFrameSize]byte)
+			conns = append(conns, conn)
+		}
+		var i = 0
+		var allocs = testing.AllocsPerRun(100, func() {
+			conns[i].emitError(err)
+			conns[i].emitError(err)
+			i++
+		})
+		as.Equal(1.0, allocs)
+	})
+}
+
+func TestConn_Context(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var serverHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var ctx context.Context
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		ctx = socket.Context()
+		conn, ok := ConnFromContext(ctx)
+		as.True(ok)
+		as.Equal(socket, conn)
+		as.NoError(ctx.Err())
+		wg.Done()
+	}
+	serverHandler.onClose = func(socket *Conn, err error) {
+		as.ErrorIs(socket.Context().Err(), context.Canceled)
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteString("hello"))
+	client.WriteClose(1000, nil)
+	wg.Wait()
+	<-ctx.Done()
+
+	_, ok := ConnFromContext(context.Background())
+	as.False(ok)
+}
+
+func TestConn_NegotiationState(t *testing.T) {
+	var as = assert.New(t)
+	var ext = new(invertExtension)
+	server, client := newPeer(new(webSocketMocker), &ServerOption{CompressEnabled: true}, new(webSocketMocker), &ClientOption{})
+	server.extensions = []Extension{ext}
+	as.True(server.IsServer())
+	as.True(server.CompressionEnabled())
+	as.Equal([]Extension{ext}, server.Extensions())
+	as.False(client.IsServer())
+	as.False(client.CompressionEnabled())
+	as.Equal(0, len(client.Extensions()))
+}
+
+func TestConn_SetCompressionEnabled(t *testing.T) {
+	var as = assert.New(t)
+	var serverOption = &ServerOption{CompressEnabled: true, CompressThreshold: 1}
+	server, client := newPeer(new(webSocketMocker), serverOption, new(webSocketMocker), &ClientOption{})
+	var compressed = func(socket *Conn) bool {
+		frame, index, err := socket.genFrame(OpcodeText, []byte("hello, hello, hello"))
+		as.NoError(err)
+		defer myBufferPool.Put(frame, index)
+		return frame.Bytes()[0]&RSV1Bit != 0
+	}
+	as.True(compressed(server))
+
+	server.SetCompressionEnabled(false)
+	as.False(compressed(server))
+	as.True(server.CompressionEnabled())
+
+	var b = NewBroadcaster(OpcodeText, []byte("hello, hello, hello"))
+	as.NoError(b.Broadcast(server))
+	as.Nil(b.msgs[1])
+	b.Release()
+
+	server.SetCompressionEnabled(true)
+	as.True(compressed(server))
+
+	client.SetCompressionEnabled(true)
+	as.False(compressed(client))
+}
+
+func TestConn_WithValue(t *testing.T) {
+	var as = assert.New(t)
+	type traceKey struct{}
+	server, _ := newPeer(new(webSocketMocker), &ServerOption{}, new(webSocketMocker), &ClientOption{})
+	var wg = &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			server.WithValue(i, i)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	server.WithValue(traceKey{}, "abc")
+
+	var ctx = server.Context()
+	as.Equal("abc", ctx.Value(traceKey{}))
+	for i := 0; i < 8; i++ {
+		as.Equal(i, ctx.Value(i))
+	}
+	conn, ok := ConnFromContext(ctx)
+	as.True(ok)
+	as.Equal(server, conn)
+
+	server.loadContext().cancel()
+	as.ErrorIs(server.Context().Err(), context.Canceled)
+}
+
+func TestConn_LazyState(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("continuation", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		as.Nil(server.continuationFrame)
+
+		// 第一个分片到达时创建, 消息结束后释放
+		go func() {
+			_ = testWrite(client, false, OpcodeText, []byte("hello"))
+			_ = testWrite(client, true, OpcodeContinuation, []byte("world"))
+		}()
+		as.NoError(server.readMessage())
+		as.NotNil(server.continuationFrame)
+		as.NoError(server.readMessage())
+		as.Nil(server.continuationFrame)
+	})
+
+	t.Run("context", func(t *testing.T) {
+		server, _ := newPeer(new(webSocketMocker), &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		as.Nil(server.ctx.Load())
+		as.NoError(server.Context().Err())
+		as.NotNil(server.ctx.Load())
+
+		// 连接关闭之后才创建的context立即取消
+		server, client := newPeer(new(webSocketMocker), &ServerOption{}, new(webSocketMocker), &ClientOption{})
+		go client.ReadLoop()
+		server.WriteClose(1000, nil)
+		as.ErrorIs(server.Context().Err(), context.Canceled)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		var q = newWorkerQueue(1)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			q.Push(func() { wg.Done() })
+		}
+		wg.Wait()
+		q.mu.Lock()
+		as.Nil(q.q)
+		q.mu.Unlock()
+	})
+}
+
+func TestConn_SetEventHandler(t *testing.T) {
+	var as = assert.New(t)
+	var wg = &sync.WaitGroup{}
+	wg.Add(3)
+	var authHandler = new(webSocketMocker)
+	var dataHandler = new(webSocketMocker)
+	var clientHandler = new(webSocketMocker)
+	var data []string
+	authHandler.onMessage = func(socket *Conn, message *Message) {
+		as.Equal("token", message.Data.String())
+		socket.SetEventHandler(dataHandler)
+		wg.Done()
+	}
+	dataHandler.onMessage = func(socket *Conn, message *Message) {
+		data = append(data, message.Data.String())
+		wg.Done()
+	}
+	server, client := newPeer(authHandler, &ServerOption{}, clientHandler, &ClientOption{})
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteString("token"))
+	as.NoError(client.WriteString("a"))
+	as.NoError(client.WriteString("b"))
+	wg.Wait()
+	as.Equal([]string{"a", "b"}, data)
+	as.Equal(dataHandler, server.eventHandler())
+}
+
+func TestBufferPoolStats(t *testing.T) {
+	var as = assert.New(t)
+	SetBufferPoolStatsEnabled(true)
+	defer SetBufferPoolStatsEnabled(false)
+	var before = BufferPoolStats()
+	var wg = &sync.WaitGroup{}
+	wg.Add(1)
+	var serverHandler = new(webSocketMocker)
+	serverHandler.onMessage = func(socket *Conn, message *Message) {
+		_ = message.Close()
+		wg.Done()
+	}
+	server, client := newPeer(serverHandler, nil, new(webSocketMocker), nil)
+	go server.ReadLoop()
+	go client.ReadLoop()
+	as.NoError(client.WriteString("hello"))
+	wg.Wait()
+
+	var after = BufferPoolStats()
+	as.Greater(after.Gets, before.Gets)
+	as.Greater(after.Puts, before.Puts)
+}
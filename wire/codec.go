@@ -0,0 +1,162 @@
+package wire
+
+import (
+	"io"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// 默认的最大消息长度
+// default maximum message length
+const defaultMaxPayloadSize = 16 * 1024 * 1024
+
+// Writer 帧编码器, 不能并发使用
+// Writer is the frame encoder, it is not safe for concurrent use
+type Writer struct {
+	w      io.Writer
+	masked bool
+	buf    []byte
+
+	// FragmentSize 数据消息的最大分片长度, 超过时WriteMessage把它拆成多个帧, 默认为0表示不分片
+	// Maximum fragment length of data messages, longer ones are split into several frames by WriteMessage.
+	// 0 by default, meaning no fragmentation
+	FragmentSize int
+}
+
+// NewWriter 创建帧编码器, 客户端(client为true)写出的帧使用随机掩码
+// NewWriter creates a frame encoder. Frames written by clients (client is true) are masked with a random key
+func NewWriter(w io.Writer, client bool) *Writer {
+	return &Writer{w: w, masked: client}
+}
+
+// WriteFrame 写出一个帧, h.Length由payload决定; 客户端覆盖h.Masked和h.Mask. payload不会被修改
+// WriteFrame writes a frame, h.Length is taken from payload. Clients override h.Masked and h.Mask.
+// payload is not modified
+func (c *Writer) WriteFrame(h Header, payload []byte) error {
+	h.Length = len(payload)
+	if c.masked {
+		h.Masked, h.Mask = true, NewMaskKey()
+	}
+	var n = h.Size()
+	if cap(c.buf) < n+len(payload) {
+		c.buf = make([]byte, n+len(payload))
+	}
+	var b = c.buf[:n+len(payload)]
+	h.Encode(b)
+	copy(b[n:], payload)
+	if h.Masked {
+		Mask(b[n:], h.Mask)
+	}
+	_, err := c.w.Write(b)
+	return err
+}
+
+// WriteMessage 写出一条消息, 数据消息按FragmentSize分片; 控制帧不能分片, 载荷超过125字节时返回ErrProtocol
+// WriteMessage writes a message, data messages are fragmented by FragmentSize. Control frames cannot be fragmented,
+// ErrProtocol is returned if their payload exceeds 125 bytes
+func (c *Writer) WriteMessage(opcode Opcode, payload []byte) error {
+	if opcode.IsControl() {
+		if len(payload) > internal.ThresholdV1 {
+			return ErrProtocol
+		}
+		return c.WriteFrame(Header{Fin: true, Opcode: opcode}, payload)
+	}
+	if c.FragmentSize <= 0 || len(payload) <= c.FragmentSize {
+		return c.WriteFrame(Header{Fin: true, Opcode: opcode}, payload)
+	}
+	for len(payload) > 0 {
+		var n = internal.SelectValue(len(payload) < c.FragmentSize, len(payload), c.FragmentSize)
+		if err := c.WriteFrame(Header{Fin: n == len(payload), Opcode: opcode}, payload[:n]); err != nil {
+			return err
+		}
+		payload, opcode = payload[n:], OpcodeContinuation
+	}
+	return nil
+}
+
+// Reader 帧解码器, 不能并发使用
+// Reader is the frame decoder, it is not safe for concurrent use
+type Reader struct {
+	r io.Reader
+
+	// 正在接收的分片消息
+	// the fragmented message being received
+	fragmented bool
+	first      Header
+	fragments  []byte
+
+	// MaxPayloadSize 帧和消息的最大长度, 默认16MB
+	// Maximum length of frames and messages, 16MB by default
+	MaxPayloadSize int
+}
+
+// NewReader 创建帧解码器
+// NewReader creates a frame decoder
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, MaxPayloadSize: defaultMaxPayloadSize}
+}
+
+// ReadFrame 读取一个帧, 返回去掉掩码的载荷; 控制帧分片或者超过125字节时返回ErrProtocol
+// ReadFrame reads a frame and returns its unmasked payload. ErrProtocol is returned for control frames
+// that are fragmented or longer than 125 bytes
+func (c *Reader) ReadFrame() (Header, []byte, error) {
+	h, err := ReadHeader(c.r)
+	if err != nil {
+		return h, nil, err
+	}
+	if h.Opcode.IsControl() && (!h.Fin || h.Length > internal.ThresholdV1) {
+		return h, nil, ErrProtocol
+	}
+	if c.MaxPayloadSize > 0 && h.Length > c.MaxPayloadSize {
+		return h, nil, ErrTooLarge
+	}
+	var payload = make([]byte, h.Length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return h, nil, err
+	}
+	if h.Masked {
+		Mask(payload, h.Mask)
+	}
+	return h, payload, nil
+}
+
+// ReadMessage 读取一条完整的消息, 合并分片; 分片之间的控制帧会先被单独返回.
+// 返回的帧头来自消息的第一个帧, Fin为true, Length为消息长度
+// ReadMessage reads a complete message, reassembling fragments. Control frames interleaved with the fragments are
+// returned on their own first. The returned header is the one of the first frame with Fin set and Length being
+// the message length
+func (c *Reader) ReadMessage() (Header, []byte, error) {
+	for {
+		h, payload, err := c.ReadFrame()
+		if err != nil {
+			return h, nil, err
+		}
+		switch {
+		case h.Opcode.IsControl():
+			return h, payload, nil
+		case h.Opcode == OpcodeContinuation:
+			if !c.fragmented {
+				return h, nil, ErrProtocol
+			}
+			if c.MaxPayloadSize > 0 && len(c.fragments)+len(payload) > c.MaxPayloadSize {
+				return h, nil, ErrTooLarge
+			}
+			c.fragments = append(c.fragments, payload...)
+			if !h.Fin {
+				continue
+			}
+			h, payload = c.first, c.fragments
+			c.fragmented, c.first, c.fragments = false, Header{}, nil
+		default:
+			if c.fragmented {
+				return h, nil, ErrProtocol
+			}
+			if !h.Fin {
+				c.fragmented, c.first, c.fragments = true, h, payload
+				continue
+			}
+		}
+		h.Fin, h.Masked, h.Mask, h.Length = true, false, [4]byte{}, len(payload)
+		return h, payload, nil
+	}
+}
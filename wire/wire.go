@@ -0,0 +1,145 @@
+// Package wire websocket帧编解码器, 包括帧头的编码和解析, 掩码以及分片, 可以用于任意的io.Reader/io.Writer,
+// 不依赖gws.Conn; 适用于代理, 模糊测试和其他传输层. 不处理扩展(压缩)和关闭握手. 帧头编解码与gws.Conn共用同一份实现
+// Package wire is the websocket frame codec: header encoding and parsing, masking and fragmentation over any
+// io.Reader/io.Writer, without a gws.Conn. It is meant for proxies, fuzzers and alternative transports.
+// Extensions (compression) and the closing handshake are not handled. Header encoding and parsing share
+// one implementation with gws.Conn
+package wire
+
+import (
+	"errors"
+	"io"
+
+	"github.com/lxzan/gws/internal"
+)
+
+// MaxHeaderSize 帧头的最大长度
+// MaxHeaderSize is the maximum length of a frame header
+const MaxHeaderSize = 14
+
+type Opcode uint8
+
+const (
+	OpcodeContinuation    Opcode = 0x0
+	OpcodeText            Opcode = 0x1
+	OpcodeBinary          Opcode = 0x2
+	OpcodeCloseConnection Opcode = 0x8
+	OpcodePing            Opcode = 0x9
+	OpcodePong            Opcode = 0xA
+)
+
+// IsControl 是否为控制帧的操作码
+// IsControl reports whether the opcode belongs to a control frame
+func (c Opcode) IsControl() bool {
+	return c >= OpcodeCloseConnection
+}
+
+// RSV位
+// RSV bits
+const (
+	RSV1 uint8 = 0x40
+	RSV2 uint8 = 0x20
+	RSV3 uint8 = 0x10
+)
+
+var (
+	// ErrProtocol 帧不符合RFC6455, 例如控制帧分片或者过长, 不完整的分片消息
+	// the frame violates RFC6455, e.g. a fragmented or oversized control frame, or an incomplete fragmented message
+	ErrProtocol = errors.New("wire: protocol error")
+
+	// ErrTooLarge 帧或者消息超过了限制
+	// the frame or message exceeds the limit
+	ErrTooLarge = errors.New("wire: payload too large")
+
+	// ErrShortBuffer 缓冲区中的帧头不完整
+	// the header in the buffer is incomplete
+	ErrShortBuffer = errors.New("wire: short buffer")
+)
+
+// Header 帧头
+// Header is a frame header
+type Header struct {
+	Fin    bool
+	RSV    uint8
+	Opcode Opcode
+	Masked bool
+	Mask   [4]byte
+	Length int
+}
+
+// Size 编码后的长度
+// Size returns the encoded length
+func (c *Header) Size() int {
+	return internal.FrameHeaderSizeOf(c.Length, c.Masked)
+}
+
+// Encode 把帧头编码到p, p的长度至少为Size(), 返回写入的字节数
+// Encode writes the header to p, which must hold at least Size() bytes, and returns the number of bytes written
+func (c *Header) Encode(p []byte) int {
+	var b0 = uint8(c.Opcode)&0x0F | c.RSV&(RSV1|RSV2|RSV3)
+	if c.Fin {
+		b0 |= 0x80
+	}
+	p[0], p[1] = b0, 0
+	var n = 2 + internal.PutFrameLength(p[1:], uint64(c.Length))
+	if c.Masked {
+		p[1] |= 0x80
+		copy(p[n:n+4], c.Mask[:])
+		n += 4
+	}
+	return n
+}
+
+// ParseHeader 从缓冲区解析帧头, 返回帧头的长度; 帧头不完整时返回ErrShortBuffer
+// ParseHeader parses a header from the buffer and returns its length, ErrShortBuffer if it is incomplete
+func ParseHeader(p []byte) (Header, int, error) {
+	if len(p) < 2 {
+		return Header{}, 0, ErrShortBuffer
+	}
+	var h = Header{
+		Fin:    p[0]&0x80 != 0,
+		RSV:    p[0] & (RSV1 | RSV2 | RSV3),
+		Opcode: Opcode(p[0] & 0x0F),
+		Masked: p[1]&0x80 != 0,
+	}
+	var n = internal.FrameHeaderLength(p[1])
+	if len(p) < n {
+		return Header{}, 0, ErrShortBuffer
+	}
+	var length = internal.ParseFrameLength(p[1], p[2:])
+	if int(length) < 0 || uint64(int(length)) != length {
+		return Header{}, 0, ErrTooLarge
+	}
+	h.Length = int(length)
+	if h.Masked {
+		copy(h.Mask[:], p[n-4:n])
+	}
+	return h, n, nil
+}
+
+// ReadHeader 从r读取一个帧头
+// ReadHeader reads a header from r
+func ReadHeader(r io.Reader) (Header, error) {
+	var b [MaxHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return Header{}, err
+	}
+	var n = internal.FrameHeaderLength(b[1])
+	if _, err := io.ReadFull(r, b[2:n]); err != nil {
+		return Header{}, err
+	}
+	h, _, err := ParseHeader(b[:n])
+	return h, err
+}
+
+// Mask 用key对p进行掩码或者去掩码, 两者是同一个运算
+// Mask masks or unmasks p with key, both are the same operation
+func Mask(p []byte, key [4]byte) {
+	internal.MaskXOR(p, key[:])
+}
+
+// NewMaskKey 生成随机的掩码
+// NewMaskKey generates a random mask key
+func NewMaskKey() [4]byte {
+	return internal.NewMaskKey()
+}
@@ -0,0 +1,182 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lxzan/gws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeader(t *testing.T) {
+	var as = assert.New(t)
+
+	// RFC6455 5.7 的示例
+	t.Run("rfc examples", func(t *testing.T) {
+		h, n, err := ParseHeader([]byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f})
+		as.NoError(err)
+		as.Equal(2, n)
+		as.Equal(Header{Fin: true, Opcode: OpcodeText, Length: 5}, h)
+
+		var frame = []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}
+		h, n, err = ParseHeader(frame)
+		as.NoError(err)
+		as.Equal(6, n)
+		as.True(h.Masked)
+		var payload = append([]byte(nil), frame[n:]...)
+		Mask(payload, h.Mask)
+		as.Equal("Hello", string(payload))
+
+		var b [MaxHeaderSize]byte
+		as.Equal(6, h.Encode(b[:]))
+		as.Equal(frame[:6], b[:6])
+
+		h, _, err = ParseHeader([]byte{0x01, 0x03})
+		as.NoError(err)
+		as.False(h.Fin)
+		h, _, err = ParseHeader([]byte{0x80, 0x02})
+		as.NoError(err)
+		as.Equal(OpcodeContinuation, h.Opcode)
+	})
+
+	t.Run("length", func(t *testing.T) {
+		for _, length := range []int{0, 125, 126, 65535, 65536, math.MaxInt} {
+			var h = Header{Fin: true, RSV: RSV1, Opcode: OpcodeBinary, Masked: true, Mask: NewMaskKey(), Length: length}
+			var b [MaxHeaderSize]byte
+			var n = h.Encode(b[:])
+			as.Equal(h.Size(), n)
+			parsed, m, err := ParseHeader(b[:n])
+			as.NoError(err)
+			as.Equal(n, m)
+			as.Equal(h, parsed)
+
+			_, _, err = ParseHeader(b[:n-1])
+			as.ErrorIs(err, ErrShortBuffer)
+			parsed, err = ReadHeader(bytes.NewReader(b[:n]))
+			as.NoError(err)
+			as.Equal(h, parsed)
+		}
+		_, _, err := ParseHeader([]byte{0x82, 127, 0xff, 0, 0, 0, 0, 0, 0, 0})
+		as.ErrorIs(err, ErrTooLarge)
+	})
+}
+
+func TestCodec(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("fragments", func(t *testing.T) {
+		var buf = bytes.NewBuffer(nil)
+		var w = NewWriter(buf, true)
+		w.FragmentSize = 4
+		as.NoError(w.WriteMessage(OpcodeText, []byte("hello world")))
+		as.ErrorIs(w.WriteMessage(OpcodePing, make([]byte, 126)), ErrProtocol)
+
+		var r = NewReader(bytes.NewReader(buf.Bytes()))
+		h, payload, err := r.ReadFrame()
+		as.NoError(err)
+		as.False(h.Fin)
+		as.True(h.Masked)
+		as.Equal("hell", string(payload))
+
+		r = NewReader(bytes.NewReader(buf.Bytes()))
+		h, payload, err = r.ReadMessage()
+		as.NoError(err)
+		as.Equal(Header{Fin: true, Opcode: OpcodeText, Length: 11}, h)
+		as.Equal("hello world", string(payload))
+		_, _, err = r.ReadMessage()
+		as.ErrorIs(err, io.EOF)
+	})
+
+	// 分片之间的控制帧先被返回
+	t.Run("interleaved", func(t *testing.T) {
+		var buf = bytes.NewBuffer(nil)
+		var w = NewWriter(buf, false)
+		as.NoError(w.WriteFrame(Header{Opcode: OpcodeBinary}, []byte("ab")))
+		as.NoError(w.WriteFrame(Header{Fin: true, Opcode: OpcodePing}, []byte("p")))
+		as.NoError(w.WriteFrame(Header{Fin: true, Opcode: OpcodeContinuation}, []byte("cd")))
+
+		var r = NewReader(buf)
+		h, payload, err := r.ReadMessage()
+		as.NoError(err)
+		as.Equal(OpcodePing, h.Opcode)
+		as.Equal("p", string(payload))
+		h, payload, err = r.ReadMessage()
+		as.NoError(err)
+		as.Equal(OpcodeBinary, h.Opcode)
+		as.Equal("abcd", string(payload))
+	})
+
+	t.Run("protocol errors", func(t *testing.T) {
+		var cases = [][]Header{
+			{{Fin: true, Opcode: OpcodeContinuation}},
+			{{Opcode: OpcodeText}, {Fin: true, Opcode: OpcodeText}},
+			{{Opcode: OpcodePing}},
+		}
+		for _, frames := range cases {
+			var buf = bytes.NewBuffer(nil)
+			var w = NewWriter(buf, false)
+			for _, h := range frames {
+				as.NoError(w.WriteFrame(h, nil))
+			}
+			_, _, err := NewReader(buf).ReadMessage()
+			as.ErrorIs(err, ErrProtocol)
+		}
+
+		var buf = bytes.NewBuffer(nil)
+		var w = NewWriter(buf, false)
+		as.NoError(w.WriteMessage(OpcodeBinary, make([]byte, 10)))
+		var r = NewReader(buf)
+		r.MaxPayloadSize = 8
+		_, _, err := r.ReadMessage()
+		as.ErrorIs(err, ErrTooLarge)
+	})
+}
+
+type echoHandler struct {
+	gws.BuiltinEventHandler
+}
+
+func (c *echoHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	_ = socket.WriteMessage(message.Opcode, message.Bytes())
+	_ = message.Close()
+}
+
+// 与gws.Conn互通
+func TestInterop(t *testing.T) {
+	var as = assert.New(t)
+	s, c := net.Pipe()
+	defer c.Close()
+	var upgrader = gws.NewUpgrader(new(echoHandler), nil)
+	go func() {
+		if socket, err := upgrader.UpgradeStream(s); err == nil {
+			socket.ReadLoop()
+		}
+	}()
+
+	// 握手不属于wire, 手写升级请求
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	_, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	as.NoError(err)
+	var br = bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if !as.NoError(err) {
+		return
+	}
+	as.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+
+	var w = NewWriter(c, true)
+	w.FragmentSize = 3
+	var r = NewReader(br)
+	go func() { _ = w.WriteMessage(OpcodeText, []byte("hello gws")) }()
+	h, payload, err := r.ReadMessage()
+	as.NoError(err)
+	as.Equal(OpcodeText, h.Opcode)
+	as.Equal("hello gws", string(payload))
+}
@@ -2,25 +2,57 @@ package gws
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"github.com/klauspost/compress/flate"
 	"github.com/lxzan/gws/internal"
+	"io"
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 // WriteClose
 // code: https://developer.mozilla.org/zh-CN/docs/Web/API/CloseEvent#status_codes
 // 通过emitError发送关闭帧, 将连接状态置为关闭, 用于服务端主动断开连接
-// 没有特殊原因的话, 建议code=0, reason=nil
+// 没有特殊原因的话, 建议code=0, reason=nil; 状态码可以使用导出的常量, 例如 CloseGoingAway.Uint16()
 // Send a close frame via emitError to set the connection state to closed, for server-initiated disconnection
-// If there is no special reason, we suggest code=0, reason=nil
+// If there is no special reason, we suggest code=0, reason=nil; use the exported constants for codes, e.g. CloseGoingAway.Uint16()
 func (c *Conn) WriteClose(code uint16, reason []byte) {
 	var err = internal.NewError(internal.StatusCode(code), internal.GwsError(""))
 	if len(reason) > 0 {
 		err.Err = errors.New(string(reason))
 	}
-	c.emitError(err)
+	c.closeWithError(err, false)
+}
+
+// StopReadingAndDrain 停止分发新的数据消息(控制帧照常处理), 等待写队列中的消息发送完毕, 然后以1001状态码关闭连接
+// 用于会话迁移和滚动重启; 超过timeout仍未发送完毕时直接关闭并返回ErrDrainTimeout
+// Stop dispatching new inbound data messages (control frames are still handled), wait for the pending write queue
+// to be flushed, then close the connection with 1001. Used for session migration and rolling restarts.
+// If the queue is not flushed within timeout, the connection is closed anyway and ErrDrainTimeout is returned
+func (c *Conn) StopReadingAndDrain(timeout time.Duration) error {
+	if c.isClosed() {
+		return internal.ErrConnClosed
+	}
+	atomic.StoreUint32(&c.draining, 1)
+
+	var done = make(chan struct{})
+	c.writeQueue.Push(func() { close(done) })
+	var timer = time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-done:
+	case <-timer.C:
+		err = internal.ErrDrainTimeout
+	}
+	c.WriteClose(internal.CloseGoingAway.Uint16(), nil)
+	return err
 }
 
 // WritePing write ping frame
@@ -39,20 +71,58 @@ func (c *Conn) WriteString(s string) error {
 }
 
 // WriteAsync 异步非阻塞地写入消息
-// Write messages asynchronously and non-blockingly
+// 需要压缩的消息在写协程中压缩, 不会阻塞调用方; 压缩后超出长度限制等错误通过OnClose报告
+// Write messages asynchronously and non-blockingly.
+// Messages to be compressed are compressed in the write worker without blocking the caller;
+// errors found after compression, such as exceeding the length limit, are reported through OnClose
 func (c *Conn) WriteAsync(opcode Opcode, payload []byte) error {
+	return c.WriteAsyncClass(CompressClassDefault, opcode, payload)
+}
+
+// WriteAsyncClass 按压缩类别异步写入消息, 见WriteAsync和WriteMessageClass
+// WriteAsyncClass writes a message of the given compression class asynchronously, see WriteAsync and WriteMessageClass
+func (c *Conn) WriteAsyncClass(class CompressClass, opcode Opcode, payload []byte) error {
+	c.observeMessage(FrameOutbound, opcode, payload)
+	if c.isWriteOrdered(opcode) || c.isCompressible(opcode, payload) {
+		if opcode == OpcodeText && !c.isTextValid(opcode, payload) {
+			var err = internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding)
+			c.emitError(err)
+			return err
+		}
+		payload = append([]byte(nil), payload...)
+		var enqueued = c.enqueueTime()
+		c.chargeWriteQueue(len(payload))
+		c.writeQueue.Push(func() {
+			c.chargeWriteQueue(-len(payload))
+			if c.isClosed() {
+				return
+			}
+			frame, index, err := c.encodeFrame(class, opcode, payload)
+			if err == nil {
+				err = c.writeQueuedFrame(frame, enqueued)
+				c.putFrameBuffer(frame, index)
+			}
+			c.emitError(err)
+		})
+		return nil
+	}
+
 	frame, index, err := c.genFrame(opcode, payload)
 	if err != nil {
 		c.emitError(err)
 		return err
 	}
 
+	var enqueued = c.enqueueTime()
+	var n = frame.Len()
+	c.chargeWriteQueue(n)
 	c.writeQueue.Push(func() {
+		c.chargeWriteQueue(-n)
 		if c.isClosed() {
 			return
 		}
-		err = internal.WriteN(c.conn, frame.Bytes(), frame.Len())
-		myBufferPool.Put(frame, index)
+		err = c.writeQueuedFrame(frame, enqueued)
+		c.putFrameBuffer(frame, index)
 		c.emitError(err)
 	})
 	return nil
@@ -60,47 +130,265 @@ func (c *Conn) WriteAsync(opcode Opcode, payload []byte) error {
 
 // WriteMessage 发送消息
 func (c *Conn) WriteMessage(opcode Opcode, payload []byte) error {
+	return c.WriteMessageClass(CompressClassDefault, opcode, payload)
+}
+
+// WriteMessageClass 按压缩类别发送消息, 类别决定使用哪个压缩级别的压缩器池
+// 开启了出站上下文接管的连接始终使用CompressLevel
+// WriteMessageClass sends a message of the given compression class, which selects the compress level.
+// Connections with outbound context takeover always use CompressLevel
+func (c *Conn) WriteMessageClass(class CompressClass, opcode Opcode, payload []byte) error {
 	if c.isClosed() {
 		return internal.ErrConnClosed
 	}
-	err := c.doWrite(opcode, payload)
+	c.observeMessage(FrameOutbound, opcode, payload)
+	err := c.doWrite(class, opcode, payload)
 	c.emitError(err)
 	return err
 }
 
 // 执行写入逻辑, 关闭状态置为1后还能写, 以便发送关闭帧
 // Execute the write logic, and write after the close state is set to 1, so that the close frame can be sent
-func (c *Conn) doWrite(opcode Opcode, payload []byte) error {
-	frame, index, err := c.genFrame(opcode, payload)
+func (c *Conn) doWrite(class CompressClass, opcode Opcode, payload []byte) error {
+	if c.isWriteOrdered(opcode) {
+		var done = make(chan error, 1)
+		c.writeQueue.Push(func() {
+			if c.isClosed() {
+				done <- internal.ErrConnClosed
+				return
+			}
+			done <- c.doWriteFrame(class, opcode, payload)
+		})
+		return <-done
+	}
+	return c.doWriteFrame(class, opcode, payload)
+}
+
+// 开启了出站上下文接管时, 数据帧必须在写队列中压缩和发送, 保证压缩顺序与发送顺序一致
+// With outbound context takeover, data frames are compressed and sent in the write queue,
+// so that compression order matches wire order
+func (c *Conn) isWriteOrdered(opcode Opcode) bool {
+	return c.deflate != nil && c.deflate.writeTakeover && opcode.isDataFrame()
+}
+
+// 消息是否可能被压缩
+// whether the message is likely to be compressed
+func (c *Conn) isCompressible(opcode Opcode, payload []byte) bool {
+	return c.isWriteCompressed() && c.isOpcodeCompressible(opcode) && len(payload) >= c.config.CompressThreshold
+}
+
+// 操作码是否允许压缩
+// whether the opcode is eligible for compression
+func (c *Conn) isOpcodeCompressible(opcode Opcode) bool {
+	if !opcode.isDataFrame() {
+		return false
+	}
+	if len(c.config.CompressOpcodes) == 0 {
+		return true
+	}
+	for _, item := range c.config.CompressOpcodes {
+		if item == opcode {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conn) doWriteFrame(class CompressClass, opcode Opcode, payload []byte) error {
+	if c.isSmallFrame(payload) && atomic.CompareAndSwapInt32(&c.smallBusy, 0, 1) {
+		var err = c.writeSmallFrame(opcode, payload)
+		atomic.StoreInt32(&c.smallBusy, 0)
+		return err
+	}
+
+	frame, index, err := c.genClassFrame(class, opcode, payload)
 	if err != nil {
 		return err
 	}
 
-	err = internal.WriteN(c.conn, frame.Bytes(), frame.Len())
-	myBufferPool.Put(frame, index)
+	err = c.writeFrame(frame)
+	c.putFrameBuffer(frame, index)
 	return err
 }
 
+// 小消息不会被压缩, 也不需要经过扩展处理
+// a small message that is neither compressed nor handled by extensions
+func (c *Conn) isSmallFrame(payload []byte) bool {
+	var n = len(payload)
+	return n < smallPayloadSize && len(c.extensions) == 0 && n <= c.config.WriteMaxPayloadSize &&
+		(!c.compressEnabled || n < c.config.CompressThreshold)
+}
+
+// 小消息的快速路径, 直接在连接的小数组中编码, 不经过内存池; 调用方持有smallBusy
+// fast path of small messages, encoded straight into a small array of the connection without the buffer pool.
+// The caller holds smallBusy
+func (c *Conn) writeSmallFrame(opcode Opcode, payload []byte) error {
+	if opcode == OpcodeText && !c.isTextValid(opcode, payload) {
+		return internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding)
+	}
+	if c.smallFrame == nil {
+		c.smallFrame = new([smallFrameSize]byte)
+	}
+	var header = frameHeader{}
+	headerLength, maskBytes := header.GenerateHeader(c.isServer, true, false, opcode, len(payload))
+	var frame = c.smallFrame[:headerLength+len(payload)]
+	copy(frame, header[:headerLength])
+	copy(frame[headerLength:], payload)
+	if !c.isServer {
+		internal.MaskXOR(frame[headerLength:], maskBytes)
+	}
+	return c.writeFrameBytes(frame, time.Time{})
+}
+
+// 将编码好的帧写入连接
+// write an encoded frame to the connection
+func (c *Conn) writeFrame(frame *bytes.Buffer) error {
+	return c.writeQueuedFrame(frame, time.Time{})
+}
+
+// 将在写队列中排过队的帧写入连接, enqueued为入队时间, 零值表示没有记录
+// write a frame that waited in the write queue, enqueued is the time it was queued, the zero value if not recorded
+func (c *Conn) writeQueuedFrame(frame *bytes.Buffer, enqueued time.Time) error {
+	return c.writeFrameBytes(frame.Bytes(), enqueued)
+}
+
+func (c *Conn) writeFrameBytes(frame []byte, enqueued time.Time) error {
+	c.observeOutbound(frame, enqueued)
+	c.captureOutbound(frame)
+	if c.watchdog == nil {
+		return c.writeN(frame)
+	}
+	c.watchdog.begin()
+	defer c.watchdog.end()
+	return c.writeN(frame)
+}
+
+func (c *Conn) writeN(b []byte) error {
+	if c.writer != nil {
+		return internal.WriteN(c.writer, b, len(b))
+	}
+	return internal.WriteN(c.conn, b, len(b))
+}
+
+// 写入看门狗, 检测卡住的写入; 控制帧可能与数据帧并发写入, 所以按进行中的写入数计时
+// write watchdog detecting stalled writes. Control frames may be written concurrently with data frames,
+// so the timer runs while any write is in flight
+type writeWatchdog struct {
+	conn     *Conn
+	mu       sync.Mutex
+	timer    *time.Timer
+	inflight int
+	started  time.Time
+}
+
+func (c *writeWatchdog) begin() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight++; c.inflight > 1 {
+		return
+	}
+	c.started = time.Now()
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.conn.config.WriteStallThreshold, c.fire)
+	} else {
+		c.timer.Reset(c.conn.config.WriteStallThreshold)
+	}
+}
+
+func (c *writeWatchdog) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight--; c.inflight == 0 {
+		c.timer.Stop()
+	}
+}
+
+func (c *writeWatchdog) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// 定时器到期, 过期的定时器(写入已经完成或者重新开始)被忽略
+// the timer expired, stale expirations (the write completed or a new one started) are ignored
+func (c *writeWatchdog) fire() {
+	c.mu.Lock()
+	var elapsed = time.Since(c.started)
+	var stalled = c.inflight > 0 && elapsed >= c.conn.config.WriteStallThreshold
+	c.mu.Unlock()
+	if stalled && !c.conn.isClosed() {
+		c.conn.onWriteStall(elapsed)
+	}
+}
+
+// 写入卡住, 告警并通知; 需要强制关闭时先设置写超时, 让卡住的写入和关闭帧立即返回
+// a write stalled, warn and notify. When force-closing, the write deadline is set first
+// so that the stuck write and the close frame return immediately
+func (c *Conn) onWriteStall(elapsed time.Duration) {
+	c.config.Logger.Warn(fmt.Sprintf("gws: write stalled, id=%d remote=%s elapsed=%s", c.ID(), c.RemoteAddr().String(), elapsed))
+	if h, ok := c.eventHandler().(WriteStallHandler); ok {
+		h.OnWriteStall(c, elapsed)
+	}
+	if c.config.WriteStallCloseEnabled {
+		_ = c.conn.SetWriteDeadline(time.Now())
+		c.emitError(internal.NewError(internal.CloseGoingAway, internal.ErrWriteStalled))
+	}
+}
+
+// 入队时间, 只在设置了FrameObserver时记录
+// time a write is queued, only recorded if a FrameObserver is set
+func (c *Conn) enqueueTime() time.Time {
+	if c.config.FrameObserver == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
 // 帧生成
 func (c *Conn) genFrame(opcode Opcode, payload []byte) (*bytes.Buffer, int, error) {
+	return c.genClassFrame(CompressClassDefault, opcode, payload)
+}
+
+// 按压缩类别生成帧
+// generate a frame of the given compression class
+func (c *Conn) genClassFrame(class CompressClass, opcode Opcode, payload []byte) (*bytes.Buffer, int, error) {
 	// 不要删除 opcode == OpcodeText
 	if opcode == OpcodeText && !c.isTextValid(opcode, payload) {
 		return nil, 0, internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding)
 	}
+	return c.encodeFrame(class, opcode, payload)
+}
+
+// 编码帧, 文本编码已经校验过
+// encode a frame whose text encoding has been checked
+func (c *Conn) encodeFrame(class CompressClass, opcode Opcode, payload []byte) (*bytes.Buffer, int, error) {
+	var rsv uint8
+	if len(c.extensions) > 0 && opcode.isDataFrame() {
+		var err error
+		if payload, rsv, err = c.encodeExtensions(opcode, payload); err != nil {
+			return nil, 0, err
+		}
+	}
 
-	if c.compressEnabled && opcode.isDataFrame() && len(payload) >= c.config.CompressThreshold {
-		return c.compressData(opcode, payload)
+	if c.compressEnabled && c.isOpcodeCompressible(opcode) && len(payload) >= c.config.CompressThreshold {
+		if c.isWriteCompressed() && !c.compressStat.skip(c.config) {
+			return c.compressData(class, opcode, payload, rsv)
+		}
+		c.recordCompression(len(payload), 0, false)
 	}
 
 	var n = len(payload)
 	if n > c.config.WriteMaxPayloadSize {
-		return nil, 0, internal.CloseMessageTooLarge
+		return nil, 0, internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge)
 	}
 
 	var header = frameHeader{}
 	headerLength, maskBytes := header.GenerateHeader(c.isServer, true, false, opcode, n)
+	header.SetRSV(rsv)
 	var totalSize = n + headerLength
-	var buf, index = myBufferPool.Get(totalSize)
+	var buf, index = c.getFrameBuffer(totalSize)
 	buf.Write(header[:headerLength])
 	buf.Write(payload)
 	var contents = buf.Bytes()
@@ -110,20 +398,56 @@ func (c *Conn) genFrame(opcode Opcode, payload []byte) (*bytes.Buffer, int, erro
 	return buf, index, nil
 }
 
-func (c *Conn) compressData(opcode Opcode, payload []byte) (*bytes.Buffer, int, error) {
+// 记录压缩统计, 同时计入连接和汇总的统计
+// record compression statistics of both the connection and the aggregate
+func (c *Conn) recordCompression(size, compressedSize int, compressed bool) {
+	c.compressionStats.add(size, compressedSize, compressed)
+	if c.config.compressionStats != nil {
+		c.config.compressionStats.add(size, compressedSize, compressed)
+	}
+}
+
+// 选择压缩器, 开启CompressorPinned时默认压缩级别的消息使用连接独占的压缩器.
+// 同步写可能并发压缩, 所以独占的压缩器通过CAS创建
+// select a compressor, the dedicated one of the connection for messages of the default level if CompressorPinned.
+// Synchronous writes may compress concurrently, so the dedicated compressor is created with a CAS
+func (c *Conn) selectCompressor(class CompressClass) *compressor {
+	var pool = c.config.getCompressors(class)
+	if !c.config.CompressorPinned || pool != c.config.compressors {
+		return pool.Select()
+	}
+	if p := atomic.LoadPointer(&c.compressor); p != nil {
+		return (*compressor)(p)
+	}
+	var cps = &compressor{cps: c.config.NewCompressor(c.config.CompressLevel)}
+	if !atomic.CompareAndSwapPointer(&c.compressor, nil, unsafe.Pointer(cps)) {
+		return (*compressor)(atomic.LoadPointer(&c.compressor))
+	}
+	return cps
+}
+
+func (c *Conn) compressData(class CompressClass, opcode Opcode, payload []byte, rsv uint8) (*bytes.Buffer, int, error) {
 	var buf, index = myBufferPool.Get(len(payload) / compressionRate)
 	buf.Write(myPadding[0:])
-	err := c.config.compressors.Select().Compress(payload, buf)
+	var err error
+	if c.deflate != nil && c.deflate.writeTakeover {
+		err = c.deflate.Compress(payload, buf)
+	} else {
+		err = c.selectCompressor(class).Compress(payload, buf)
+	}
 	if err != nil {
 		return nil, 0, err
 	}
 	var contents = buf.Bytes()
 	var payloadSize = buf.Len() - frameHeaderSize
+	c.compressStat.record(c.config, len(payload), payloadSize)
+	c.recordCompression(len(payload), payloadSize, true)
 	if payloadSize > c.config.WriteMaxPayloadSize {
-		return nil, 0, internal.CloseMessageTooLarge
+		return nil, 0, internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge)
 	}
 	var header = frameHeader{}
 	headerLength, maskBytes := header.GenerateHeader(c.isServer, true, true, opcode, payloadSize)
+	header.SetRSV(rsv)
 	if !c.isServer {
 		internal.MaskXOR(contents[frameHeaderSize:], maskBytes)
 	}
@@ -138,6 +462,9 @@ type (
 		payload []byte
 		msgs    [2]*broadcastMessageWrapper
 		state   int64
+		// 创建广播器的刷写器, 为nil时逐个连接排队写入
+		// the flusher that created the broadcaster, nil to queue a write per connection
+		flusher *BroadcastFlusher
 	}
 
 	broadcastMessageWrapper struct {
@@ -145,6 +472,9 @@ type (
 		err   error
 		index int
 		frame *bytes.Buffer
+		// 生成帧的连接, 帧可能在它的写缓冲区中
+		// the connection that generated the frame, which may live in its write arena
+		owner *Conn
 	}
 )
 
@@ -165,10 +495,17 @@ func NewBroadcaster(opcode Opcode, payload []byte) *Broadcaster {
 // 向单个客户端发送广播消息. 注意: 不要并行调用Broadcast方法
 // Send a broadcast message to a single client. Note: Do not call the Broadcast method in parallel.
 func (c *Broadcaster) Broadcast(socket *Conn) error {
-	var idx = internal.SelectValue(socket.compressEnabled, 1, 0)
+	// 开启了上下文接管的连接无法共享压缩后的帧
+	// connections with context takeover cannot share the compressed frame
+	if socket.isWriteOrdered(c.opcode) {
+		return socket.WriteAsync(c.opcode, c.payload)
+	}
+	socket.observeMessage(FrameOutbound, c.opcode, c.payload)
+
+	var idx = internal.SelectValue(socket.isWriteCompressed(), 1, 0)
 	var msg = c.msgs[idx]
 	if msg == nil {
-		c.msgs[idx] = &broadcastMessageWrapper{}
+		c.msgs[idx] = &broadcastMessageWrapper{owner: socket}
 		msg = c.msgs[idx]
 		msg.frame, msg.index, msg.err = socket.genFrame(c.opcode, c.payload)
 	}
@@ -177,21 +514,34 @@ func (c *Broadcaster) Broadcast(socket *Conn) error {
 	}
 
 	atomic.AddInt64(&c.state, 1)
+	var enqueued = socket.enqueueTime()
+	var n = msg.frame.Len()
+	socket.chargeWriteQueue(n)
+	if c.flusher != nil && c.flusher.add(socket, c, msg.frame.Bytes(), enqueued) {
+		return nil
+	}
 	socket.writeQueue.Push(func() {
+		socket.chargeWriteQueue(-n)
 		if !socket.isClosed() {
-			socket.emitError(internal.WriteN(socket.conn, msg.frame.Bytes(), msg.frame.Len()))
-		}
-		if atomic.AddInt64(&c.state, -1) == 0 {
-			c.doClose()
+			socket.emitError(socket.writeQueuedFrame(msg.frame, enqueued))
 		}
+		c.done()
 	})
 	return nil
 }
 
+// 一次广播写入完成
+// one broadcast write has completed
+func (c *Broadcaster) done() {
+	if atomic.AddInt64(&c.state, -1) == 0 {
+		c.doClose()
+	}
+}
+
 func (c *Broadcaster) doClose() {
 	for _, item := range c.msgs {
 		if item != nil {
-			myBufferPool.Put(item.frame, item.index)
+			item.owner.putFrameBuffer(item.frame, item.index)
 		}
 	}
 }
@@ -204,3 +554,158 @@ func (c *Broadcaster) Release() {
 		c.doClose()
 	}
 }
+
+// 流式写入时每个分片的最大长度(压缩时为压缩后的长度)
+// maximum length of a fragment when streaming, measured after compression if compressing
+const streamFragmentSize = 16 * 1024
+
+// NewMessageWriter 创建分片写入器, 每次Write发送一个或多个约16KB的分片, Close发送结束分片;
+// 其他协程写入的ping, pong和关闭帧可以插在分片之间发出
+// 开启压缩时整条消息使用同一个deflate流增量压缩, 内存占用不随消息长度增长; 此时忽略CompressThreshold和自定义压缩器,
+// 开启了出站上下文接管的连接不压缩流式消息. 自定义扩展不作用于流式消息.
+// 注意: 写完一条消息之前不要并发写入其他数据消息; opcode必须是OpcodeText或OpcodeBinary
+// NewMessageWriter creates a fragmented writer: every Write sends one or more fragments of about 16KB and Close
+// sends the final one. Pings, pongs and close frames written from other goroutines may go out between fragments.
+// With compression, the whole message goes through a single deflate stream compressed incrementally, so memory stays
+// flat regardless of the message length; CompressThreshold and custom compressors are ignored in this case, and
+// connections with outbound context takeover do not compress streamed messages. Custom extensions do not apply.
+// Note: do not write other data messages concurrently before the message is finished.
+// opcode must be OpcodeText or OpcodeBinary
+func (c *Conn) NewMessageWriter(opcode Opcode) io.WriteCloser {
+	var w = &messageWriter{conn: c, opcode: opcode}
+	if !opcode.isDataFrame() {
+		w.err = internal.ErrUnexpectedOpcode
+		return w
+	}
+	w.validating = opcode == OpcodeText && c.config.CheckUtf8Enabled
+	var takeover = c.deflate != nil && c.deflate.writeTakeover
+	if c.isWriteCompressed() && c.isOpcodeCompressible(opcode) && !takeover && !c.compressStat.skip(c.config) {
+		w.buf = bytes.NewBuffer(nil)
+		w.fw, _ = flate.NewWriterDict(w.buf, c.config.CompressLevel, c.config.CompressDictionary)
+	}
+	return w
+}
+
+type messageWriter struct {
+	conn       *Conn
+	opcode     Opcode
+	started    bool
+	closed     bool
+	err        error
+	size       int
+	validating bool
+	utf8       internal.Utf8Checker
+
+	// 压缩时的deflate流及其输出
+	// the deflate stream and its output when compressing
+	fw        *flate.Writer
+	buf       *bytes.Buffer
+	flateSize int
+}
+
+func (c *messageWriter) Write(p []byte) (int, error) {
+	if c.closed {
+		return 0, internal.ErrConnClosed
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.validating && !c.utf8.Check(p, c.conn.config.Utf8Validator) {
+		return 0, c.fail(internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding))
+	}
+	c.size += len(p)
+	// 大块数据拆成多个分片, 控制帧可以在分片之间发出, 心跳不会被长时间的上传阻塞
+	// large writes are split into several fragments, so that control frames can go out in between
+	// and keepalives are not starved by a long upload
+	var total = len(p)
+	for len(p) > 0 {
+		var n = internal.SelectValue(len(p) > streamFragmentSize, streamFragmentSize, len(p))
+		if err := c.writeChunk(p[:n]); err != nil {
+			return total - len(p), c.fail(err)
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// 写入不超过streamFragmentSize的数据, 压缩时输出积累到streamFragmentSize才发送分片
+// write at most streamFragmentSize bytes. When compressing, a fragment is sent once the output reaches streamFragmentSize
+func (c *messageWriter) writeChunk(p []byte) error {
+	if c.fw == nil {
+		return c.writeFragment(false, p)
+	}
+	if err := internal.WriteN(c.fw, p, len(p)); err != nil {
+		return err
+	}
+	if c.buf.Len() >= streamFragmentSize {
+		c.flateSize += c.buf.Len()
+		err := c.writeFragment(false, c.buf.Bytes())
+		c.buf.Reset()
+		return err
+	}
+	return nil
+}
+
+func (c *messageWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.err != nil {
+		return c.err
+	}
+	if c.validating && !c.utf8.Done() {
+		return c.fail(internal.NewError(internal.CloseUnsupportedData, internal.ErrTextEncoding))
+	}
+	if c.fw == nil {
+		return c.fail(c.writeFragment(true, nil))
+	}
+	if err := c.fw.Flush(); err != nil {
+		return c.fail(err)
+	}
+	var p = c.buf.Bytes()
+	if n := len(p); n >= 4 && binary.BigEndian.Uint32(p[n-4:]) == math.MaxUint16 {
+		p = p[:n-4]
+	}
+	c.flateSize += len(p)
+	c.conn.compressStat.record(c.conn.config, c.size, c.flateSize)
+	c.conn.recordCompression(c.size, c.flateSize, true)
+	return c.fail(c.writeFragment(true, p))
+}
+
+// 记录错误并关闭连接
+// remember the error and close the connection
+func (c *messageWriter) fail(err error) error {
+	if err != nil {
+		c.err = err
+		c.conn.emitError(err)
+	}
+	return err
+}
+
+// 发送一个分片, 首个分片使用消息的操作码, 压缩时设置RSV1
+// send a fragment, the first one carries the opcode of the message and RSV1 if compressed
+func (c *messageWriter) writeFragment(fin bool, payload []byte) error {
+	if c.conn.isClosed() {
+		return internal.ErrConnClosed
+	}
+	var n = len(payload)
+	if n > c.conn.config.WriteMaxPayloadSize {
+		return internal.NewError(internal.CloseMessageTooLarge, internal.ErrMessageTooLarge)
+	}
+	var opcode = internal.SelectValue(c.started, OpcodeContinuation, c.opcode)
+	var compress = c.fw != nil && !c.started
+	c.started = true
+
+	var header = frameHeader{}
+	headerLength, maskBytes := header.GenerateHeader(c.conn.isServer, fin, compress, opcode, n)
+	var buf, index = c.conn.getFrameBuffer(headerLength + n)
+	buf.Write(header[:headerLength])
+	buf.Write(payload)
+	if !c.conn.isServer {
+		internal.MaskXOR(buf.Bytes()[headerLength:], maskBytes)
+	}
+	err := c.conn.writeFrame(buf)
+	c.conn.putFrameBuffer(buf, index)
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -106,6 +107,53 @@ func TestConn_WriteAsyncError(t *testing.T) {
 	})
 }
 
+type blockingCompressor struct {
+	Compressor
+	ch chan struct{}
+}
+
+func (c *blockingCompressor) Compress(src []byte, dst *bytes.Buffer) error {
+	<-c.ch
+	return c.Compressor.Compress(src, dst)
+}
+
+func TestConn_WriteAsyncCompress(t *testing.T) {
+	var as = assert.New(t)
+	var ch = make(chan struct{})
+	var serverOption = &ServerOption{
+		CompressEnabled:   true,
+		CompressThreshold: 16,
+		CheckUtf8Enabled:  true,
+		NewCompressor: func(level int) Compressor {
+			return &blockingCompressor{Compressor: newFlateCompressor(level, nil), ch: ch}
+		},
+	}
+	var text = bytes.Repeat([]byte("hello"), 100)
+	var wg = &sync.WaitGroup{}
+	wg.Add(2)
+	var clientHandler = new(webSocketMocker)
+	var received []string
+	clientHandler.onMessage = func(socket *Conn, message *Message) {
+		received = append(received, message.Data.String())
+		wg.Done()
+	}
+	server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, &ClientOption{CompressEnabled: true})
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	// the caller returns while the compressor is blocked in the write worker
+	var payload = append([]byte(nil), text...)
+	as.NoError(server.WriteAsync(OpcodeText, payload))
+	as.NoError(server.WriteAsync(OpcodeText, []byte("hi")))
+	payload[0] = 'x'
+	close(ch)
+	wg.Wait()
+	as.Equal([]string{string(text), "hi"}, received)
+
+	// text encoding is still checked in the caller's goroutine
+	as.Error(server.WriteAsync(OpcodeText, append([]byte{255}, text...)))
+}
+
 func TestConn_WriteInvalidUTF8(t *testing.T) {
 	var as = assert.New(t)
 	var serverHandler = new(webSocketMocker)
@@ -255,3 +303,265 @@ func (b broadcastHandler) OnMessage(socket *Conn, message *Message) {
 	defer message.Close()
 	b.wg.Done()
 }
+
+func TestWriteMessageTooLarge(t *testing.T) {
+	var as = assert.New(t)
+	server, client := newPeer(new(webSocketMocker), &ServerOption{WriteMaxPayloadSize: 16}, new(webSocketMocker), &ClientOption{})
+	go client.ReadLoop()
+	var err = server.WriteMessage(OpcodeBinary, internal.AlphabetNumeric.Generate(32))
+	as.ErrorIs(err, ErrMessageTooLarge)
+	as.ErrorIs(server.WriteString("hello"), ErrConnClosed)
+}
+
+func TestConn_StopReadingAndDrain(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("flush", func(t *testing.T) {
+		var wg = &sync.WaitGroup{}
+		wg.Add(4)
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var received = 0
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			received++
+			wg.Done()
+		}
+		clientHandler.onClose = func(socket *Conn, err error) {
+			as.True(IsGoingAway(err))
+			wg.Done()
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+		for i := 0; i < 3; i++ {
+			as.NoError(server.WriteAsync(OpcodeText, []byte("hello")))
+		}
+		as.NoError(server.StopReadingAndDrain(time.Second))
+		wg.Wait()
+		as.Equal(3, received)
+		as.ErrorIs(server.StopReadingAndDrain(time.Second), ErrConnClosed)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		var serverHandler = new(webSocketMocker)
+		var clientHandler = new(webSocketMocker)
+		var pinged = make(chan struct{})
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			as.Fail("message dispatched while draining")
+		}
+		serverHandler.onPing = func(socket *Conn, payload []byte) {
+			close(pinged)
+		}
+		server, client := newPeer(serverHandler, &ServerOption{}, clientHandler, &ClientOption{})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var blocker = make(chan struct{})
+		server.writeQueue.Push(func() { <-blocker })
+		var ch = make(chan error)
+		go func() { ch <- server.StopReadingAndDrain(100 * time.Millisecond) }()
+		for atomic.LoadUint32(&server.draining) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		as.NoError(client.WriteString("hello"))
+		as.NoError(client.WritePing(nil))
+		<-pinged
+		as.ErrorIs(<-ch, ErrDrainTimeout)
+		close(blocker)
+	})
+}
+
+func TestConn_NewMessageWriter(t *testing.T) {
+	var as = assert.New(t)
+	var text = bytes.Repeat([]byte("hello, world! "), 20*1024)
+
+	for _, compress := range []bool{false, true} {
+		var wg = &sync.WaitGroup{}
+		wg.Add(2)
+		var clientHandler = new(webSocketMocker)
+		var received []string
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			received = append(received, message.Data.String())
+			wg.Done()
+		}
+		var serverOption = &ServerOption{CompressEnabled: compress, CheckUtf8Enabled: true}
+		var clientOption = &ClientOption{CompressEnabled: compress, ReadMaxPayloadSize: 32 * 1024, ReadMaxMessageSize: 1024 * 1024}
+		server, client := newPeer(new(webSocketMocker), serverOption, clientHandler, clientOption)
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		var w = server.NewMessageWriter(OpcodeText)
+		for i := 0; i < len(text); i += 4096 {
+			n, err := w.Write(text[i:internal.SelectValue(i+4096 > len(text), len(text), i+4096)])
+			as.NoError(err)
+			as.Greater(n, 0)
+		}
+		as.NoError(w.Close())
+		as.NoError(w.Close())
+		_, err := w.Write(text)
+		as.Error(err)
+
+		w = server.NewMessageWriter(OpcodeBinary)
+		as.NoError(w.Close())
+		wg.Wait()
+		as.Equal([]string{string(text), ""}, received)
+		as.Equal(uint64(internal.SelectValue(compress, 2, 0)), server.CompressionStats().Compressed)
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		server, client := newPeer(new(webSocketMocker), &ServerOption{CheckUtf8Enabled: true}, new(webSocketMocker), nil)
+		go client.ReadLoop()
+		var w = server.NewMessageWriter(OpcodePing)
+		_, err := w.Write([]byte("hello"))
+		as.ErrorIs(err, internal.ErrUnexpectedOpcode)
+
+		w = server.NewMessageWriter(OpcodeText)
+		_, err = w.Write([]byte{'a', 0xE4, 0xBD})
+		as.NoError(err)
+		as.Error(w.Close())
+	})
+}
+
+type frameFunc func(socket *Conn, frame FrameInfo)
+
+func (c frameFunc) OnFrame(socket *Conn, frame FrameInfo) { c(socket, frame) }
+
+// 长消息的分片之间可以插入控制帧
+func TestConn_NewMessageWriter_Interleave(t *testing.T) {
+	var as = assert.New(t)
+	var server *Conn
+	var events = make(chan string, 2)
+	var once sync.Once
+	var fragments int32
+	var clientHandler = new(webSocketMocker)
+	clientHandler.onPing = func(socket *Conn, payload []byte) { events <- "ping" }
+	clientHandler.onMessage = func(socket *Conn, message *Message) { events <- "message" }
+	var clientOption = &ClientOption{
+		ReadMaxMessageSize: 2 * 1024 * 1024,
+		FrameObserver: frameFunc(func(socket *Conn, frame FrameInfo) {
+			if frame.Direction == FrameInbound && frame.Opcode.isDataFrame() {
+				atomic.AddInt32(&fragments, 1)
+				// 暂停读取, 让ping在分片写入的锁上等待足够久, 下一次解锁时直接交给它
+				once.Do(func() {
+					go func() { _ = server.WritePing(nil) }()
+					time.Sleep(10 * time.Millisecond)
+				})
+			}
+		}),
+	}
+	server, client := newPeer(new(webSocketMocker), &ServerOption{}, clientHandler, clientOption)
+	go server.ReadLoop()
+	go client.ReadLoop()
+
+	var w = server.NewMessageWriter(OpcodeBinary)
+	n, err := w.Write(make([]byte, 1024*1024))
+	as.NoError(err)
+	as.Equal(1024*1024, n)
+	as.NoError(w.Close())
+	as.Equal("ping", <-events)
+	as.Equal("message", <-events)
+	as.Equal(int32(1024*1024/streamFragmentSize+1), atomic.LoadInt32(&fragments))
+}
+
+type stallHandler struct {
+	BuiltinEventHandler
+	stalls chan time.Duration
+	closed chan error
+}
+
+func (c *stallHandler) OnWriteStall(socket *Conn, elapsed time.Duration) {
+	c.stalls <- elapsed
+}
+
+func (c *stallHandler) OnClose(socket *Conn, err error) {
+	c.closed <- err
+}
+
+func TestWriteStall(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("notify", func(t *testing.T) {
+		var handler = &stallHandler{stalls: make(chan time.Duration, 1), closed: make(chan error, 1)}
+		var logger = new(countLogger)
+		var option = &ServerOption{WriteStallThreshold: 20 * time.Millisecond, Logger: logger}
+		server, client := newPeer(handler, option, new(webSocketMocker), &ClientOption{})
+		// 客户端不读取, 写入卡住
+		as.NoError(server.WriteAsync(OpcodeText, []byte("hello")))
+		as.GreaterOrEqual(<-handler.stalls, 20*time.Millisecond)
+		logger.Lock()
+		as.Equal(1, logger.n)
+		logger.Unlock()
+		as.False(server.isClosed())
+
+		// 对端恢复读取后写入完成
+		go client.ReadLoop()
+		as.Eventually(func() bool { return server.WriteQueueLen() == 0 && server.Stats().WriteQueue.Running == 0 }, time.Second, time.Millisecond)
+		as.NoError(server.WriteString("world"))
+		select {
+		case <-handler.stalls:
+			as.Fail("unexpected stall")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		var handler = &stallHandler{stalls: make(chan time.Duration, 1), closed: make(chan error, 1)}
+		var option = &ServerOption{WriteStallThreshold: 20 * time.Millisecond, WriteStallCloseEnabled: true, Logger: new(countLogger)}
+		server, _ := newPeer(handler, option, new(webSocketMocker), &ClientOption{})
+		as.NoError(server.WriteAsync(OpcodeText, []byte("hello")))
+		<-handler.stalls
+		as.ErrorIs(<-handler.closed, ErrWriteStalled)
+		as.True(server.isClosed())
+	})
+}
+
+func TestConn_WriteSmallFrame(t *testing.T) {
+	var as = assert.New(t)
+
+	t.Run("peer", func(t *testing.T) {
+		var received = make(chan string, 8)
+		var serverHandler, clientHandler = new(webSocketMocker), new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) { received <- "server " + message.Data.String() }
+		clientHandler.onMessage = func(socket *Conn, message *Message) { received <- "client " + message.Data.String() }
+		serverHandler.onPing = func(socket *Conn, payload []byte) { received <- "ping " + string(payload) }
+		var serverOption = &ServerOption{CompressEnabled: true, CompressThreshold: 64}
+		server, client := newPeer(serverHandler, serverOption, clientHandler, &ClientOption{CompressEnabled: true})
+		go server.ReadLoop()
+		go client.ReadLoop()
+
+		// 客户端的帧需要掩码
+		as.NoError(client.WriteString("hello"))
+		as.Equal("server hello", <-received)
+		as.NoError(client.WritePing([]byte("ping")))
+		as.Equal("ping ping", <-received)
+		as.NoError(server.WriteMessage(OpcodeBinary, []byte("world")))
+		as.Equal("client world", <-received)
+
+		// 超过压缩阈值的小消息仍然压缩
+		var text = string(bytes.Repeat([]byte("a"), 100))
+		as.NoError(server.WriteString(text))
+		as.Equal("client "+text, <-received)
+		as.Equal(uint64(1), server.Stats().Compression.Compressed)
+
+		// 被占用时走普通路径
+		atomic.StoreInt32(&server.smallBusy, 1)
+		as.NoError(server.WriteString("busy"))
+		as.Equal("client busy", <-received)
+		atomic.StoreInt32(&server.smallBusy, 0)
+	})
+
+	t.Run("invalid text", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{CheckUtf8Enabled: true})
+		var socket = &Conn{conn: &benchConn{}, config: upgrader.option.getConfig()}
+		as.Error(socket.doWriteFrame(CompressClassDefault, OpcodeText, []byte{0xff}))
+		as.Equal(int32(0), socket.smallBusy)
+	})
+
+	t.Run("allocs", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), nil)
+		var socket = &Conn{conn: &benchConn{}, config: upgrader.option.getConfig()}
+		var payload = []byte("hello")
+		as.NoError(socket.WriteMessage(OpcodeText, payload))
+		as.Equal(0.0, testing.AllocsPerRun(100, func() { _ = socket.WriteMessage(OpcodeText, payload) }))
+	})
+}
@@ -0,0 +1,86 @@
+package gws
+
+import (
+	"errors"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lxzan/gws/internal"
+)
+
+const extensionZstd = "permessage-zstd"
+
+var errZstdFrameSize = errors.New("zstd frame content size is missing or too large")
+
+// ZstdExtension 非标准的permessage-zstd扩展, 只适用于两端都是gws的连接, 压缩率和CPU开销都明显优于permessage-deflate
+// 扩展占用RSV1位, 协商成功时取代permessage-deflate; 对端不支持时, 如果开启了CompressEnabled则退化为permessage-deflate
+// 同一个实例可以被多个连接共享
+// Non-standard permessage-zstd extension, only for gws-to-gws links. It gives a much better ratio/CPU trade-off
+// than permessage-deflate.
+// The extension claims RSV1 and replaces permessage-deflate once negotiated; with peers that do not support it,
+// compression falls back to permessage-deflate if CompressEnabled is on.
+// One instance can be shared by many connections.
+type ZstdExtension struct {
+	threshold int
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+// NewZstdExtension 创建permessage-zstd扩展, level为zstd压缩级别(1~22), 低于threshold字节的消息不会被压缩
+// NewZstdExtension creates a permessage-zstd extension. level is the zstd compression level (1~22),
+// messages shorter than threshold bytes are not compressed
+func NewZstdExtension(level int, threshold int) (*ZstdExtension, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true))
+	if err != nil {
+		return nil, err
+	}
+	return &ZstdExtension{
+		threshold: internal.SelectValue(threshold <= 0, defaultCompressThreshold, threshold),
+		encoder:   encoder,
+		decoder:   decoder,
+	}, nil
+}
+
+func (c *ZstdExtension) Name() string { return extensionZstd }
+
+func (c *ZstdExtension) RSV() uint8 { return RSV1Bit }
+
+func (c *ZstdExtension) Offer() []string { return nil }
+
+func (c *ZstdExtension) Negotiate(params []string) ([]string, bool) { return nil, len(params) == 0 }
+
+func (c *ZstdExtension) Accept(params []string) error {
+	if len(params) > 0 {
+		return internal.ErrHandshake
+	}
+	return nil
+}
+
+func (c *ZstdExtension) Encode(socket *Conn, opcode Opcode, payload []byte) ([]byte, bool, error) {
+	if len(payload) < c.threshold {
+		return payload, false, nil
+	}
+	return c.encoder.EncodeAll(payload, make([]byte, 0, len(payload)/compressionRate)), true, nil
+}
+
+// Decode 解压前根据帧头中的原始大小检查消息大小限制, 防止解压炸弹
+// Decode checks the content size in the frame header against the message size limit before decompressing,
+// which guards against decompression bombs
+func (c *ZstdExtension) Decode(socket *Conn, opcode Opcode, rsv uint8, payload []byte) ([]byte, error) {
+	if rsv&RSV1Bit == 0 {
+		return payload, nil
+	}
+	var header zstd.Header
+	if err := header.Decode(payload); err != nil {
+		return nil, err
+	}
+	if !header.HasFCS || header.FrameContentSize > uint64(socket.config.ReadMaxMessageSize) {
+		return nil, errZstdFrameSize
+	}
+	// WithDecodeAllCapLimit限制输出不超过dst的容量
+	// WithDecodeAllCapLimit keeps the output within the capacity of dst
+	return c.decoder.DecodeAll(payload, make([]byte, 0, header.FrameContentSize))
+}
@@ -0,0 +1,96 @@
+package gws
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/lxzan/gws/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZstdExtension(t *testing.T) {
+	var as = assert.New(t)
+	ext, err := NewZstdExtension(3, 0)
+	if !as.NoError(err) {
+		return
+	}
+
+	t.Run("negotiate", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{CompressEnabled: true, Extensions: []Extension{ext}})
+		server, client, err := testHandshake(upgrader, new(webSocketMocker), &ClientOption{CompressEnabled: true, Extensions: []Extension{ext}})
+		if !as.NoError(err) {
+			return
+		}
+		as.False(server.CompressionEnabled())
+		as.False(client.CompressionEnabled())
+		as.Equal([]Extension{ext}, server.Extensions())
+		as.Equal([]Extension{ext}, client.Extensions())
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		var upgrader = NewUpgrader(new(webSocketMocker), &ServerOption{CompressEnabled: true, Extensions: []Extension{ext}})
+		server, client, err := testHandshake(upgrader, new(webSocketMocker), &ClientOption{CompressEnabled: true})
+		if !as.NoError(err) {
+			return
+		}
+		as.True(server.CompressionEnabled())
+		as.True(client.CompressionEnabled())
+		as.Empty(server.Extensions())
+	})
+
+	t.Run("message", func(t *testing.T) {
+		var long = string(internal.AlphabetNumeric.Generate(4096))
+		var wg = &sync.WaitGroup{}
+		wg.Add(4)
+		var serverHandler = new(webSocketMocker)
+		serverHandler.onMessage = func(socket *Conn, message *Message) {
+			_ = socket.WriteMessage(message.Opcode, message.Bytes())
+		}
+		var clientHandler = new(webSocketMocker)
+		var received []string
+		clientHandler.onMessage = func(socket *Conn, message *Message) {
+			received = append(received, message.Data.String())
+			wg.Done()
+		}
+		var upgrader = NewUpgrader(serverHandler, &ServerOption{Extensions: []Extension{ext}})
+		server, client, err := testHandshake(upgrader, clientHandler, &ClientOption{Extensions: []Extension{ext}})
+		if !as.NoError(err) {
+			return
+		}
+		go server.ReadLoop()
+		go client.ReadLoop()
+		for _, s := range []string{"hello", long, "", long} {
+			as.NoError(client.WriteString(s))
+		}
+		wg.Wait()
+		as.Equal([]string{"hello", long, "", long}, received)
+	})
+
+	t.Run("decode", func(t *testing.T) {
+		var socket = &Conn{config: initServerOption(&ServerOption{ReadMaxPayloadSize: 1024}).getConfig()}
+		p, err := ext.Decode(socket, OpcodeText, 0, []byte("raw"))
+		as.NoError(err)
+		as.Equal("raw", string(p))
+
+		encoder, _ := zstd.NewWriter(nil)
+		var payload = encoder.EncodeAll(make([]byte, 2048), nil)
+		_, err = ext.Decode(socket, OpcodeText, RSV1Bit, payload)
+		as.ErrorIs(err, errZstdFrameSize)
+
+		_, err = ext.Decode(socket, OpcodeText, RSV1Bit, []byte("not zstd"))
+		as.Error(err)
+
+		payload = encoder.EncodeAll(make([]byte, 512), nil)
+		p, err = ext.Decode(socket, OpcodeText, RSV1Bit, payload)
+		as.NoError(err)
+		as.Equal(512, len(p))
+	})
+
+	t.Run("params", func(t *testing.T) {
+		_, ok := ext.Negotiate([]string{"level=3"})
+		as.False(ok)
+		as.Error(ext.Accept([]string{"level=3"}))
+		as.NoError(ext.Accept(nil))
+	})
+}